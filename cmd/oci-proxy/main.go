@@ -2,37 +2,80 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 	"time"
 
 	"oci-proxy/internal/pkg/config"
 	"oci-proxy/internal/pkg/logging"
 	"oci-proxy/internal/pkg/proxy"
+	"oci-proxy/internal/pkg/proxyproto"
+	"oci-proxy/internal/pkg/systemd"
+	"oci-proxy/pkg/client"
 )
 
 func main() {
 	configFile := flag.String("c", "config.yaml", "path to config file")
+	exportFile := flag.String("export", "", "write the state of the stopped proxy to this file and exit")
+	importFile := flag.String("import", "", "restore the config and state from this file and exit")
+	schema := flag.Bool("schema", false, "print the JSON Schema of the management API responses and exit")
 	flag.Parse()
 
-	cfg, err := config.LoadConfig(*configFile)
+	if *schema {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(client.Schemas())
+		return
+	}
+
+	if *importFile != "" {
+		importState(*configFile, *importFile)
+		return
+	}
+
+	provider, err := config.NewProvider(*configFile)
 	if err != nil {
 		logging.Logger.Error("Failed to load config", "error", err)
 		os.Exit(1)
 	}
+	cfg := provider.Current()
 
-	if cfg.LogLevel == "" {
-		cfg.LogLevel = "info"
+	if err := logging.Init(cfg.LogLevel, cfg.LogFormat, cfg.LogOutput, logRotation(cfg)); err != nil {
+		logging.Logger.Error("Failed to open log output", "log_output", cfg.LogOutput, "error", err)
+		os.Exit(1)
 	}
+	logging.InitAccessLog(cfg.AccessLogFormat)
+	provider.OnReload(func(old, new *config.Config) {
+		if err := logging.Init(new.LogLevel, new.LogFormat, new.LogOutput, logRotation(new)); err != nil {
+			logging.Logger.Error("Failed to open log output, keeping the previous one", "log_output", new.LogOutput, "error", err)
+		}
+		logging.InitAccessLog(new.AccessLogFormat)
+		if old.Port != new.Port || old.ListenAddress != new.ListenAddress || old.IPVersion != new.IPVersion {
+			logging.Logger.Warn("Listen address change requires a restart", "port", old.Port, "listen_address", old.ListenAddress)
+		}
+		if !reflect.DeepEqual(old.TLS, new.TLS) || !reflect.DeepEqual(old.ACME, new.ACME) {
+			logging.Logger.Warn("TLS change requires a restart")
+		}
+		if old.Store != new.Store {
+			logging.Logger.Warn("Store change requires a restart")
+		}
+		logging.Logger.Info("Config reloaded")
+	})
 
-	logging.Init(cfg.LogLevel)
+	if *exportFile != "" {
+		exportState(provider, *exportFile)
+		return
+	}
 
 	logging.Logger.Info("Starting OCI proxy", "port", cfg.Port)
 
-	server, err := proxy.NewProxy(cfg)
+	server, err := proxy.NewProxy(provider)
 	if err != nil {
 		logging.Logger.Error("Failed to create proxy", "error", err)
 		os.Exit(1)
@@ -41,16 +84,59 @@ func main() {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	// Sockets passed by systemd socket activation replace the port.
+	listeners, err := systemd.Listeners()
+	if err == nil && len(listeners) == 0 {
+		var l net.Listener
+		l, err = net.Listen(cfg.Listen())
+		listeners = append(listeners, l)
+	}
+	if err != nil {
+		logging.Logger.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+	for _, l := range listeners {
+		logging.Logger.Info("Listening", "address", l.Addr().String())
+		if pp := cfg.ProxyProtocol; pp != nil {
+			l = &proxyproto.Listener{Listener: l, Trusts: pp.Trusts, Timeout: pp.HeaderTimeout}
+		}
+		go func() {
+			var err error
+			switch {
+			case cfg.ACME != nil:
+				err = server.ServeTLS(l, "", "")
+			case cfg.TLS != nil:
+				err = server.ServeTLS(l, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			default:
+				err = server.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logging.Logger.Error("Server failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	stopWatchdog := make(chan struct{})
+	go systemd.Watchdog(stopWatchdog)
+	systemd.Notify("READY=1")
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logging.Logger.Error("Server failed", "error", err)
-			os.Exit(1)
+		for range reload {
+			systemd.Notify("RELOADING=1")
+			if err := provider.Reload(); err != nil {
+				logging.Logger.Error("Failed to reload config", "error", err)
+			}
+			systemd.Notify("READY=1")
 		}
 	}()
 
 	<-shutdown
 
 	logging.Logger.Info("Shutting down server...")
+	systemd.Notify("STOPPING=1")
+	close(stopWatchdog)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -63,3 +149,45 @@ func main() {
 
 	logging.Logger.Info("Server gracefully stopped")
 }
+
+func logRotation(cfg *config.Config) logging.Rotation {
+	r := cfg.LogRotation
+	return logging.Rotation{MaxSize: int64(r.MaxSize), Interval: r.Interval, MaxFiles: r.MaxFiles, MaxAge: r.MaxAge, Compress: r.Compress}
+}
+
+func exportState(provider *config.Provider, path string) {
+	state, err := proxy.ExportState(provider)
+	if err != nil {
+		logging.Logger.Error("Failed to export state", "error", err)
+		os.Exit(1)
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		logging.Logger.Error("Failed to write state", "path", path, "error", err)
+		os.Exit(1)
+	}
+	logging.Logger.Info("Exported state", "path", path, "registries", len(state.Caches))
+}
+
+func importState(configFile, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logging.Logger.Error("Failed to read state", "path", path, "error", err)
+		os.Exit(1)
+	}
+	var state proxy.State
+	if err := json.Unmarshal(data, &state); err != nil {
+		logging.Logger.Error("Failed to decode state", "path", path, "error", err)
+		os.Exit(1)
+	}
+	result, err := proxy.ImportState(configFile, &state)
+	if err != nil {
+		logging.Logger.Error("Failed to import state", "error", err)
+		os.Exit(1)
+	}
+	logging.Logger.Info("Imported state", "config", configFile, "exported_at", state.ExportedAt,
+		"metadata_keys", result.MetadataKeys, "cache_entries", result.CacheEntries, "missing_blobs", result.MissingBlobs)
+}
@@ -0,0 +1,65 @@
+// Package aws obtains ECR registry credentials with the AWS SDK.
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// ErrNoRegion is returned when neither the caller nor the AWS config names a region.
+var ErrNoRegion = errors.New("no AWS region configured")
+
+// ecrHost matches private ECR registries, <account>.dkr.ecr.<region>.amazonaws.com.
+var ecrHost = regexp.MustCompile(`^\d{12}\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// ECRRegion returns the region of an ECR registry host, or "" for other hosts.
+func ECRRegion(host string) string {
+	if m := ecrHost.FindStringSubmatch(host); m != nil {
+		return m[2]
+	}
+	return ""
+}
+
+// ECRAuthorizationToken calls GetAuthorizationToken in region, or in the
+// region of the AWS config when empty, and returns the registry username and
+// password with their expiry, usually 12 hours ahead. AWS credentials come
+// from the SDK's default chain.
+func ECRAuthorizationToken(ctx context.Context, region string) (string, string, time.Time, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return "", "", time.Time{}, ErrNoRegion
+	}
+	out, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("ecr GetAuthorizationToken failed: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return "", "", time.Time{}, fmt.Errorf("ecr GetAuthorizationToken returned no token")
+	}
+	data := out.AuthorizationData[0]
+	token, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	username, password, _ := strings.Cut(string(token), ":")
+	var expires time.Time
+	if data.ExpiresAt != nil {
+		expires = *data.ExpiresAt
+	}
+	return username, password, expires, nil
+}
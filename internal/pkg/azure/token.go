@@ -0,0 +1,121 @@
+// Package azure obtains Azure Container Registry refresh tokens for Entra ID
+// identities found by azidentity.
+package azure
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Username is the registry username that goes with a refresh token.
+const Username = "00000000-0000-0000-0000-000000000000"
+
+const armScope = "https://management.azure.com/.default"
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Identity selects the Entra ID identity to authenticate as. Without them,
+// azidentity's DefaultAzureCredential finds one from AZURE_* variables,
+// workload identity or managed identity.
+type Identity struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
+// ACRRefreshToken exchanges an Entra ID token of identity for a refresh token
+// of registry and returns it with its expiry, about three hours ahead.
+func ACRRefreshToken(ctx context.Context, registry string, identity Identity) (string, time.Time, error) {
+	credential, err := identity.credential()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{armScope}})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("entra id token request failed: %w", err)
+	}
+
+	form := url.Values{"grant_type": {"access_token"}, "service": {registry}, "access_token": {token.Token}}
+	if tenant := cmp.Or(identity.TenantID, os.Getenv("AZURE_TENANT_ID")); tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := fetchJSON(req, &exchange); err != nil {
+		return "", time.Time{}, fmt.Errorf("acr token exchange failed: %w", err)
+	}
+	return exchange.RefreshToken, tokenExpiry(exchange.RefreshToken), nil
+}
+
+// credential returns the service principal of a configured client secret;
+// for a configured client ID alone, AKS workload identity, else the
+// user-assigned managed identity; and otherwise DefaultAzureCredential.
+func (identity Identity) credential() (azcore.TokenCredential, error) {
+	options := azcore.ClientOptions{Transport: client}
+	switch {
+	case identity.ClientSecret != "":
+		return azidentity.NewClientSecretCredential(cmp.Or(identity.TenantID, os.Getenv("AZURE_TENANT_ID")), cmp.Or(identity.ClientID, os.Getenv("AZURE_CLIENT_ID")), identity.ClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: options})
+	case identity.ClientID != "":
+		var chain []azcore.TokenCredential
+		if workload, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{ClientOptions: options, ClientID: identity.ClientID, TenantID: identity.TenantID}); err == nil {
+			chain = append(chain, workload)
+		}
+		managed, err := azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{ClientOptions: options, ID: azidentity.ClientID(identity.ClientID)})
+		if err != nil {
+			return nil, err
+		}
+		return azidentity.NewChainedTokenCredential(append(chain, managed), nil)
+	default:
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{ClientOptions: options, TenantID: identity.TenantID})
+	}
+}
+
+// tokenExpiry reads the exp claim of a JWT, assuming an hour if it has none.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+			return time.Unix(claims.Exp, 0)
+		}
+	}
+	return time.Now().Add(time.Hour)
+}
+
+func fetchJSON(req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -3,22 +3,87 @@ package config
 import (
 	"encoding/base64"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 )
 
 type Auth struct {
-	Username string `yaml:"username,omitempty"`
-	Password string `yaml:"password,omitempty"`
+	// Mode passthrough forwards each client's own credentials to the
+	// upstream instead of using the registry's.
+	Mode string `yaml:"mode,omitempty"`
+	// Type fetches upstream credentials from a cloud provider instead of
+	// using Username and Password: ecr with the AWS credentials of the proxy,
+	// where Region overrides the region of the registry host, gcp with the
+	// service account KeyFile or the metadata server, or acr with a service
+	// principal, workload identity or managed identity.
+	Type         string        `yaml:"type,omitempty"`
+	Region       string        `yaml:"region,omitempty"`
+	KeyFile      string        `yaml:"key_file,omitempty"`
+	TenantID     string        `yaml:"tenant_id,omitempty"`
+	ClientID     string        `yaml:"client_id,omitempty"`
+	ClientSecret string        `yaml:"client_secret,omitempty"`
+	Username     string        `yaml:"username,omitempty"`
+	Password     string        `yaml:"password,omitempty"`
+	HtpasswdFile string        `yaml:"htpasswd_file,omitempty"`
+	OIDC         *OIDCSettings `yaml:"oidc,omitempty"`
+	// Admins and AdminGroups, OIDC groups, may use the management API.
+	Admins      []string `yaml:"admins,omitempty"`
+	AdminGroups []string `yaml:"admin_groups,omitempty"`
+
+	htpasswd *htpasswd
+	oidc     *oidcVerifier
 }
 
-func (a *Auth) IsAuthenticated(r *http.Request) bool {
-	if a.Username == "" || a.Password == "" {
-		return true
+// Authenticate checks the request's credentials against the configured user,
+// htpasswd file and OIDC issuer, returning the authenticated username and, for
+// OIDC, its groups. JWTs are accepted as bearer tokens or as the basic auth
+// password, and a verified client certificate authenticates on its own.
+// Requests always pass when no credentials are configured.
+func (a *Auth) Authenticate(r *http.Request) (string, []string, bool) {
+	if user := clientCertIdentity(r); user != "" {
+		return user, nil, true
+	}
+	if !a.enabled() {
+		return "", nil, true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.oidc != nil {
+		user, groups, err := a.oidc.verify(token)
+		return user, groups, err == nil
 	}
 	user, pass, ok := r.BasicAuth()
 	if !ok {
-		return false
+		return "", nil, false
+	}
+	if a.oidc != nil && isJWT(pass) {
+		if user, groups, err := a.oidc.verify(pass); err == nil {
+			return user, groups, true
+		}
+	}
+	if a.Username != "" && user == a.Username && pass == a.Password {
+		return user, nil, true
+	}
+	if a.htpasswd != nil && a.htpasswd.verify(user, pass) {
+		return user, nil, true
+	}
+	return "", nil, false
+}
+
+func (a *Auth) enabled() bool {
+	return a.Username != "" && a.Password != "" || a.htpasswd != nil || a.oidc != nil
+}
+
+// IsAdmin reports whether an authenticated client may use the management API:
+// a user listed in auth.admins or a member of auth.admin_groups. Without client
+// authentication, clients admitted by admin_allowed_cidrs are admins, so the
+// management API is closed unless those are set.
+func (c *Config) IsAdmin(user string, groups []string, addr netip.Addr) bool {
+	if user != "" && (slices.Contains(c.Auth.Admins, user) || slices.ContainsFunc(groups, func(group string) bool {
+		return slices.Contains(c.Auth.AdminGroups, group)
+	})) {
+		return true
 	}
-	return user == a.Username && pass == a.Password
+	return !c.Auth.enabled() && c.adminCIDRs != nil && containsAddr(c.adminCIDRs, addr)
 }
 
 func (a *Auth) ApplyToRequest(req *http.Request) bool {
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"oci-proxy/internal/pkg/aws"
+	"oci-proxy/internal/pkg/azure"
+	"oci-proxy/internal/pkg/gcp"
+)
+
+// authTypes are the values of auth.type, each obtaining registry credentials
+// from a cloud provider.
+var authTypes = []string{"ecr", "gcp", "acr"}
+
+// cloudAuth fetches registry credentials of auth.type for registry and
+// returns them with the time they should be renewed.
+func cloudAuth(registry string, auth Auth) (Auth, time.Time, error) {
+	ctx := context.Background()
+	switch auth.Type {
+	case "ecr":
+		username, password, expires, err := aws.ECRAuthorizationToken(ctx, cmp.Or(auth.Region, aws.ECRRegion(registry)))
+		if errors.Is(err, aws.ErrNoRegion) {
+			return Auth{}, time.Time{}, fmt.Errorf("cannot tell the AWS region of %s, set auth.region", registry)
+		}
+		if err != nil {
+			return Auth{}, time.Time{}, err
+		}
+		// ECR tokens last 12 hours; renew them an hour early.
+		return Auth{Username: username, Password: password}, expires.Add(-time.Hour), nil
+	case "gcp":
+		token, expires, err := gcp.AccessToken(ctx, auth.KeyFile)
+		if err != nil {
+			return Auth{}, time.Time{}, err
+		}
+		return Auth{Username: gcp.Username, Password: token}, expires.Add(-5 * time.Minute), nil
+	case "acr":
+		identity := azure.Identity{TenantID: auth.TenantID, ClientID: auth.ClientID, ClientSecret: auth.ClientSecret}
+		token, expires, err := azure.ACRRefreshToken(ctx, registry, identity)
+		if err != nil {
+			return Auth{}, time.Time{}, err
+		}
+		return Auth{Username: azure.Username, Password: token}, expires.Add(-15 * time.Minute), nil
+	}
+	return Auth{}, time.Time{}, fmt.Errorf("unknown auth.type %q", auth.Type)
+}
@@ -1,52 +1,855 @@
 package config
 
 import (
+	"cmp"
+	"crypto/x509"
+	"fmt"
+	"iter"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"oci-proxy/internal/pkg/cron"
+)
+
+// S3Settings configures an S3-compatible cache backend.
+type S3Settings struct {
+	Endpoint  string `yaml:"endpoint,omitempty"`
+	Region    string `yaml:"region,omitempty"`
+	Bucket    string `yaml:"bucket,omitempty"`
+	Prefix    string `yaml:"prefix,omitempty"`
+	AccessKey string `yaml:"access_key,omitempty"`
+	SecretKey string `yaml:"secret_key,omitempty"`
+	PathStyle *bool  `yaml:"path_style,omitempty"`
+}
+
+// UsePathStyle reports whether objects are addressed as endpoint/bucket/key,
+// as MinIO and other S3-compatible stores require, which is the default with
+// a custom endpoint.
+func (s S3Settings) UsePathStyle() bool {
+	if s.PathStyle != nil {
+		return *s.PathStyle
+	}
+	return s.Endpoint != ""
+}
+
+// CanarySettings routes a percentage of pull requests to an alternate upstream.
+type CanarySettings struct {
+	Upstream string  `yaml:"upstream"`
+	Percent  float64 `yaml:"percent"`
+	Insecure bool    `yaml:"insecure,omitempty"`
+}
+
+// MirrorHost returns the host of a mirrors entry and whether it is served
+// over plain HTTP, as entries with an http:// prefix are.
+func MirrorHost(mirror string) (string, bool) {
+	if host, ok := strings.CutPrefix(mirror, "http://"); ok {
+		return strings.TrimSuffix(host, "/"), true
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(mirror, "https://"), "/"), false
+}
+
+// ChaosSettings inject synthetic upstream failures into a share of the
+// requests sent to a registry, for testing clients and resilience settings.
+// Percentages apply independently to each upstream request.
+type ChaosSettings struct {
+	Latency         time.Duration `yaml:"latency,omitempty"`
+	LatencyPercent  float64       `yaml:"latency_percent,omitempty"`
+	ErrorPercent    float64       `yaml:"error_percent,omitempty"`
+	ErrorStatus     int           `yaml:"error_status,omitempty"`
+	TruncatePercent float64       `yaml:"truncate_percent,omitempty"`
+}
+
+func (c *ChaosSettings) validate() error {
+	for name, percent := range map[string]float64{"latency_percent": c.LatencyPercent, "error_percent": c.ErrorPercent, "truncate_percent": c.TruncatePercent} {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("chaos.%s must be between 0 and 100", name)
+		}
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 400 || c.ErrorStatus > 599) {
+		return fmt.Errorf("chaos.error_status must be a 4xx or 5xx status")
+	}
+	return nil
+}
+
+// ShadowSettings mirrors a sample of client pull requests to a secondary endpoint.
+// Mode "headers" (default) sends them as HEAD requests; "full" replays the
+// original method and downloads the response. ForwardCredentials sends the
+// client's Authorization and Cookie headers to the target too.
+type ShadowSettings struct {
+	Target             string  `yaml:"target"`
+	Percent            float64 `yaml:"percent"`
+	Mode               string  `yaml:"mode,omitempty"`
+	ForwardCredentials bool    `yaml:"forward_credentials,omitempty"`
+}
+
+// StoreSettings selects where state shared between replicas, such as upstream
+// tokens and tag resolutions, is kept. CacheIndex also keeps the sizes and
+// last access times of cached blobs there, for replicas sharing cache storage.
+type StoreSettings struct {
+	Backend    string        `yaml:"backend,omitempty"`
+	Redis      RedisSettings `yaml:"redis,omitempty"`
+	CacheIndex bool          `yaml:"cache_index,omitempty"`
+}
+
+type RedisSettings struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	DB       int    `yaml:"db,omitempty"`
+	Prefix   string `yaml:"prefix,omitempty"`
+}
+
+// RepositoryRules restricts which repositories of a registry may be accessed.
+// Patterns are globs where * does not cross /, or regular expressions when they start with ^.
+type RepositoryRules struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// TagRules restricts which tags clients may pull by tag. Patterns follow
+// RepositoryRules; the keyword semver matches semantic version tags such as v1.2.3.
+// Pulls by digest are not affected.
+type TagRules struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// ArtifactTypeRules restricts which artifacts clients may pull by the
+// artifactType of their manifests, or else their config media type. Patterns
+// follow RepositoryRules. Indexes without an artifactType are not affected.
+type ArtifactTypeRules struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// RetentionSettings prunes cached blobs that have not been pulled for MaxAge,
+// except the content of each repository's KeepTags most recently pulled tags
+// and of Pinned images, given as repo:tag or repo@digest.
+type RetentionSettings struct {
+	MaxAge   time.Duration `yaml:"max_age,omitempty"`
+	KeepTags int           `yaml:"keep_tags,omitempty"`
+	Pinned   []string      `yaml:"pinned,omitempty"`
+}
+
+// Client compatibility profiles, enabled with compat_profiles. Each works
+// around quirks of the clients it names, identified by their User-Agent.
+const (
+	CompatDockerLegacy = "docker-legacy"
+	CompatBuildKit     = "buildkit"
+	CompatPodman       = "podman"
 )
 
+var compatProfiles = []string{CompatDockerLegacy, CompatBuildKit, CompatPodman}
+
+// PreloadSettings lists images fully downloaded into the cache at startup and
+// every Interval.
+type PreloadSettings struct {
+	Interval time.Duration  `yaml:"interval"`
+	Images   []PreloadImage `yaml:"images"`
+}
+
+// PreloadImage is an image reference such as ghcr.io/org/app:v1, optionally
+// limited to Platforms such as linux/amd64.
+type PreloadImage struct {
+	Image     string   `yaml:"image"`
+	Platforms []string `yaml:"platforms,omitempty"`
+}
+
+// MirrorSyncSettings copies the tags of Repository, such as ghcr.io/org/app,
+// that match the Tags globs (all when empty) into the cache whenever the cron
+// Schedule fires, optionally limited to Platforms.
+type MirrorSyncSettings struct {
+	Repository string   `yaml:"repository"`
+	Schedule   string   `yaml:"schedule"`
+	Tags       []string `yaml:"tags,omitempty"`
+	Platforms  []string `yaml:"platforms,omitempty"`
+
+	schedule *cron.Schedule
+}
+
+// Due reports whether the sync is scheduled in the minute of t.
+func (m MirrorSyncSettings) Due(t time.Time) bool {
+	return m.schedule != nil && m.schedule.Matches(t)
+}
+
+// MatchesTag reports whether tag is selected for syncing.
+func (m MirrorSyncSettings) MatchesTag(tag string) bool {
+	if len(m.Tags) == 0 {
+		return true
+	}
+	for _, pattern := range m.Tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// BackgroundSettings pace the upstream requests of preload and mirror_sync,
+// which only run inside one of the Windows, cron expressions matched per
+// minute such as "* 1-5 * * *", and pause while the upstream reports fewer
+// than RateLimitReserve pulls left in its quota.
+type BackgroundSettings struct {
+	Windows          []string `yaml:"windows,omitempty"`
+	RateLimitReserve int      `yaml:"rate_limit_reserve,omitempty"`
+
+	windows []*cron.Schedule
+}
+
+// InWindow reports whether background work may run in the minute of t.
+func (b BackgroundSettings) InWindow(t time.Time) bool {
+	for _, window := range b.windows {
+		if window.Matches(t) {
+			return true
+		}
+	}
+	return len(b.windows) == 0
+}
+
+func (b *BackgroundSettings) compile() error {
+	b.windows = nil
+	for _, window := range b.Windows {
+		schedule, err := cron.Parse(window)
+		if err != nil {
+			return fmt.Errorf("background window %q: %w", window, err)
+		}
+		b.windows = append(b.windows, schedule)
+	}
+	return nil
+}
+
+// ScrubSettings enable re-hashing every cached blob at Rate bytes per second,
+// one pass every Interval, to find bit rot and truncated writes.
+type ScrubSettings struct {
+	Rate     StorageSize   `yaml:"rate,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// ScanSettings submit the images clients pull to a Trivy server by running
+// the trivy client in server mode against the proxy, and optionally block
+// images with vulnerabilities of BlockSeverity or worse. Scanning is enabled
+// by TrivyServer.
+type ScanSettings struct {
+	TrivyServer   string        `yaml:"trivy_server,omitempty"`
+	Command       string        `yaml:"command,omitempty"`
+	Registry      string        `yaml:"registry,omitempty"`
+	BlockSeverity string        `yaml:"block_severity,omitempty"`
+	Concurrency   int           `yaml:"concurrency,omitempty"`
+	Timeout       time.Duration `yaml:"timeout,omitempty"`
+	MaxAge        time.Duration `yaml:"max_age,omitempty"`
+}
+
+// Severities are the vulnerability severities of Trivy, least severe first.
+var Severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func (s ScanSettings) validate() error {
+	if s.BlockSeverity != "" && !slices.Contains(Severities, s.BlockSeverity) {
+		return fmt.Errorf("invalid scan.block_severity %q, expected one of %s", s.BlockSeverity, strings.Join(Severities, ", "))
+	}
+	return nil
+}
+
+// LogRotationSettings rotate the log_output file once it reaches MaxSize or
+// Interval has passed since it was opened, keeping MaxFiles rotated files
+// for at most MaxAge, gzipped with Compress. Zero values disable each limit.
+type LogRotationSettings struct {
+	MaxSize  StorageSize   `yaml:"max_size,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	MaxFiles int           `yaml:"max_files,omitempty"`
+	MaxAge   time.Duration `yaml:"max_age,omitempty"`
+	Compress bool          `yaml:"compress,omitempty"`
+}
+
+func (c *Config) validateLogRotation() error {
+	r := c.LogRotation
+	if r == (LogRotationSettings{}) {
+		return nil
+	}
+	if c.LogOutput == "" || c.LogOutput == "stdout" || c.LogOutput == "stderr" {
+		return fmt.Errorf("log_rotation requires log_output to be a file path")
+	}
+	if r.MaxSize < 0 || r.Interval < 0 || r.MaxFiles < 0 || r.MaxAge < 0 {
+		return fmt.Errorf("log_rotation limits must not be negative")
+	}
+	return nil
+}
+
+// AuditSettings enable the pull audit log, an append-only JSONL file of the
+// manifest pulls of clients.
+type AuditSettings struct {
+	File string `yaml:"file,omitempty"`
+}
+
+// PolicySettings evaluate an OPA/Rego policy on each manifest request, either
+// on an OPA server through the data API endpoint at URL or on an opa server
+// the proxy runs for Bundle. Evaluation is enabled by URL or Bundle.
+type PolicySettings struct {
+	URL      string        `yaml:"url,omitempty"`
+	Bundle   string        `yaml:"bundle,omitempty"`
+	Query    string        `yaml:"query,omitempty"`
+	Command  string        `yaml:"command,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	FailOpen bool          `yaml:"fail_open,omitempty"`
+}
+
+// policyQuery matches the data references a bundle's OPA server answers.
+var policyQuery = regexp.MustCompile(`^data(\.[A-Za-z_][A-Za-z0-9_]*)+$`)
+
+func (p PolicySettings) validate() error {
+	if p.URL != "" && p.Bundle != "" {
+		return fmt.Errorf("policy.url and policy.bundle are mutually exclusive")
+	}
+	if p.Query != "" && !policyQuery.MatchString(p.Query) {
+		return fmt.Errorf("invalid policy.query %q, expected a data reference such as data.oci_proxy.allow", p.Query)
+	}
+	return nil
+}
+
+// OverloadSettings are the thresholds past which registry requests are shed
+// with 503 responses. Zero disables a check.
+type OverloadSettings struct {
+	MaxInFlight    int           `yaml:"max_in_flight,omitempty"`
+	MaxMemory      StorageSize   `yaml:"max_memory,omitempty"`
+	MaxDiskLatency time.Duration `yaml:"max_disk_latency,omitempty"`
+	RetryAfter     time.Duration `yaml:"retry_after,omitempty"`
+}
+
+// ClientLimitSettings cap the registry requests of each client, the
+// authenticated user or else the client IP, so that one busy client cannot
+// starve the others. Users with an entry under Users get its limits instead,
+// falling back to the "*" entry. Zero disables a limit.
+type ClientLimitSettings struct {
+	ClientLimits `yaml:",inline"`
+	Users        map[string]ClientLimits `yaml:"users,omitempty"`
+}
+
+// ClientLimits are the limits of one client. Burst defaults to one second of
+// requests.
+type ClientLimits struct {
+	RequestsPerSecond  float64 `yaml:"requests_per_second,omitempty"`
+	Burst              int     `yaml:"burst,omitempty"`
+	MaxConcurrentBlobs int     `yaml:"max_concurrent_blobs,omitempty"`
+}
+
+// For returns the limits of user, "" for anonymous clients.
+func (c ClientLimitSettings) For(user string) ClientLimits {
+	if user != "" {
+		if limits, ok := c.Users[user]; ok {
+			return limits
+		}
+		if limits, ok := c.Users["*"]; ok {
+			return limits
+		}
+	}
+	return c.ClientLimits
+}
+
+func (c ClientLimitSettings) validate() error {
+	check := func(subject string, limits ClientLimits) error {
+		if limits.RequestsPerSecond < 0 || limits.Burst < 0 || limits.MaxConcurrentBlobs < 0 {
+			return fmt.Errorf("client_limits%s: limits must not be negative", subject)
+		}
+		return nil
+	}
+	if err := check("", c.ClientLimits); err != nil {
+		return err
+	}
+	for user, limits := range c.Users {
+		if err := check(" user "+user, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuotaSettings limits the bytes transferred per calendar month (UTC), and
+// upstream and cache consumption per day, for each authenticated user, each
+// tenant, a named group of users billed together, and each repository
+// namespace, such as docker.io/library. Users without an entry fall back to
+// the "*" entry, if any.
+type QuotaSettings struct {
+	Users      map[string]QuotaLimits `yaml:"users,omitempty"`
+	Tenants    map[string]TenantQuota `yaml:"tenants,omitempty"`
+	Namespaces map[string]QuotaLimits `yaml:"namespaces,omitempty"`
+	// Webhook receives a JSON POST the first time in a month a user or tenant
+	// crosses its soft or hard limit.
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+// QuotaLimits are monthly transfer limits. Past Soft, responses carry a
+// warning header; past Hard, requests are rejected until the next month.
+// Past DailyUpstream bytes not served from the cache, or DailyCache bytes
+// added to it, requests are rejected until the next day. Zero disables a
+// limit.
+type QuotaLimits struct {
+	Soft          StorageSize `yaml:"soft,omitempty"`
+	Hard          StorageSize `yaml:"hard,omitempty"`
+	DailyUpstream StorageSize `yaml:"daily_upstream,omitempty"`
+	DailyCache    StorageSize `yaml:"daily_cache,omitempty"`
+}
+
+type TenantQuota struct {
+	QuotaLimits `yaml:",inline"`
+	Members     []string `yaml:"members"`
+}
+
+// UserLimits returns the limits of user.
+func (q QuotaSettings) UserLimits(user string) (QuotaLimits, bool) {
+	if limits, ok := q.Users[user]; ok {
+		return limits, true
+	}
+	limits, ok := q.Users["*"]
+	return limits, ok
+}
+
+// TenantOf returns the tenant user belongs to.
+func (q QuotaSettings) TenantOf(user string) (string, bool) {
+	for name, tenant := range q.Tenants {
+		if slices.Contains(tenant.Members, user) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (q QuotaSettings) validate() error {
+	check := func(subject string, limits QuotaLimits) error {
+		if limits.Soft < 0 || limits.Hard < 0 || limits.Hard > 0 && limits.Soft > limits.Hard {
+			return fmt.Errorf("quotas %s: soft limit must not exceed the hard limit", subject)
+		}
+		if limits.DailyUpstream < 0 || limits.DailyCache < 0 {
+			return fmt.Errorf("quotas %s: daily limits must not be negative", subject)
+		}
+		return nil
+	}
+	for namespace, limits := range q.Namespaces {
+		if registry, ns, _ := strings.Cut(namespace, "/"); registry == "" || ns == "" || strings.Contains(ns, "/") {
+			return fmt.Errorf("quotas: namespace %q must be a registry and namespace, e.g. docker.io/library", namespace)
+		}
+		if err := check("namespace "+namespace, limits); err != nil {
+			return err
+		}
+	}
+	for user, limits := range q.Users {
+		if err := check("user "+user, limits); err != nil {
+			return err
+		}
+	}
+	tenants := make(map[string]string)
+	for name, tenant := range q.Tenants {
+		if err := check("tenant "+name, tenant.QuotaLimits); err != nil {
+			return err
+		}
+		for _, member := range tenant.Members {
+			if other, ok := tenants[member]; ok {
+				return fmt.Errorf("quotas: user %s is a member of tenants %s and %s", member, other, name)
+			}
+			tenants[member] = name
+		}
+	}
+	if q.Webhook != "" {
+		if u, err := url.Parse(q.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("quotas.webhook must be an http or https URL")
+		}
+	}
+	return nil
+}
+
+// semverPattern matches semantic versions with an optional v prefix.
+const semverPattern = `^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`
+
 // RegistrySettings defines the settings for a registry.
 type RegistrySettings struct {
-	Auth            Auth        `yaml:"auth,omitempty"`
-	CacheDir        string      `yaml:"cache_dir,omitempty"`
-	CacheMaxSize    StorageSize `yaml:"cache_max_size,omitempty"`
-	UpstreamProxy   string      `yaml:"upstream_proxy,omitempty"`
-	FollowRedirects *bool       `yaml:"follow_redirects,omitempty"`
-	Insecure        *bool       `yaml:"insecure,omitempty"`
+	Auth               Auth              `yaml:"auth,omitempty"`
+	TenantAuth         map[string]Auth   `yaml:"tenant_auth,omitempty"`
+	ForbidAnonymous    *bool             `yaml:"forbid_anonymous,omitempty"`
+	CredentialHelper   string            `yaml:"credential_helper,omitempty"`
+	DockerConfig       string            `yaml:"docker_config,omitempty"`
+	CacheBackend       string            `yaml:"cache_backend,omitempty"`
+	CacheDir           string            `yaml:"cache_dir,omitempty"`
+	CacheMaxSize       StorageSize       `yaml:"cache_max_size,omitempty"`
+	CacheReservedSize  StorageSize       `yaml:"cache_reserved_size,omitempty"`
+	CacheMinFreeDisk   StorageSize       `yaml:"cache_min_free_disk,omitempty"`
+	S3                 S3Settings        `yaml:"s3,omitempty"`
+	UpstreamProxy      string            `yaml:"upstream_proxy,omitempty"`
+	FollowRedirects    *bool             `yaml:"follow_redirects,omitempty"`
+	Insecure           *bool             `yaml:"insecure,omitempty"`
+	Offline            *bool             `yaml:"offline,omitempty"`
+	KeepWarm           int               `yaml:"keep_warm,omitempty"`
+	MaxIdleConns       int               `yaml:"max_idle_conns_per_host,omitempty"`
+	AllowedMethods     []string          `yaml:"allowed_methods,omitempty"`
+	BlockedPaths       []string          `yaml:"blocked_paths,omitempty"`
+	Canary             *CanarySettings   `yaml:"canary,omitempty"`
+	Mirrors            []string          `yaml:"mirrors,omitempty"`
+	Chaos              *ChaosSettings    `yaml:"chaos,omitempty"`
+	RetryAfterBudget   time.Duration     `yaml:"retry_after_budget,omitempty"`
+	MaxRequestsPerMin  int               `yaml:"max_requests_per_minute,omitempty"`
+	RateLimitWait      time.Duration     `yaml:"rate_limit_wait,omitempty"`
+	DownloadBandwidth  StorageSize       `yaml:"max_download_bandwidth,omitempty"`
+	CAFile             string            `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify,omitempty"`
+	MinTLSVersion      string            `yaml:"min_tls_version,omitempty"`
+	TagCacheTTL        time.Duration     `yaml:"tag_cache_ttl,omitempty"`
+	TagListTTL         time.Duration     `yaml:"tag_list_ttl,omitempty"`
+	ManifestTTL        time.Duration     `yaml:"manifest_ttl,omitempty"`
+	ManifestListTTL    time.Duration     `yaml:"manifest_list_ttl,omitempty"`
+	ReferrersTTL       time.Duration     `yaml:"referrers_ttl,omitempty"`
+	Repositories       RepositoryRules   `yaml:"repositories,omitempty"`
+	Tags               TagRules          `yaml:"tags,omitempty"`
+	ArtifactTypes      ArtifactTypeRules `yaml:"artifact_types,omitempty"`
+	Signatures         []SignaturePolicy `yaml:"signatures,omitempty"`
+	Namespaces         map[string]string `yaml:"namespaces,omitempty"`
+	Retention          RetentionSettings `yaml:"retention,omitempty"`
+
+	blockedPaths  []*regexp.Regexp
+	allowedRepos  []*regexp.Regexp
+	deniedRepos   []*regexp.Regexp
+	allowedTags   []*regexp.Regexp
+	deniedTags    []*regexp.Regexp
+	allowedTypes  []*regexp.Regexp
+	deniedTypes   []*regexp.Regexp
+	rootCAs       *x509.CertPool
+	minTLSVersion uint16
 }
 
 // Config holds the application configuration.
 type Config struct {
-	Port            int                         `yaml:"port"`
-	LogLevel        string                      `yaml:"log_level"`
-	DefaultRegistry string                      `yaml:"default_registry"`
-	BaseURL         string                      `yaml:"base_url"`
-	WhitelistMode   bool                        `yaml:"whitelist_mode"`
-	Auth            Auth                        `yaml:"auth"`
-	Defaults        RegistrySettings            `yaml:"defaults"`
-	Registries      map[string]RegistrySettings `yaml:"registries"`
+	Port                    int                         `yaml:"port"`
+	ListenAddress           string                      `yaml:"listen_address"`
+	IPVersion               string                      `yaml:"ip_version"`
+	LogLevel                string                      `yaml:"log_level"`
+	LogFormat               string                      `yaml:"log_format,omitempty"`
+	LogOutput               string                      `yaml:"log_output,omitempty"`
+	LogRotation             LogRotationSettings         `yaml:"log_rotation,omitempty"`
+	Webhooks                []WebhookSettings           `yaml:"webhooks,omitempty"`
+	AccessLogFormat         string                      `yaml:"access_log_format"`
+	DefaultRegistry         string                      `yaml:"default_registry"`
+	BaseURL                 string                      `yaml:"base_url"`
+	WhitelistMode           bool                        `yaml:"whitelist_mode"`
+	Allow                   []string                    `yaml:"allow"`
+	Deny                    []string                    `yaml:"deny"`
+	CredentialCheckInterval time.Duration               `yaml:"credential_check_interval"`
+	MetadataDB              string                      `yaml:"metadata_db"`
+	KeepWarmInterval        time.Duration               `yaml:"keep_warm_interval"`
+	DiskWriteConcurrency    int                         `yaml:"disk_write_concurrency"`
+	CachePersistInterval    time.Duration               `yaml:"cache_persist_interval"`
+	SharedCache             bool                        `yaml:"shared_cache"`
+	RetentionInterval       time.Duration               `yaml:"retention_interval"`
+	PipelineAudit           bool                        `yaml:"pipeline_audit"`
+	StatsSnapshotInterval   time.Duration               `yaml:"stats_snapshot_interval"`
+	StatsRetention          time.Duration               `yaml:"stats_retention"`
+	PullSessionIdle         time.Duration               `yaml:"pull_session_idle"`
+	CompatProfiles          []string                    `yaml:"compat_profiles,omitempty"`
+	Store                   StoreSettings               `yaml:"store"`
+	Shadow                  *ShadowSettings             `yaml:"shadow,omitempty"`
+	Sharding                *ShardingSettings           `yaml:"sharding,omitempty"`
+	Preload                 PreloadSettings             `yaml:"preload,omitempty"`
+	MirrorSync              []MirrorSyncSettings        `yaml:"mirror_sync,omitempty"`
+	Background              BackgroundSettings          `yaml:"background,omitempty"`
+	Scrub                   ScrubSettings               `yaml:"scrub,omitempty"`
+	Scan                    ScanSettings                `yaml:"scan,omitempty"`
+	Policy                  PolicySettings              `yaml:"policy,omitempty"`
+	Audit                   AuditSettings               `yaml:"audit,omitempty"`
+	Quotas                  QuotaSettings               `yaml:"quotas,omitempty"`
+	Overload                OverloadSettings            `yaml:"overload,omitempty"`
+	ClientLimits            ClientLimitSettings         `yaml:"client_limits,omitempty"`
+	Aliases                 map[string]string           `yaml:"aliases,omitempty"`
+	TLS                     *TLSSettings                `yaml:"tls,omitempty"`
+	ACME                    *ACMESettings               `yaml:"acme,omitempty"`
+	ProxyProtocol           *ProxyProtocolSettings      `yaml:"proxy_protocol,omitempty"`
+	AllowedCIDRs            []string                    `yaml:"allowed_cidrs,omitempty"`
+	AdminAllowedCIDRs       []string                    `yaml:"admin_allowed_cidrs,omitempty"`
+	Notation                *NotationSettings           `yaml:"notation,omitempty"`
+	Auth                    Auth                        `yaml:"auth"`
+	Defaults                RegistrySettings            `yaml:"defaults"`
+	Registries              map[string]RegistrySettings `yaml:"registries"`
+
+	registryPatterns []registryPattern
+	credentials      *credentialCache
+	allowedCIDRs     []netip.Prefix
+	adminCIDRs       []netip.Prefix
+}
+
+// registryPattern is a registries key matching a family of hosts: a glob such
+// as *.gcr.io, or a regular expression when the key starts with ^.
+type registryPattern struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func (p registryPattern) match(host string) bool {
+	if p.re != nil {
+		return p.re.MatchString(host)
+	}
+	ok, _ := path.Match(strings.ToLower(p.key), strings.ToLower(host))
+	return ok
+}
+
+// IsRegistryPattern reports whether a registries key is a glob or regular
+// expression rather than a host name.
+func IsRegistryPattern(key string) bool {
+	return strings.HasPrefix(key, "^") || strings.ContainsAny(key, "*?[")
 }
 
 // LoadConfig reads the configuration from the given path.
 func LoadConfig(path string) (*Config, error) {
-	config := &Config{}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	if err := yaml.Unmarshal(data, config); err != nil {
+	return parseConfig(data, nil)
+}
+
+// parseConfig decodes and validates a config file. The users of
+// auth.htpasswd_file are read from it unless users is given.
+func parseConfig(data []byte, users *htpasswd) (*Config, error) {
+	config := &Config{credentials: newCredentialCache()}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
 		return nil, err
 	}
+	if err := expandEnv(&root); err != nil {
+		return nil, err
+	}
+	if err := root.Decode(config); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(append(config.Allow, config.Deny...)); err != nil {
+		return nil, err
+	}
+	if users != nil {
+		config.Auth.htpasswd = users
+	} else if config.Auth.HtpasswdFile != "" {
+		var err error
+		if config.Auth.htpasswd, err = loadHtpasswd(config.Auth.HtpasswdFile); err != nil {
+			return nil, fmt.Errorf("failed to load htpasswd file: %w", err)
+		}
+	}
+	if config.Auth.OIDC != nil {
+		if config.Auth.OIDC.Issuer == "" || config.Auth.OIDC.Audience == "" {
+			return nil, fmt.Errorf("auth.oidc.issuer and auth.oidc.audience are required")
+		}
+		config.Auth.oidc = newOIDCVerifier(*config.Auth.OIDC)
+	}
+	switch config.Store.Backend {
+	case "", "memory":
+	case "redis":
+		if config.Store.Redis.Address == "" {
+			return nil, fmt.Errorf("store.redis.address is required")
+		}
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", config.Store.Backend)
+	}
+	if config.Store.CacheIndex && config.Store.Backend != "redis" {
+		return nil, fmt.Errorf("store.cache_index requires store.backend redis")
+	}
+	if config.ProxyProtocol != nil {
+		if err := config.ProxyProtocol.compile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.compileCIDRs(); err != nil {
+		return nil, err
+	}
+	if err := validateAliases(config.Aliases); err != nil {
+		return nil, err
+	}
+	if err := config.validateListen(); err != nil {
+		return nil, err
+	}
+	if config.LogFormat != "" && config.LogFormat != "text" && config.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid log_format %q, expected text or json", config.LogFormat)
+	}
+	if err := config.validateLogRotation(); err != nil {
+		return nil, err
+	}
+	for i := range config.Webhooks {
+		if err := config.Webhooks[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.AccessLogFormat != "" && config.AccessLogFormat != "text" && config.AccessLogFormat != "json" {
+		return nil, fmt.Errorf("invalid access_log_format %q, expected text or json", config.AccessLogFormat)
+	}
+	if config.Shadow != nil && config.Shadow.Mode != "" && config.Shadow.Mode != "headers" && config.Shadow.Mode != "full" {
+		return nil, fmt.Errorf("invalid shadow.mode %q, expected headers or full", config.Shadow.Mode)
+	}
+	if config.Sharding != nil {
+		if err := config.Sharding.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := compileMirrorSync(config.MirrorSync); err != nil {
+		return nil, err
+	}
+	if err := config.Background.compile(); err != nil {
+		return nil, err
+	}
+	if err := config.Quotas.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.ClientLimits.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Scan.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Policy.validate(); err != nil {
+		return nil, err
+	}
+	if config.Notation != nil {
+		if err := config.Notation.load(); err != nil {
+			return nil, err
+		}
+	}
+	for name, settings := range config.Registries {
+		for tenant := range settings.TenantAuth {
+			if _, ok := config.Quotas.Tenants[tenant]; !ok {
+				return nil, fmt.Errorf("registry %s: tenant_auth names unknown tenant %q, define it under quotas.tenants", name, tenant)
+			}
+		}
+	}
+	for _, profile := range config.CompatProfiles {
+		if !slices.Contains(compatProfiles, profile) {
+			return nil, fmt.Errorf("unknown compat profile %q, expected one of %s", profile, strings.Join(compatProfiles, ", "))
+		}
+	}
+	for _, image := range config.Preload.Images {
+		if image.Image == "" {
+			return nil, fmt.Errorf("preload.images entries require an image")
+		}
+	}
+	if config.ACME != nil && (len(config.ACME.Domains) == 0 || config.ACME.CacheDir == "") {
+		return nil, fmt.Errorf("acme.domains and acme.cache_dir are required")
+	}
+	if config.TLS != nil && config.ACME == nil && (config.TLS.CertFile == "" || config.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file are required")
+	}
 	config.applyDefaults()
+	if err := config.compileSettings(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
+func (c *Config) validateListen() error {
+	ip := net.ParseIP(strings.Trim(c.ListenAddress, "[]"))
+	switch c.IPVersion {
+	case "", "dual":
+	case "ipv4":
+		if ip != nil && ip.To4() == nil {
+			return fmt.Errorf("listen_address %s is not an IPv4 address", c.ListenAddress)
+		}
+	case "ipv6":
+		if ip != nil && ip.To4() != nil {
+			return fmt.Errorf("listen_address %s is not an IPv6 address", c.ListenAddress)
+		}
+	default:
+		return fmt.Errorf("invalid ip_version %q, expected dual, ipv4 or ipv6", c.IPVersion)
+	}
+	return nil
+}
+
+// Listen returns the network and address the proxy listens on: all
+// interfaces unless listen_address is set, on IPv4 and IPv6 unless ip_version
+// restricts it to one of them.
+func (c *Config) Listen() (network, address string) {
+	network = "tcp"
+	switch c.IPVersion {
+	case "ipv4":
+		network = "tcp4"
+	case "ipv6":
+		network = "tcp6"
+	}
+	return network, net.JoinHostPort(strings.Trim(c.ListenAddress, "[]"), strconv.Itoa(c.Port))
+}
+
 func (c *Config) applyDefaults() {
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.KeepWarmInterval <= 0 {
+		c.KeepWarmInterval = 30 * time.Second
+	}
+	if c.StatsSnapshotInterval <= 0 {
+		c.StatsSnapshotInterval = time.Hour
+	}
+	if c.StatsRetention <= 0 {
+		c.StatsRetention = 90 * 24 * time.Hour
+	}
+	if c.RetentionInterval <= 0 {
+		c.RetentionInterval = time.Hour
+	}
+	if c.PullSessionIdle <= 0 {
+		c.PullSessionIdle = 10 * time.Second
+	}
+	if c.Preload.Interval <= 0 {
+		c.Preload.Interval = 6 * time.Hour
+	}
+	if c.Background.RateLimitReserve <= 0 {
+		c.Background.RateLimitReserve = 10
+	}
+	if c.Overload.RetryAfter <= 0 {
+		c.Overload.RetryAfter = 10 * time.Second
+	}
+	if c.DiskWriteConcurrency <= 0 {
+		c.DiskWriteConcurrency = 2
+	}
+	if c.Scrub.Interval <= 0 {
+		c.Scrub.Interval = 24 * time.Hour
+	}
+	if c.Scan.Command == "" {
+		c.Scan.Command = "trivy"
+	}
+	if c.Scan.Concurrency <= 0 {
+		c.Scan.Concurrency = 1
+	}
+	if c.Scan.Timeout <= 0 {
+		c.Scan.Timeout = 10 * time.Minute
+	}
+	if c.Scan.MaxAge <= 0 {
+		c.Scan.MaxAge = 24 * time.Hour
+	}
+	if c.Policy.Query == "" {
+		c.Policy.Query = "data.oci_proxy.allow"
+	}
+	if c.Policy.Command == "" {
+		c.Policy.Command = "opa"
+	}
+	if c.Policy.Timeout <= 0 {
+		c.Policy.Timeout = 5 * time.Second
+	}
+	if c.CachePersistInterval <= 0 {
+		c.CachePersistInterval = time.Minute
+	}
+	if c.Store.Redis.Prefix == "" {
+		c.Store.Redis.Prefix = "oci-proxy:"
+	}
+	if c.MetadataDB == "" && c.Defaults.CacheDir != "" {
+		c.MetadataDB = filepath.Join(c.Defaults.CacheDir, "metadata.json")
+	}
 	if c.Defaults.FollowRedirects == nil {
 		b := true
 		c.Defaults.FollowRedirects = &b
 	}
+	if c.Defaults.MaxIdleConns <= 0 {
+		c.Defaults.MaxIdleConns = 32
+	}
+	if c.Defaults.RateLimitWait == 0 {
+		c.Defaults.RateLimitWait = 30 * time.Second
+	}
 	if c.Defaults.Insecure == nil {
 		b := false
 		c.Defaults.Insecure = &b
@@ -54,16 +857,28 @@ func (c *Config) applyDefaults() {
 
 	for name, registrySettings := range c.Registries {
 		merged := c.Defaults
-		if registrySettings.Auth.Username != "" {
+		if registrySettings.Auth.Username != "" || registrySettings.Auth.Type != "" || registrySettings.Auth.Mode != "" {
 			merged.Auth = registrySettings.Auth
 		}
 
+		if registrySettings.CacheBackend != "" {
+			merged.CacheBackend = registrySettings.CacheBackend
+		}
+		if registrySettings.S3.Bucket != "" {
+			merged.S3 = registrySettings.S3
+		}
 		if registrySettings.CacheDir != "" {
 			merged.CacheDir = registrySettings.CacheDir
 		}
 		if registrySettings.CacheMaxSize != 0 {
 			merged.CacheMaxSize = registrySettings.CacheMaxSize
 		}
+		if registrySettings.CacheReservedSize != 0 {
+			merged.CacheReservedSize = registrySettings.CacheReservedSize
+		}
+		if registrySettings.CacheMinFreeDisk != 0 {
+			merged.CacheMinFreeDisk = registrySettings.CacheMinFreeDisk
+		}
 		if registrySettings.UpstreamProxy != "" {
 			merged.UpstreamProxy = registrySettings.UpstreamProxy
 		}
@@ -73,23 +888,482 @@ func (c *Config) applyDefaults() {
 		if registrySettings.Insecure != nil {
 			merged.Insecure = registrySettings.Insecure
 		}
+		if registrySettings.Offline != nil {
+			merged.Offline = registrySettings.Offline
+		}
+		if registrySettings.TenantAuth != nil {
+			merged.TenantAuth = registrySettings.TenantAuth
+		}
+		if registrySettings.ForbidAnonymous != nil {
+			merged.ForbidAnonymous = registrySettings.ForbidAnonymous
+		}
+		if registrySettings.CredentialHelper != "" {
+			merged.CredentialHelper = registrySettings.CredentialHelper
+		}
+		if registrySettings.DockerConfig != "" {
+			merged.DockerConfig = registrySettings.DockerConfig
+		}
+		if registrySettings.KeepWarm != 0 {
+			merged.KeepWarm = registrySettings.KeepWarm
+		}
+		if registrySettings.MaxIdleConns != 0 {
+			merged.MaxIdleConns = registrySettings.MaxIdleConns
+		}
+		if registrySettings.AllowedMethods != nil {
+			merged.AllowedMethods = registrySettings.AllowedMethods
+		}
+		if registrySettings.BlockedPaths != nil {
+			merged.BlockedPaths = registrySettings.BlockedPaths
+		}
+		if registrySettings.Canary != nil {
+			merged.Canary = registrySettings.Canary
+		}
+		if len(registrySettings.Mirrors) > 0 {
+			merged.Mirrors = registrySettings.Mirrors
+		}
+		if registrySettings.Chaos != nil {
+			merged.Chaos = registrySettings.Chaos
+		}
+		if registrySettings.RetryAfterBudget != 0 {
+			merged.RetryAfterBudget = registrySettings.RetryAfterBudget
+		}
+		if registrySettings.MaxRequestsPerMin != 0 {
+			merged.MaxRequestsPerMin = registrySettings.MaxRequestsPerMin
+		}
+		if registrySettings.RateLimitWait != 0 {
+			merged.RateLimitWait = registrySettings.RateLimitWait
+		}
+		if registrySettings.DownloadBandwidth != 0 {
+			merged.DownloadBandwidth = registrySettings.DownloadBandwidth
+		}
+		if registrySettings.CAFile != "" {
+			merged.CAFile = registrySettings.CAFile
+		}
+		if registrySettings.InsecureSkipVerify {
+			merged.InsecureSkipVerify = true
+		}
+		if registrySettings.MinTLSVersion != "" {
+			merged.MinTLSVersion = registrySettings.MinTLSVersion
+		}
+		if registrySettings.TagCacheTTL != 0 {
+			merged.TagCacheTTL = registrySettings.TagCacheTTL
+		}
+		if registrySettings.TagListTTL != 0 {
+			merged.TagListTTL = registrySettings.TagListTTL
+		}
+		if registrySettings.ManifestTTL != 0 {
+			merged.ManifestTTL = registrySettings.ManifestTTL
+		}
+		if registrySettings.ManifestListTTL != 0 {
+			merged.ManifestListTTL = registrySettings.ManifestListTTL
+		}
+		if registrySettings.ReferrersTTL != 0 {
+			merged.ReferrersTTL = registrySettings.ReferrersTTL
+		}
+		if registrySettings.Repositories.Allow != nil || registrySettings.Repositories.Deny != nil {
+			merged.Repositories = registrySettings.Repositories
+		}
+		if registrySettings.Tags.Allow != nil || registrySettings.Tags.Deny != nil {
+			merged.Tags = registrySettings.Tags
+		}
+		if registrySettings.ArtifactTypes.Allow != nil || registrySettings.ArtifactTypes.Deny != nil {
+			merged.ArtifactTypes = registrySettings.ArtifactTypes
+		}
+		if registrySettings.Namespaces != nil {
+			merged.Namespaces = registrySettings.Namespaces
+		}
+		if registrySettings.Signatures != nil {
+			merged.Signatures = registrySettings.Signatures
+		}
+		if r := registrySettings.Retention; r.MaxAge != 0 || r.KeepTags != 0 || r.Pinned != nil {
+			merged.Retention = r
+		}
 		c.Registries[name] = merged
 	}
 }
 
+// compileSettings prepares path and repository patterns and upstream TLS options of every registry.
+func (c *Config) compileSettings() error {
+	compile := func(s *RegistrySettings) error {
+		s.blockedPaths = nil
+		for _, pattern := range s.BlockedPaths {
+			re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+			if err != nil {
+				return fmt.Errorf("invalid blocked path %q: %w", pattern, err)
+			}
+			s.blockedPaths = append(s.blockedPaths, re)
+		}
+		var err error
+		if s.allowedRepos, err = compileRepositoryPatterns(s.Repositories.Allow); err != nil {
+			return err
+		}
+		if s.deniedRepos, err = compileRepositoryPatterns(s.Repositories.Deny); err != nil {
+			return err
+		}
+		if s.allowedTags, err = compileRepositoryPatterns(s.Tags.Allow); err != nil {
+			return err
+		}
+		if s.deniedTags, err = compileRepositoryPatterns(s.Tags.Deny); err != nil {
+			return err
+		}
+		if s.allowedTypes, err = compileRepositoryPatterns(s.ArtifactTypes.Allow); err != nil {
+			return err
+		}
+		if s.deniedTypes, err = compileRepositoryPatterns(s.ArtifactTypes.Deny); err != nil {
+			return err
+		}
+		if s.Chaos != nil {
+			if err := s.Chaos.validate(); err != nil {
+				return err
+			}
+		}
+		s.Signatures = slices.Clone(s.Signatures)
+		for i := range s.Signatures {
+			if err := s.Signatures[i].compile(); err != nil {
+				return err
+			}
+		}
+		if s.Auth.Mode != "" && s.Auth.Mode != AuthPassthrough {
+			return fmt.Errorf("invalid auth.mode %q, expected %s", s.Auth.Mode, AuthPassthrough)
+		}
+		if s.Auth.Type != "" && !slices.Contains(authTypes, s.Auth.Type) {
+			return fmt.Errorf("invalid auth.type %q, expected one of %s", s.Auth.Type, strings.Join(authTypes, ", "))
+		}
+		for _, mirror := range s.Mirrors {
+			if host, _ := MirrorHost(mirror); host == "" || strings.Contains(host, "/") {
+				return fmt.Errorf("invalid mirror %q, expected a host such as mirror.example.com or http://mirror.local:5000", mirror)
+			}
+		}
+		if s.CredentialHelper != "" && !credentialHelperName.MatchString(s.CredentialHelper) {
+			return fmt.Errorf("credential_helper %q must name a docker-credential-<name> binary on PATH, not a path", s.CredentialHelper)
+		}
+		return s.compileTLS()
+	}
+
+	if err := compile(&c.Defaults); err != nil {
+		return err
+	}
+	c.registryPatterns = nil
+	for key := range c.Registries {
+		if !IsRegistryPattern(key) {
+			continue
+		}
+		p := registryPattern{key: key}
+		if strings.HasPrefix(key, "^") {
+			re, err := regexp.Compile(key)
+			if err != nil {
+				return fmt.Errorf("invalid registry pattern %q: %w", key, err)
+			}
+			p.re = re
+		} else if _, err := path.Match(key, ""); err != nil {
+			return fmt.Errorf("invalid registry pattern %q: %w", key, err)
+		}
+		c.registryPatterns = append(c.registryPatterns, p)
+	}
+	slices.SortFunc(c.registryPatterns, func(a, b registryPattern) int {
+		return cmp.Or(cmp.Compare(len(b.key), len(a.key)), strings.Compare(a.key, b.key))
+	})
+	for name, settings := range c.Registries {
+		if err := compile(&settings); err != nil {
+			return err
+		}
+		c.Registries[name] = settings
+	}
+	return nil
+}
+
+func compileRepositoryPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		expr := pattern
+		if pattern == "semver" {
+			expr = semverPattern
+		} else if !strings.HasPrefix(pattern, "^") {
+			expr = regexp.QuoteMeta(pattern)
+			expr = strings.ReplaceAll(expr, `\*`, "[^/]*")
+			expr = "^" + strings.ReplaceAll(expr, `\?`, "[^/]") + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// AllowsRepository reports whether repository passes the registry's repository
+// rules. Deny patterns win; with allow patterns, only matching repositories pass.
+func (s *RegistrySettings) AllowsRepository(repository string) bool {
+	return allowedBy(s.allowedRepos, s.deniedRepos, repository)
+}
+
+// AllowsTag reports whether tag passes the registry's tag rules, with the same
+// precedence as AllowsRepository.
+func (s *RegistrySettings) AllowsTag(tag string) bool {
+	return allowedBy(s.allowedTags, s.deniedTags, tag)
+}
+
+// RestrictsArtifactTypes reports whether the registry has artifact type rules.
+func (s *RegistrySettings) RestrictsArtifactTypes() bool {
+	return len(s.allowedTypes) > 0 || len(s.deniedTypes) > 0
+}
+
+// AllowsArtifactType reports whether an artifact or config media type passes
+// the registry's artifact type rules, with the same precedence as
+// AllowsRepository.
+func (s *RegistrySettings) AllowsArtifactType(mediaType string) bool {
+	return allowedBy(s.allowedTypes, s.deniedTypes, mediaType)
+}
+
+func allowedBy(allow, deny []*regexp.Regexp, name string) bool {
+	matches := func(patterns []*regexp.Regexp) bool {
+		for _, re := range patterns {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(deny) {
+		return false
+	}
+	return len(allow) == 0 || matches(allow)
+}
+
+// UpstreamRepository maps a client-visible repository to its upstream name using
+// the longest matching namespaces prefix.
+func (s *RegistrySettings) UpstreamRepository(repository string) string {
+	return mapPrefix(repository, maps.All(s.Namespaces))
+}
+
+// ClientRepository reverses UpstreamRepository for names returned by the upstream.
+func (s *RegistrySettings) ClientRepository(repository string) string {
+	return mapPrefix(repository, func(yield func(string, string) bool) {
+		for client, upstream := range s.Namespaces {
+			if !yield(upstream, client) {
+				return
+			}
+		}
+	})
+}
+
+// mapPrefix replaces the longest from prefix of name, matched on whole path segments.
+func mapPrefix(name string, mappings iter.Seq2[string, string]) string {
+	best, replacement := "", ""
+	for from, to := range mappings {
+		from = strings.Trim(from, "/")
+		if (name == from || strings.HasPrefix(name, from+"/")) && len(from) > len(best) {
+			best, replacement = from, strings.Trim(to, "/")
+		}
+	}
+	if best == "" {
+		return name
+	}
+	return strings.TrimPrefix(replacement+strings.TrimPrefix(name, best), "/")
+}
+
+// AllowsMethod reports whether clients may use method against the registry.
+// All methods are allowed when allowed_methods is not set.
+func (s *RegistrySettings) AllowsMethod(method string) bool {
+	return s.AllowedMethods == nil || slices.ContainsFunc(s.AllowedMethods, func(m string) bool {
+		return strings.EqualFold(m, method)
+	})
+}
+
+// IsPathBlocked reports whether an upstream path matches a blocked_paths pattern,
+// where '*' matches any sequence of characters including '/'.
+func (s *RegistrySettings) IsPathBlocked(path string) bool {
+	for _, re := range s.blockedPaths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOffline reports whether the registry is served from the cache only,
+// without contacting the upstream.
+func (s RegistrySettings) IsOffline() bool {
+	return s.Offline != nil && *s.Offline
+}
+
+// UpstreamAuth returns the upstream credentials for requests of user to
+// registry: those of the user's tenant in tenant_auth, falling back to the
+// registry's auth, fetched from a cloud provider with auth.type, and then to
+// its credential_helper or docker_config.
+func (c *Config) UpstreamAuth(registry string, settings RegistrySettings, user string) (Auth, error) {
+	if tenant, ok := c.Quotas.TenantOf(user); ok && user != "" {
+		if auth, ok := settings.TenantAuth[tenant]; ok {
+			return auth, nil
+		}
+	}
+	if settings.Auth.Type == "" && (settings.Auth.Username != "" || settings.CredentialHelper == "" && settings.DockerConfig == "") {
+		return settings.Auth, nil
+	}
+	return c.credentials.externalAuth(registry, settings)
+}
+
+// MirrorAuth returns the credentials for a registry mirror: those of the
+// mirror host's own registries entry, or none, so a registry's credentials
+// are never sent to its mirrors.
+func (c *Config) MirrorAuth(host string) (Auth, error) {
+	settings, ok := c.lookupRegistry(host)
+	if !ok || settings.Passthrough() {
+		return Auth{}, nil
+	}
+	return c.UpstreamAuth(host, settings, "")
+}
+
+// AuthPassthrough is the auth.mode forwarding clients' own credentials.
+const AuthPassthrough = "passthrough"
+
+// Passthrough reports whether requests to the registry use the credentials
+// of the client instead of the registry's.
+func (s RegistrySettings) Passthrough() bool {
+	return s.Auth.Mode == AuthPassthrough
+}
+
+// HasPassthrough reports whether any registry forwards clients' credentials.
+func (c *Config) HasPassthrough() bool {
+	if c.Defaults.Passthrough() {
+		return true
+	}
+	for _, settings := range c.Registries {
+		if settings.Passthrough() {
+			return true
+		}
+	}
+	return false
+}
+
+// AnonymousForbidden reports whether requests to the registry without
+// upstream credentials must be rejected instead of sent anonymously.
+func (s RegistrySettings) AnonymousForbidden() bool {
+	return s.ForbidAnonymous != nil && *s.ForbidAnonymous
+}
+
 // GetRegistrySettings returns the merged settings for a given registry.
 func (c *Config) GetRegistrySettings(registryName string) RegistrySettings {
-	if settings, ok := c.Registries[registryName]; ok {
+	if settings, ok := c.lookupRegistry(registryName); ok {
 		return settings
 	}
 	return c.Defaults
 }
 
-// IsRegistryAllowed checks if a registry is allowed in whitelist mode.
+// lookupRegistry finds the registries entry for a host: an exact key first,
+// then the longest matching glob or regular expression key.
+func (c *Config) lookupRegistry(registryName string) (RegistrySettings, bool) {
+	if settings, ok := c.Registries[registryName]; ok {
+		return settings, true
+	}
+	for _, p := range c.registryPatterns {
+		if p.match(registryName) {
+			return c.Registries[p.key], true
+		}
+	}
+	return RegistrySettings{}, false
+}
+
+// CompatEnabled reports whether the client compatibility profile is enabled.
+func (c *Config) CompatEnabled(profile string) bool {
+	return slices.Contains(c.CompatProfiles, profile)
+}
+
+// IsRegistryAllowed checks a registry against the deny list and, in whitelist mode,
+// against the configured registries and the allow list.
 func (c *Config) IsRegistryAllowed(registryName string) bool {
+	if matchesAny(c.Deny, registryName) {
+		return false
+	}
 	if !c.WhitelistMode {
 		return true
 	}
-	_, ok := c.Registries[registryName]
-	return ok
+	if _, ok := c.lookupRegistry(registryName); ok {
+		return true
+	}
+	return matchesAny(c.Allow, registryName)
+}
+
+func validateAliases(aliases map[string]string) error {
+	for alias, target := range aliases {
+		if alias == "" || strings.ContainsAny(alias, "/.:") || alias == "localhost" {
+			return fmt.Errorf("invalid alias %q: must be a single path segment that is not a registry host", alias)
+		}
+		if host, _, _ := strings.Cut(target, "/"); host == "" {
+			return fmt.Errorf("invalid target %q for alias %q", target, alias)
+		}
+	}
+	return nil
+}
+
+// ResolveAlias returns the registry and repository prefix an alias points to.
+func (c *Config) ResolveAlias(alias string) (registry, prefix string, ok bool) {
+	target, ok := c.Aliases[alias]
+	if !ok {
+		return "", "", false
+	}
+	registry, prefix, _ = strings.Cut(strings.Trim(target, "/"), "/")
+	return registry, prefix, true
+}
+
+// AliasFor returns the alias covering repository on registry and the repository
+// name relative to it, preferring the alias with the longest prefix.
+func (c *Config) AliasFor(registry, repository string) (alias, name string, ok bool) {
+	bestLen := -1
+	for a := range c.Aliases {
+		host, prefix, _ := c.ResolveAlias(a)
+		if host != registry || len(prefix) <= bestLen {
+			continue
+		}
+		switch {
+		case prefix == "":
+			alias, name = a, repository
+		case strings.HasPrefix(repository, prefix+"/"):
+			alias, name = a, strings.TrimPrefix(repository, prefix+"/")
+		default:
+			continue
+		}
+		bestLen, ok = len(prefix), true
+	}
+	return alias, name, ok
+}
+
+// compileMirrorSync validates mirror_sync entries and parses their schedules.
+func compileMirrorSync(syncs []MirrorSyncSettings) error {
+	for i, sync := range syncs {
+		if sync.Repository == "" {
+			return fmt.Errorf("mirror_sync entries require a repository")
+		}
+		schedule, err := cron.Parse(sync.Schedule)
+		if err != nil {
+			return fmt.Errorf("mirror_sync %s: %w", sync.Repository, err)
+		}
+		syncs[i].schedule = schedule
+		for _, pattern := range sync.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("mirror_sync %s: invalid tag pattern %q: %w", sync.Repository, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid registry pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
 }
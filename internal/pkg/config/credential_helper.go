@@ -0,0 +1,185 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// externalCredentialTTL is how long credentials from a credential helper or
+// docker config.json are reused. Helpers such as ecr-login return tokens valid
+// for hours, so this only bounds how quickly rotated credentials are picked up.
+const externalCredentialTTL = 10 * time.Minute
+
+const credentialHelperTimeout = 30 * time.Second
+
+// credentialHelperName matches the <name> of docker-credential-<name>
+// binaries, keeping paths out of the command run.
+var credentialHelperName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// credentialCache caches credentials obtained from credential helpers and
+// docker config files. It lives on the Config, so a reload starts afresh.
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedCredential
+}
+
+type cachedCredential struct {
+	auth    Auth
+	expires time.Time
+}
+
+func newCredentialCache() *credentialCache {
+	return &credentialCache{entries: make(map[string]cachedCredential)}
+}
+
+// externalAuth returns the credentials for registry from its cloud provider,
+// the settings' credential_helper or docker_config, caching them until they expire or for
+// externalCredentialTTL.
+func (c *credentialCache) externalAuth(registry string, settings RegistrySettings) (Auth, error) {
+	key := settings.Auth.Type + "\x00" + settings.Auth.KeyFile + "\x00" + settings.Auth.ClientID + "\x00" + settings.CredentialHelper + "\x00" + settings.DockerConfig + "\x00" + registry
+	if c != nil {
+		c.mu.Lock()
+		cached, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.auth, nil
+		}
+	}
+
+	var auth Auth
+	var err error
+	expires := time.Now().Add(externalCredentialTTL)
+	switch {
+	case settings.Auth.Type != "":
+		auth, expires, err = cloudAuth(registry, settings.Auth)
+	case settings.CredentialHelper != "":
+		auth, err = runCredentialHelper(settings.CredentialHelper, registry)
+	default:
+		auth, err = dockerConfigAuth(settings.DockerConfig, registry)
+	}
+	if err != nil {
+		return Auth{}, err
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.entries[key] = cachedCredential{auth: auth, expires: expires}
+		c.mu.Unlock()
+	}
+	return auth, nil
+}
+
+// dockerServerAddress returns the server address docker uses for registry in
+// config.json and with credential helpers.
+func dockerServerAddress(registry string) string {
+	switch registry {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return "https://index.docker.io/v1/"
+	}
+	return registry
+}
+
+// runCredentialHelper runs docker-credential-<helper> get for registry, as
+// the docker CLI does. A helper without credentials for the registry yields no
+// credentials rather than an error.
+func runCredentialHelper(helper, registry string) (Auth, error) {
+	if !credentialHelperName.MatchString(helper) {
+		return Auth{}, fmt.Errorf("invalid credential helper name %q", helper)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(dockerServerAddress(registry))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + " " + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return Auth{}, nil
+		}
+		if message != "" {
+			err = fmt.Errorf("%w: %s", err, message)
+		}
+		return Auth{}, fmt.Errorf("credential helper %s failed: %w", helper, err)
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return Auth{}, fmt.Errorf("credential helper %s returned invalid output: %w", helper, err)
+	}
+	return Auth{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// dockerConfig is the part of a docker config.json holding credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// dockerConfigAuth looks up registry in the docker config.json at path,
+// preferring its credHelpers entry, then inline auths, then its credsStore.
+func dockerConfigAuth(path, registry string) (Auth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Auth{}, err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Auth{}, fmt.Errorf("invalid docker config %s: %w", path, err)
+	}
+	address := dockerServerAddress(registry)
+	if helper := config.CredHelpers[address]; helper != "" {
+		return runCredentialHelper(helper, registry)
+	}
+	if helper := config.CredHelpers[registry]; helper != "" {
+		return runCredentialHelper(helper, registry)
+	}
+	for server, entry := range config.Auths {
+		if dockerConfigHost(server) != dockerConfigHost(address) {
+			continue
+		}
+		if entry.Auth == "" && entry.Username == "" {
+			// With a credsStore, docker records logged-in servers as empty entries.
+			break
+		}
+		if entry.Auth == "" {
+			return Auth{Username: entry.Username, Password: entry.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return Auth{}, fmt.Errorf("invalid auth for %s in docker config %s: %w", server, path, err)
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return Auth{Username: username, Password: password}, nil
+	}
+	if config.CredsStore != "" {
+		return runCredentialHelper(config.CredsStore, registry)
+	}
+	return Auth{}, nil
+}
+
+// dockerConfigHost strips the scheme and path that older docker versions
+// wrote into auths keys, such as https://index.docker.io/v1/.
+func dockerConfigHost(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		return u.Host
+	}
+	host, _, _ := strings.Cut(server, "/")
+	return host
+}
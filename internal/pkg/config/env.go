@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in scalar values with
+// environment variables, so secrets can be injected at deploy time. Keys are
+// left alone and the result is never re-parsed as YAML. Unset variables
+// without a default are an error rather than a silently empty value, and so are
+// malformed references such as an unterminated ${VAR, which would otherwise
+// reach the config as literal text.
+func expandEnv(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var missing []string
+		original := node.Value
+		if strings.Contains(envPattern.ReplaceAllString(original, ""), "${") {
+			return fmt.Errorf("line %d: malformed environment variable reference, expected ${VAR} or ${VAR:-default}", node.Line)
+		}
+		node.Value = envPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			m := envPattern.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok {
+				return value
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			missing = append(missing, m[1])
+			return ""
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("line %d: environment variable %s is not set", node.Line, strings.Join(missing, ", "))
+		}
+		if node.Value != original && node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// Let plain values such as ports resolve to their type after expansion.
+			node.Tag = ""
+		}
+		return nil
+	}
+
+	for i, child := range node.Content {
+		if node.Kind == yaml.MappingNode && i%2 == 0 {
+			continue
+		}
+		if err := expandEnv(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PROXY_USER", "alice")
+	t.Setenv("PROXY_PORT", "5000")
+	t.Setenv("PROXY_EMPTY", "")
+	t.Setenv("PROXY_NESTED", "${PROXY_USER}")
+
+	tests := []struct {
+		name    string
+		input   string
+		want    any
+		wantErr bool
+	}{
+		{"variable", "value: ${PROXY_USER}", "alice", false},
+		{"embedded", "value: http://${PROXY_USER}@host:${PROXY_PORT}/", "http://alice@host:5000/", false},
+		{"default of unset variable", "value: ${PROXY_UNSET:-fallback}", "fallback", false},
+		{"empty default", "value: x${PROXY_UNSET:-}y", "xy", false},
+		{"set variable wins over default", "value: ${PROXY_USER:-fallback}", "alice", false},
+		{"empty variable is set", "value: x${PROXY_EMPTY:-fallback}", "x", false},
+		{"plain value resolves its type", "value: ${PROXY_PORT}", 5000, false},
+		{"quoted value stays a string", `value: "${PROXY_PORT}"`, "5000", false},
+		{"expanded values are not expanded again", "value: ${PROXY_NESTED}", "${PROXY_USER}", false},
+		{"no reference", "value: $PROXY_USER", "$PROXY_USER", false},
+		{"unset variable", "value: ${PROXY_UNSET}", nil, true},
+		{"unterminated reference", "value: ${PROXY_USER", nil, true},
+		{"unterminated default", "value: ${PROXY_UNSET:-fallback", nil, true},
+		{"unterminated after valid reference", "value: ${PROXY_USER}${", nil, true},
+		{"empty name", "value: ${}", nil, true},
+		{"invalid name", "value: ${1PROXY}", nil, true},
+		{"invalid default syntax", "value: ${PROXY_USER-fallback}", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.input), &root); err != nil {
+				t.Fatal(err)
+			}
+			err := expandEnv(&root)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expandEnv succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Value any `yaml:"value"`
+			}
+			if err := root.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Value != tt.want {
+				t.Fatalf("got %#v, want %#v", got.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandEnvLeavesKeys(t *testing.T) {
+	t.Setenv("PROXY_KEY", "expanded")
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte("${PROXY_KEY}: ${PROXY_KEY}"), &root); err != nil {
+		t.Fatal(err)
+	}
+	if err := expandEnv(&root); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := root.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["${PROXY_KEY}"] != "expanded" {
+		t.Fatalf("got %v, want the key unexpanded and the value expanded", got)
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type htpasswd struct {
+	users map[string]string
+	// verified caches the password digest of each user's last successful
+	// check, since bcrypt is too slow to run on every registry request.
+	verified sync.Map
+}
+
+func loadHtpasswd(path string) (*htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseHtpasswd(file, path)
+}
+
+func parseHtpasswd(r io.Reader, name string) (*htpasswd, error) {
+	h := &htpasswd{users: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("%s:%d: expected user:bcrypt-hash entry", name, line)
+		}
+		h.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *htpasswd) verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256([]byte(password))
+	if cached, ok := h.verified.Load(user); ok && cached.([32]byte) == digest {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	h.verified.Store(user, digest)
+	return true
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Install validates data as a config file and atomically replaces the file at
+// path with it. Non-empty htpasswd entries are written to htpasswdFile, which
+// the new config must name as its auth.htpasswd_file; nothing is written
+// unless both are valid.
+func Install(path string, data []byte, entries, htpasswdFile string) error {
+	var users *htpasswd
+	if entries != "" {
+		if htpasswdFile == "" {
+			return fmt.Errorf("htpasswd entries given but the current config sets no auth.htpasswd_file")
+		}
+		var err error
+		if users, err = parseHtpasswd(strings.NewReader(entries), "htpasswd"); err != nil {
+			return err
+		}
+	}
+	cfg, err := parseConfig(data, users)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if users != nil {
+		if cfg.Auth.HtpasswdFile != htpasswdFile {
+			return fmt.Errorf("htpasswd entries can only be installed to %s, the config names %q", htpasswdFile, cfg.Auth.HtpasswdFile)
+		}
+		if err := writeFileAtomic(htpasswdFile, []byte(entries), 0600); err != nil {
+			return fmt.Errorf("failed to write htpasswd file: %w", err)
+		}
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// HtpasswdFile returns the auth.htpasswd_file a config file names.
+func HtpasswdFile(data []byte) (string, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return "", err
+	}
+	if err := expandEnv(&root); err != nil {
+		return "", err
+	}
+	var parsed struct {
+		Auth Auth `yaml:"auth"`
+	}
+	if err := root.Decode(&parsed); err != nil {
+		return "", err
+	}
+	return parsed.Auth.HtpasswdFile, nil
+}
+
+const redacted = "REDACTED"
+
+var secretKeys = []string{"password", "secret", "secret_key", "client_secret"}
+
+// Redact returns a config file with the values of its password and secret
+// settings replaced, so it can be shown without the credentials it holds.
+func Redact(data []byte) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	redactNode(&root)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+func redactNode(node *yaml.Node) {
+	for i, child := range node.Content {
+		if node.Kind == yaml.MappingNode && i%2 == 1 && child.Kind == yaml.ScalarNode &&
+			child.Value != "" && slices.Contains(secretKeys, node.Content[i-1].Value) {
+			child.Value, child.Tag, child.Style = redacted, "!!str", 0
+			continue
+		}
+		redactNode(child)
+	}
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
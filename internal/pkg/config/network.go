@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ProxyProtocolSettings accept PROXY protocol headers from the load balancers
+// at Trusted addresses or networks, so clients are seen with their own
+// addresses. Connections from trusted sources must start with a header;
+// others are served with their peer address.
+type ProxyProtocolSettings struct {
+	Trusted       []string      `yaml:"trusted"`
+	HeaderTimeout time.Duration `yaml:"header_timeout,omitempty"`
+
+	trusted []netip.Prefix
+}
+
+func (p *ProxyProtocolSettings) compile() error {
+	if len(p.Trusted) == 0 {
+		return fmt.Errorf("proxy_protocol.trusted is required, e.g. the load balancer subnet")
+	}
+	var err error
+	if p.trusted, err = parsePrefixes(p.Trusted); err != nil {
+		return fmt.Errorf("proxy_protocol.trusted: %w", err)
+	}
+	if p.HeaderTimeout <= 0 {
+		p.HeaderTimeout = 5 * time.Second
+	}
+	return nil
+}
+
+// Trusts reports whether a connection from addr must send a PROXY protocol
+// header.
+func (p *ProxyProtocolSettings) Trusts(addr netip.Addr) bool {
+	return containsAddr(p.trusted, addr)
+}
+
+func (c *Config) compileCIDRs() error {
+	var err error
+	if c.allowedCIDRs, err = parsePrefixes(c.AllowedCIDRs); err != nil {
+		return fmt.Errorf("allowed_cidrs: %w", err)
+	}
+	if c.adminCIDRs, err = parsePrefixes(c.AdminAllowedCIDRs); err != nil {
+		return fmt.Errorf("admin_allowed_cidrs: %w", err)
+	}
+	return nil
+}
+
+// AllowsClient reports whether a client at addr may use the registry
+// endpoints or, with admin, the management API and web UI. admin_allowed_cidrs
+// replaces allowed_cidrs for the latter when set; without either, all clients
+// are allowed.
+func (c *Config) AllowsClient(addr netip.Addr, admin bool) bool {
+	prefixes := c.allowedCIDRs
+	if admin && c.adminCIDRs != nil {
+		prefixes = c.adminCIDRs
+	}
+	return prefixes == nil || containsAddr(prefixes, addr)
+}
+
+// parsePrefixes parses CIDRs such as 10.0.0.0/8, and bare addresses as
+// single-address prefixes.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// NotationSettings points at a Notary Project trust policy and trust store in
+// the layout of the notation CLI, so the policies clusters would enforce are
+// enforced once by the proxy.
+type NotationSettings struct {
+	TrustPolicy string `yaml:"trust_policy"`
+	TrustStore  string `yaml:"trust_store"`
+
+	policies []NotationPolicy
+}
+
+// NotationPolicy is a trust policy of a trustpolicy.json file.
+type NotationPolicy struct {
+	Name                  string   `json:"name"`
+	RegistryScopes        []string `json:"registryScopes"`
+	SignatureVerification struct {
+		Level string `json:"level"`
+	} `json:"signatureVerification"`
+	TrustStores       []string `json:"trustStores"`
+	TrustedIdentities []string `json:"trustedIdentities"`
+
+	roots map[string]*x509.CertPool
+}
+
+var notationLevels = []string{"strict", "permissive", "audit", "skip"}
+
+func (n *NotationSettings) load() error {
+	data, err := os.ReadFile(n.TrustPolicy)
+	if err != nil {
+		return fmt.Errorf("failed to read notation.trust_policy: %w", err)
+	}
+	var document struct {
+		TrustPolicies []NotationPolicy `json:"trustPolicies"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("invalid notation trust policy %s: %w", n.TrustPolicy, err)
+	}
+	for i := range document.TrustPolicies {
+		p := &document.TrustPolicies[i]
+		if !slices.Contains(notationLevels, p.SignatureVerification.Level) {
+			return fmt.Errorf("notation trust policy %q: invalid signatureVerification level %q, expected one of %s", p.Name, p.SignatureVerification.Level, strings.Join(notationLevels, ", "))
+		}
+		if p.SignatureVerification.Level == "skip" {
+			continue
+		}
+		p.roots = make(map[string]*x509.CertPool)
+		loaded := false
+		for _, store := range p.TrustStores {
+			kind, name, ok := strings.Cut(store, ":")
+			if !ok || kind != "ca" && kind != "signingAuthority" {
+				return fmt.Errorf("notation trust policy %q: invalid trust store %q, expected ca:<name> or signingAuthority:<name>", p.Name, store)
+			}
+			if p.roots[kind] == nil {
+				p.roots[kind] = x509.NewCertPool()
+			}
+			files, _ := filepath.Glob(filepath.Join(n.TrustStore, "x509", kind, name, "*"))
+			for _, file := range files {
+				if pem, err := os.ReadFile(file); err == nil && p.roots[kind].AppendCertsFromPEM(pem) {
+					loaded = true
+				}
+			}
+		}
+		if !loaded {
+			return fmt.Errorf("notation trust policy %q: no certificates found in its trust stores under %s", p.Name, n.TrustStore)
+		}
+	}
+	n.policies = document.TrustPolicies
+	return nil
+}
+
+// Policy returns the trust policy for repository, a name such as
+// ghcr.io/org/app: the one listing it in registryScopes, else the one scoped
+// to *, or nil when none applies.
+func (n *NotationSettings) Policy(repository string) *NotationPolicy {
+	var wildcard *NotationPolicy
+	for i := range n.policies {
+		p := &n.policies[i]
+		if slices.Contains(p.RegistryScopes, repository) {
+			return p
+		}
+		if slices.Contains(p.RegistryScopes, "*") {
+			wildcard = p
+		}
+	}
+	return wildcard
+}
+
+// Level returns the policy's signature verification level.
+func (p *NotationPolicy) Level() string {
+	return p.SignatureVerification.Level
+}
+
+// Roots returns the certificates of the policy's trust stores of kind, ca
+// for the notary.x509 signing scheme and signingAuthority for
+// notary.x509.signingAuthority, or nil when it has none.
+func (p *NotationPolicy) Roots(kind string) *x509.CertPool {
+	return p.roots[kind]
+}
+
+// TrustsIdentity reports whether the policy's trustedIdentities admit a
+// signing certificate: * admits any, and x509.subject entries require every
+// attribute they list, e.g. "x509.subject: C=US, O=Example".
+func (p *NotationPolicy) TrustsIdentity(cert *x509.Certificate) bool {
+	subject := map[string][]string{
+		"C":  cert.Subject.Country,
+		"ST": cert.Subject.Province,
+		"L":  cert.Subject.Locality,
+		"O":  cert.Subject.Organization,
+		"OU": cert.Subject.OrganizationalUnit,
+		"CN": {cert.Subject.CommonName},
+	}
+	for _, identity := range p.TrustedIdentities {
+		if identity == "*" {
+			return true
+		}
+		dn, ok := strings.CutPrefix(identity, "x509.subject:")
+		if !ok {
+			continue
+		}
+		matches := true
+		for _, attr := range strings.Split(dn, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+			if !slices.Contains(subject[key], value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
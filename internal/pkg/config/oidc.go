@@ -0,0 +1,101 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// OIDCSettings configures validation of client JWTs issued by an OIDC provider.
+// Tokens must be issued for Audience, the proxy's client ID.
+type OIDCSettings struct {
+	Issuer        string `yaml:"issuer"`
+	Audience      string `yaml:"audience"`
+	UsernameClaim string `yaml:"username_claim,omitempty"`
+	GroupsClaim   string `yaml:"groups_claim,omitempty"`
+}
+
+// oidcVerifier checks client JWTs with go-oidc. The provider is discovered on
+// the first token rather than at config load, so an unreachable issuer fails
+// OIDC logins instead of the proxy's start, and is retried at most once a
+// minute.
+type oidcVerifier struct {
+	settings OIDCSettings
+	client   *http.Client
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+	failedAt time.Time
+	failure  error
+}
+
+func newOIDCVerifier(settings OIDCSettings) *oidcVerifier {
+	if settings.UsernameClaim == "" {
+		settings.UsernameClaim = "sub"
+	}
+	if settings.GroupsClaim == "" {
+		settings.GroupsClaim = "groups"
+	}
+	return &oidcVerifier{settings: settings, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func isJWT(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// verify checks the token signature, issuer, audience and expiry, returning
+// the username and groups claims.
+func (v *oidcVerifier) verify(token string) (string, []string, error) {
+	ctx := oidc.ClientContext(context.Background(), v.client)
+	verifier, err := v.idTokenVerifier(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	idToken, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return "", nil, err
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, err
+	}
+
+	username, _ := claims[v.settings.UsernameClaim].(string)
+	if username == "" {
+		return "", nil, fmt.Errorf("missing %s claim", v.settings.UsernameClaim)
+	}
+	var groups []string
+	if values, ok := claims[v.settings.GroupsClaim].([]any); ok {
+		for _, value := range values {
+			if group, ok := value.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return username, groups, nil
+}
+
+// idTokenVerifier discovers the provider, whose discovery document must name
+// the configured issuer, and returns its verifier. Signing keys are fetched
+// from its jwks_uri and refetched when a token names an unknown key.
+func (v *oidcVerifier) idTokenVerifier(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.verifier != nil {
+		return v.verifier, nil
+	}
+	if time.Since(v.failedAt) < time.Minute {
+		return nil, v.failure
+	}
+	provider, err := oidc.NewProvider(ctx, v.settings.Issuer)
+	if err != nil {
+		v.failedAt, v.failure = time.Now(), fmt.Errorf("failed to discover oidc provider: %w", err)
+		return nil, v.failure
+	}
+	v.verifier = provider.Verifier(&oidc.Config{ClientID: v.settings.Audience})
+	return v.verifier, nil
+}
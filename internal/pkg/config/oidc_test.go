@@ -0,0 +1,126 @@
+package config
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestIssuer serves an OIDC discovery document naming issuer, or the
+// server's own URL when issuer is empty, and a JWKS with key under kid "k1".
+func newTestIssuer(t *testing.T, key *rsa.PublicKey, issuer string) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	if issuer == "" {
+		issuer = server.URL
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer,
+			"jwks_uri":                              server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	return server.URL
+}
+
+// signJWT returns an RS256 signature over header and claims, whatever alg
+// the header names.
+func signJWT(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, &key.PublicKey, "")
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": issuer, "aud": "proxy", "sub": "alice", "groups": []string{"ops"}, "exp": time.Now().Add(time.Hour).Unix()}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	header := map[string]any{"alg": "RS256", "kid": "k1"}
+
+	tests := []struct {
+		name    string
+		header  map[string]any
+		claims  map[string]any
+		wantErr bool
+	}{
+		{"valid", header, claims(nil), false},
+		{"expired", header, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }), true},
+		{"wrong audience", header, claims(func(c map[string]any) { c["aud"] = "other" }), true},
+		{"wrong issuer", header, claims(func(c map[string]any) { c["iss"] = "https://attacker.example" }), true},
+		{"unknown kid", map[string]any{"alg": "RS256", "kid": "k2"}, claims(nil), true},
+		{"alg mismatch", map[string]any{"alg": "PS256", "kid": "k1"}, claims(nil), true},
+		{"missing username", header, claims(func(c map[string]any) { delete(c, "sub") }), true},
+	}
+	v := newOIDCVerifier(OIDCSettings{Issuer: issuer, Audience: "proxy"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, groups, err := v.verify(signJWT(t, key, tt.header, tt.claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("verify accepted the token as %q", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != "alice" || len(groups) != 1 || groups[0] != "ops" {
+				t.Fatalf("got user %q and groups %v, want alice and [ops]", user, groups)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, &key.PublicKey, "https://attacker.example")
+	token := signJWT(t, key, map[string]any{"alg": "RS256", "kid": "k1"},
+		map[string]any{"iss": issuer, "aud": "proxy", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+
+	v := newOIDCVerifier(OIDCSettings{Issuer: issuer, Audience: "proxy"})
+	if user, _, err := v.verify(token); err == nil {
+		t.Fatalf("verify accepted a token as %q from a provider whose discovery names another issuer", user)
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Provider serves the active configuration and replaces it atomically on reload.
+type Provider struct {
+	path    string
+	current atomic.Pointer[Config]
+	mu      sync.Mutex
+	hooks   []func(old, new *Config)
+}
+
+func NewProvider(path string) (*Provider, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{path: path}
+	p.current.Store(cfg)
+	return p, nil
+}
+
+// Path returns the path of the config file.
+func (p *Provider) Path() string {
+	return p.path
+}
+
+func (p *Provider) Current() *Config {
+	return p.current.Load()
+}
+
+// OnReload registers a hook that runs after each successful reload.
+func (p *Provider) OnReload(hook func(old, new *Config)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks = append(p.hooks, hook)
+}
+
+// Reload re-reads the config file. On error the active configuration is kept.
+func (p *Provider) Reload() error {
+	cfg, err := LoadConfig(p.path)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.current.Swap(cfg)
+	for _, hook := range p.hooks {
+		hook(old, cfg)
+	}
+	return nil
+}
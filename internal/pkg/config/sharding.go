@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ShardingSettings spreads the cache over a fleet of proxies. Every blob and
+// manifest digest is owned by one of Peers, the base URLs of all instances,
+// and requests for it are proxied to its owner so the fleet caches it once.
+// Self is this instance's entry of Peers; Secret authenticates requests
+// between peers.
+type ShardingSettings struct {
+	Self   string   `yaml:"self"`
+	Peers  []string `yaml:"peers"`
+	Secret string   `yaml:"secret"`
+}
+
+func (s *ShardingSettings) validate() error {
+	if s.Self == "" || len(s.Peers) == 0 || s.Secret == "" {
+		return fmt.Errorf("sharding.self, sharding.peers and sharding.secret are required")
+	}
+	for i, peer := range s.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid sharding peer %q, expected an http or https URL", peer)
+		}
+		s.Peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	s.Self = strings.TrimSuffix(s.Self, "/")
+	if !slices.Contains(s.Peers, s.Self) {
+		return fmt.Errorf("sharding.self %s is not one of sharding.peers", s.Self)
+	}
+	return nil
+}
+
+// Owner returns the peer owning digest by rendezvous hashing, so peers agree
+// on owners regardless of the order they are listed in and adding or removing
+// a peer only moves the digests it gains or owned.
+func (s *ShardingSettings) Owner(digest string) string {
+	var owner string
+	var best uint64
+	for _, peer := range s.Peers {
+		h := fnv.New64a()
+		h.Write([]byte(peer))
+		h.Write([]byte{0})
+		h.Write([]byte(digest))
+		if score := h.Sum64(); owner == "" || score > best {
+			owner, best = peer, score
+		}
+	}
+	return owner
+}
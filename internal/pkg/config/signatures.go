@@ -0,0 +1,151 @@
+package config
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+)
+
+// SignaturePolicy requires cosign signatures on the manifests of matching
+// repositories. Signatures are verified with the public key in Key or,
+// keyless, with a certificate issued by a FulcioRoots CA to Identity by the
+// OIDC Issuer and logged in the Rekor transparency log signed by RekorKey.
+type SignaturePolicy struct {
+	Repositories []string `yaml:"repositories"`
+	Key          string   `yaml:"key,omitempty"`
+	Issuer       string   `yaml:"issuer,omitempty"`
+	Identity     string   `yaml:"identity,omitempty"`
+	FulcioRoots  string   `yaml:"fulcio_roots,omitempty"`
+	RekorKey     string   `yaml:"rekor_key,omitempty"`
+
+	repositories []*regexp.Regexp
+	identity     *regexp.Regexp
+	key          crypto.PublicKey
+	rekorKey     crypto.PublicKey
+	roots        *x509.CertPool
+}
+
+var (
+	oidcIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidcIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+func (p *SignaturePolicy) compile() error {
+	var err error
+	if len(p.Repositories) == 0 {
+		return fmt.Errorf("signatures entries require repositories")
+	}
+	if p.repositories, err = compileRepositoryPatterns(p.Repositories); err != nil {
+		return err
+	}
+	if p.Key != "" {
+		if p.key, err = readPublicKey(p.Key); err != nil {
+			return err
+		}
+	} else {
+		if p.Issuer == "" || p.Identity == "" || p.FulcioRoots == "" || p.RekorKey == "" {
+			return fmt.Errorf("signatures for %v require a key, or issuer, identity, fulcio_roots and rekor_key for keyless verification", p.Repositories)
+		}
+		if p.identity, err = regexp.Compile("^(?:" + p.Identity + ")$"); err != nil {
+			return fmt.Errorf("invalid signature identity %q: %w", p.Identity, err)
+		}
+		data, err := os.ReadFile(p.FulcioRoots)
+		if err != nil {
+			return fmt.Errorf("failed to read fulcio_roots: %w", err)
+		}
+		roots, err := cryptoutils.UnmarshalCertificatesFromPEM(data)
+		if err != nil || len(roots) == 0 {
+			return fmt.Errorf("no certificates found in %s", p.FulcioRoots)
+		}
+		p.roots = x509.NewCertPool()
+		for _, root := range roots {
+			p.roots.AddCert(root)
+		}
+	}
+	if p.RekorKey != "" {
+		if p.rekorKey, err = readPublicKey(p.RekorKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	key, err := cryptoutils.UnmarshalPEMToPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %w", file, err)
+	}
+	return key, nil
+}
+
+// SignaturePolicy returns the first policy matching repository, or nil when
+// its manifests need no signature.
+func (s *RegistrySettings) SignaturePolicy(repository string) *SignaturePolicy {
+	for i := range s.Signatures {
+		if allowedBy(s.Signatures[i].repositories, nil, repository) {
+			return &s.Signatures[i]
+		}
+	}
+	return nil
+}
+
+// PublicKey returns the key signatures are verified with, or nil for keyless
+// verification.
+func (p *SignaturePolicy) PublicKey() crypto.PublicKey {
+	return p.key
+}
+
+// RekorPublicKey returns the key transparency log entries are verified with,
+// or nil when they are not required.
+func (p *SignaturePolicy) RekorPublicKey() crypto.PublicKey {
+	return p.rekorKey
+}
+
+// VerifyCertificate checks a keyless signing certificate against the Fulcio
+// roots at the time it was logged, and its identity and OIDC issuer against
+// the policy.
+func (p *SignaturePolicy) VerifyCertificate(cert *x509.Certificate, intermediates *x509.CertPool, at time.Time) error {
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("certificate not issued by fulcio_roots: %w", err)
+	}
+	identities := cryptoutils.GetSubjectAlternateNames(cert)
+	if !slices.ContainsFunc(identities, p.identity.MatchString) {
+		return fmt.Errorf("certificate identity %v does not match %q", identities, p.Identity)
+	}
+	if issuer := certificateIssuer(cert); issuer != p.Issuer {
+		return fmt.Errorf("certificate issuer %q does not match %q", issuer, p.Issuer)
+	}
+	return nil
+}
+
+// certificateIssuer returns the OIDC issuer Fulcio recorded in cert.
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidcIssuerV2):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(oidcIssuerV1):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSSettings enables HTTPS on the listener, optionally verifying client certificates.
+type TLSSettings struct {
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	ClientCAFile      string `yaml:"client_ca_file,omitempty"`
+	RequireClientCert bool   `yaml:"require_client_cert,omitempty"`
+}
+
+// ACMESettings obtains listener certificates from an ACME CA such as Let's Encrypt.
+type ACMESettings struct {
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email,omitempty"`
+	CacheDir     string   `yaml:"cache_dir"`
+	DirectoryURL string   `yaml:"directory_url,omitempty"`
+}
+
+// ServerConfig returns the listener TLS configuration. Client certificates are
+// verified against client_ca_file when present, and demanded when require_client_cert is set.
+func (t *TLSSettings) ServerConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", t.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if t.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// clientCertIdentity returns the identity of a verified client certificate: its
+// common name, or else the first DNS, email or URI subject alternative name.
+func clientCertIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (s *RegistrySettings) compileTLS() error {
+	s.rootCAs, s.minTLSVersion = nil, 0
+	if s.MinTLSVersion != "" {
+		version, ok := tlsVersions[s.MinTLSVersion]
+		if !ok {
+			return fmt.Errorf("invalid min_tls_version %q, expected one of 1.0, 1.1, 1.2, 1.3", s.MinTLSVersion)
+		}
+		s.minTLSVersion = version
+	}
+	if s.CAFile == "" {
+		return nil
+	}
+
+	pem, err := os.ReadFile(s.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ca_file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", s.CAFile)
+	}
+	s.rootCAs = pool
+	return nil
+}
+
+// ClientTLSConfig returns the TLS configuration for connections to the
+// registry, or nil when the transport defaults apply. CAs from ca_file are
+// trusted in addition to the system roots.
+func (s *RegistrySettings) ClientTLSConfig() *tls.Config {
+	if s.rootCAs == nil && !s.InsecureSkipVerify && s.minTLSVersion == 0 {
+		return nil
+	}
+	return &tls.Config{
+		RootCAs:            s.rootCAs,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		MinVersion:         s.minTLSVersion,
+	}
+}
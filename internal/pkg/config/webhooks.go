@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// WebhookEvents are the events webhooks can subscribe to, and
+// RegistryNotificationActions the actions of webhooks in the Docker registry
+// notification format.
+var (
+	WebhookEvents               = []string{"blob.cached", "image.pulled", "cache.evicted", "upstream.failed", "policy.denied"}
+	RegistryNotificationActions = []string{"pull", "push"}
+)
+
+// WebhookSettings POST the Events named, or every event when empty, to URL as
+// JSON, signed with an HMAC-SHA256 of Secret when set. With Format "registry",
+// the events are the manifest and blob pulls and pushes of clients, sent as
+// Docker registry notification envelopes. Deliveries failing with
+// a transport error, 429 or 5xx are retried Retries times (default 3) with
+// exponential backoff.
+type WebhookSettings struct {
+	URL     string        `yaml:"url"`
+	Format  string        `yaml:"format,omitempty"`
+	Events  []string      `yaml:"events,omitempty"`
+	Secret  string        `yaml:"secret,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	Retries *int          `yaml:"retries,omitempty"`
+}
+
+func (w *WebhookSettings) validate() error {
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhooks: url %q must be an http or https URL", w.URL)
+	}
+	events := WebhookEvents
+	switch w.Format {
+	case "":
+		w.Format = "proxy"
+	case "proxy":
+	case "registry":
+		events = RegistryNotificationActions
+	default:
+		return fmt.Errorf("webhooks %s: invalid format %q, expected proxy or registry", w.URL, w.Format)
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(events, event) {
+			return fmt.Errorf("webhooks %s: unknown event %q, expected one of %v", w.URL, event, events)
+		}
+	}
+	if w.Retries != nil && *w.Retries < 0 {
+		return fmt.Errorf("webhooks %s: retries must not be negative", w.URL)
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// MaxRetries returns the number of retries of a failed delivery.
+func (w *WebhookSettings) MaxRetries() int {
+	if w.Retries == nil {
+		return 3
+	}
+	return *w.Retries
+}
+
+// Subscribes reports whether the webhook receives event.
+func (w *WebhookSettings) Subscribes(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
@@ -0,0 +1,94 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 2-6 * * 1-5", false},
+		{"0,30 8-18/2 1,15 */3 7", false},
+		{"5/10 * * * *", false},
+		{"  @daily  ", false},
+		{"", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"@every 5m", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"-1 * * * *", true},
+		{"5- * * * *", true},
+		{"10-5 * * * *", true},
+		{"1-2-3 * * * *", true},
+		{"*/0 * * * *", true},
+		{"*/-5 * * * *", true},
+		{"*/ * * * *", true},
+		{"*/x * * * *", true},
+		{"1,,2 * * * *", true},
+		{"1, * * * *", true},
+		{"a * * * *", true},
+		{"** * * * *", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"*/15 * * * *", at(1, 0, 45), true},
+		{"*/15 * * * *", at(1, 0, 40), false},
+		{"5/20 * * * *", at(1, 0, 45), true},
+		{"5/20 * * * *", at(1, 0, 40), false},
+		{"0 2-6 * * *", at(1, 6, 0), true},
+		{"0 2-6 * * *", at(1, 7, 0), false},
+		{"0 8-18/5 * * *", at(1, 13, 0), true},
+		{"0 8-18/5 * * *", at(1, 12, 0), false},
+		{"0 0 * * 1-5", at(5, 0, 0), true},
+		{"0 0 * * 1-5", at(6, 0, 0), false},
+		{"0 0 * * 7", at(7, 0, 0), true},
+		{"0 0 * * 0", at(7, 0, 0), true},
+		{"0,30 * * * *", at(1, 3, 30), true},
+		{"0,30 * * * *", at(1, 3, 15), false},
+		// Restricting both days matches either; otherwise both must match.
+		{"0 0 15 * 1", at(1, 0, 0), true},
+		{"0 0 15 * 1", at(15, 0, 0), true},
+		{"0 0 15 * 1", at(2, 0, 0), false},
+		{"0 0 15 * *", at(1, 0, 0), false},
+		{"0 0 * 2 *", at(1, 0, 0), false},
+		{"@monthly", at(1, 0, 0), true},
+		{"@monthly", at(2, 0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" at "+tt.at.Format(time.DateTime), func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Matches(tt.at); got != tt.want {
+				t.Fatalf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Package gcp obtains Google OAuth2 access tokens for Artifact Registry and
+// Container Registry with Application Default Credentials.
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Username is the registry username that goes with an access token.
+const Username = "oauth2accesstoken"
+
+const scope = "https://www.googleapis.com/auth/cloud-platform"
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// AccessToken returns an access token and its expiry from the service
+// account or authorized user key file, else from Application Default
+// Credentials: GOOGLE_APPLICATION_CREDENTIALS, gcloud's default credentials,
+// or the metadata server, which serves workload identity on GKE and the
+// attached service account on Compute Engine and Cloud Run.
+func AccessToken(ctx context.Context, keyFile string) (string, time.Time, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	var creds *google.Credentials
+	if keyFile == "" {
+		var err error
+		if creds, err = google.FindDefaultCredentials(ctx, scope); err != nil {
+			return "", time.Time{}, err
+		}
+	} else {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		var key struct {
+			Type google.CredentialsType `json:"type"`
+		}
+		if err := json.Unmarshal(data, &key); err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid credentials file %s: %w", keyFile, err)
+		}
+		if key.Type != google.ServiceAccount && key.Type != google.AuthorizedUser {
+			return "", time.Time{}, fmt.Errorf("unsupported credentials type %q in %s, expected service_account or authorized_user", key.Type, keyFile)
+		}
+		if creds, err = google.CredentialsFromJSONWithType(ctx, data, key.Type, scope); err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid credentials file %s: %w", keyFile, err)
+		}
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.AccessToken, token.Expiry, nil
+}
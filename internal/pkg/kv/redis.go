@@ -0,0 +1,69 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisOptions struct {
+	Address  string
+	Username string
+	Password string
+	DB       int
+	Prefix   string
+}
+
+// RedisStore is a Store backed by Redis, shared by all replicas using the same
+// server and prefix.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore connects to opts.Address, a host:port or a redis:// or
+// rediss:// (TLS) URL. Username, Password and DB override those of the URL.
+func NewRedisStore(opts RedisOptions) (*RedisStore, error) {
+	options := &redis.Options{Addr: opts.Address}
+	if strings.Contains(opts.Address, "://") {
+		var err error
+		if options, err = redis.ParseURL(opts.Address); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Username != "" {
+		options.Username = opts.Username
+	}
+	if opts.Password != "" {
+		options.Password = opts.Password
+	}
+	if opts.DB != 0 {
+		options.DB = opts.DB
+	}
+	return &RedisStore{client: redis.NewClient(options), prefix: opts.Prefix}, nil
+}
+
+func (s *RedisStore) Get(key string) ([]byte, bool, error) {
+	value, err := s.client.Get(context.Background(), s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl > 0 {
+		ttl = max(ttl, time.Millisecond)
+	}
+	return s.client.Set(context.Background(), s.prefix+key, value, ttl).Err()
+}
+
+func (s *RedisStore) Delete(key string) error {
+	return s.client.Del(context.Background(), s.prefix+key).Err()
+}
@@ -1,9 +1,11 @@
 package logging
 
 import (
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lmittmann/tint"
@@ -11,11 +13,25 @@ import (
 
 var Logger *slog.Logger
 
+// AccessLogger writes one line per served request. It shares Logger's output
+// unless InitAccessLog selects JSON.
+var AccessLogger *slog.Logger
+
+var (
+	mu sync.Mutex
+	// out is where logs are written, file when log_output is a path.
+	out  io.Writer = os.Stdout
+	file *rotatingFile
+)
+
 func init() {
-	Init("info")
+	Init("info", "text", "", Rotation{})
 }
 
-func Init(level string) {
+// Init sets up Logger at level in format, text (colored on terminals) or json,
+// writing to output: stdout (the default), stderr or a file path appended to
+// and rotated as rotation sets. On error the previous logger is kept.
+func Init(level, format, output string, rotation Rotation) error {
 	var logLevel slog.Level
 	switch strings.ToLower(level) {
 	case "debug":
@@ -30,9 +46,71 @@ func Init(level string) {
 		logLevel = slog.LevelInfo
 	}
 
-	w := os.Stdout
-	Logger = slog.New(tint.NewHandler(w, &tint.Options{
-		Level:      logLevel,
-		TimeFormat: time.Kitchen,
-	}))
+	mu.Lock()
+	defer mu.Unlock()
+	w, err := openOutput(output, rotation)
+	if err != nil {
+		return err
+	}
+	var handler slog.Handler
+	if strings.ToLower(format) == "json" {
+		handler = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel})
+	} else {
+		handler = tint.NewHandler(w, &tint.Options{
+			Level:      logLevel,
+			TimeFormat: time.Kitchen,
+			NoColor:    !isTerminal(w),
+		})
+	}
+	out = w
+	Logger = slog.New(contextHandler{handler})
+	AccessLogger = Logger
+	return nil
+}
+
+// openOutput returns the writer of output, reusing the open log file when
+// its path and rotation are unchanged and closing it otherwise.
+func openOutput(output string, rotation Rotation) (io.Writer, error) {
+	var w io.Writer
+	switch output {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		if file != nil && file.path == output && file.rotation == rotation {
+			return file, nil
+		}
+		f, err := openRotating(output, rotation)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	if file != nil {
+		file.Close()
+	}
+	file, _ = w.(*rotatingFile)
+	return w, nil
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// InitAccessLog selects the access log format, text or json. It must be called
+// after Init.
+func InitAccessLog(format string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.ToLower(format) == "json" {
+		AccessLogger = slog.New(contextHandler{slog.NewJSONHandler(out, nil)})
+		return
+	}
+	AccessLogger = Logger
 }
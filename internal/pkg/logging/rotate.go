@@ -0,0 +1,162 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotation rotates a log file once it reaches MaxSize bytes or is older than
+// Interval, keeping at most MaxFiles rotated files no older than MaxAge,
+// gzipped with Compress. Zero values disable each limit.
+type Rotation struct {
+	MaxSize  int64
+	Interval time.Duration
+	MaxFiles int
+	MaxAge   time.Duration
+	Compress bool
+}
+
+// rotatedSuffix is appended to rotated files, the time of the rotation.
+const rotatedSuffix = "20060102-150405.000"
+
+// rotatingFile is a log file renamed to path.<time> and reopened as
+// rotation requires. Rotated files are compressed and pruned in the
+// background.
+type rotatingFile struct {
+	path     string
+	rotation Rotation
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	prune  sync.Mutex
+}
+
+func openRotating(path string, rotation Rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.cleanup()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	r := f.rotation
+	if f.size > 0 && (r.MaxSize > 0 && f.size+int64(len(p)) > r.MaxSize || r.Interval > 0 && time.Since(f.opened) >= r.Interval) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one in its place. The
+// current file is only closed once the new one is open, so when either step
+// fails writes go on to it and rotation is retried on a later write.
+func (f *rotatingFile) rotate() error {
+	current := f.file
+	// The file is already renamed when opening its replacement failed before.
+	if err := os.Rename(f.path, f.path+"."+time.Now().Format(rotatedSuffix)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	current.Close()
+	go f.cleanup()
+	return nil
+}
+
+// cleanup compresses rotated files with Compress and removes those beyond
+// MaxFiles or MaxAge.
+func (f *rotatingFile) cleanup() {
+	f.prune.Lock()
+	defer f.prune.Unlock()
+	rotated, _ := filepath.Glob(f.path + ".*")
+	// The time suffix sorts oldest first.
+	slices.Sort(rotated)
+	for i, name := range rotated {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if f.rotation.MaxFiles > 0 && i < len(rotated)-f.rotation.MaxFiles ||
+			f.rotation.MaxAge > 0 && time.Since(info.ModTime()) > f.rotation.MaxAge {
+			os.Remove(name)
+			continue
+		}
+		if f.rotation.Compress && !strings.HasSuffix(name, ".gz") {
+			if err := compress(name); err != nil {
+				Logger.Warn("failed to compress rotated log", "file", name, "error", err)
+			}
+		}
+	}
+}
+
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,159 @@
+package metadb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DB is a small embedded key-value store grouped into buckets and persisted as
+// a single JSON file. An empty path keeps the data in memory only.
+type DB struct {
+	path    string
+	mu      sync.RWMutex
+	buckets map[string]map[string]json.RawMessage
+	dirty   bool
+}
+
+func Open(path string) (*DB, error) {
+	db := &DB{path: path, buckets: make(map[string]map[string]json.RawMessage)}
+	if path == "" {
+		return db, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return db, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &db.buckets); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata db: %w", err)
+	}
+	return db, nil
+}
+
+// Get decodes the value stored under key into v and reports whether it exists.
+func (db *DB) Get(bucket, key string, v any) (bool, error) {
+	db.mu.RLock()
+	raw, ok := db.buckets[bucket][key]
+	db.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+func (db *DB) Put(bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b, ok := db.buckets[bucket]
+	if !ok {
+		b = make(map[string]json.RawMessage)
+		db.buckets[bucket] = b
+	}
+	b[key] = raw
+	db.dirty = true
+	return nil
+}
+
+func (db *DB) Delete(bucket, key string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.buckets[bucket][key]; ok {
+		delete(db.buckets[bucket], key)
+		db.dirty = true
+	}
+}
+
+// ForEach calls fn for every key in bucket. fn must not modify the DB.
+func (db *DB) ForEach(bucket string, fn func(key string, value json.RawMessage) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for k, v := range db.buckets[bucket] {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dump returns a copy of every bucket.
+func (db *DB) Dump() map[string]map[string]json.RawMessage {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	dump := make(map[string]map[string]json.RawMessage, len(db.buckets))
+	for name, bucket := range db.buckets {
+		dump[name] = maps.Clone(bucket)
+	}
+	return dump
+}
+
+// Merge stores every key of buckets, replacing existing values.
+func (db *DB) Merge(buckets map[string]map[string]json.RawMessage) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for name, bucket := range buckets {
+		b, ok := db.buckets[name]
+		if !ok {
+			b = make(map[string]json.RawMessage, len(bucket))
+			db.buckets[name] = b
+		}
+		maps.Copy(b, bucket)
+		db.dirty = true
+	}
+}
+
+// Flush atomically writes the DB to disk if it changed since the last flush.
+func (db *DB) Flush() error {
+	if db.path == "" {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(db.buckets)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(db.path), ".metadata.*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp metadata file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync metadata: %w", err)
+	}
+	tmpFile.Close()
+
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		return fmt.Errorf("failed to rename metadata file: %w", err)
+	}
+	db.dirty = false
+	return nil
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type accessKey struct{}
+
+// accessEntry collects the fields of a request's access log line that are only
+// known once the request has been routed.
+type accessEntry struct {
+	user, client, registry, repository, reference, cache string
+	session                                              *pullSession
+	// response records the status and size of the reply for the middlewares
+	// inside accessLog.
+	response *accessLogWriter
+	// peer marks requests proxied by a sharding peer, which accounts for and
+	// audits them.
+	peer bool
+}
+
+func accessEntryFrom(ctx context.Context) *accessEntry {
+	if e, ok := ctx.Value(accessKey{}).(*accessEntry); ok {
+		return e
+	}
+	return &accessEntry{}
+}
+
+// accessLog assigns the request ID and writes one access log line per request
+// once the response has been sent. The ID is taken from the client's
+// X-Request-Id header when valid, returned to the client and forwarded
+// upstream.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		lw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		entry := &accessEntry{client: clientIP(r), response: lw}
+		ctx := logging.WithRequestID(r.Context(), id)
+		ctx = context.WithValue(ctx, accessKey{}, entry)
+		ctx = middleware.WithCacheStatus(ctx, &entry.cache)
+		next.ServeHTTP(lw, r.WithContext(ctx))
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", lw.status),
+			slog.Int64("bytes", lw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client_ip", entry.client),
+			slog.String("user", entry.user),
+		}
+		for _, field := range []struct{ key, value string }{
+			{"registry", entry.registry},
+			{"repository", entry.repository},
+			{"reference", entry.reference},
+			{"cache", entry.cache},
+		} {
+			if field.value != "" {
+				attrs = append(attrs, slog.String(field.key, field.value))
+			}
+		}
+		logging.AccessLogger.LogAttrs(ctx, slog.LevelInfo, "Request", attrs...)
+	})
+}
+
+// accountTraffic observes registry traffic in the stats history, accounts it
+// against transfer quotas, ends pull sessions and sends pulls and pushes to
+// registry format webhooks.
+func (ps *ProxyServer) accountTraffic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := accessEntryFrom(r.Context())
+		lw := entry.response
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		// The session is ended even when the reverse proxy aborts the response.
+		defer func() {
+			if entry.session != nil {
+				ps.sessions.end(entry.session, lw.bytes, entry.cache == "hit")
+			}
+		}()
+		next.ServeHTTP(w, r)
+		if entry.registry == "" || entry.peer {
+			return
+		}
+		ps.history.observe(entry.registry, lw.bytes, entry.cache == "hit")
+		var upstream, cached int64
+		if entry.cache != "hit" {
+			upstream = lw.bytes + body.n
+		}
+		if entry.cache == "miss" && lw.status == http.StatusOK && r.Method == http.MethodGet && isBlobPath(r.URL.Path) {
+			cached = lw.bytes
+		}
+		ps.quotas.record(entry.user, quotaNamespace(entry.registry, entry.repository), lw.bytes+body.n, upstream, cached)
+		size := lw.bytes
+		if r.Method == http.MethodPut {
+			size = body.n
+		}
+		ps.webhooks.notifyRegistry(r, lw.status, lw.Header(), entry.user, size)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts client IDs of up to 128 printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// reference returns the tag or digest addressed by a manifest or blob request.
+func reference(upstreamPath string) string {
+	parts := strings.Split(strings.Trim(upstreamPath, "/"), "/")
+	if i := endpointIndex(parts); i >= 2 && i == len(parts)-2 && (parts[i] == "manifests" || parts[i] == "blobs") {
+		return parts[i+1]
+	}
+	return ""
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accessLogWriter records the status and body size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
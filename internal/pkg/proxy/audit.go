@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// defaultAuditLimit and maxAuditLimit bound the records a query returns.
+const (
+	defaultAuditLimit = 1000
+	maxAuditLimit     = 10000
+)
+
+// auditLog appends a record of each client manifest GET to the JSONL file of
+// audit.file, reopened when the setting changes. Records are only appended.
+type auditLog struct {
+	cfg *config.Provider
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newAuditLog(cfg *config.Provider) *auditLog {
+	return &auditLog{cfg: cfg}
+}
+
+// recordPulls records the client manifest GETs answered by next.
+func (a *auditLog) recordPulls(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		entry := accessEntryFrom(r.Context())
+		if r.Method != http.MethodGet || entry.reference == "" || isBlobPath(r.URL.Path) || entry.peer {
+			return
+		}
+		rec := AuditRecord{
+			Time: start, User: entry.user, ClientIP: entry.client, Registry: entry.registry, Repository: entry.repository,
+			Digest: w.Header().Get("Docker-Content-Digest"), Status: entry.response.status, Cache: entry.cache,
+			RequestID: r.Header.Get(requestIDHeader),
+		}
+		if strings.Contains(entry.reference, ":") {
+			rec.Digest = entry.reference
+		} else {
+			rec.Tag = entry.reference
+		}
+		a.record(rec)
+	})
+}
+
+func (a *auditLog) record(rec AuditRecord) {
+	path := a.cfg.Current().Audit.File
+	if path == "" {
+		return
+	}
+	line, _ := json.Marshal(rec)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil || a.file.Name() != path {
+		if a.file != nil {
+			a.file.Close()
+		}
+		var err error
+		if a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			logging.Logger.Error("failed to open audit log", "file", path, "error", err)
+			return
+		}
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logging.Logger.Error("failed to write audit log", "file", path, "error", err)
+	}
+}
+
+// auditFilter selects audit records by the query parameters user, client_ip,
+// registry, repository, reference (a tag or digest), since and until.
+type auditFilter struct {
+	user, clientIP, registry, repository, reference string
+	since, until                                    time.Time
+}
+
+func parseAuditFilter(q url.Values) (auditFilter, error) {
+	f := auditFilter{user: q.Get("user"), clientIP: q.Get("client_ip"), registry: q.Get("registry"), repository: q.Get("repository"), reference: q.Get("reference")}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, err
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (f auditFilter) matches(rec AuditRecord) bool {
+	return (f.user == "" || rec.User == f.user) &&
+		(f.clientIP == "" || rec.ClientIP == f.clientIP) &&
+		(f.registry == "" || rec.Registry == f.registry) &&
+		(f.repository == "" || rec.Repository == f.repository) &&
+		(f.reference == "" || rec.Tag == f.reference || rec.Digest == f.reference) &&
+		(f.since.IsZero() || !rec.Time.Before(f.since)) &&
+		(f.until.IsZero() || rec.Time.Before(f.until))
+}
+
+// serve answers /_/audit with the newest matching records, newest first, or
+// with format=jsonl with every matching line as written, oldest first, for
+// export as evidence.
+func (a *auditLog) serve(w http.ResponseWriter, r *http.Request) {
+	path := a.cfg.Current().Audit.File
+	if path == "" {
+		http.Error(w, "audit log is not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	filter, err := parseAuditFilter(q)
+	if err != nil {
+		http.Error(w, "since and until must be RFC 3339 times", http.StatusBadRequest)
+		return
+	}
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxAuditLimit)
+	}
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var reader io.Reader = strings.NewReader("")
+	if file != nil {
+		defer file.Close()
+		reader = file
+	}
+
+	jsonl := q.Get("format") == "jsonl"
+	if jsonl {
+		w.Header().Set("Content-Type", "application/jsonl")
+	}
+	// Keep the newest limit matches in a ring.
+	records := make([]AuditRecord, 0, min(limit, 64))
+	next := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || !filter.matches(rec) {
+			continue
+		}
+		if jsonl {
+			io.WriteString(w, scanner.Text()+"\n")
+			continue
+		}
+		if len(records) < limit {
+			records = append(records, rec)
+		} else {
+			records[next] = rec
+		}
+		next = (next + 1) % limit
+	}
+	if jsonl {
+		return
+	}
+	newest := make([]AuditRecord, 0, len(records))
+	for i := range records {
+		newest = append(newest, records[(next-1-i+2*len(records))%len(records)])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newest)
+}
+
+// close syncs and closes the audit log file.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+		a.file = nil
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+type backgroundKey struct{}
+
+// withBackground marks requests made with ctx as background work, such as
+// preload and mirror_sync, which yields the upstream to client pulls.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	background, _ := ctx.Value(backgroundKey{}).(bool)
+	return background
+}
+
+// backgroundScheduler holds background requests about to reach an upstream
+// until they cannot get in the way of client pulls: inside a configured
+// window, after any 429 back-off and while the upstream's quota stays above
+// rate_limit_reserve. Cache hits never reach the scheduler.
+type backgroundScheduler struct {
+	cfg      *config.Provider
+	throttle *throttle
+
+	mu     sync.Mutex
+	paused map[string]string
+}
+
+func newBackgroundScheduler(cfg *config.Provider, throttle *throttle) *backgroundScheduler {
+	return &backgroundScheduler{cfg: cfg, throttle: throttle, paused: make(map[string]string)}
+}
+
+// wait blocks until a background request may be sent to registry.
+func (s *backgroundScheduler) wait(ctx context.Context, registry string) error {
+	for {
+		reason, delay := s.blocked(registry, time.Now())
+		s.logTransition(registry, reason)
+		if reason == "" {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// blocked returns why background requests to registry must wait at now and
+// how long until it is worth checking again, or "" when they may proceed.
+func (s *backgroundScheduler) blocked(registry string, now time.Time) (string, time.Duration) {
+	settings := s.cfg.Current().Background
+	if !settings.InWindow(now) {
+		return "outside background windows", now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+	}
+	if wait := s.throttle.remaining(registry); wait > 0 {
+		return "upstream is rate limiting requests", wait
+	}
+	if remaining, ok := s.throttle.rateLimitRemaining(registry); ok && remaining < settings.RateLimitReserve {
+		return fmt.Sprintf("upstream quota down to %d pulls, below rate_limit_reserve", remaining), time.Minute
+	}
+	return "", 0
+}
+
+func (s *backgroundScheduler) logTransition(registry, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch previous := s.paused[registry]; {
+	case reason != "" && previous == "":
+		logging.Logger.Info("background work paused", "registry", registry, "reason", reason)
+		s.paused[registry] = reason
+	case reason == "" && previous != "":
+		logging.Logger.Info("background work resumed", "registry", registry)
+		delete(s.paused, registry)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math"
+	"time"
+)
+
+// throttledBody paces reads of an upstream response body so that all
+// downloads from a registry together stay under max_download_bandwidth. Bytes
+// are accounted after each read of at most a 32 KiB chunk, which keeps the
+// transfer smooth instead of bursting a second's worth at a time.
+type throttledBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiter  *rateLimiter
+	registry string
+	rate     float64
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if chunk := int(min(32<<10, max(b.rate, 1))); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		wait, _ := b.limiter.reserve(b.registry, float64(n), b.rate, b.rate, math.MaxInt64)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-b.ctx.Done():
+				return n, b.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
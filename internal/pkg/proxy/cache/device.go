@@ -0,0 +1,41 @@
+package cache
+
+import "sync"
+
+// deviceLimiter bounds how many caches flush blobs to the same physical device
+// at once, so per-registry caches sharing a disk queue up during a pull storm
+// instead of competing for it.
+type deviceLimiter struct {
+	mu    sync.Mutex
+	limit int
+	slots map[uint64]chan struct{}
+}
+
+var writeLimiter = &deviceLimiter{limit: 2, slots: make(map[uint64]chan struct{})}
+
+// SetDeviceWriteLimit sets how many cache writes may be flushed concurrently to
+// each device. Writes already holding a slot finish under the previous limit.
+func SetDeviceWriteLimit(n int) {
+	if n <= 0 {
+		return
+	}
+	writeLimiter.mu.Lock()
+	defer writeLimiter.mu.Unlock()
+	if n != writeLimiter.limit {
+		writeLimiter.limit = n
+		writeLimiter.slots = make(map[uint64]chan struct{})
+	}
+}
+
+func (l *deviceLimiter) acquire(device uint64) func() {
+	l.mu.Lock()
+	slots, ok := l.slots[device]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[device] = slots
+	}
+	l.mu.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package cache
+
+// DeviceOf reports no device where it cannot be determined, leaving writes
+// unlimited.
+func DeviceOf(string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DeviceOf returns the ID of the device holding dir, or the nearest existing
+// parent if dir has not been created yet.
+func DeviceOf(dir string) (uint64, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, false
+	}
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return 0, false
+			}
+			return uint64(stat.Dev), true
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return 0, false
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,283 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/logging"
+)
+
+// An interrupted fill keeps what it downloaded in the storage's TempDir under
+// partialPrefix followed by the key, for the next fill of the key to resume.
+// Partial files not resumed within partialMaxAge are removed on startup.
+const (
+	partialPrefix = "partial-"
+	partialMaxAge = 24 * time.Hour
+)
+
+// Fill stages a blob being downloaded into the cache. Other clients of the
+// blob can read it from the staged file while it downloads, see NewReader.
+type Fill struct {
+	c      *Cache
+	key    string
+	file   *os.File
+	hasher hash.Hash
+	offset int64
+	// resumable fills keep their file when interrupted.
+	resumable bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written int64
+	ended   bool
+	err     error
+	readers int
+}
+
+// StartFill stages key, resuming the partial file an interrupted fill left
+// behind, if any. Offset reports how much of it is already downloaded.
+func (c *Cache) StartFill(key string) (*Fill, error) {
+	f, err := c.newFill(key)
+	if err != nil {
+		return nil, err
+	}
+	f.resumable = true
+	// Renaming the partial file over the new temp file claims it, so
+	// concurrent fills never append to the same file.
+	if err := os.Rename(c.partialPath(key), f.file.Name()); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logging.Logger.Warn("failed to resume partial cache file", "key", key, "error", err)
+		}
+		return f, nil
+	}
+	f.file.Close()
+	if f.file, err = os.OpenFile(f.file.Name(), os.O_RDWR|os.O_APPEND, 0); err != nil {
+		return nil, fmt.Errorf("failed to open partial file: %w", err)
+	}
+	if f.offset, err = io.Copy(f.hasher, f.file); err != nil {
+		if err := f.Restart(); err != nil {
+			f.close(0)
+			return nil, fmt.Errorf("failed to restart partial file: %w", err)
+		}
+	}
+	f.written = f.offset
+	return f, nil
+}
+
+func (c *Cache) newFill(key string) (*Fill, error) {
+	file, err := os.CreateTemp(c.storage.TempDir(), "blob-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	f := &Fill{c: c, key: key, file: file, hasher: sha256.New()}
+	f.cond = sync.NewCond(&f.mu)
+	return f, nil
+}
+
+func (c *Cache) partialPath(key string) string {
+	return filepath.Join(c.storage.TempDir(), partialPrefix+key)
+}
+
+// Offset returns the number of bytes resumed from a partial file.
+func (f *Fill) Offset() int64 {
+	return f.offset
+}
+
+// Prefix reads the resumed bytes, for serving them ahead of the rest of the
+// download.
+func (f *Fill) Prefix() io.Reader {
+	return io.NewSectionReader(f.file, 0, f.offset)
+}
+
+// Restart discards the resumed bytes, for when the upstream sends the whole
+// blob instead of the rest.
+func (f *Fill) Restart() error {
+	f.hasher.Reset()
+	f.offset, f.written = 0, 0
+	return f.file.Truncate(0)
+}
+
+// Abort ends a fill without downloading anything, keeping the resumed bytes
+// for a later fill.
+func (f *Fill) Abort() {
+	f.close(f.offset)
+}
+
+// close closes the staged file, keeping it as the key's partial file when
+// the fill is resumable and got size bytes.
+func (f *Fill) close(size int64) {
+	f.file.Close()
+	if f.resumable && size > 0 {
+		if err := os.Rename(f.file.Name(), f.c.partialPath(f.key)); err == nil {
+			return
+		}
+	}
+	os.Remove(f.file.Name())
+}
+
+// Finish appends reader to the staged file, verifies the content against
+// expectedDigest and stores it. When size is known and reader ends short of
+// it, the bytes downloaded so far are kept for a later fill to resume.
+func (f *Fill) Finish(reader io.Reader, expectedDigest string, size int64) error {
+	c := f.c
+	written, err := io.Copy(fillWriter{f}, io.TeeReader(reader, f.hasher))
+	total := f.offset + written
+	if err != nil || size >= 0 && total < size {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		err = fmt.Errorf("failed to write to temp file after %d bytes: %w", total, err)
+		f.end(err)
+		f.close(total)
+		return err
+	}
+	defer func() {
+		f.file.Close()
+		os.Remove(f.file.Name())
+	}()
+
+	// Writes are staged as the blob streams to the client; flushing them to
+	// disk is what contends for the device, so that is where fills queue.
+	if c.limitWrites {
+		release := writeLimiter.acquire(c.device)
+		defer release()
+	}
+	if err := f.file.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync temp file: %w", err)
+		f.end(err)
+		return err
+	}
+
+	actualDigest := "sha256:" + hex.EncodeToString(f.hasher.Sum(nil))
+	if actualDigest != expectedDigest {
+		err := fmt.Errorf("digest mismatch: expected %s, got %s", expectedDigest, actualDigest)
+		f.end(err)
+		return err
+	}
+	f.end(nil)
+	f.file.Close()
+	return c.store(f.key, f.file.Name(), total)
+}
+
+// fillWriter appends to the staged file and wakes the readers of the fill.
+type fillWriter struct{ f *Fill }
+
+func (w fillWriter) Write(p []byte) (int, error) {
+	n, err := w.f.file.Write(p)
+	w.f.mu.Lock()
+	w.f.written += int64(n)
+	w.f.mu.Unlock()
+	w.f.cond.Broadcast()
+	return n, err
+}
+
+// end marks the download finished, failed when err is not nil. It must be
+// called before the staged file is moved or removed.
+func (f *Fill) end(err error) {
+	f.mu.Lock()
+	f.ended, f.err = true, err
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// NewReader returns a reader of the blob from its first byte that follows
+// the download as it is written, blocking until more arrives, or nil when
+// the download has already ended. Reads fail if the download does, or once
+// ctx is done or the reader is closed.
+func (f *Fill) NewReader(ctx context.Context) io.ReadCloser {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ended {
+		return nil
+	}
+	// A file of its own keeps reading after the staged file is moved.
+	file, err := os.Open(f.file.Name())
+	if err != nil {
+		return nil
+	}
+	f.readers++
+	r := &fillReader{f: f, file: file, ctx: ctx}
+	r.stop = context.AfterFunc(ctx, f.wake)
+	return r
+}
+
+// wake wakes the readers of the fill to recheck their context.
+func (f *Fill) wake() {
+	f.mu.Lock()
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// Readers returns the number of readers that were attached to the fill.
+func (f *Fill) Readers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readers
+}
+
+type fillReader struct {
+	f    *Fill
+	file *os.File
+	pos  int64
+	ctx  context.Context
+	stop func() bool
+	// closed is guarded by f.mu.
+	closed bool
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	for r.pos >= f.written && !f.ended && !r.closed && r.ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	available, ended, err, closed := f.written-r.pos, f.ended, f.err, r.closed
+	f.mu.Unlock()
+	if closed {
+		return 0, os.ErrClosed
+	}
+	if err := r.ctx.Err(); err != nil && available <= 0 {
+		return 0, err
+	}
+	if available <= 0 {
+		if ended && err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	n, err := r.file.ReadAt(p[:min(int64(len(p)), available)], r.pos)
+	r.pos += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	r.stop()
+	r.f.mu.Lock()
+	r.closed = true
+	r.f.mu.Unlock()
+	r.f.cond.Broadcast()
+	return r.file.Close()
+}
+
+// removeStalePartials removes partial files older than partialMaxAge.
+func removeStalePartials(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, partialPrefix+"*"))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > partialMaxAge {
+			os.Remove(path)
+		}
+	}
+}
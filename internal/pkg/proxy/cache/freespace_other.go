@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package cache
+
+// FreeSpace reports no value where free space cannot be determined.
+func FreeSpace(string) (uint64, bool) {
+	return 0, false
+}
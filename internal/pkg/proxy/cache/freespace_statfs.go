@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package cache
+
+import "syscall"
+
+// FreeSpace returns the bytes available to unprivileged users on the file
+// system holding dir.
+func FreeSpace(dir string) (uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true
+}
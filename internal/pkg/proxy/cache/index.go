@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"time"
+)
+
+// indexTouchInterval bounds how often a hit refreshes an entry's last access
+// in the index.
+const indexTouchInterval = time.Minute
+
+// Index shares the sizes and last access times of entries between the caches
+// of replicas using the same storage, so they serve what another stored and
+// agree on which entries are least recently used. Implementations report
+// their own errors; a failed lookup reads as a missing entry and makes
+// eviction fall back to the local LRU order.
+type Index interface {
+	Lookup(key string) (size int64, lastAccess time.Time, ok bool, err error)
+	Touch(key string, size int64, lastAccess time.Time)
+	Remove(key string)
+}
+
+// SetIndex shares the cache's entries through index.
+func (c *Cache) SetIndex(index Index) {
+	c.index = index
+}
+
+// indexed returns the size and last access of key when a replica indexed it
+// and its file is in the storage.
+func (c *Cache) indexed(key string) (int64, time.Time, bool) {
+	if c.index == nil || c.storage == nil {
+		return 0, time.Time{}, false
+	}
+	size, lastAccess, ok, _ := c.index.Lookup(key)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	if stored, err := c.storage.Stat(key); err != nil || stored != size {
+		return 0, time.Time{}, false
+	}
+	return size, lastAccess, true
+}
+
+// adoptIndexed adds key when a replica stored it, reporting whether it is
+// cached.
+func (c *Cache) adoptIndexed(key string) bool {
+	size, lastAccess, ok := c.indexed(key)
+	if !ok {
+		return false
+	}
+	c.refreshOldest(c.overflow(size))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cache[key]; !ok {
+		c.cache[key] = c.ll.PushFront(&entry{Key: key, Size: size, LastAccess: lastAccess, touched: lastAccess})
+		c.size.Add(size)
+		c.evictIfNeeded()
+		c.persistDirty.Store(true)
+	}
+	_, ok = c.cache[key]
+	return ok
+}
+
+// refreshOldest looks up the entries eviction would remove to free need bytes
+// in the index and moves those a replica accessed more recently than this
+// cache did to the front, so replicas only evict entries none of them uses.
+// The lookups run outside c.mu, so a slow index never stalls cache hits.
+func (c *Cache) refreshOldest(need int64) {
+	if c.index == nil || need <= 0 {
+		return
+	}
+	checked := make(map[string]bool)
+	for {
+		var candidates []entry
+		c.mu.RLock()
+		var freed int64
+		for el := c.ll.Back(); el != nil && freed < need; el = el.Prev() {
+			e := el.Value.(*entry)
+			if !checked[e.Key] {
+				candidates = append(candidates, *e)
+			}
+			freed += e.Size
+		}
+		c.mu.RUnlock()
+		if len(candidates) == 0 {
+			return
+		}
+
+		newer := make(map[string]time.Time)
+		for _, e := range candidates {
+			_, lastAccess, ok, err := c.index.Lookup(e.Key)
+			if err != nil {
+				return
+			}
+			checked[e.Key] = true
+			if ok && lastAccess.After(e.LastAccess) {
+				newer[e.Key] = lastAccess
+			}
+		}
+		if len(newer) == 0 {
+			return
+		}
+		c.mu.Lock()
+		for key, lastAccess := range newer {
+			if el, ok := c.cache[key]; ok {
+				e := el.Value.(*entry)
+				e.LastAccess, e.touched = lastAccess, lastAccess
+				c.ll.MoveToFront(el)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// overflow returns by how much adding incoming bytes would exceed the size
+// limit.
+func (c *Cache) overflow(incoming int64) int64 {
+	maxSize := c.maxSize.Load()
+	if maxSize <= 0 {
+		return 0
+	}
+	return c.size.Load() + incoming - maxSize
+}
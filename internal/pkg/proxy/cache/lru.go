@@ -6,15 +6,18 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/pkg/api"
 )
 
 // entry is used to hold a value in the cache.
@@ -22,68 +25,109 @@ type entry struct {
 	Key        string    `json:"key"`
 	Size       int64     `json:"size"`
 	LastAccess time.Time `json:"last_access"`
+	// touched is when LastAccess was last written to the index.
+	touched time.Time
 }
 
-// CacheStats provides statistics about cache usage.
-type CacheStats struct {
-	Hits        int64
-	Misses      int64
-	Evictions   int64
-	Items       int
-	CurrentSize int64
-	MaxSize     int64
-}
+// Entries and statistics are reported by the management API, see pkg/api.
+type (
+	Entry              = api.CacheEntry
+	CacheStats         = api.CacheStats
+	WorkingSetEstimate = api.WorkingSetEstimate
+)
 
 type Cache struct {
-	maxSize  int64
-	size     atomic.Int64
-	ll       *list.List
-	cache    map[string]*list.Element
-	mu       sync.RWMutex
-	cacheDir string
+	maxSize atomic.Int64
+	size    atomic.Int64
+	ll      *list.List
+	cache   map[string]*list.Element
+	mu      sync.RWMutex
+	storage Storage
 
 	hits      atomic.Int64
 	misses    atomic.Int64
 	evictions atomic.Int64
+	scrubbed  atomic.Int64
+	corrupted atomic.Int64
+	working   *workingSet
+	readers   *readers
+
+	device      uint64
+	limitWrites bool
+	reserved    func() int64
+	minFree     atomic.Int64
 
 	persistMu    sync.Mutex
 	lastPersist  time.Time
 	persistDirty atomic.Bool
-}
 
-func NewLRUCache(maxSize int64, cacheDir string) (*Cache, error) {
-	if cacheDir != "" {
-		if err := os.MkdirAll(cacheDir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create cache directory: %w", err)
-		}
-	}
+	// onStore and onEvict are called with the key and size of each entry
+	// stored and each evicted for space, see SetHooks.
+	onStore, onEvict func(key string, size int64)
+	index            Index
+}
 
+// NewLRUCache creates a cache on top of storage. A nil storage disables caching.
+func NewLRUCache(maxSize int64, storage Storage) (*Cache, error) {
 	c := &Cache{
-		maxSize:  maxSize,
-		ll:       list.New(),
-		cache:    make(map[string]*list.Element),
-		cacheDir: cacheDir,
+		ll:      list.New(),
+		cache:   make(map[string]*list.Element),
+		storage: storage,
+		working: newWorkingSet(),
+		readers: newReaders(),
+	}
+	c.maxSize.Store(maxSize)
+	if storage != nil {
+		c.device, c.limitWrites = DeviceOf(storage.TempDir())
+		removeStalePartials(storage.TempDir())
 	}
 
 	if err := c.load(); err != nil {
-		logging.Logger.Warn("could not load cache persistence, starting fresh", "path", c.persistencePath(), "error", err)
+		logging.Logger.Warn("could not load cache persistence, starting fresh", "error", err)
 	}
 
 	return c, nil
 }
 
-func (c *Cache) persistencePath() string {
-	if c.cacheDir == "" {
-		return ""
+// SetHooks sets functions called after an entry is stored and after one is
+// evicted to stay within the size or free disk limits. They must not block.
+func (c *Cache) SetHooks(onStore, onEvict func(key string, size int64)) {
+	c.onStore, c.onEvict = onStore, onEvict
+}
+
+// Enabled reports whether the cache has a backing storage.
+func (c *Cache) Enabled() bool {
+	return c.storage != nil
+}
+
+// Contains reports whether key is cached without counting a hit or refreshing
+// its recency. In a shared store, keys stored by other registries' caches
+// count as cached.
+func (c *Cache) Contains(key string) bool {
+	c.mu.RLock()
+	_, ok := c.cache[key]
+	c.mu.RUnlock()
+	if shared, isShared := c.storage.(*sharedStorage); isShared && !ok {
+		_, err := shared.Stat(key)
+		return err == nil
 	}
-	return filepath.Join(c.cacheDir, ".lru_persistence")
+	if !ok {
+		_, _, ok = c.indexed(key)
+	}
+	return ok
 }
 
 func (c *Cache) GetReader(key string) (io.ReadCloser, int64, bool) {
 	c.mu.Lock()
 	ee, exists := c.cache[key]
+	if !exists {
+		ee, exists = c.adoptLocked(key)
+	}
 	if !exists {
 		c.mu.Unlock()
+		if c.adoptIndexed(key) {
+			return c.GetReader(key)
+		}
 		c.misses.Add(1)
 		return nil, 0, false
 	}
@@ -92,12 +136,19 @@ func (c *Cache) GetReader(key string) (io.ReadCloser, int64, bool) {
 	e := ee.Value.(*entry)
 	e.LastAccess = time.Now()
 	size := e.Size
-	filePath := filepath.Join(c.cacheDir, key)
+	accessed := e.LastAccess
+	touch := c.index != nil && accessed.Sub(e.touched) >= indexTouchInterval
+	if touch {
+		e.touched = accessed
+	}
 	c.mu.Unlock()
+	if touch {
+		c.index.Touch(key, size, accessed)
+	}
 
-	file, err := os.Open(filePath)
+	file, err := c.openFile(key)
 	if err != nil {
-		logging.Logger.Warn("file in cache but not on disk, removing", "key", key, "path", filePath, "error", err)
+		logging.Logger.Warn("file in cache but not in storage, removing", "key", key, "error", err)
 		c.mu.Lock()
 		if ee, exists := c.cache[key]; exists {
 			c.removeElementLocked(ee)
@@ -108,52 +159,50 @@ func (c *Cache) GetReader(key string) (io.ReadCloser, int64, bool) {
 	}
 
 	c.hits.Add(1)
+	c.working.record(key, size)
 	c.persistDirty.Store(true)
 	return file, size, true
 }
 
 func (c *Cache) Put(key string, reader io.Reader, expectedDigest string) error {
-	if c.cacheDir == "" {
-		_, err := io.Copy(io.Discard, reader)
+	if c.storage == nil {
+		size, err := io.Copy(io.Discard, reader)
+		if err == nil {
+			c.working.record(key, size)
+		}
 		return err
 	}
 
-	tmpFile, err := os.CreateTemp(c.cacheDir, "blob-*.tmp")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	tmpPath := tmpFile.Name()
-
-	defer func() {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-	}()
-
-	hasher := sha256.New()
-	size, err := io.Copy(tmpFile, io.TeeReader(reader, hasher))
+	f, err := c.newFill(key)
 	if err != nil {
-		return fmt.Errorf("failed to write to temp file: %w", err)
+		return err
 	}
+	return f.Finish(reader, expectedDigest, -1)
+}
 
-	if err := tmpFile.Sync(); err != nil {
-		return fmt.Errorf("failed to sync temp file: %w", err)
-	}
+// store indexes the verified file at tmpPath under key, unless it does not fit.
+func (c *Cache) store(key, tmpPath string, size int64) error {
+	c.working.record(key, size)
 
-	actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-	if actualDigest != expectedDigest {
-		return fmt.Errorf("digest mismatch: expected %s, got %s", expectedDigest, actualDigest)
+	if maxSize := c.maxSize.Load(); maxSize > 0 && size > maxSize {
+		logging.Logger.Warn("file size exceeds max cache size, skipping cache", "key", key, "size", size, "maxSize", maxSize)
+		return nil
 	}
 
-	if c.maxSize > 0 && size > c.maxSize {
-		logging.Logger.Warn("file size exceeds max cache size, skipping cache", "key", key, "size", size, "maxSize", c.maxSize)
+	if _, ok := c.EnsureFreeSpace(); !ok {
+		logging.Logger.Warn("not enough free disk space outside other registries' reservations, skipping cache", "key", key, "size", size)
 		return nil
 	}
 
-	finalPath := filepath.Join(c.cacheDir, key)
-	if err := os.Rename(tmpPath, finalPath); err != nil {
+	if err := c.commitFile(key, tmpPath); err != nil {
 		return fmt.Errorf("failed to move cached file: %w", err)
 	}
 
+	now := time.Now()
+	if c.index != nil {
+		c.index.Touch(key, size, now)
+	}
+	c.refreshOldest(c.overflow(size))
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -162,31 +211,98 @@ func (c *Cache) Put(key string, reader io.Reader, expectedDigest string) error {
 		e := ee.Value.(*entry)
 		oldSize := e.Size
 		e.Size = size
-		e.LastAccess = time.Now()
+		e.LastAccess, e.touched = now, now
 		c.size.Add(size - oldSize)
 	} else {
 		e := &entry{
 			Key:        key,
 			Size:       size,
-			LastAccess: time.Now(),
+			LastAccess: now,
+			touched:    now,
 		}
 		ee := c.ll.PushFront(e)
 		c.cache[key] = ee
 		c.size.Add(size)
 	}
+	if c.onStore != nil {
+		c.onStore(key, size)
+	}
 
 	c.evictIfNeeded()
 	c.persistDirty.Store(true)
 	return nil
 }
 
+// adoptLocked indexes key when another registry's cache stored it in a shared
+// store, so identical content is not fetched and stored again.
+func (c *Cache) adoptLocked(key string) (*list.Element, bool) {
+	shared, ok := c.storage.(*sharedStorage)
+	if !ok {
+		return nil, false
+	}
+	size, err := shared.Stat(key)
+	if err != nil {
+		return nil, false
+	}
+	shared.retain(key)
+	c.cache[key] = c.ll.PushFront(&entry{Key: key, Size: size, LastAccess: time.Now()})
+	c.size.Add(size)
+	c.evictIfNeeded()
+	ee, ok := c.cache[key]
+	return ee, ok
+}
+
+// Import adds entries whose files are already in the storage, such as a cache
+// directory copied from another instance, keeping their last access times.
+// Entries already cached are skipped. It returns the number of entries added
+// and of those missing from the storage or stored with another size.
+func (c *Cache) Import(entries []Entry) (added, missing int) {
+	if c.storage == nil {
+		return 0, len(entries)
+	}
+	for _, e := range entries {
+		if size, err := c.storage.Stat(e.Key); err != nil || size != e.Size {
+			missing++
+			continue
+		}
+		c.mu.Lock()
+		if _, ok := c.cache[e.Key]; !ok {
+			if shared, ok := c.storage.(*sharedStorage); ok {
+				shared.retain(e.Key)
+			}
+			c.cache[e.Key] = c.ll.PushBack(&entry{Key: e.Key, Size: e.Size, LastAccess: e.LastAccess})
+			c.size.Add(e.Size)
+			added++
+		}
+		c.mu.Unlock()
+	}
+	if added > 0 {
+		c.refreshOldest(c.overflow(0))
+		c.mu.Lock()
+		c.evictIfNeeded()
+		c.mu.Unlock()
+		c.persistDirty.Store(true)
+	}
+	return added, missing
+}
+
+// SetMaxSize changes the size limit, evicting entries if the cache now exceeds it.
+func (c *Cache) SetMaxSize(maxSize int64) {
+	c.maxSize.Store(maxSize)
+	c.refreshOldest(c.overflow(0))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictIfNeeded()
+}
+
 func (c *Cache) evictIfNeeded() {
-	if c.maxSize <= 0 {
+	maxSize := c.maxSize.Load()
+	if maxSize <= 0 {
 		return
 	}
 
 	var toEvict []*entry
-	for c.size.Load() > c.maxSize {
+	for c.size.Load() > maxSize {
 		oldest := c.ll.Back()
 		if oldest == nil {
 			break
@@ -199,33 +315,167 @@ func (c *Cache) evictIfNeeded() {
 	if len(toEvict) > 0 {
 		c.mu.Unlock()
 		c.deleteFiles(toEvict)
+		c.evicted(toEvict)
 		c.mu.Lock()
 	}
 }
 
+// SetReserved installs a function returning the space on the cache's device
+// that is reserved for other caches. Puts evict this cache's least recently used
+// entries until the device's free space covers it.
+func (c *Cache) SetReserved(reserved func() int64) {
+	c.reserved = reserved
+}
+
+// SetMinFreeDisk makes the cache evict its least recently used entries
+// whenever the free space of its file system drops below minFree.
+func (c *Cache) SetMinFreeDisk(minFree int64) {
+	c.minFree.Store(minFree)
+}
+
+// EnsureFreeSpace evicts entries until the file system's free space covers
+// the minimum free space and other caches' reservations. It returns the bytes
+// freed and whether enough space is free.
+func (c *Cache) EnsureFreeSpace() (int64, bool) {
+	needed := c.minFree.Load()
+	if c.reserved != nil {
+		needed += c.reserved()
+	}
+	if c.storage == nil || needed <= 0 {
+		return 0, true
+	}
+	free, ok := FreeSpace(c.storage.TempDir())
+	if !ok {
+		return 0, true
+	}
+	deficit := needed - int64(free)
+	if deficit <= 0 {
+		return 0, true
+	}
+
+	c.refreshOldest(deficit)
+	c.mu.Lock()
+	var toEvict []*entry
+	var freed int64
+	for freed < deficit {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		e := c.removeElementLocked(oldest)
+		toEvict = append(toEvict, e)
+		freed += e.Size
+		c.evictions.Add(1)
+	}
+	c.mu.Unlock()
+
+	if len(toEvict) > 0 {
+		c.deleteFiles(toEvict)
+		c.evicted(toEvict)
+		c.persistDirty.Store(true)
+	}
+	return freed, freed >= deficit
+}
+
+func (c *Cache) evicted(entries []*entry) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, e := range entries {
+		c.onEvict(e.Key, e.Size)
+	}
+}
+
 func (c *Cache) deleteFiles(entries []*entry) {
 	for _, entry := range entries {
-		filePath := filepath.Join(c.cacheDir, entry.Key)
-		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			logging.Logger.Warn("failed to remove cache file", "path", filePath, "error", err)
-		} else {
-			logging.Logger.Debug("evicted cache file", "key", entry.Key, "size", entry.Size)
-		}
+		c.deleteFile(entry.Key)
+		logging.Logger.Debug("evicted cache file", "key", entry.Key, "size", entry.Size)
 	}
 }
 
-func (c *Cache) Remove(key string) {
+// Remove evicts key and deletes its file, reporting whether it was cached.
+func (c *Cache) Remove(key string) bool {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if ee, ok := c.cache[key]; ok {
+	ee, ok := c.cache[key]
+	if ok {
 		c.removeElementLocked(ee)
-		filePath := filepath.Join(c.cacheDir, key)
-		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			logging.Logger.Warn("failed to remove cache file", "path", filePath, "error", err)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	c.deleteFile(key)
+	c.persistDirty.Store(true)
+	return true
+}
+
+// Verify re-hashes the content of key, a sha256 digest, read through pace,
+// and removes the entry when its file is gone or its content no longer matches
+// the digest or recorded size. It neither counts a hit nor refreshes recency.
+// Keys that are not sha256 digests are skipped.
+func (c *Cache) Verify(key string, pace func(io.Reader) io.Reader) (bool, error) {
+	want, ok := strings.CutPrefix(key, "sha256:")
+	if !ok || c.storage == nil {
+		return true, nil
+	}
+	c.mu.RLock()
+	ee, ok := c.cache[key]
+	var size int64
+	if ok {
+		size = ee.Value.(*entry).Size
+	}
+	c.mu.RUnlock()
+	if !ok {
+		return true, nil
+	}
+
+	reason := "file missing"
+	file, err := c.openFile(key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if err == nil {
+		hash := sha256.New()
+		n, err := io.Copy(hash, pace(file))
+		file.Close()
+		if err != nil {
+			return false, err
+		}
+		if n == size && hex.EncodeToString(hash.Sum(nil)) == want {
+			c.scrubbed.Add(1)
+			return true, nil
+		}
+		reason = fmt.Sprintf("read %d bytes hashing to sha256:%x", n, hash.Sum(nil))
+	}
+	c.scrubbed.Add(1)
+	c.corrupted.Add(1)
+	logging.Logger.Warn("removing corrupted cache entry", "key", key, "size", size, "reason", reason)
+	c.Remove(key)
+	return false, nil
+}
+
+// Prune removes entries last accessed before cutoff unless keep reports them,
+// returning the number of entries and bytes removed.
+func (c *Cache) Prune(cutoff time.Time, keep func(key string) bool) (int, int64) {
+	c.mu.Lock()
+	var toRemove []*entry
+	var freed int64
+	for e := c.ll.Back(); e != nil; {
+		prev := e.Prev()
+		ent := e.Value.(*entry)
+		if ent.LastAccess.Before(cutoff) && !keep(ent.Key) {
+			toRemove = append(toRemove, c.removeElementLocked(e))
+			freed += ent.Size
 		}
+		e = prev
+	}
+	c.mu.Unlock()
+
+	if len(toRemove) > 0 {
+		c.deleteFiles(toRemove)
 		c.persistDirty.Store(true)
 	}
+	return len(toRemove), freed
 }
 
 func (c *Cache) removeElementLocked(e *list.Element) *entry {
@@ -236,7 +486,7 @@ func (c *Cache) removeElementLocked(e *list.Element) *entry {
 	return kv
 }
 
-func (c *Cache) Persist() error {
+func (c *Cache) Persist() (err error) {
 	if !c.persistDirty.Load() {
 		return nil
 	}
@@ -244,11 +494,18 @@ func (c *Cache) Persist() error {
 	c.persistMu.Lock()
 	defer c.persistMu.Unlock()
 
-	path := c.persistencePath()
-	if path == "" {
+	if c.storage == nil {
 		return nil
 	}
 
+	// Changes made while the index is written mark it dirty for the next run.
+	c.persistDirty.Store(false)
+	defer func() {
+		if err != nil {
+			c.persistDirty.Store(true)
+		}
+	}()
+
 	c.mu.RLock()
 	entries := make([]*entry, 0, c.ll.Len())
 	for e := c.ll.Back(); e != nil; e = e.Prev() {
@@ -256,7 +513,7 @@ func (c *Cache) Persist() error {
 	}
 	c.mu.RUnlock()
 
-	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".lru_persistence.*.tmp")
+	tmpFile, err := os.CreateTemp(c.storage.TempDir(), ".lru_persistence.*.tmp")
 	if err != nil {
 		return fmt.Errorf("failed to create temp persistence file: %w", err)
 	}
@@ -286,24 +543,22 @@ func (c *Cache) Persist() error {
 
 	tmpFile.Close()
 
-	if err := os.Rename(tmpPath, path); err != nil {
+	if err := c.storage.Commit(indexKey, tmpPath); err != nil {
 		return fmt.Errorf("failed to rename persistence file: %w", err)
 	}
 
-	c.persistDirty.Store(false)
 	c.lastPersist = time.Now()
 	return nil
 }
 
 func (c *Cache) load() error {
-	path := c.persistencePath()
-	if path == "" {
+	if c.storage == nil {
 		return nil
 	}
 
-	file, err := os.Open(path)
+	file, err := c.storage.Open(indexKey)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return nil
 		}
 		return err
@@ -322,11 +577,10 @@ func (c *Cache) load() error {
 			continue
 		}
 
-		filePath := filepath.Join(c.cacheDir, e.Key)
-		stat, err := os.Stat(filePath)
+		size, err := c.storage.Stat(e.Key)
 		if err != nil {
-			if os.IsNotExist(err) {
-				logging.Logger.Debug("file in persistence but not on disk, skipping", "key", e.Key)
+			if errors.Is(err, fs.ErrNotExist) {
+				logging.Logger.Debug("file in persistence but not in storage, skipping", "key", e.Key)
 			} else {
 				logging.Logger.Warn("failed to stat cached file, skipping", "key", e.Key, "error", err)
 			}
@@ -334,9 +588,9 @@ func (c *Cache) load() error {
 			continue
 		}
 
-		if stat.Size() != e.Size {
-			logging.Logger.Warn("cached file size mismatch, removing", "key", e.Key, "expected", e.Size, "actual", stat.Size())
-			os.Remove(filePath)
+		if size != e.Size {
+			logging.Logger.Warn("cached file size mismatch, removing", "key", e.Key, "expected", e.Size, "actual", size)
+			c.storage.Remove(e.Key)
 			skippedEntries++
 			continue
 		}
@@ -367,13 +621,29 @@ func (c *Cache) Stats() CacheStats {
 	defer c.mu.RUnlock()
 
 	return CacheStats{
-		Hits:        c.hits.Load(),
-		Misses:      c.misses.Load(),
-		Evictions:   c.evictions.Load(),
-		Items:       c.ll.Len(),
-		CurrentSize: c.size.Load(),
-		MaxSize:     c.maxSize,
+		Hits:           c.hits.Load(),
+		Misses:         c.misses.Load(),
+		Evictions:      c.evictions.Load(),
+		Items:          c.ll.Len(),
+		CurrentSize:    c.size.Load(),
+		MaxSize:        c.maxSize.Load(),
+		WorkingSet:     c.working.estimates(),
+		Scrubbed:       c.scrubbed.Load(),
+		Corrupted:      c.corrupted.Load(),
+		PendingDeletes: c.pendingDeletes(),
+	}
+}
+
+// Entries returns all cached items, most recently used first.
+func (c *Cache) Entries() []Entry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make([]Entry, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*entry)
+		entries = append(entries, Entry{Key: ent.Key, Size: ent.Size, LastAccess: ent.LastAccess})
 	}
+	return entries
 }
 
 func (c *Cache) CurrentSize() int64 {
@@ -388,18 +658,15 @@ func (c *Cache) Len() int {
 
 func (c *Cache) Clear() error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	for key := range c.cache {
-		filePath := filepath.Join(c.cacheDir, key)
-		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			logging.Logger.Warn("failed to remove cache file during clear", "path", filePath, "error", err)
-		}
-	}
-
+	keys := c.cache
 	c.ll.Init()
 	c.cache = make(map[string]*list.Element)
 	c.size.Store(0)
+	c.mu.Unlock()
+
+	for key := range keys {
+		c.deleteFile(key)
+	}
 	c.persistDirty.Store(true)
 
 	return nil
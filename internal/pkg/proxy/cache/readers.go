@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"io"
+	"sync"
+
+	"oci-proxy/internal/pkg/logging"
+)
+
+// readers counts the open readers of each cached file so that evicting or
+// removing an entry defers deleting its file until the last reader closes it.
+// Deleting open files works on Linux but fails on Windows and breaks readers
+// on NFS.
+type readers struct {
+	mu      sync.Mutex
+	open    map[string]int
+	pending map[string]bool
+}
+
+func newReaders() *readers {
+	return &readers{open: make(map[string]int), pending: make(map[string]bool)}
+}
+
+// openFile opens key in storage, counting the reader until it is closed.
+func (c *Cache) openFile(key string) (io.ReadCloser, error) {
+	c.readers.mu.Lock()
+	c.readers.open[key]++
+	c.readers.mu.Unlock()
+
+	file, err := c.storage.Open(key)
+	if err != nil {
+		c.release(key)
+		return nil, err
+	}
+	return &trackedReader{ReadCloser: file, release: func() { c.release(key) }}, nil
+}
+
+// release drops a reader of key, deleting its file if it was removed from the
+// cache while open.
+func (c *Cache) release(key string) {
+	c.readers.mu.Lock()
+	defer c.readers.mu.Unlock()
+	if c.readers.open[key]--; c.readers.open[key] > 0 {
+		return
+	}
+	delete(c.readers.open, key)
+	if c.readers.pending[key] {
+		delete(c.readers.pending, key)
+		c.removeFileLocked(key)
+	}
+}
+
+// deleteFile deletes the file of a removed entry, or marks it pending until
+// its readers are closed.
+func (c *Cache) deleteFile(key string) {
+	if c.index != nil {
+		c.index.Remove(key)
+	}
+	c.readers.mu.Lock()
+	defer c.readers.mu.Unlock()
+	if c.readers.open[key] > 0 {
+		c.readers.pending[key] = true
+		return
+	}
+	c.removeFileLocked(key)
+}
+
+func (c *Cache) removeFileLocked(key string) {
+	if err := c.storage.Remove(key); err != nil {
+		logging.Logger.Warn("failed to remove cache file", "key", key, "error", err)
+	}
+}
+
+// commitFile moves a staged file into storage under key, cancelling a pending
+// delete of the file it replaces.
+func (c *Cache) commitFile(key, tmpPath string) error {
+	c.readers.mu.Lock()
+	defer c.readers.mu.Unlock()
+	delete(c.readers.pending, key)
+	return c.storage.Commit(key, tmpPath)
+}
+
+func (c *Cache) pendingDeletes() int {
+	c.readers.mu.Lock()
+	defer c.readers.mu.Unlock()
+	return len(c.readers.pending)
+}
+
+type trackedReader struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *trackedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
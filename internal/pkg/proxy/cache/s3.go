@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Timeout bounds how long an S3 request may make no progress: connecting,
+// waiting for response headers or transferring either body.
+const s3Timeout = 30 * time.Second
+
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+}
+
+// S3Storage stores blobs in an S3-compatible bucket. When a local directory is
+// given, the LRU index is kept there instead of in the bucket.
+type S3Storage struct {
+	opts   S3Options
+	client *s3.Client
+	local  *FileStorage
+}
+
+// NewS3Storage connects to the bucket with the access key of opts or, without
+// one, the AWS SDK's default credential chain.
+func NewS3Storage(opts S3Options, localDir string) (*S3Storage, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+		transport.DialContext = (&net.Dialer{Timeout: s3Timeout}).DialContext
+		transport.TLSHandshakeTimeout = s3Timeout
+		transport.ResponseHeaderTimeout = s3Timeout
+	})
+	loadOpts := []func(*awsconfig.LoadOptions) error{awsconfig.WithHTTPClient(client)}
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(opts.Region))
+	}
+	if opts.AccessKey != "" {
+		loadOpts = append(loadOpts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(opts.AccessKey, opts.SecretKey, "")))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	s := &S3Storage{opts: opts}
+	s.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.PathStyle
+		// S3-compatible stores do not all support the SDK's default checksums.
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	})
+
+	if localDir != "" {
+		if s.local, err = NewFileStorage(localDir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *S3Storage) TempDir() string {
+	if s.local != nil {
+		return s.local.TempDir()
+	}
+	return os.TempDir()
+}
+
+func (s *S3Storage) Open(key string) (io.ReadCloser, error) {
+	if key == indexKey && s.local != nil {
+		return s.local.Open(key)
+	}
+	ctx, stall, done := s.request()
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.opts.Bucket, Key: s.key(key)})
+	if err != nil {
+		done()
+		return nil, s3Error("GET", key, err)
+	}
+	stall.Reset(s3Timeout)
+	return &progressReader{Reader: out.Body, stall: stall, close: func() error {
+		defer done()
+		return out.Body.Close()
+	}}, nil
+}
+
+func (s *S3Storage) Stat(key string) (int64, error) {
+	if key == indexKey && s.local != nil {
+		return s.local.Stat(key)
+	}
+	ctx, _, done := s.request()
+	defer done()
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.opts.Bucket, Key: s.key(key)})
+	if err != nil {
+		return 0, s3Error("HEAD", key, err)
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+func (s *S3Storage) Commit(key, tmpPath string) error {
+	if key == indexKey && s.local != nil {
+		return s.local.Commit(key, tmpPath)
+	}
+	file, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	ctx, stall, done := s.request()
+	defer done()
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &s.opts.Bucket,
+		Key:           s.key(key),
+		Body:          &progressFile{file: file, stall: stall},
+		ContentLength: aws.Int64(stat.Size()),
+	})
+	return s3Error("PUT", key, err)
+}
+
+func (s *S3Storage) Remove(key string) error {
+	if key == indexKey && s.local != nil {
+		return s.local.Remove(key)
+	}
+	ctx, _, done := s.request()
+	defer done()
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.opts.Bucket, Key: s.key(key)})
+	if err = s3Error("DELETE", key, err); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3Storage) key(key string) *string {
+	return aws.String(path.Join(s.opts.Prefix, key))
+}
+
+// request returns the context of an S3 request, cancelled once it makes no
+// progress for s3Timeout, and a function releasing it.
+func (s *S3Storage) request() (context.Context, *time.Timer, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stall := time.AfterFunc(s3Timeout, cancel)
+	return ctx, stall, func() {
+		stall.Stop()
+		cancel()
+	}
+}
+
+// s3Error returns fs.ErrNotExist for missing objects.
+func s3Error(method, key string, err error) error {
+	var resp *awshttp.ResponseError
+	if errors.As(err, &resp) && resp.HTTPStatusCode() == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	if err != nil {
+		return fmt.Errorf("s3 %s %s failed: %w", method, key, err)
+	}
+	return nil
+}
+
+// progressReader postpones the cancellation of a stalled S3 download each
+// time its body is read from.
+type progressReader struct {
+	io.Reader
+	stall *time.Timer
+	close func() error
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.stall.Reset(s3Timeout)
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return r.close()
+}
+
+// progressFile postpones the cancellation of a stalled S3 upload each time
+// the file is read from, staying seekable so the SDK can sign and retry it.
+type progressFile struct {
+	file  *os.File
+	stall *time.Timer
+}
+
+func (f *progressFile) Read(p []byte) (int, error) {
+	n, err := f.file.Read(p)
+	f.stall.Reset(s3Timeout)
+	return n, err
+}
+
+func (f *progressFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
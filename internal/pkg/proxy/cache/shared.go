@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SharedStore keeps the blobs of several registries' caches in one directory,
+// keyed purely by digest, so content pulled through different registries is
+// stored once. Each registry's cache keeps its own index, size accounting and
+// eviction; a blob's file is deleted once no registry's index references it.
+type SharedStore struct {
+	files *FileStorage
+
+	mu sync.Mutex
+	// refs maps a key to the registries whose indexes reference it.
+	refs map[string]map[string]bool
+}
+
+// NewSharedStore opens the shared store in dir, reading the persisted index of
+// every registry so that blobs of registries whose caches are not loaded yet
+// are not deleted.
+func NewSharedStore(dir string) (*SharedStore, error) {
+	files, err := NewFileStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &SharedStore{files: files, refs: make(map[string]map[string]bool)}
+	indexes, _ := filepath.Glob(filepath.Join(dir, indexKey+".*"))
+	for _, index := range indexes {
+		if registry := strings.TrimPrefix(filepath.Base(index), indexKey+"."); !strings.HasSuffix(registry, ".tmp") {
+			s.readRefs(registry, index)
+		}
+	}
+	return s, nil
+}
+
+func (s *SharedStore) readRefs(registry, index string) {
+	file, err := os.Open(index)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e entry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			s.retainLocked(e.Key, registry)
+		}
+	}
+}
+
+// For returns the storage of registry's cache within the shared store.
+func (s *SharedStore) For(registry string) Storage {
+	return &sharedStorage{store: s, registry: registry}
+}
+
+func (s *SharedStore) retainLocked(key, registry string) {
+	if s.refs[key] == nil {
+		s.refs[key] = make(map[string]bool)
+	}
+	s.refs[key][registry] = true
+}
+
+// sharedStorage is one registry's view of a SharedStore. Its index is stored
+// under the registry's name; blobs are shared.
+type sharedStorage struct {
+	store    *SharedStore
+	registry string
+}
+
+func (v *sharedStorage) name(key string) string {
+	if key == indexKey {
+		return indexKey + "." + strings.ReplaceAll(v.registry, "/", "_")
+	}
+	return key
+}
+
+func (v *sharedStorage) TempDir() string {
+	return v.store.files.TempDir()
+}
+
+func (v *sharedStorage) Open(key string) (io.ReadCloser, error) {
+	return v.store.files.Open(v.name(key))
+}
+
+func (v *sharedStorage) Stat(key string) (int64, error) {
+	return v.store.files.Stat(v.name(key))
+}
+
+func (v *sharedStorage) Commit(key, tmpPath string) error {
+	v.store.mu.Lock()
+	defer v.store.mu.Unlock()
+	if key != indexKey {
+		v.store.retainLocked(key, v.registry)
+	}
+	return v.store.files.Commit(v.name(key), tmpPath)
+}
+
+// Remove drops the registry's reference to key and deletes its file unless
+// another registry still references it.
+func (v *sharedStorage) Remove(key string) error {
+	v.store.mu.Lock()
+	defer v.store.mu.Unlock()
+	if key == indexKey {
+		return v.store.files.Remove(v.name(key))
+	}
+	if refs := v.store.refs[key]; refs != nil {
+		delete(refs, v.registry)
+		if len(refs) > 0 {
+			return nil
+		}
+		delete(v.store.refs, key)
+	}
+	return v.store.files.Remove(key)
+}
+
+// retain records that the registry's index references key, whose file is
+// already in the store.
+func (v *sharedStorage) retain(key string) {
+	v.store.mu.Lock()
+	defer v.store.mu.Unlock()
+	v.store.retainLocked(key, v.registry)
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const indexKey = ".lru_persistence"
+
+// Storage is the backing store for cached blobs and the persisted LRU index.
+type Storage interface {
+	// TempDir returns a local directory used to stage files before Commit.
+	TempDir() string
+	Open(key string) (io.ReadCloser, error)
+	Stat(key string) (int64, error)
+	// Commit moves the staged local file at tmpPath into storage under key.
+	Commit(key, tmpPath string) error
+	Remove(key string) error
+}
+
+type FileStorage struct {
+	dir string
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (s *FileStorage) TempDir() string {
+	return s.dir
+}
+
+func (s *FileStorage) Open(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, key))
+}
+
+func (s *FileStorage) Stat(key string) (int64, error) {
+	stat, err := os.Stat(filepath.Join(s.dir, key))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (s *FileStorage) Commit(key, tmpPath string) error {
+	return os.Rename(tmpPath, filepath.Join(s.dir, key))
+}
+
+func (s *FileStorage) Remove(key string) error {
+	if err := os.Remove(filepath.Join(s.dir, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
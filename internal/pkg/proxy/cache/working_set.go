@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	workingSetBucket    = time.Hour
+	workingSetRetention = 7 * 24 * time.Hour
+)
+
+// workingSetWindows are the rolling windows reported in CacheStats.
+var workingSetWindows = []struct {
+	name   string
+	window time.Duration
+}{{"1h", time.Hour}, {"24h", 24 * time.Hour}, {"7d", 7 * 24 * time.Hour}}
+
+// workingSetTargets are the byte hit ratios sizes are recommended for.
+var workingSetTargets = []struct {
+	name  string
+	ratio float64
+}{{"90%", 0.90}, {"95%", 0.95}, {"99%", 0.99}}
+
+type workingSetBucketCounts struct {
+	start  time.Time
+	counts map[string]int64
+}
+
+// workingSet counts blob requests in hourly buckets to estimate how much cache
+// the observed traffic needs.
+type workingSet struct {
+	mu      sync.Mutex
+	sizes   map[string]int64
+	buckets []workingSetBucketCounts
+}
+
+func newWorkingSet() *workingSet {
+	return &workingSet{sizes: make(map[string]int64)}
+}
+
+func (w *workingSet) record(key string, size int64) {
+	now := time.Now().Truncate(workingSetBucket)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n := len(w.buckets); n == 0 || w.buckets[n-1].start != now {
+		w.buckets = append(w.buckets, workingSetBucketCounts{start: now, counts: make(map[string]int64)})
+		w.expire(now)
+	}
+	w.buckets[len(w.buckets)-1].counts[key]++
+	w.sizes[key] = size
+}
+
+// expire drops buckets past the retention and sizes of blobs no longer counted.
+func (w *workingSet) expire(now time.Time) {
+	i := 0
+	for i < len(w.buckets) && now.Sub(w.buckets[i].start) >= workingSetRetention {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	w.buckets = slices.Delete(w.buckets, 0, i)
+
+	live := make(map[string]int64, len(w.sizes))
+	for _, b := range w.buckets {
+		for key := range b.counts {
+			live[key] = w.sizes[key]
+		}
+	}
+	w.sizes = live
+}
+
+func (w *workingSet) estimates() map[string]WorkingSetEstimate {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buckets) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	estimates := make(map[string]WorkingSetEstimate, len(workingSetWindows))
+	for _, window := range workingSetWindows {
+		counts := make(map[string]int64)
+		for _, b := range w.buckets {
+			if now.Sub(b.start) < window.window {
+				for key, n := range b.counts {
+					counts[key] += n
+				}
+			}
+		}
+		estimates[window.name] = w.estimate(counts)
+	}
+	return estimates
+}
+
+// estimate fills a cache with blobs in order of request count. Every blob's
+// first request is a miss, so only repeat requests can become hits.
+func (w *workingSet) estimate(counts map[string]int64) WorkingSetEstimate {
+	type blob struct{ size, count int64 }
+	blobs := make([]blob, 0, len(counts))
+	var est WorkingSetEstimate
+	for key, n := range counts {
+		size := w.sizes[key]
+		blobs = append(blobs, blob{size, n})
+		est.UniqueBytes += size
+		est.RequestedBytes += size * n
+	}
+	slices.SortFunc(blobs, func(a, b blob) int { return cmp.Compare(b.count, a.count) })
+
+	targets := workingSetTargets
+	var hits, cached int64
+	for _, b := range blobs {
+		if len(targets) == 0 || b.count < 2 {
+			break
+		}
+		hits += b.size * (b.count - 1)
+		cached += b.size
+		for len(targets) > 0 && float64(hits) >= targets[0].ratio*float64(est.RequestedBytes) {
+			if est.Recommended == nil {
+				est.Recommended = make(map[string]int64)
+			}
+			est.Recommended[targets[0].name] = cached
+			targets = targets[1:]
+		}
+	}
+	return est
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/json"
+	"time"
+
+	"oci-proxy/internal/pkg/kv"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// storeIndex is the cache.Index of a registry's cache kept in the shared
+// store under cacheindex/<registry>/<key>.
+type storeIndex struct {
+	store    kv.Store
+	registry string
+}
+
+type storeIndexEntry struct {
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+func (i storeIndex) Lookup(key string) (int64, time.Time, bool, error) {
+	data, ok, err := i.store.Get("cacheindex/" + i.registry + "/" + key)
+	if err != nil {
+		logging.Logger.Warn("failed to read cache index entry", "registry", i.registry, "key", key, "error", err)
+		return 0, time.Time{}, false, err
+	}
+	var e storeIndexEntry
+	if !ok || json.Unmarshal(data, &e) != nil {
+		return 0, time.Time{}, false, nil
+	}
+	return e.Size, e.LastAccess, true, nil
+}
+
+func (i storeIndex) Touch(key string, size int64, lastAccess time.Time) {
+	data, _ := json.Marshal(storeIndexEntry{Size: size, LastAccess: lastAccess})
+	if err := i.store.Set("cacheindex/"+i.registry+"/"+key, data, 0); err != nil {
+		logging.Logger.Warn("failed to store cache index entry", "registry", i.registry, "key", key, "error", err)
+	}
+}
+
+func (i storeIndex) Remove(key string) {
+	if err := i.store.Delete("cacheindex/" + i.registry + "/" + key); err != nil {
+		logging.Logger.Warn("failed to remove cache index entry", "registry", i.registry, "key", key, "error", err)
+	}
+}
@@ -1,24 +1,44 @@
 package proxy
 
 import (
+	"fmt"
+	"maps"
 	"sync"
+	"time"
 
 	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/kv"
 	"oci-proxy/internal/pkg/logging"
 	"oci-proxy/internal/pkg/proxy/cache"
 )
 
 type CacheManager struct {
-	cfg    *config.Config
-	caches map[string]*cache.Cache
-	mu     sync.RWMutex
+	cfg      *config.Provider
+	caches   map[string]*cache.Cache
+	settings map[string]config.RegistrySettings
+	// stores holds the shared stores by cache directory when shared_cache is
+	// set, as it was when the caches were created.
+	stores map[string]*cache.SharedStore
+	shared bool
+	// webhooks receives the blobs stored and evicted, and index shares the
+	// caches' indexes with store.cache_index, when set before the first cache
+	// is created.
+	webhooks *webhooks
+	index    kv.Store
+	mu       sync.RWMutex
 }
 
-func NewCacheManager(cfg *config.Config) *CacheManager {
-	return &CacheManager{
-		cfg:    cfg,
-		caches: make(map[string]*cache.Cache),
+func NewCacheManager(cfg *config.Provider) *CacheManager {
+	cm := &CacheManager{
+		cfg:      cfg,
+		caches:   make(map[string]*cache.Cache),
+		settings: make(map[string]config.RegistrySettings),
+		stores:   make(map[string]*cache.SharedStore),
+		shared:   cfg.Current().SharedCache,
 	}
+	cache.SetDeviceWriteLimit(cfg.Current().DiskWriteConcurrency)
+	cfg.OnReload(func(_, _ *config.Config) { cm.Reload() })
+	return cm
 }
 
 func (cm *CacheManager) GetCache(registryHost string) *cache.Cache {
@@ -37,18 +57,166 @@ func (cm *CacheManager) GetCache(registryHost string) *cache.Cache {
 		return c
 	}
 
-	settings := cm.cfg.GetRegistrySettings(registryHost)
-	newCache, err := cache.NewLRUCache(settings.CacheMaxSize.Bytes(), settings.CacheDir)
+	settings := cm.cfg.Current().GetRegistrySettings(registryHost)
+	storage, err := cm.newStorage(registryHost, settings)
+	if err != nil {
+		logging.Logger.Error("failed to create cache storage for registry", "registry", registryHost, "error", err)
+		storage = nil
+	}
+	newCache, err := cache.NewLRUCache(settings.CacheMaxSize.Bytes(), storage)
 	if err != nil {
 		logging.Logger.Error("failed to create cache for registry", "registry", registryHost, "error", err)
-		newCache, _ = cache.NewLRUCache(0, "")
+		newCache, _ = cache.NewLRUCache(0, nil)
+	}
+
+	if (settings.CacheBackend == "" || settings.CacheBackend == "fs") && settings.CacheDir != "" {
+		if device, ok := cache.DeviceOf(settings.CacheDir); ok {
+			newCache.SetReserved(func() int64 { return cm.reservedElsewhere(registryHost, device) })
+		}
+		newCache.SetMinFreeDisk(settings.CacheMinFreeDisk.Bytes())
 	}
 
+	newCache.SetHooks(func(key string, size int64) {
+		cm.webhooks.send(WebhookEvent{Event: "blob.cached", Registry: registryHost, Digest: key, Size: size})
+	}, func(key string, size int64) {
+		cm.webhooks.send(WebhookEvent{Event: "cache.evicted", Registry: registryHost, Digest: key, Size: size})
+	})
+	if cm.index != nil && storage != nil {
+		newCache.SetIndex(storeIndex{store: cm.index, registry: registryHost})
+	}
 	cm.caches[registryHost] = newCache
+	cm.settings[registryHost] = settings
 	logging.Logger.Debug("initialized cache for registry", "registry", registryHost)
 	return newCache
 }
 
+// newStorage creates the storage of registryHost's cache. It must be called
+// with cm.mu held.
+func (cm *CacheManager) newStorage(registryHost string, settings config.RegistrySettings) (cache.Storage, error) {
+	switch settings.CacheBackend {
+	case "", "fs":
+		if settings.CacheDir == "" {
+			return nil, nil
+		}
+		if !cm.shared {
+			return cache.NewFileStorage(settings.CacheDir)
+		}
+		store, ok := cm.stores[settings.CacheDir]
+		if !ok {
+			var err error
+			if store, err = cache.NewSharedStore(settings.CacheDir); err != nil {
+				return nil, err
+			}
+			cm.stores[settings.CacheDir] = store
+		}
+		return store.For(registryHost), nil
+	case "s3":
+		return cache.NewS3Storage(cache.S3Options{
+			Endpoint:  settings.S3.Endpoint,
+			Region:    settings.S3.Region,
+			Bucket:    settings.S3.Bucket,
+			Prefix:    settings.S3.Prefix,
+			AccessKey: settings.S3.AccessKey,
+			SecretKey: settings.S3.SecretKey,
+			PathStyle: settings.S3.UsePathStyle(),
+		}, settings.CacheDir)
+	default:
+		return nil, fmt.Errorf("unsupported cache backend: %s", settings.CacheBackend)
+	}
+}
+
+// Run keeps cache_min_free_disk and cache_reserved_size free between Puts, as
+// other workloads on the same file system fill it up, and persists changed
+// cache indexes every cache_persist_interval so a crash loses little of them.
+func (cm *CacheManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	persist := time.NewTimer(cm.cfg.Current().CachePersistInterval)
+	defer persist.Stop()
+	for {
+		select {
+		case <-persist.C:
+			cm.PersistAll()
+			persist.Reset(cm.cfg.Current().CachePersistInterval)
+		case <-ticker.C:
+			for host, c := range cm.snapshot() {
+				if freed, _ := c.EnsureFreeSpace(); freed > 0 {
+					logging.Logger.Info("evicted cached blobs to keep disk space free", "registry", host, "bytes", freed)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Reload applies the current configuration to existing caches. Caches whose
+// storage settings changed are persisted and recreated lazily on next use.
+func (cm *CacheManager) Reload() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cfg := cm.cfg.Current()
+	cache.SetDeviceWriteLimit(cfg.DiskWriteConcurrency)
+	sharingChanged := cfg.SharedCache != cm.shared
+	for host, c := range cm.caches {
+		old, settings := cm.settings[host], cfg.GetRegistrySettings(host)
+		if !sharingChanged && old.CacheBackend == settings.CacheBackend && old.CacheDir == settings.CacheDir && old.S3 == settings.S3 {
+			c.SetMaxSize(settings.CacheMaxSize.Bytes())
+			if settings.CacheBackend != "s3" {
+				c.SetMinFreeDisk(settings.CacheMinFreeDisk.Bytes())
+			}
+			cm.settings[host] = settings
+			continue
+		}
+		if err := c.Persist(); err != nil {
+			logging.Logger.Error("failed to persist cache", "registry", host, "error", err)
+		}
+		delete(cm.caches, host)
+		delete(cm.settings, host)
+		logging.Logger.Info("cache storage settings changed, recreating cache", "registry", host)
+	}
+	if sharingChanged {
+		cm.shared = cfg.SharedCache
+		cm.stores = make(map[string]*cache.SharedStore)
+	}
+}
+
+// reservedElsewhere returns the unused cache_reserved_size of the other
+// registries whose cache directories are on device.
+func (cm *CacheManager) reservedElsewhere(host string, device uint64) int64 {
+	cfg := cm.cfg.Current()
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var total int64
+	for name := range cfg.Registries {
+		if name == host || config.IsRegistryPattern(name) {
+			continue
+		}
+		settings := cfg.GetRegistrySettings(name)
+		reserved := settings.CacheReservedSize.Bytes()
+		if reserved <= 0 || settings.CacheBackend == "s3" || settings.CacheDir == "" {
+			continue
+		}
+		if d, ok := cache.DeviceOf(settings.CacheDir); !ok || d != device {
+			continue
+		}
+		if c, ok := cm.caches[name]; ok {
+			reserved -= c.CurrentSize()
+		}
+		total += max(reserved, 0)
+	}
+	return total
+}
+
+// snapshot returns the caches created so far by registry.
+func (cm *CacheManager) snapshot() map[string]*cache.Cache {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return maps.Clone(cm.caches)
+}
+
 func (cm *CacheManager) PersistAll() {
 	cm.mu.RLock()
 	caches := make([]*cache.Cache, 0, len(cm.caches))
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+var errChaos = errors.New("chaos: injected upstream connection failure")
+
+// doChaos sends req like client.Do, after injecting the latency, errors and
+// truncated bodies of a registry's chaos settings. Injected errors are
+// answered without reaching the upstream: with error_status when set and as a
+// connection failure otherwise.
+func doChaos(client *http.Client, req *http.Request, chaos *config.ChaosSettings) (*http.Response, error) {
+	if chaos == nil {
+		return client.Do(req)
+	}
+	ctx := req.Context()
+	if chaos.Latency > 0 && rand.Float64()*100 < chaos.LatencyPercent {
+		logging.Logger.DebugContext(ctx, "chaos: delaying upstream request", "url", req.URL.String(), "latency", chaos.Latency)
+		select {
+		case <-time.After(chaos.Latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if rand.Float64()*100 < chaos.ErrorPercent {
+		logging.Logger.DebugContext(ctx, "chaos: failing upstream request", "url", req.URL.String(), "status", chaos.ErrorStatus)
+		if chaos.ErrorStatus == 0 {
+			return nil, errChaos
+		}
+		code := "UNAVAILABLE"
+		if chaos.ErrorStatus == http.StatusTooManyRequests {
+			code = "TOOMANYREQUESTS"
+		}
+		body := fmt.Sprintf(`{"errors":[{"code":%q,"message":"chaos: injected %d response"}]}`, code, chaos.ErrorStatus)
+		resp := &http.Response{
+			StatusCode:    chaos.ErrorStatus,
+			Status:        fmt.Sprintf("%d %s", chaos.ErrorStatus, http.StatusText(chaos.ErrorStatus)),
+			Header:        make(http.Header),
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+		resp.Header.Set("Content-Type", "application/json")
+		if chaos.ErrorStatus == http.StatusTooManyRequests || chaos.ErrorStatus == http.StatusServiceUnavailable {
+			resp.Header.Set("Retry-After", "1")
+		}
+		return resp, nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil || resp.ContentLength <= 0 || rand.Float64()*100 >= chaos.TruncatePercent {
+		return resp, err
+	}
+	logging.Logger.DebugContext(ctx, "chaos: truncating upstream response", "url", req.URL.String(), "size", resp.ContentLength)
+	resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: resp.ContentLength / 2}
+	return resp, nil
+}
+
+// truncatedBody fails with io.ErrUnexpectedEOF after remaining bytes, like a
+// connection dropped mid-transfer.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
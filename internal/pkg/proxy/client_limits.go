@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+)
+
+// clientLimiter enforces client_limits: a token bucket of registry requests
+// and a cap on concurrent blob downloads for each client, the authenticated
+// user or else the client IP. Requests over a limit are rejected right away
+// with 429 so that clients back off instead of holding connections open.
+type clientLimiter struct {
+	cfg      *config.Provider
+	requests *rateLimiter
+	rejected atomic.Int64
+
+	mu    sync.Mutex
+	blobs map[string]int
+}
+
+func newClientLimiter(cfg *config.Provider) *clientLimiter {
+	return &clientLimiter{cfg: cfg, requests: newRateLimiter(), blobs: make(map[string]int)}
+}
+
+// admit checks a request of client, authenticated as user if not empty. It
+// returns a function to call once the request finishes, or why the request is
+// rejected and when to retry.
+func (l *clientLimiter) admit(client, user string, blob bool) (done func(), reason string, retryAfter time.Duration) {
+	limits := l.cfg.Current().ClientLimits.For(user)
+	key := "client " + client
+	if user != "" {
+		key = "user " + user
+	}
+	if rate := limits.RequestsPerSecond; rate > 0 {
+		burst := float64(limits.Burst)
+		if burst == 0 {
+			burst = math.Ceil(rate)
+		}
+		if wait, ok := l.requests.reserve(key, 1, rate, burst, 0); !ok {
+			l.rejected.Add(1)
+			return nil, fmt.Sprintf("%s exceeded requests_per_second of %g", key, rate), wait
+		}
+	}
+	if !blob || limits.MaxConcurrentBlobs <= 0 {
+		return func() {}, "", 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.blobs[key] >= limits.MaxConcurrentBlobs {
+		l.rejected.Add(1)
+		return nil, fmt.Sprintf("%s reached max_concurrent_blobs of %d", key, limits.MaxConcurrentBlobs), time.Second
+	}
+	l.blobs[key]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.blobs[key]--; l.blobs[key] == 0 {
+			delete(l.blobs, key)
+		}
+	}, "", 0
+}
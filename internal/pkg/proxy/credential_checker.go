@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+// CredentialChecker periodically validates configured registry credentials.
+type CredentialChecker struct {
+	cfg      *config.Provider
+	executor *Executor
+	mu       sync.RWMutex
+	statuses map[string]CredentialStatus
+}
+
+func NewCredentialChecker(cfg *config.Provider, executor *Executor) *CredentialChecker {
+	return &CredentialChecker{
+		cfg:      cfg,
+		executor: executor,
+		statuses: make(map[string]CredentialStatus),
+	}
+}
+
+// Run checks credentials every credential_check_interval until stop is closed.
+func (c *CredentialChecker) Run(stop <-chan struct{}) {
+	for {
+		interval := c.cfg.Current().CredentialCheckInterval
+		if interval > 0 {
+			c.CheckAll()
+		} else {
+			interval = time.Minute
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *CredentialChecker) CheckAll() {
+	cfg := c.cfg.Current()
+	checked := make(map[string]bool)
+	for host, settings := range cfg.Registries {
+		if settings.Auth.Username == "" || settings.IsOffline() || config.IsRegistryPattern(host) {
+			continue
+		}
+		checked[host] = true
+
+		status := CredentialStatus{Healthy: true, CheckedAt: time.Now()}
+		if err := c.check(host, settings); err != nil {
+			status.Healthy, status.Error = false, err.Error()
+		}
+
+		c.mu.Lock()
+		prev, seen := c.statuses[host]
+		c.statuses[host] = status
+		c.mu.Unlock()
+
+		switch {
+		case !status.Healthy && (!seen || prev.Healthy):
+			logging.Logger.Warn("registry credential check failed", "registry", host, "username", settings.Auth.Username, "error", status.Error)
+		case status.Healthy && seen && !prev.Healthy:
+			logging.Logger.Info("registry credential recovered", "registry", host, "username", settings.Auth.Username)
+		}
+	}
+
+	c.mu.Lock()
+	for host := range c.statuses {
+		if !checked[host] {
+			delete(c.statuses, host)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *CredentialChecker) Statuses() map[string]CredentialStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	statuses := make(map[string]CredentialStatus, len(c.statuses))
+	for host, status := range c.statuses {
+		statuses[host] = status
+	}
+	return statuses
+}
+
+// check probes /v2/ with basic auth and, on a bearer challenge, fetches a token
+// from the realm with the same credentials.
+func (c *CredentialChecker) check(host string, settings config.RegistrySettings) error {
+	scheme := "https"
+	if settings.Insecure != nil && *settings.Insecure {
+		scheme = "http"
+	}
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+host+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	settings.Auth.ApplyToRequest(req)
+
+	resp, err := c.executor.Execute(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	challenge := resp.Header.Get("Www-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("registry probe failed with status %s", resp.Status)
+	}
+
+	params := middleware.ParseAuthHeader(challenge)
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid realm in Www-Authenticate header")
+	}
+	query := realm.Query()
+	query.Set("service", params["service"])
+	realm.RawQuery = query.Encode()
+
+	tokenReq, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	settings.Auth.ApplyToRequest(tokenReq)
+	tokenResp, err := c.executor.Execute(tokenReq)
+	if err != nil {
+		return err
+	}
+	tokenResp.Body.Close()
+	if tokenResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed with status %s", tokenResp.Status)
+	}
+	return nil
+}
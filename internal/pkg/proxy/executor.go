@@ -2,69 +2,272 @@ package proxy
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"oci-proxy/internal/pkg/config"
 	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
 
 	"golang.org/x/net/proxy"
 )
 
 type Executor struct {
-	cfg *config.Config
+	cfg        *config.Provider
+	mu         sync.Mutex
+	clients    map[string]*http.Client
+	stats      *upstreamStats
+	throttle   *throttle
+	limiter    *rateLimiter
+	bandwidth  *rateLimiter
+	mirrors    *mirrorHealth
+	auth       *middleware.AuthMiddleware
+	background *backgroundScheduler
 }
 
-func NewExecutor(cfg *config.Config) *Executor {
-	return &Executor{cfg: cfg}
+// NewExecutor sends requests upstream; auth authenticates those it sends to
+// registry mirrors.
+func NewExecutor(cfg *config.Provider, auth *middleware.AuthMiddleware) *Executor {
+	e := &Executor{cfg: cfg, clients: make(map[string]*http.Client), stats: newUpstreamStats(), throttle: newThrottle(), limiter: newRateLimiter(), bandwidth: newRateLimiter(), mirrors: newMirrorHealth(), auth: auth}
+	e.background = newBackgroundScheduler(cfg, e.throttle)
+	cfg.OnReload(func(_, _ *config.Config) { e.resetClients() })
+	return e
 }
 
 func (e *Executor) Execute(req *http.Request) (*http.Response, error) {
-	settings := e.cfg.GetRegistrySettings(req.URL.Host)
-	client := e.getClientForRegistry(settings)
-	logging.Logger.Debug("executing request", "url", req.URL.String())
-	return client.Do(req)
+	registry := req.URL.Host
+	settings := e.cfg.Current().GetRegistrySettings(registry)
+	if isBackground(req.Context()) {
+		if err := e.background.wait(req.Context(), registry); err != nil {
+			return nil, err
+		}
+	}
+	outReq := routeCanary(req, settings)
+	client := e.getClientForRegistry(outReq.URL.Host, settings)
+	logging.Logger.DebugContext(req.Context(), "executing request", "url", outReq.URL.String())
+
+	timing := upstreamTimingFrom(req.Context())
+	if timing != nil {
+		outReq = timing.trace(outReq)
+	}
+	var resp *http.Response
+	var err error
+	if len(settings.Mirrors) > 0 && outReq.URL.Host == registry && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		resp, err = e.doMirrors(registry, outReq, settings)
+	}
+	mirrored := resp != nil
+	if resp == nil && err == nil && outReq.URL.Host != registry {
+		resp, err = e.auth.Mirror(outReq, func(r *http.Request) (*http.Response, error) {
+			return e.do(client, registry, r, settings)
+		})
+	} else if resp == nil && err == nil {
+		resp, err = e.do(client, registry, outReq, settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mirrored || outReq.URL.Host != registry {
+		// Downstream handling works on the logical registry, not the canary or mirror target.
+		resp.Request = req
+	}
+	if timing != nil {
+		timing.annotate(resp)
+	}
+	if rate := settings.DownloadBandwidth; rate > 0 && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &throttledBody{ReadCloser: resp.Body, ctx: req.Context(), limiter: e.bandwidth, registry: registry, rate: float64(rate)}
+	}
+	return resp, nil
 }
 
-func (e *Executor) getClientForRegistry(settings config.RegistrySettings) *http.Client {
-	transport := http.DefaultTransport
+// Confirm sends req to the registry itself, never to a mirror or canary, and
+// does not follow redirects, so the registry's own answer shows whether the
+// request's credentials may access what it names.
+func (e *Executor) Confirm(req *http.Request) (*http.Response, error) {
+	settings := e.cfg.Current().GetRegistrySettings(req.URL.Host)
+	client := *e.getClientForRegistry(req.URL.Host, settings)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return e.do(&client, req.URL.Host, req, settings)
+}
 
-	if settings.UpstreamProxy != "" {
-		var err error
-		transport, err = createTransportWithProxy(settings.UpstreamProxy)
-		if err != nil {
-			logging.Logger.Error("failed to create transport for upstream proxy", "error", err)
-			transport = http.DefaultTransport
+// do sends the request, honoring upstream 429 Retry-After delays. While a registry
+// is backing off, requests wait if the delay fits in the remaining budget and
+// otherwise get a synthesized 429 with the remaining delay. With
+// max_requests_per_minute, each attempt also queues for up to rate_limit_wait.
+func (e *Executor) do(client *http.Client, registry string, req *http.Request, settings config.RegistrySettings) (*http.Response, error) {
+	budget := settings.RetryAfterBudget
+	req = e.stats.traceConns(registry, req)
+	for attempt := 0; ; attempt++ {
+		if wait := e.throttle.remaining(registry); wait > 0 {
+			if wait > budget {
+				e.throttle.rejected(registry)
+				return tooManyRequests(req, wait, "upstream registry is rate limiting requests"), nil
+			}
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			budget -= wait
+		}
+		if settings.MaxRequestsPerMin > 0 {
+			// The bucket holds ten seconds of requests, so a rollout pulling
+			// on many nodes at once is smoothed out instead of sent as one burst.
+			rate := float64(settings.MaxRequestsPerMin) / 60
+			wait, ok := e.limiter.reserve(registry, 1, rate, rate*10, settings.RateLimitWait)
+			if !ok {
+				e.throttle.limited(registry)
+				return tooManyRequests(req, wait, "the proxy's max_requests_per_minute for this upstream registry is reached"), nil
+			}
+			if wait > 0 {
+				e.throttle.queued(registry)
+				select {
+				case <-time.After(wait):
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				}
+			}
+		}
+		if attempt > 0 {
+			e.throttle.retried(registry)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		start := time.Now()
+		resp, err := doChaos(client, req, settings.Chaos)
+		e.stats.record(registry, req.URL.Host, start, resp, err)
+		if err == nil {
+			e.throttle.observe(registry, resp.Header)
+		}
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
 		}
+		delay, ok := retryAfter(resp.Header)
+		if !ok {
+			return resp, nil
+		}
+		e.throttle.throttled(registry, delay)
+		if delay > budget || (req.Body != nil && req.GetBody == nil) {
+			resp.Header.Set("Retry-After", retryAfterSeconds(delay))
+			return resp, nil
+		}
+		resp.Body.Close()
 	}
+}
 
-	client := &http.Client{Transport: transport}
+// ThrottleStats returns 429 counters per registry.
+func (e *Executor) ThrottleStats() map[string]ThrottleStats {
+	return e.throttle.snapshot()
+}
 
+// UpstreamStats returns request counters per registry and upstream target.
+func (e *Executor) UpstreamStats() map[string]map[string]UpstreamStats {
+	return e.stats.snapshot()
+}
+
+// routeCanary sends the configured percentage of pull requests to the canary
+// upstream, which is authenticated like a mirror. Pushes always go to the
+// primary so upload sessions stay on one backend.
+func routeCanary(req *http.Request, settings config.RegistrySettings) *http.Request {
+	canary := settings.Canary
+	if canary == nil || canary.Upstream == "" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return req
+	}
+	if rand.Float64()*100 >= canary.Percent {
+		return req
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.URL.Host, outReq.Host = canary.Upstream, canary.Upstream
+	if canary.Insecure {
+		outReq.URL.Scheme = "http"
+	} else {
+		outReq.URL.Scheme = "https"
+	}
+	return outReq
+}
+
+// getClientForRegistry returns the client for an upstream host, built once and
+// reused across requests so connections stay pooled. Clients are rebuilt on
+// config reloads.
+func (e *Executor) getClientForRegistry(host string, settings config.RegistrySettings) *http.Client {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if client, ok := e.clients[host]; ok {
+		return client
+	}
+	transport, err := newTransport(settings)
+	if err != nil {
+		logging.Logger.Error("failed to create transport", "registry", host, "error", err)
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	client := &http.Client{Transport: transport}
 	if settings.FollowRedirects != nil && !*settings.FollowRedirects {
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		}
 	}
-
+	e.clients[host] = client
 	return client
 }
 
-func createTransportWithProxy(upstreamProxy string) (http.RoundTripper, error) {
-	proxyURL, err := url.Parse(upstreamProxy)
+// Transport returns the transport of an upstream host, used for its token
+// service as well.
+func (e *Executor) Transport(host string) http.RoundTripper {
+	return e.getClientForRegistry(host, e.cfg.Current().GetRegistrySettings(host)).Transport
+}
+
+func (e *Executor) resetClients() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for host, client := range e.clients {
+		client.CloseIdleConnections()
+		delete(e.clients, host)
+	}
+}
+
+func newTransport(settings config.RegistrySettings) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = max(settings.MaxIdleConns, settings.KeepWarm)
+	// A custom TLS config or dialer disables HTTP/2 unless it is forced.
+	transport.ForceAttemptHTTP2 = true
+	if tlsConfig := settings.ClientTLSConfig(); tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if settings.UpstreamProxy == "" {
+		return transport, nil
+	}
+
+	proxyURL, err := url.Parse(settings.UpstreamProxy)
 	if err != nil {
 		return nil, fmt.Errorf("invalid upstream_proxy URL: %w", err)
 	}
 
 	switch proxyURL.Scheme {
 	case "http", "https":
-		return &http.Transport{Proxy: http.ProxyURL(proxyURL)}, nil
+		transport.Proxy = http.ProxyURL(proxyURL)
 	case "socks5":
 		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create socks5 dialer: %w", err)
 		}
-		return &http.Transport{Dial: dialer.Dial}, nil
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("socks5 dialer does not support contexts")
+		}
+		transport.Proxy = nil
+		transport.DialContext = contextDialer.DialContext
 	default:
 		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
 	}
+	return transport, nil
 }
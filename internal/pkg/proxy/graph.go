@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"oci-proxy/internal/pkg/config"
+)
+
+// manifestMediaTypes are requested when building graphs; every other node
+// of a graph is a blob.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var manifestAccept = strings.Join(manifestMediaTypes, ", ")
+
+// maxManifestSize bounds manifest bodies read while building graphs.
+const maxManifestSize = 4 << 20
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	} `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// GraphBuilder fetches manifests through the proxy pipeline, so upstream
+// authentication applies, and checks their blobs against the cache.
+type GraphBuilder struct {
+	cfg          *config.Provider
+	cacheManager *CacheManager
+	transport    http.RoundTripper
+}
+
+func NewGraphBuilder(cfg *config.Provider, cacheManager *CacheManager, transport http.RoundTripper) *GraphBuilder {
+	return &GraphBuilder{cfg: cfg, cacheManager: cacheManager, transport: transport}
+}
+
+// Build returns the graph of image, a reference such as ghcr.io/org/app:v1 or
+// nginx@sha256:..., resolved like a client pull through the proxy.
+func (g *GraphBuilder) Build(ctx context.Context, image string) (*ImageGraph, error) {
+	name, ref := splitImageReference(image)
+	if name == "" {
+		return nil, fmt.Errorf("invalid image reference %q", image)
+	}
+	cfg := g.cfg.Current()
+	registry, upstreamPath := resolveUpstream("/v2/"+name+"/manifests/"+ref, cfg)
+	if !cfg.IsRegistryAllowed(registry) {
+		return nil, fmt.Errorf("registry %s is not allowed", registry)
+	}
+	return g.build(ctx, registry, repositoryName(upstreamPath), ref)
+}
+
+// build returns the graph of an upstream repository reference.
+func (g *GraphBuilder) build(ctx context.Context, registry, repository, ref string) (*ImageGraph, error) {
+	graph := &ImageGraph{Registry: registry, Repository: repository, Reference: ref}
+	root, err := g.node(ctx, graph, descriptor{Digest: ref}, 0)
+	if err != nil {
+		return nil, err
+	}
+	graph.Root = root
+	return graph, nil
+}
+
+func (g *GraphBuilder) node(ctx context.Context, graph *ImageGraph, desc descriptor, depth int) (GraphNode, error) {
+	m, node, err := g.fetch(ctx, graph, desc.Digest)
+	if err != nil {
+		return GraphNode{}, err
+	}
+	if desc.Platform != nil {
+		node.Platform = strings.TrimSuffix(desc.Platform.OS+"/"+desc.Platform.Architecture+"/"+desc.Platform.Variant, "/")
+	}
+
+	node.Cached = true
+	if len(m.Manifests) > 0 {
+		if depth > 1 {
+			return GraphNode{}, fmt.Errorf("manifest %s nests indexes too deeply", node.Digest)
+		}
+		for _, child := range m.Manifests {
+			childNode, err := g.node(ctx, graph, child, depth+1)
+			if err != nil {
+				return GraphNode{}, err
+			}
+			node.Cached = node.Cached && childNode.Cached
+			node.Children = append(node.Children, childNode)
+		}
+		return node, nil
+	}
+
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append([]descriptor{*m.Config}, blobs...)
+	}
+	c := g.cacheManager.GetCache(graph.Registry)
+	for _, blob := range blobs {
+		cached := c.Contains(blob.Digest)
+		graph.TotalBytes += blob.Size
+		if cached {
+			graph.CachedBytes += blob.Size
+		}
+		node.Cached = node.Cached && cached
+		node.Children = append(node.Children, GraphNode{Digest: blob.Digest, MediaType: blob.MediaType, Size: blob.Size, Cached: cached})
+	}
+	return node, nil
+}
+
+func (g *GraphBuilder) fetch(ctx context.Context, graph *ImageGraph, ref string) (manifest, GraphNode, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.upstreamURL(graph.Registry, graph.Repository, "manifests", ref), nil)
+	if err != nil {
+		return manifest{}, GraphNode{}, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+
+	resp, err := g.transport.RoundTrip(req)
+	if err != nil {
+		return manifest{}, GraphNode{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return manifest{}, GraphNode{}, fmt.Errorf("fetching manifest %s: upstream returned %s", ref, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return manifest{}, GraphNode{}, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifest{}, GraphNode{}, fmt.Errorf("decoding manifest %s: %w", ref, err)
+	}
+	node := GraphNode{Digest: resp.Header.Get("Docker-Content-Digest"), MediaType: m.MediaType, Size: int64(len(data))}
+	if node.Digest == "" {
+		sum := sha256.Sum256(data)
+		node.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if node.MediaType == "" {
+		node.MediaType = resp.Header.Get("Content-Type")
+	}
+	return m, node, nil
+}
+
+// upstreamURL returns the URL of a manifest or blob as the pipeline expects it.
+func (g *GraphBuilder) upstreamURL(registry, repository, kind, ref string) string {
+	settings := g.cfg.Current().GetRegistrySettings(registry)
+	scheme := "https"
+	if settings.Insecure != nil && *settings.Insecure {
+		scheme = "http"
+	}
+	u := &url.URL{Scheme: scheme, Host: registry, Path: "/v2/" + repository + "/" + kind + "/" + ref}
+	return u.String()
+}
+
+// Check builds the graph of image and lists the blobs that are not cached.
+// Platforms such as linux/amd64 select the manifests of an index to consider;
+// all are considered when none are given. Attestation manifests, whose platform
+// is unknown/unknown, are never pulled by clients and are skipped.
+func (g *GraphBuilder) Check(ctx context.Context, image string, platforms []string) CacheCheck {
+	check := CacheCheck{Image: image}
+	graph, err := g.Build(ctx, image)
+	if err == nil {
+		check.Missing, err = missingBlobs(graph, platforms)
+	}
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Cached = len(check.Missing) == 0
+	return check
+}
+
+// missingBlobs lists the uncached blobs of graph for platforms, as Check
+// selects them.
+func missingBlobs(graph *ImageGraph, platforms []string) ([]string, error) {
+	var missing []string
+	var walk func(node GraphNode) bool
+	walk = func(node GraphNode) bool {
+		if !slices.Contains(manifestMediaTypes, node.MediaType) {
+			if !node.Cached {
+				missing = append(missing, node.Digest)
+			}
+			return true
+		}
+		if node.Platform == "unknown/unknown" || node.Platform != "" && !matchesPlatform(node.Platform, platforms) {
+			return false
+		}
+		selected := len(node.Children) == 0
+		for _, child := range node.Children {
+			if walk(child) {
+				selected = true
+			}
+		}
+		return selected
+	}
+	if !walk(graph.Root) {
+		return nil, fmt.Errorf("no manifest for platforms %s", strings.Join(platforms, ", "))
+	}
+	return missing, nil
+}
+
+func matchesPlatform(platform string, platforms []string) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	for _, p := range platforms {
+		if platform == p || strings.HasPrefix(platform, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitImageReference splits an image reference into its name and tag or
+// digest, defaulting to the latest tag.
+func splitImageReference(image string) (name, ref string) {
+	if name, digest, ok := strings.Cut(image, "@"); ok {
+		return name, digest
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
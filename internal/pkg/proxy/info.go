@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/cache"
+)
+
+func newInfo(cfg *config.Config, pipeline *Pipeline) Info {
+	scheme := "http"
+	if cfg.TLS != nil || cfg.ACME != nil {
+		scheme = "https"
+	}
+	network, addr := cfg.Listen()
+	info := Info{
+		Listeners:   []string{fmt.Sprintf("%s://%s (%s)", scheme, addr, network)},
+		Middlewares: pipeline.Names(),
+		Features: map[string]bool{
+			"whitelist_mode":    cfg.WhitelistMode,
+			"client_auth":       cfg.Auth.Username != "" && cfg.Auth.Password != "" || cfg.Auth.HtpasswdFile != "" || cfg.Auth.OIDC != nil,
+			"oidc":              cfg.Auth.OIDC != nil,
+			"tls":               cfg.TLS != nil || cfg.ACME != nil,
+			"client_certs":      cfg.TLS != nil && cfg.TLS.ClientCAFile != "",
+			"acme":              cfg.ACME != nil,
+			"proxy_protocol":    cfg.ProxyProtocol != nil,
+			"shadow":            cfg.Shadow != nil,
+			"redis_store":       cfg.Store.Backend == "redis",
+			"cache_index":       cfg.Store.CacheIndex,
+			"credential_checks": cfg.CredentialCheckInterval > 0,
+			"metadata_db":       cfg.MetadataDB != "",
+		},
+		Registries: make(map[string]RegistryInfo),
+	}
+
+	hosts := []string{cfg.DefaultRegistry}
+	for host := range cfg.Registries {
+		hosts = append(hosts, host)
+	}
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		settings := cfg.GetRegistrySettings(host)
+		ri := RegistryInfo{
+			Auth:         maskAuth(settings.Auth),
+			CacheBackend: settings.CacheBackend,
+			CacheDir:     settings.CacheDir,
+			CacheMaxSize: settings.CacheMaxSize.Bytes(),
+			Chaos:        settings.Chaos != nil,
+			Signatures:   len(settings.Signatures),
+		}
+		if settings.Auth.Type != "" {
+			ri.Auth = settings.Auth.Type
+		} else if ri.Auth == "" && settings.CredentialHelper != "" {
+			ri.Auth = "credential_helper " + settings.CredentialHelper
+		} else if ri.Auth == "" && settings.DockerConfig != "" {
+			ri.Auth = "docker_config " + settings.DockerConfig
+		}
+		if ri.CacheBackend == "" {
+			ri.CacheBackend = "fs"
+		}
+		if ri.CacheBackend == "s3" {
+			ri.CacheDir = "s3://" + path.Join(settings.S3.Bucket, settings.S3.Prefix)
+		} else if free, ok := cache.FreeSpace(settings.CacheDir); ok && settings.CacheDir != "" {
+			ri.FreeBytes = &free
+			ri.MinFreeDisk = settings.CacheMinFreeDisk.Bytes()
+		}
+		info.Registries[host] = ri
+	}
+	return info
+}
+
+func maskAuth(auth config.Auth) string {
+	if auth.Username == "" {
+		return ""
+	}
+	if auth.Password == "" {
+		return auth.Username
+	}
+	return auth.Username + ":****"
+}
+
+// logStartupReport logs the effective configuration, one line per registry.
+func logStartupReport(info Info) {
+	var features []string
+	for name, enabled := range info.Features {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	slices.Sort(features)
+	logging.Logger.Info("Effective configuration", "listeners", info.Listeners, "middlewares", info.Middlewares, "features", features)
+	for host, ri := range info.Registries {
+		args := []any{"registry", host, "cache_backend", ri.CacheBackend}
+		if ri.Auth != "" {
+			args = append(args, "auth", ri.Auth)
+		}
+		if ri.CacheDir != "" {
+			args = append(args, "cache_dir", ri.CacheDir)
+		}
+		if ri.CacheMaxSize > 0 {
+			args = append(args, "cache_max_size", ri.CacheMaxSize)
+		}
+		if ri.FreeBytes != nil {
+			args = append(args, "free_bytes", *ri.FreeBytes)
+		}
+		logging.Logger.Info("Registry", args...)
+		if ri.Chaos {
+			logging.Logger.Warn("chaos testing is injecting upstream failures", "registry", host)
+		}
+	}
+}
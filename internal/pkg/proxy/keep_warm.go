@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// KeepWarm periodically pings registries with keep_warm set, so their pooled
+// connections stay established and the next pull skips DNS, TCP and TLS setup.
+type KeepWarm struct {
+	cfg      *config.Provider
+	executor *Executor
+}
+
+func NewKeepWarm(cfg *config.Provider, executor *Executor) *KeepWarm {
+	return &KeepWarm{cfg: cfg, executor: executor}
+}
+
+func (k *KeepWarm) Run(stop <-chan struct{}) {
+	for {
+		k.pingAll()
+		select {
+		case <-time.After(k.cfg.Current().KeepWarmInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (k *KeepWarm) pingAll() {
+	cfg := k.cfg.Current()
+	hosts := map[string]config.RegistrySettings{cfg.DefaultRegistry: cfg.GetRegistrySettings(cfg.DefaultRegistry)}
+	for host, settings := range cfg.Registries {
+		if !config.IsRegistryPattern(host) {
+			hosts[host] = settings
+		}
+	}
+
+	var wg sync.WaitGroup
+	for host, settings := range hosts {
+		if host == "" || settings.KeepWarm <= 0 || settings.IsOffline() {
+			continue
+		}
+		scheme := "https"
+		if settings.Insecure != nil && *settings.Insecure {
+			scheme = "http"
+		}
+		for range settings.KeepWarm {
+			wg.Go(func() { k.ping(scheme + "://" + host + "/v2/") })
+		}
+	}
+	wg.Wait()
+}
+
+func (k *KeepWarm) ping(url string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := k.executor.Execute(req)
+	if err != nil {
+		logging.Logger.Debug("keep-warm ping failed", "url", url, "error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
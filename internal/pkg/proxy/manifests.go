@@ -0,0 +1,446 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+// manifestsBucket maps registry/repository:tag and registry/repository@digest
+// keys to the manifests stored in the cache. Digests are recorded per
+// repository, so a manifest is only served from the cache for repositories it
+// was pulled from.
+const manifestsBucket = "manifests"
+
+// StoredManifest identifies a manifest kept in a registry's cache. Platform
+// manifests only known from a stored index have no body in the cache.
+type StoredManifest struct {
+	Digest    string
+	MediaType string
+	Size      int64     `json:",omitempty"`
+	Index     bool      `json:",omitempty"`
+	Stored    time.Time `json:",omitempty"`
+}
+
+// manifestMiddleware runs last in the pipeline and keeps manifests in the
+// registry's cache next to blobs, recording their tag, media type and, for
+// indexes, their per-platform children in the metadata DB.
+//   - Registries with manifest_ttl or manifest_list_ttl answer manifests from
+//     the cache: by digest whenever cached, as digests are immutable, and by tag
+//     while the tag's platform manifest or index is younger than its TTL. HEADs
+//     of platform manifests listed in a cached index are answered from the
+//     index without fetching the manifest.
+//   - Offline registries never call the upstream, answering manifests and
+//     referrers lists from the cache regardless of age and everything the
+//     cache middleware could not serve with a 404 registry error.
+//   - Referrers lists are answered as described in referrers.
+//   - Manifests served to clients must be admitted by the policy engine, and
+//     platform manifests pulled are checked against their scan verdicts as
+//     described in Scanner.
+type manifestMiddleware struct {
+	cfg          *config.Provider
+	cacheManager *CacheManager
+	db           *metadb.DB
+	scanner      *Scanner
+	policy       *policyEngine
+	webhooks     *webhooks
+}
+
+func newManifestMiddleware(cfg *config.Provider, cacheManager *CacheManager, db *metadb.DB, scanner *Scanner, policy *policyEngine, webhooks *webhooks) *manifestMiddleware {
+	return &manifestMiddleware{cfg: cfg, cacheManager: cacheManager, db: db, scanner: scanner, policy: policy, webhooks: webhooks}
+}
+
+func (m *manifestMiddleware) Name() string {
+	return "manifests"
+}
+
+func (m *manifestMiddleware) Process(req *http.Request, next middleware.Handler) (*http.Response, error) {
+	resp, err := m.process(req, next)
+	if err != nil || req.Method != http.MethodGet && req.Method != http.MethodHead || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	registry := req.URL.Host
+	repo, kind, ref := splitEndpoint(req.URL.Path)
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if kind != "manifests" || digest == "" {
+		return resp, nil
+	}
+	mediaType := resp.Header.Get("Content-Type")
+
+	// Pipeline requests of the proxy itself, such as signature fetches and
+	// preloads, are not subject to artifact type rules or the policy.
+	entry, client := req.Context().Value(accessKey{}).(*accessEntry)
+	client = client && req.Context().Value(signatureFetchKey{}) == nil
+	if settings := m.cfg.Current().GetRegistrySettings(registry); client && req.Method == http.MethodGet && settings.RestrictsArtifactTypes() {
+		if artifactType, err := readArtifactType(resp); err != nil {
+			return nil, err
+		} else if artifactType != "" && !settings.AllowsArtifactType(artifactType) {
+			resp.Body.Close()
+			logging.Logger.WarnContext(req.Context(), "rejected artifact type", "registry", registry, "repository", repo, "reference", ref, "artifact_type", artifactType)
+			m.webhooks.send(WebhookEvent{Event: "policy.denied", Registry: registry, Repository: repo, Reference: ref, Digest: digest, User: entry.user, ClientIP: entry.client, Reason: "artifact type " + artifactType + " is not allowed"})
+			body, _ := json.Marshal(map[string]any{
+				"errors": []map[string]string{{"code": "DENIED", "message": fmt.Sprintf("artifact type %s of %s/%s:%s is not allowed by proxy policy", artifactType, registry, repo, ref)}},
+			})
+			return localResponse(req, http.StatusForbidden, "application/json", body), nil
+		}
+	}
+	if client {
+		input := policyInput{Method: req.Method, Registry: registry, Repository: repo, Digest: digest, MediaType: mediaType, User: entry.user, ClientIP: entry.client}
+		if !strings.Contains(ref, ":") {
+			input.Tag = ref
+		}
+		reason, err := m.policy.admit(req.Context(), input)
+		if err != nil {
+			resp.Body.Close()
+			logging.Logger.WarnContext(req.Context(), "policy evaluation failed", "registry", registry, "repository", repo, "reference", ref, "error", err)
+			body, _ := json.Marshal(map[string]any{
+				"errors": []map[string]string{{"code": "UNAVAILABLE", "message": "policy evaluation failed, retry later"}},
+			})
+			return localResponse(req, http.StatusServiceUnavailable, "application/json", body), nil
+		}
+		if reason != "" {
+			resp.Body.Close()
+			logging.Logger.WarnContext(req.Context(), "rejected manifest by policy", "registry", registry, "repository", repo, "reference", ref, "digest", digest, "reason", reason)
+			m.webhooks.send(WebhookEvent{Event: "policy.denied", Registry: registry, Repository: repo, Reference: ref, Digest: digest, User: entry.user, ClientIP: entry.client, Reason: reason})
+			body, _ := json.Marshal(map[string]any{
+				"errors": []map[string]string{{"code": "DENIED", "message": fmt.Sprintf("manifest %s of %s/%s is not allowed by policy: %s", ref, registry, repo, reason)}},
+			})
+			return localResponse(req, http.StatusForbidden, "application/json", body), nil
+		}
+	}
+
+	if req.Method != http.MethodGet || !slices.Contains(scannedMediaTypes, mediaType) {
+		return resp, nil
+	}
+	if found := m.scanner.check(registry, repo, digest); found != "" {
+		resp.Body.Close()
+		logging.Logger.WarnContext(req.Context(), "rejected vulnerable image", "registry", registry, "repository", repo, "digest", digest, "vulnerabilities", found)
+		body, _ := json.Marshal(map[string]any{
+			"errors": []map[string]string{{"code": "DENIED", "message": fmt.Sprintf("image %s of %s/%s has vulnerabilities at or above %s: %s", digest, registry, repo, m.cfg.Current().Scan.BlockSeverity, found)}},
+		})
+		return localResponse(req, http.StatusForbidden, "application/json", body), nil
+	}
+	return resp, nil
+}
+
+func (m *manifestMiddleware) process(req *http.Request, next middleware.Handler) (*http.Response, error) {
+	registry := req.URL.Host
+	repo, kind, ref := splitEndpoint(req.URL.Path)
+	settings := m.cfg.Current().GetRegistrySettings(registry)
+	if settings.IsOffline() {
+		return m.serveOffline(req, registry, repo, kind, ref), nil
+	}
+
+	if kind == "manifests" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		if resp, ok := m.serveCached(req, settings, registry, repo, ref); ok {
+			middleware.SetCacheStatus(req, "hit")
+			return resp, nil
+		}
+	}
+	if kind == "referrers" && req.Method == http.MethodGet {
+		return m.referrers(req, settings, registry, repo, ref, next)
+	}
+	stored, revalidate := m.revalidation(req, registry, repo, kind, ref)
+	upstreamReq := req
+	if revalidate {
+		upstreamReq = req.Clone(req.Context())
+		upstreamReq.Header.Set("If-None-Match", `"`+stored.Digest+`"`)
+	}
+	resp, err := next(upstreamReq)
+	if err == nil && revalidate {
+		resp.Request = req
+		if resp.StatusCode == http.StatusNotModified {
+			if data, ok := m.readManifest(registry, stored); ok {
+				resp.Body.Close()
+				logging.Logger.DebugContext(req.Context(), "manifest not modified upstream, serving from cache", "registry", registry, "reference", ref, "digest", stored.Digest)
+				stored.Stored = time.Now()
+				if err := m.db.Put(manifestsBucket, registry+"/"+repo+":"+ref, stored); err != nil {
+					logging.Logger.WarnContext(req.Context(), "failed to record manifest", "reference", ref, "error", err)
+				}
+				middleware.SetCacheStatus(req, "hit")
+				return manifestResponse(req, stored, data), nil
+			}
+			resp.Body.Close()
+			resp, err = next(req)
+		}
+	}
+	if err != nil || req.Method != http.MethodGet || kind != "manifests" || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	return m.store(req, resp, registry, repo, ref), nil
+}
+
+// readArtifactType returns the artifactType of a manifest response, or else
+// its config media type, leaving the body to be read again.
+func readArtifactType(resp *http.Response) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		resp.Body.Close()
+		return "", err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	var parsed struct {
+		ArtifactType string      `json:"artifactType"`
+		Config       *descriptor `json:"config"`
+	}
+	json.Unmarshal(data, &parsed)
+	if parsed.ArtifactType == "" && parsed.Config != nil {
+		return parsed.Config.MediaType, nil
+	}
+	return parsed.ArtifactType, nil
+}
+
+// revalidation returns the stored manifest of a tag to revalidate upstream
+// with If-None-Match, so an unchanged manifest is answered with a 304
+// instead of downloaded again. Requests with their own conditions are
+// forwarded as they are.
+func (m *manifestMiddleware) revalidation(req *http.Request, registry, repo, kind, ref string) (StoredManifest, bool) {
+	if kind != "manifests" || req.Method != http.MethodGet || strings.Contains(ref, ":") || req.Header.Get("If-None-Match") != "" || !m.cacheManager.GetCache(registry).Enabled() {
+		return StoredManifest{}, false
+	}
+	stored, ok := m.lookup(registry, repo, ref)
+	if !ok || stored.Size == 0 || !acceptsMediaType(req, stored.MediaType) {
+		return StoredManifest{}, false
+	}
+	return stored, true
+}
+
+// splitEndpoint splits an upstream path into repository, endpoint keyword and
+// reference, such as org/app, manifests and v1.
+func splitEndpoint(upstreamPath string) (repo, kind, ref string) {
+	parts := strings.Split(strings.Trim(upstreamPath, "/"), "/")
+	if i := endpointIndex(parts); i >= 2 && i == len(parts)-2 {
+		return strings.Join(parts[1:i], "/"), parts[i], parts[i+1]
+	}
+	return "", "", ""
+}
+
+// store reads a manifest response, caches it by digest and records its tag
+// and media type. Manifests over maxManifestSize are passed through unstored.
+func (m *manifestMiddleware) store(req *http.Request, resp *http.Response, registry, repo, ref string) *http.Response {
+	c := m.cacheManager.GetCache(registry)
+	if !c.Enabled() {
+		return resp
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil || len(data) > maxManifestSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" && header != digest {
+		return resp
+	}
+	var parsed manifest
+	json.Unmarshal(data, &parsed)
+	now := time.Now()
+	stored := StoredManifest{
+		Digest:    digest,
+		MediaType: resp.Header.Get("Content-Type"),
+		Size:      int64(len(data)),
+		Index:     len(parsed.Manifests) > 0,
+		Stored:    now,
+	}
+
+	go func() {
+		if !c.Contains(digest) {
+			if err := c.Put(digest, bytes.NewReader(data), digest); err != nil {
+				logging.Logger.WarnContext(req.Context(), "failed to cache manifest", "digest", digest, "error", err)
+				return
+			}
+		}
+		records := map[string]StoredManifest{registry + "/" + repo + "@" + digest: stored}
+		if !strings.Contains(ref, ":") {
+			records[registry+"/"+repo+":"+ref] = stored
+		}
+		for _, child := range parsed.Manifests {
+			key := registry + "/" + repo + "@" + child.Digest
+			if ok, _ := m.db.Get(manifestsBucket, key, &StoredManifest{}); !ok {
+				records[key] = StoredManifest{Digest: child.Digest, MediaType: child.MediaType, Size: child.Size, Stored: now}
+			}
+		}
+		for key, record := range records {
+			if err := m.db.Put(manifestsBucket, key, record); err != nil {
+				logging.Logger.WarnContext(req.Context(), "failed to record manifest", "key", key, "error", err)
+			}
+		}
+	}()
+	return resp
+}
+
+// lookup returns the stored manifest a tag or digest refers to.
+func (m *manifestMiddleware) lookup(registry, repo, ref string) (StoredManifest, bool) {
+	key := registry + "/" + repo + ":" + ref
+	if strings.Contains(ref, ":") {
+		key = registry + "/" + repo + "@" + ref
+	}
+	var stored StoredManifest
+	ok, _ := m.db.Get(manifestsBucket, key, &stored)
+	return stored, ok
+}
+
+// serveCached answers a manifest request from the cache when the registry
+// caches manifests, the client accepts the stored media type and, for tags,
+// the manifest is younger than its TTL.
+func (m *manifestMiddleware) serveCached(req *http.Request, settings config.RegistrySettings, registry, repo, ref string) (*http.Response, bool) {
+	if settings.ManifestTTL <= 0 && settings.ManifestListTTL <= 0 {
+		return nil, false
+	}
+	stored, ok := m.lookup(registry, repo, ref)
+	if !ok || !acceptsMediaType(req, stored.MediaType) {
+		return nil, false
+	}
+	if !strings.Contains(ref, ":") {
+		ttl := settings.ManifestTTL
+		if stored.Index {
+			ttl = settings.ManifestListTTL
+		}
+		if ttl <= 0 || time.Since(stored.Stored) >= ttl {
+			return nil, false
+		}
+	}
+	if req.Method == http.MethodHead && stored.Size > 0 {
+		logging.Logger.DebugContext(req.Context(), "serving manifest from cache", "registry", registry, "reference", ref, "digest", stored.Digest)
+		return manifestResponse(req, stored, nil), true
+	}
+	data, ok := m.readManifest(registry, stored)
+	if !ok {
+		return nil, false
+	}
+	logging.Logger.DebugContext(req.Context(), "serving manifest from cache", "registry", registry, "reference", ref, "digest", stored.Digest)
+	return manifestResponse(req, stored, data), true
+}
+
+// acceptsMediaType reports whether the request's Accept header lists
+// mediaType, so a cached manifest cannot be served in a format the client did
+// not ask for.
+func acceptsMediaType(req *http.Request, mediaType string) bool {
+	for _, value := range req.Header.Values("Accept") {
+		for _, t := range strings.Split(value, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if t = strings.TrimSpace(t); t == mediaType || t == "*/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *manifestMiddleware) readManifest(registry string, stored StoredManifest) ([]byte, bool) {
+	reader, size, ok := m.cacheManager.GetCache(registry).GetReader(stored.Digest)
+	if !ok {
+		return nil, false
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil || int64(len(data)) != size {
+		return nil, false
+	}
+	return data, true
+}
+
+// manifestResponse answers with a stored manifest, or with 304 Not Modified
+// when the request's If-None-Match names its digest. HEAD responses take
+// their size from the record when data is nil.
+func manifestResponse(req *http.Request, stored StoredManifest, data []byte) *http.Response {
+	resp := localResponse(req, http.StatusOK, stored.MediaType, data)
+	if data == nil {
+		resp.ContentLength = stored.Size
+		resp.Header.Set("Content-Length", strconv.FormatInt(stored.Size, 10))
+	}
+	resp.Header.Set("Docker-Content-Digest", stored.Digest)
+	resp.Header.Set("Docker-Distribution-Api-Version", "registry/2.0")
+	resp.Header.Set("Etag", `"`+stored.Digest+`"`)
+	if matchesETag(req, stored.Digest) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+// matchesETag reports whether the request's If-None-Match lists digest or *.
+func matchesETag(req *http.Request, digest string) bool {
+	for _, value := range req.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+			if tag == digest || tag == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *manifestMiddleware) serveOffline(req *http.Request, registry, repo, kind, ref string) *http.Response {
+	if req.URL.Path == "/v2/" || req.URL.Path == "/v2" {
+		return localResponse(req, http.StatusOK, "application/json", []byte("{}\n"))
+	}
+
+	var code string
+	switch kind {
+	case "manifests":
+		if stored, ok := m.lookup(registry, repo, ref); ok {
+			if data, ok := m.readManifest(registry, stored); ok {
+				middleware.SetCacheStatus(req, "hit")
+				return manifestResponse(req, stored, data)
+			}
+		}
+		code = "MANIFEST_UNKNOWN"
+	case "referrers":
+		var stored storedReferrers
+		if ok, _ := m.db.Get(referrersBucket, registry+"/"+repo+"@"+ref+"?"+req.URL.RawQuery, &stored); ok {
+			middleware.SetCacheStatus(req, "hit")
+			return stored.response(req)
+		}
+		code = "MANIFEST_UNKNOWN"
+	case "blobs":
+		code = "BLOB_UNKNOWN"
+	default:
+		code = "UNSUPPORTED"
+	}
+	logging.Logger.DebugContext(req.Context(), "not available offline", "registry", registry, "path", req.URL.Path)
+	body, _ := json.Marshal(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": fmt.Sprintf("%s is not available: registry %s is offline and it is not cached", req.URL.Path, registry)}},
+	})
+	return localResponse(req, http.StatusNotFound, "application/json", body)
+}
+
+func localResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	resp := &http.Response{
+		StatusCode:    status,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp
+}
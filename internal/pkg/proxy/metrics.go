@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsTopImages bounds the images exported as series, by pulls, to keep
+// the cardinality of /_/metrics in check.
+const metricsTopImages = 100
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample of name with labels given as name, value pairs.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		if i+2 >= len(labels) {
+			b.WriteByte('}')
+		}
+	}
+	fmt.Fprintf(m.w, "%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// histogram writes the cumulative buckets, sum and count, in seconds, of h.
+func (m metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	var cumulative int64
+	for i, bound := range latencyBuckets {
+		cumulative += h.buckets[i].Load()
+		m.sample(name+"_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	count := h.count.Load()
+	m.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", time.Duration(h.sum.Load()).Seconds(), labels...)
+	m.sample(name+"_count", float64(count), labels...)
+}
+
+// splitImage splits a pull stats image name into registry, repository and tag
+// or digest.
+func splitImage(name string) (registry, repository, reference string) {
+	registry, repository, _ = strings.Cut(name, "/")
+	if i := strings.Index(repository, "@"); i >= 0 {
+		return registry, repository[:i], repository[i+1:]
+	}
+	if i := strings.LastIndex(repository, ":"); i >= 0 {
+		return registry, repository[:i], repository[i+1:]
+	}
+	return registry, repository, ""
+}
+
+// serveMetrics answers /_/metrics with the requests, status codes and
+// latencies of each upstream and the pull counters of every repository and of
+// the most pulled images.
+func serveMetrics(executor *Executor, pullStats *PullStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m := metricsWriter{w}
+
+		type upstream struct {
+			registry, target string
+			counters         *upstreamCounters
+		}
+		var upstreams []upstream
+		executor.stats.mu.RLock()
+		for registry, targets := range executor.stats.counters {
+			for target, c := range targets {
+				upstreams = append(upstreams, upstream{registry, target, c})
+			}
+		}
+		executor.stats.mu.RUnlock()
+		slices.SortFunc(upstreams, func(a, b upstream) int {
+			return cmp.Or(cmp.Compare(a.registry, b.registry), cmp.Compare(a.target, b.target))
+		})
+		m.family("oci_proxy_upstream_requests_total", "counter", "Upstream requests by status code, or \"error\" for transport errors.")
+		for _, u := range upstreams {
+			u.counters.mu.Lock()
+			codes := slices.Sorted(maps.Keys(u.counters.statuses))
+			for _, code := range codes {
+				m.sample("oci_proxy_upstream_requests_total", float64(u.counters.statuses[code]), "registry", u.registry, "upstream", u.target, "code", code)
+			}
+			u.counters.mu.Unlock()
+		}
+		m.family("oci_proxy_upstream_first_byte_seconds", "histogram", "Time from sending an upstream request to its response headers.")
+		for _, u := range upstreams {
+			m.histogram("oci_proxy_upstream_first_byte_seconds", &u.counters.firstByte, "registry", u.registry, "upstream", u.target)
+		}
+		m.family("oci_proxy_upstream_transfer_seconds", "histogram", "Time from sending an upstream request until its response body was read or closed.")
+		for _, u := range upstreams {
+			m.histogram("oci_proxy_upstream_transfer_seconds", &u.counters.transfer, "registry", u.registry, "upstream", u.target)
+		}
+
+		repositories := pullStats.Top(false, "", "pulls", 0)
+		images := pullStats.Top(true, "", "pulls", metricsTopImages)
+		for _, family := range []struct {
+			name, help string
+			value      func(RepositoryStats) int64
+		}{
+			{"pulls_total", "Pulls, counted as manifest GETs for repositories and pull sessions for images.", func(s RepositoryStats) int64 { return s.Pulls }},
+			{"bytes_total", "Bytes served to pull sessions.", func(s RepositoryStats) int64 { return s.Bytes }},
+			{"cached_bytes_total", "Bytes served to pull sessions from the cache.", func(s RepositoryStats) int64 { return s.CachedBytes }},
+		} {
+			m.family("oci_proxy_repository_"+family.name, "counter", family.help)
+			for _, repo := range repositories {
+				registry, repository, _ := strings.Cut(repo.Name, "/")
+				m.sample("oci_proxy_repository_"+family.name, float64(family.value(repo.RepositoryStats)), "registry", registry, "repository", repository)
+			}
+			m.family("oci_proxy_image_"+family.name, "counter", family.help)
+			for _, image := range images {
+				registry, repository, reference := splitImage(image.Name)
+				m.sample("oci_proxy_image_"+family.name, float64(family.value(image.RepositoryStats)), "registry", registry, "repository", repository, "reference", reference)
+			}
+		}
+	}
+}
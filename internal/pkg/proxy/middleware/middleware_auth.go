@@ -1,57 +1,154 @@
 package middleware
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/kv"
 	"oci-proxy/internal/pkg/logging"
 )
 
 type Handler func(*http.Request) (*http.Response, error)
 
-type cachedToken struct {
-	token     string
-	expiresAt time.Time
-}
+// tokenTimeout bounds a request to an upstream token service.
+const tokenTimeout = 30 * time.Second
 
 type AuthMiddleware struct {
-	cfg        *config.Config
-	tokenCache sync.Map
+	cfg       *config.Provider
+	tokens    kv.Store
+	transport func(host string) http.RoundTripper
 }
 
-func NewAuthMiddleware(cfg *config.Config) *AuthMiddleware {
-	return &AuthMiddleware{cfg: cfg}
+// NewAuthMiddleware caches upstream tokens in store. Process-local stores are
+// cleared on reload; shared stores rely on token expiry.
+func NewAuthMiddleware(cfg *config.Provider, store kv.Store) *AuthMiddleware {
+	m := &AuthMiddleware{cfg: cfg, tokens: store}
+	if local, ok := store.(*kv.MemoryStore); ok {
+		cfg.OnReload(func(_, _ *config.Config) { local.Clear() })
+	}
+	return m
+}
+
+// SetTransport makes token requests for an upstream host use the transport
+// returned for it, so the host's TLS and proxy settings apply to its token
+// service too.
+func (m *AuthMiddleware) SetTransport(transport func(host string) http.RoundTripper) {
+	m.transport = transport
 }
 
 func (m *AuthMiddleware) Name() string {
 	return "auth"
 }
 
+type userKey struct{}
+
+// WithUser returns a context in which the auth middleware uses the upstream
+// credentials of the tenant of user, the authenticated client.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+type clientAuthKey struct{}
+
+// WithClientAuth returns a context carrying the client's own credentials,
+// which registries in passthrough mode use upstream.
+func WithClientAuth(ctx context.Context, auth config.Auth) context.Context {
+	return context.WithValue(ctx, clientAuthKey{}, auth)
+}
+
+// credentialIdentity names the credentials of auth in token and tag cache
+// keys, so what was obtained with one tenant's or client's credentials is
+// never used for another's requests. Passwords are hashed to keep them out of shared stores.
+func credentialIdentity(auth config.Auth) string {
+	if auth.Username == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(auth.Username + ":" + auth.Password))
+	return auth.Username + "@" + hex.EncodeToString(sum[:6])
+}
+
+// upstreamAuth returns the credentials req is sent upstream with: the
+// client's own in passthrough mode, otherwise those of the registry or of the
+// client's tenant.
+func upstreamAuth(cfg *config.Config, settings config.RegistrySettings, req *http.Request) (config.Auth, error) {
+	if settings.Passthrough() {
+		auth, _ := req.Context().Value(clientAuthKey{}).(config.Auth)
+		return auth, nil
+	}
+	auth, err := cfg.UpstreamAuth(req.URL.Host, settings, userFrom(req.Context()))
+	if err != nil {
+		return config.Auth{}, fmt.Errorf("failed to get upstream credentials for %s: %w", req.URL.Host, err)
+	}
+	return auth, nil
+}
+
 func (m *AuthMiddleware) Process(req *http.Request, next Handler) (*http.Response, error) {
-	req = m.applyAuth(req)
+	cfg := m.cfg.Current()
+	settings := cfg.GetRegistrySettings(req.URL.Host)
+	auth, err := upstreamAuth(cfg, settings, req)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Username == "" && settings.AnonymousForbidden() {
+		logging.Logger.DebugContext(req.Context(), "rejecting request without upstream credentials", "registry", req.URL.Host)
+		return anonymousForbidden(req), nil
+	}
+	req = m.applyAuth(req, auth)
 	resp, err := next(req)
 	if err != nil {
 		return nil, err
 	}
-	return m.handleAuthChallenge(req, resp, next)
+	return m.handleAuthChallenge(req, resp, next, auth)
 }
 
-func (m *AuthMiddleware) applyAuth(req *http.Request) *http.Request {
-	settings := m.cfg.GetRegistrySettings(req.URL.Host)
-	if settings.Auth.Username != "" {
+// Mirror sends req, a pull redirected to one of a registry's mirrors or to
+// its canary, with that host's own credentials instead of the registry's.
+// Their tokens are cached under that host.
+func (m *AuthMiddleware) Mirror(req *http.Request, next Handler) (*http.Response, error) {
+	auth, err := m.cfg.Current().MirrorAuth(req.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials for mirror %s: %w", req.URL.Host, err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	req = m.applyAuth(req, auth)
+	resp, err := next(req)
+	if err != nil {
+		return nil, err
+	}
+	return m.handleAuthChallenge(req, resp, next, auth)
+}
+
+func (m *AuthMiddleware) applyAuth(req *http.Request, auth config.Auth) *http.Request {
+	if newReq, ok := m.tryApplyCachedToken(req, credentialIdentity(auth)); ok {
+		return newReq
+	}
+	if auth.Username != "" {
 		newReq := req.Clone(req.Context())
-		settings.Auth.ApplyToRequest(newReq)
+		auth.ApplyToRequest(newReq)
 		return newReq
 	}
-	return m.tryApplyCachedToken(req)
+	return req
 }
 
-func (m *AuthMiddleware) handleAuthChallenge(req *http.Request, resp *http.Response, next Handler) (*http.Response, error) {
+// handleAuthChallenge answers a bearer challenge with a token from the
+// upstream's token service, fetched with auth's credentials when it has any
+// and anonymously otherwise, and retries the request with it.
+func (m *AuthMiddleware) handleAuthChallenge(req *http.Request, resp *http.Response, next Handler, auth config.Auth) (*http.Response, error) {
 	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
 		return resp, nil
 	}
@@ -61,82 +158,159 @@ func (m *AuthMiddleware) handleAuthChallenge(req *http.Request, resp *http.Respo
 		return resp, nil
 	}
 
-	logging.Logger.Debug("attempting anonymous authentication", "status", resp.StatusCode, "registry", req.URL.Host)
-	retryResp, err := m.fetchTokenAndRetry(req, resp, next)
+	kind := "anonymous"
+	if auth.Username != "" {
+		kind = "token"
+	}
+	logging.Logger.DebugContext(req.Context(), "attempting "+kind+" authentication", "status", resp.StatusCode, "registry", req.URL.Host)
+	retryResp, err := m.fetchTokenAndRetry(req, resp, next, auth)
 	if err != nil {
-		logging.Logger.Error("anonymous authentication failed", "error", err, "registry", req.URL.Host)
+		logging.Logger.ErrorContext(req.Context(), kind+" authentication failed", "error", err, "registry", req.URL.Host)
 		return resp, nil
 	}
 	return retryResp, nil
 }
 
-func (m *AuthMiddleware) tryApplyCachedToken(req *http.Request) *http.Request {
+func tokenKey(registry, identity, scope string) string {
+	return fmt.Sprintf("token/%s/%s::%s", registry, identity, scope)
+}
+
+func (m *AuthMiddleware) tryApplyCachedToken(req *http.Request, identity string) (*http.Request, bool) {
 	scope := getScopeFromRequest(req)
 	if scope == "" {
-		return req
+		return req, false
 	}
 
-	cacheKey := fmt.Sprintf("%s::%s", req.URL.Host, scope)
-	val, ok := m.tokenCache.Load(cacheKey)
-	if !ok {
-		return req
+	cacheKey := tokenKey(req.URL.Host, identity, scope)
+	token, ok, err := m.tokens.Get(cacheKey)
+	if err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to read cached token", "key", cacheKey, "error", err)
 	}
-
-	cached := val.(cachedToken)
-	if time.Now().After(cached.expiresAt) {
-		m.tokenCache.Delete(cacheKey)
-		return req
+	if !ok {
+		return req, false
 	}
 
-	logging.Logger.Debug("using cached token", "key", cacheKey)
+	logging.Logger.DebugContext(req.Context(), "using cached token", "key", cacheKey)
 	newReq := req.Clone(req.Context())
-	newReq.Header.Set("Authorization", "Bearer "+cached.token)
-	return newReq
+	newReq.Header.Set("Authorization", "Bearer "+string(token))
+	return newReq, true
 }
 
-func (m *AuthMiddleware) fetchTokenAndRetry(req *http.Request, origResp *http.Response, next Handler) (*http.Response, error) {
+// anonymousForbidden answers requests that have no upstream credentials for a
+// registry with forbid_anonymous.
+func anonymousForbidden(req *http.Request) *http.Response {
+	body := fmt.Sprintf(`{"errors":[{"code":"UNAUTHORIZED","message":"registry %s forbids anonymous access and no upstream credentials are configured for this client"}]}`, req.URL.Host)
+	resp := &http.Response{
+		StatusCode:    http.StatusUnauthorized,
+		Status:        fmt.Sprintf("%d %s", http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)),
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	return resp
+}
+
+func (m *AuthMiddleware) fetchTokenAndRetry(req *http.Request, origResp *http.Response, next Handler, auth config.Auth) (*http.Response, error) {
 	authHeader := origResp.Header.Get("Www-Authenticate")
-	params := parseAuthHeader(authHeader)
+	params := ParseAuthHeader(authHeader)
 
 	realm, ok := params["realm"]
 	if !ok {
 		return nil, fmt.Errorf("missing realm in Www-Authenticate header")
 	}
 
-	token, expiresIn, err := m.getAnonymousToken(realm, params["service"], params["scope"])
+	client := &http.Client{Timeout: tokenTimeout}
+	if m.transport != nil {
+		client.Transport = m.transport(req.URL.Host)
+	}
+	token, expiresIn, err := getToken(req.Context(), client, realm, params["service"], params["scope"], auth)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get anonymous token: %w", err)
+		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
 
 	if expiresIn == 0 {
 		expiresIn = 60
 	}
-	cacheKey := fmt.Sprintf("%s::%s", req.URL.Host, params["scope"])
-	expiresAt := time.Now().Add(time.Duration(expiresIn) * time.Second)
-	m.tokenCache.Store(cacheKey, cachedToken{token: token, expiresAt: expiresAt})
-	logging.Logger.Debug("stored token in cache", "key", cacheKey, "expires_in", expiresIn)
+	cacheKey := tokenKey(req.URL.Host, credentialIdentity(auth), params["scope"])
+	if err := m.tokens.Set(cacheKey, []byte(token), time.Duration(expiresIn)*time.Second); err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to cache token", "key", cacheKey, "error", err)
+	} else {
+		logging.Logger.DebugContext(req.Context(), "stored token in cache", "key", cacheKey, "expires_in", expiresIn)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, fmt.Errorf("cannot replay request body after authentication")
+	}
 
 	origResp.Body.Close()
 	retryReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
 	retryReq.Header.Set("Authorization", "Bearer "+token)
 	return next(retryReq)
 }
 
-func (m *AuthMiddleware) getAnonymousToken(realm, service, scope string) (string, int, error) {
-	authURL := fmt.Sprintf("%s?service=%s", realm, service)
+// getToken fetches a bearer token for scope from the token service at realm.
+// With credentials it authenticates with basic auth, as Docker Hub, GHCR and
+// Harbor expect, and falls back to the OAuth2 password grant (a form POST) for
+// token services that do not support GET; without credentials it asks for an
+// anonymous token.
+func getToken(ctx context.Context, client *http.Client, realm, service, scope string, auth config.Auth) (string, int, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", 0, err
+	}
+	query := u.Query()
+	query.Set("service", service)
 	if scope != "" {
-		authURL += "&scope=" + scope
+		query.Set("scope", scope)
 	}
-
-	logging.Logger.Debug("fetching anonymous token", "url", authURL)
-	resp, err := http.Get(authURL)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return "", 0, err
 	}
+	auth.ApplyToRequest(req)
+
+	logging.Logger.DebugContext(ctx, "fetching token", "url", req.URL.String(), "user", auth.Username)
+	token, expiresIn, status, err := requestToken(client, req)
+	if auth.Username != "" && (status == http.StatusNotFound || status == http.StatusMethodNotAllowed) {
+		form := url.Values{
+			"grant_type": {"password"},
+			"username":   {auth.Username},
+			"password":   {auth.Password},
+			"service":    {service},
+			"client_id":  {"oci-proxy"},
+		}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(form.Encode())); err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		logging.Logger.DebugContext(ctx, "fetching token with OAuth2 password grant", "url", realm, "user", auth.Username)
+		token, expiresIn, _, err = requestToken(client, req)
+	}
+	return token, expiresIn, err
+}
+
+// requestToken sends a token request and returns the token with its lifetime
+// in seconds and the response status.
+func requestToken(client *http.Client, req *http.Request) (string, int, int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, 0, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", 0, fmt.Errorf("token request failed with status %s", resp.Status)
+		return "", 0, resp.StatusCode, fmt.Errorf("token request failed with status %s", resp.Status)
 	}
 
 	var tokenResp struct {
@@ -145,40 +319,58 @@ func (m *AuthMiddleware) getAnonymousToken(realm, service, scope string) (string
 		ExpiresIn   int    `json:"expires_in"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", 0, err
+		return "", 0, resp.StatusCode, err
 	}
 
 	if tokenResp.Token != "" {
-		return tokenResp.Token, tokenResp.ExpiresIn, nil
+		return tokenResp.Token, tokenResp.ExpiresIn, resp.StatusCode, nil
 	}
 	if tokenResp.AccessToken != "" {
-		return tokenResp.AccessToken, tokenResp.ExpiresIn, nil
+		return tokenResp.AccessToken, tokenResp.ExpiresIn, resp.StatusCode, nil
 	}
-	return "", 0, fmt.Errorf("token not found in response")
+	return "", 0, resp.StatusCode, fmt.Errorf("token not found in response")
 }
 
 func getScopeFromRequest(req *http.Request) string {
-	path := req.URL.Path
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	if len(parts) >= 3 && parts[0] == "v2" {
-		repo := strings.Join(parts[1:len(parts)-2], "/")
-		lastPart := parts[len(parts)-2]
-		if repo != "" && (lastPart == "manifests" || lastPart == "blobs") {
-			return fmt.Sprintf("repository:%s:pull", repo)
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) == 2 && parts[0] == "v2" && parts[1] == "_catalog" {
+		return "registry:catalog:*"
+	}
+	if len(parts) < 3 || parts[0] != "v2" {
+		return ""
+	}
+	for i := len(parts) - 2; i >= 2; i-- {
+		if parts[i] == "manifests" || parts[i] == "blobs" || parts[i] == "tags" || parts[i] == "referrers" {
+			actions := "pull"
+			if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
+				actions = "pull,push"
+			}
+			return fmt.Sprintf("repository:%s:%s", strings.Join(parts[1:i], "/"), actions)
 		}
 	}
 	return ""
 }
 
-func parseAuthHeader(header string) map[string]string {
+// ParseAuthHeader returns the parameters of a Bearer Www-Authenticate challenge.
+func ParseAuthHeader(header string) map[string]string {
 	params := make(map[string]string)
-	parts := strings.Split(strings.TrimPrefix(strings.ToLower(header), "bearer "), ",")
-	for _, p := range parts {
-		p = strings.TrimSpace(p)
-		kv := strings.SplitN(p, "=", 2)
-		if len(kv) == 2 {
-			params[kv[0]] = strings.Trim(kv[1], "\"")
+	if len(header) >= len("bearer ") && strings.EqualFold(header[:len("bearer ")], "bearer ") {
+		header = header[len("bearer "):]
+	}
+	for header != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(header, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			// Quoted values may contain commas, as in scope="repository:app:pull,push".
+			value, header, _ = strings.Cut(rest[1:], "\"")
+		} else {
+			value, header, _ = strings.Cut(rest, ",")
 		}
+		// Values such as realm URLs and repository scopes keep their case.
+		params[strings.ToLower(strings.TrimSpace(key))] = value
 	}
 	return params
 }
@@ -1,8 +1,12 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -12,15 +16,71 @@ import (
 
 type CacheMiddleware struct {
 	cacheManager CacheManager
+
+	mu       sync.Mutex
+	inflight map[string]*flight
+}
+
+// flight is an upstream fetch of a blob other requests for it can join.
+type flight struct {
+	// started is closed once the fetch streams into a fill other requests can
+	// read, or once it is done.
+	started chan struct{}
+	done    chan struct{}
+	land    func()
+	once    sync.Once
+
+	fill   *cache.Fill
+	header http.Header
+	size   int64
+}
+
+func newFlight(land func()) *flight {
+	return &flight{started: make(chan struct{}), done: make(chan struct{}), land: land}
+}
+
+// publish lets joined requests read fill as it downloads.
+func (f *flight) publish(fill *cache.Fill, header http.Header, size int64) {
+	f.fill, f.header, f.size = fill, header, size
+	close(f.started)
+}
+
+func (f *flight) finish() {
+	f.once.Do(func() {
+		f.land()
+		select {
+		case <-f.started:
+		default:
+			close(f.started)
+		}
+		close(f.done)
+	})
 }
 
 type CacheManager interface {
 	GetCache(registryHost string) *cache.Cache
 }
 
+type cacheStatusKey struct{}
+
+// WithCacheStatus returns a context in which the cache and tag middlewares
+// record into status whether a request was answered from the cache, "hit", or
+// fetched from upstream, "miss".
+func WithCacheStatus(ctx context.Context, status *string) context.Context {
+	return context.WithValue(ctx, cacheStatusKey{}, status)
+}
+
+// SetCacheStatus records the cache status of req, see WithCacheStatus.
+func SetCacheStatus(req *http.Request, status string) {
+	if s, ok := req.Context().Value(cacheStatusKey{}).(*string); ok {
+		*s = status
+	}
+}
+
 func NewCacheMiddleware(cm CacheManager) *CacheMiddleware {
 	return &CacheMiddleware{
 		cacheManager: cm,
+		inflight:     make(map[string]*flight),
 	}
 }
 
@@ -30,18 +90,175 @@ func (m *CacheMiddleware) Name() string {
 
 func (m *CacheMiddleware) Process(req *http.Request, next Handler) (*http.Response, error) {
 	if resp, ok := m.tryServeFromCache(req); ok {
+		SetCacheStatus(req, "hit")
 		return resp, nil
 	}
 
-	resp, err := next(req)
+	leader, wait := m.join(req)
+	if wait != nil {
+		select {
+		case <-wait.started:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if resp, ok := m.attach(req, wait); ok {
+			SetCacheStatus(req, "hit")
+			return resp, nil
+		}
+		select {
+		case <-wait.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if resp, ok := m.tryServeFromCache(req); ok {
+			SetCacheStatus(req, "hit")
+			return resp, nil
+		}
+	}
+
+	if isBlobRequest(req) {
+		SetCacheStatus(req, "miss")
+	}
+	fill := m.startFill(req)
+	if fill != nil {
+		// The fill outlives the client when joined requests still read it,
+		// see cacheWriter.
+		req = req.WithContext(context.WithoutCancel(req.Context()))
+	}
+	var resp *http.Response
+	var err error
+	if fill != nil && fill.Offset() > 0 {
+		resp, err = m.resume(req, fill, next)
+	} else {
+		resp, err = next(req)
+	}
 	if err != nil {
+		if fill != nil {
+			fill.Abort()
+		}
+		leader.finish()
 		return nil, err
 	}
 
-	resp = m.cacheResponse(req, resp)
+	resp = m.cacheResponse(req, resp, fill, leader)
 	return resp, nil
 }
 
+// startFill stages the cache fill of a blob request, resuming an interrupted
+// one. It returns nil when the response is not cached, such as for range
+// requests of clients.
+func (m *CacheMiddleware) startFill(req *http.Request) *cache.Fill {
+	digest := extractDigestFromPath(req.URL.Path)
+	c := m.cacheManager.GetCache(req.URL.Host)
+	if !isBlobRequest(req) || digest == "" || !c.Enabled() || req.Header.Get("Range") != "" {
+		return nil
+	}
+	fill, err := c.StartFill(digest)
+	if err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to start cache fill", "digest", digest, "error", err)
+		return nil
+	}
+	if fill.Offset() > 0 {
+		logging.Logger.DebugContext(req.Context(), "resuming interrupted cache fill", "digest", digest, "offset", fill.Offset())
+	}
+	return fill
+}
+
+// resume requests the rest of a partially cached blob, returning it as a
+// response for the whole blob that cacheResponse prefixes with the cached
+// bytes. Upstreams ignoring the range restart the fill; other answers are retried
+// without it.
+func (m *CacheMiddleware) resume(req *http.Request, fill *cache.Fill, next Handler) (*http.Response, error) {
+	rangeReq := req.Clone(req.Context())
+	rangeReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", fill.Offset()))
+	resp, err := next(rangeReq)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && ok && start == fill.Offset():
+		resp.StatusCode, resp.Status = http.StatusOK, "200 OK"
+		resp.Header.Del("Content-Range")
+		resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		resp.ContentLength = size
+		return resp, nil
+	case resp.StatusCode == http.StatusOK:
+		if err := fill.Restart(); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp, nil
+	}
+	resp.Body.Close()
+	if err := fill.Restart(); err != nil {
+		return nil, err
+	}
+	return next(req)
+}
+
+// parseContentRange parses a "bytes start-end/size" header.
+func parseContentRange(header string) (start, size int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	byteRange, total, found2 := strings.Cut(spec, "/")
+	first, _, found3 := strings.Cut(byteRange, "-")
+	if !found || !found2 || !found3 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size, err = strconv.ParseInt(total, 10, 64)
+	return start, size, err == nil
+}
+
+// join coalesces concurrent fetches of the same uncached blob. The first caller
+// becomes the leader of a flight it must finish once its cache fill finishes;
+// later callers get the flight to wait for or to read its fill.
+func (m *CacheMiddleware) join(req *http.Request) (leader, wait *flight) {
+	digest := extractDigestFromPath(req.URL.Path)
+	if !isBlobRequest(req) || digest == "" || !m.cacheManager.GetCache(req.URL.Host).Enabled() {
+		return newFlight(func() {}), nil
+	}
+
+	key := req.URL.Host + "/" + digest
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.inflight[key]; ok {
+		return newFlight(func() {}), f
+	}
+
+	f := newFlight(func() {
+		m.mu.Lock()
+		delete(m.inflight, key)
+		m.mu.Unlock()
+	})
+	m.inflight[key] = f
+	return f, nil
+}
+
+// attach streams the blob a flight is downloading from its fill, so a
+// request does not wait for the download to finish.
+func (m *CacheMiddleware) attach(req *http.Request, f *flight) (*http.Response, bool) {
+	if f.fill == nil || req.Header.Get("Range") != "" {
+		return nil, false
+	}
+	body := f.fill.NewReader(req.Context())
+	if body == nil {
+		return nil, false
+	}
+	logging.Logger.DebugContext(req.Context(), "streaming blob from in-progress download", "digest", extractDigestFromPath(req.URL.Path))
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          body,
+		Header:        f.header.Clone(),
+		ContentLength: f.size,
+		Request:       req,
+	}, true
+}
+
 func (m *CacheMiddleware) tryServeFromCache(req *http.Request) (*http.Response, bool) {
 	if !isBlobRequest(req) {
 		return nil, false
@@ -58,36 +275,152 @@ func (m *CacheMiddleware) tryServeFromCache(req *http.Request) (*http.Response,
 		return nil, false
 	}
 
-	logging.Logger.Debug("serving blob from cache", "digest", digest)
-	return &http.Response{
+	logging.Logger.DebugContext(req.Context(), "serving blob from cache", "digest", digest)
+	resp := &http.Response{
 		StatusCode:    http.StatusOK,
 		Body:          reader,
 		Header:        make(http.Header),
 		ContentLength: size,
 		Request:       req,
-	}, true
+	}
+	// Blobs are content-addressed, so a cache hit can answer with the headers
+	// a registry would send and let clients and intermediaries cache it.
+	resp.Header.Set("Content-Type", "application/octet-stream")
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	resp.Header.Set("Docker-Content-Digest", digest)
+	resp.Header.Set("Docker-Distribution-Api-Version", "registry/2.0")
+	resp.Header.Set("Etag", `"`+digest+`"`)
+	resp.Header.Set("Cache-Control", "max-age=31536000")
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && strings.Trim(ifRange, `"`) != digest {
+		return resp, true
+	}
+	start, end, ok, err := parseByteRange(req.Header.Get("Range"), size)
+	if err != nil {
+		reader.Close()
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Set("Content-Length", "0")
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		return resp, true
+	}
+	if !ok {
+		return resp, true
+	}
+
+	if seeker, isSeeker := reader.(io.Seeker); isSeeker {
+		_, err = seeker.Seek(start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, reader, start)
+	}
+	if err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to seek cached blob", "digest", digest, "error", err)
+		reader.Close()
+		return nil, false
+	}
+
+	resp.StatusCode = http.StatusPartialContent
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	resp.ContentLength = end - start + 1
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, resp.ContentLength), reader}
+	return resp, true
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseByteRange parses a single "bytes=" range into an inclusive [start, end].
+// ok is false when the header is absent, malformed or multi-range, in which
+// case the full content is served.
+func parseByteRange(header string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		n, valid := parseRangeNumber(last)
+		if !valid {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		return max(size-n, 0), size - 1, true, nil
+	}
+
+	start, valid := parseRangeNumber(first)
+	if !valid {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	end = size - 1
+	if last != "" {
+		e, valid := parseRangeNumber(last)
+		if !valid || e < start {
+			return 0, 0, false, nil
+		}
+		end = min(e, end)
+	}
+	return start, end, true, nil
 }
 
-func (m *CacheMiddleware) cacheResponse(req *http.Request, resp *http.Response) *http.Response {
+// parseRangeNumber parses a range position, which unlike strconv.ParseInt
+// input may only consist of digits.
+func parseRangeNumber(s string) (int64, bool) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+func (m *CacheMiddleware) cacheResponse(req *http.Request, resp *http.Response, fill *cache.Fill, leader *flight) *http.Response {
 	if !isBlobRequest(req) || resp.StatusCode != http.StatusOK {
+		if fill != nil {
+			fill.Abort()
+		}
+		leader.finish()
 		return resp
 	}
 
 	digest := extractDigestFromPath(req.URL.Path)
 	if digest == "" {
+		leader.finish()
 		return resp
 	}
 
 	cache := m.cacheManager.GetCache(req.URL.Host)
 	pr, pw := io.Pipe()
 	tee := io.TeeReader(resp.Body, pw)
+	if fill != nil && fill.Offset() > 0 {
+		tee = io.MultiReader(fill.Prefix(), tee)
+	}
 
+	if fill != nil {
+		leader.publish(fill, resp.Header.Clone(), resp.ContentLength)
+	}
 	go func() {
+		defer leader.finish()
 		defer pr.Close()
-		if err := cache.Put(digest, pr, digest); err != nil {
-			logging.Logger.Error("failed to cache blob", "digest", digest, "error", err)
+		put := func() error { return cache.Put(digest, pr, digest) }
+		if fill != nil {
+			put = func() error { return fill.Finish(pr, digest, resp.ContentLength) }
+		}
+		if err := put(); err != nil {
+			logging.Logger.ErrorContext(req.Context(), "failed to cache blob", "digest", digest, "error", err)
 		} else {
-			logging.Logger.Info("successfully cached blob", "digest", digest)
+			logging.Logger.InfoContext(req.Context(), "successfully cached blob", "digest", digest)
 		}
 	}()
 
@@ -95,6 +428,7 @@ func (m *CacheMiddleware) cacheResponse(req *http.Request, resp *http.Response)
 		original:   resp.Body,
 		teeReader:  tee,
 		pipeWriter: pw,
+		fill:       fill,
 	}
 	return resp
 }
@@ -119,6 +453,7 @@ type cacheWriter struct {
 	original   io.ReadCloser
 	teeReader  io.Reader
 	pipeWriter *io.PipeWriter
+	fill       *cache.Fill
 	closeOnce  sync.Once
 }
 
@@ -126,9 +461,19 @@ func (cw *cacheWriter) Read(p []byte) (int, error) {
 	return cw.teeReader.Read(p)
 }
 
+// Close ends the fill with the client's download, unless other clients are
+// reading the fill, for whom the rest of the blob is downloaded anyway.
 func (cw *cacheWriter) Close() error {
 	var err error
 	cw.closeOnce.Do(func() {
+		if cw.fill != nil && cw.fill.Readers() > 0 {
+			go func() {
+				io.Copy(io.Discard, cw.teeReader)
+				cw.original.Close()
+				cw.pipeWriter.Close()
+			}()
+			return
+		}
 		err = cw.original.Close()
 		cw.pipeWriter.Close()
 	})
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		start, end int64
+		ok         bool
+		notSatisfy bool
+	}{
+		{"bytes=0-99", 1000, 0, 99, true, false},
+		{"bytes=100-", 1000, 100, 999, true, false},
+		{"bytes=900-2000", 1000, 900, 999, true, false},
+		{"bytes=999-999", 1000, 999, 999, true, false},
+		{"bytes= 5-10 ", 1000, 5, 10, true, false},
+		// Suffix ranges count from the end and cover the whole blob at most.
+		{"bytes=-100", 1000, 900, 999, true, false},
+		{"bytes=-5000", 1000, 0, 999, true, false},
+		{"bytes=-0", 1000, 0, 0, false, true},
+		{"bytes=-10", 0, 0, 0, false, true},
+		{"bytes=1000-", 1000, 0, 0, false, true},
+		{"bytes=5000-6000", 1000, 0, 0, false, true},
+		// Multi-range and malformed headers are ignored and the full blob served.
+		{"", 1000, 0, 0, false, false},
+		{"bytes=0-1,5-6", 1000, 0, 0, false, false},
+		{"bytes=-5,-10", 1000, 0, 0, false, false},
+		{"bytes=0-1,", 1000, 0, 0, false, false},
+		{"items=0-99", 1000, 0, 0, false, false},
+		{"bytes=", 1000, 0, 0, false, false},
+		{"bytes=-", 1000, 0, 0, false, false},
+		{"bytes=5", 1000, 0, 0, false, false},
+		{"bytes=10-5", 1000, 0, 0, false, false},
+		{"bytes=a-5", 1000, 0, 0, false, false},
+		{"bytes=0-b", 1000, 0, 0, false, false},
+		{"bytes=+5-10", 1000, 0, 0, false, false},
+		{"bytes=0-+10", 1000, 0, 0, false, false},
+		{"bytes=--5", 1000, 0, 0, false, false},
+		{"bytes=-+5", 1000, 0, 0, false, false},
+		{"bytes=1-2-3", 1000, 0, 0, false, false},
+		{"bytes=99999999999999999999-", 1000, 0, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, ok, err := parseByteRange(tt.header, tt.size)
+			if tt.notSatisfy != errors.Is(err, errRangeNotSatisfiable) {
+				t.Fatalf("error = %v, want not satisfiable %v", err, tt.notSatisfy)
+			}
+			if ok != tt.ok || ok && (start != tt.start || end != tt.end) {
+				t.Fatalf("got %d-%d ok=%v, want %d-%d ok=%v", start, end, ok, tt.start, tt.end, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// maxCompatManifestSize bounds manifests downloaded to answer a HEAD request.
+const maxCompatManifestSize = 4 << 20
+
+// defaultManifestAccept is sent for legacy Docker clients whose Accept header
+// names no manifest type the upstream can serve.
+var defaultManifestAccept = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// CompatMiddleware works around upstream-facing quirks of the clients named by
+// the enabled compat_profiles:
+//   - docker-legacy: old Docker engines send Accept headers as one
+//     comma-separated value with duplicates or parameters, or without any
+//     manifest type, so upstreams fall back to the retired schema 1. The header
+//     is split into clean values and schema 2 types are added when missing.
+//   - buildkit: BuildKit resolves tags with HEAD and fails when the upstream
+//     rejects HEAD or omits Docker-Content-Digest. Such requests are retried as
+//     GET and answered with the manifest's headers and computed digest.
+type CompatMiddleware struct {
+	cfg *config.Provider
+}
+
+func NewCompatMiddleware(cfg *config.Provider) *CompatMiddleware {
+	return &CompatMiddleware{cfg: cfg}
+}
+
+func (m *CompatMiddleware) Name() string {
+	return "compat"
+}
+
+func (m *CompatMiddleware) Process(req *http.Request, next Handler) (*http.Response, error) {
+	if !isManifestRequest(req) {
+		return next(req)
+	}
+	cfg := m.cfg.Current()
+	agent := req.Header.Get("User-Agent")
+	if cfg.CompatEnabled(config.CompatDockerLegacy) && strings.HasPrefix(agent, "docker/") {
+		req = normalizeAccept(req)
+	}
+	if cfg.CompatEnabled(config.CompatBuildKit) && req.Method == http.MethodHead && strings.HasPrefix(agent, "buildkit/") {
+		return headViaGet(req, next)
+	}
+	return next(req)
+}
+
+func isManifestRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	return len(parts) >= 4 && parts[len(parts)-2] == "manifests"
+}
+
+func normalizeAccept(req *http.Request) *http.Request {
+	var types []string
+	for _, value := range req.Header.Values("Accept") {
+		for _, t := range strings.Split(value, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if t = strings.TrimSpace(t); t != "" && !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+	if !slices.ContainsFunc(types, isCurrentManifestType) {
+		types = append(types, defaultManifestAccept...)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header["Accept"] = types
+	return req
+}
+
+// isCurrentManifestType reports whether t is a Docker schema 2 or OCI manifest
+// or index type.
+func isCurrentManifestType(t string) bool {
+	return strings.HasPrefix(t, "application/vnd.docker.distribution.manifest.") && strings.HasSuffix(t, ".v2+json") ||
+		strings.HasPrefix(t, "application/vnd.oci.image.manifest.") || strings.HasPrefix(t, "application/vnd.oci.image.index.")
+}
+
+func headViaGet(req *http.Request, next Handler) (*http.Response, error) {
+	resp, err := next(req)
+	if err != nil || !(resp.StatusCode == http.StatusMethodNotAllowed ||
+		resp.StatusCode == http.StatusOK && resp.Header.Get("Docker-Content-Digest") == "") {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	getReq := req.Clone(req.Context())
+	getReq.Method = http.MethodGet
+	resp, err = next(getReq)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCompatManifestSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Docker-Content-Digest") == "" {
+		sum := sha256.Sum256(data)
+		resp.Header.Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+	}
+	logging.Logger.DebugContext(req.Context(), "answered manifest HEAD with GET", "url", req.URL.String())
+	head := &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          http.NoBody,
+		Header:        resp.Header,
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+	head.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return head, nil
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/kv"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// TagMiddleware caches tag to digest resolutions of manifest requests for the
+// registry's tag_cache_ttl and answers manifest HEADs by tag from the cache.
+// Tag lists are cached for tag_list_ttl, one entry per page. Both are cached
+// per upstream credentials, so clients only get answers their tenant's or,
+// in passthrough mode, their own credentials obtained.
+type TagMiddleware struct {
+	cfg   *config.Provider
+	store kv.Store
+}
+
+type tagEntry struct {
+	Digest    string
+	MediaType string
+	Size      int64
+}
+
+type tagListEntry struct {
+	Body        []byte
+	ContentType string
+	Link        string
+}
+
+const maxTagListSize = 4 << 20
+
+func NewTagMiddleware(cfg *config.Provider, store kv.Store) *TagMiddleware {
+	return &TagMiddleware{cfg: cfg, store: store}
+}
+
+func (m *TagMiddleware) Name() string {
+	return "tags"
+}
+
+func (m *TagMiddleware) Process(req *http.Request, next Handler) (*http.Response, error) {
+	cfg := m.cfg.Current()
+	settings := cfg.GetRegistrySettings(req.URL.Host)
+	tagList := settings.TagListTTL > 0 && req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/tags/list")
+	key, ok := tagCacheKey(req)
+	if !tagList && (settings.TagCacheTTL <= 0 || !ok) {
+		return next(req)
+	}
+	auth, err := upstreamAuth(cfg, settings, req)
+	if err != nil {
+		return nil, err
+	}
+	identity := credentialIdentity(auth)
+	if tagList {
+		return m.tagList(req, "taglist/"+identity+"/"+req.URL.Host+req.URL.Path+"?"+req.URL.RawQuery, settings.TagListTTL, next)
+	}
+	key, ttl := "tag/"+identity+"/"+key, settings.TagCacheTTL
+
+	if req.Method == http.MethodHead {
+		if resp, ok := m.lookup(req, key); ok {
+			SetCacheStatus(req, "hit")
+			return resp, nil
+		}
+		SetCacheStatus(req, "miss")
+	}
+
+	resp, err := next(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Docker-Content-Digest") == "" {
+		return resp, err
+	}
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if size <= 0 {
+		return resp, nil
+	}
+	data, _ := json.Marshal(tagEntry{
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		MediaType: resp.Header.Get("Content-Type"),
+		Size:      size,
+	})
+	if err := m.store.Set(key, data, ttl); err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to store tag resolution", "key", key, "error", err)
+	}
+	return resp, nil
+}
+
+func (m *TagMiddleware) lookup(req *http.Request, key string) (*http.Response, bool) {
+	data, ok, err := m.store.Get(key)
+	if err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to read tag resolution", "key", key, "error", err)
+	}
+	var entry tagEntry
+	if !ok || json.Unmarshal(data, &entry) != nil {
+		return nil, false
+	}
+
+	logging.Logger.DebugContext(req.Context(), "serving tag resolution from cache", "key", key, "digest", entry.Digest)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          http.NoBody,
+		Header:        make(http.Header),
+		ContentLength: entry.Size,
+		Request:       req,
+	}
+	resp.Header.Set("Docker-Content-Digest", entry.Digest)
+	resp.Header.Set("Content-Type", entry.MediaType)
+	resp.Header.Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	resp.Header.Set("Docker-Distribution-Api-Version", "registry/2.0")
+	return resp, true
+}
+
+// tagList answers a tag list page from the cache, or fetches and caches it.
+// The upstream Link header is kept so pagination works on cached pages.
+func (m *TagMiddleware) tagList(req *http.Request, key string, ttl time.Duration, next Handler) (*http.Response, error) {
+	data, ok, err := m.store.Get(key)
+	if err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to read tag list", "key", key, "error", err)
+	}
+	var entry tagListEntry
+	if ok && json.Unmarshal(data, &entry) == nil {
+		logging.Logger.DebugContext(req.Context(), "serving tag list from cache", "key", key)
+		SetCacheStatus(req, "hit")
+		return entry.response(req), nil
+	}
+	SetCacheStatus(req, "miss")
+
+	resp, err := next(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTagListSize+1))
+	if err != nil || len(body) > maxTagListSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	data, _ = json.Marshal(tagListEntry{Body: body, ContentType: resp.Header.Get("Content-Type"), Link: resp.Header.Get("Link")})
+	if err := m.store.Set(key, data, ttl); err != nil {
+		logging.Logger.WarnContext(req.Context(), "failed to store tag list", "key", key, "error", err)
+	}
+	return resp, nil
+}
+
+func (e tagListEntry) response(req *http.Request) *http.Response {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		Header:        make(http.Header),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", e.ContentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	resp.Header.Set("Docker-Distribution-Api-Version", "registry/2.0")
+	if e.Link != "" {
+		resp.Header.Set("Link", e.Link)
+	}
+	return resp
+}
+
+// tagCacheKey returns the store key for a manifest request by tag, without
+// the credential identity prefix. The Accept header is part of the key
+// because it selects the manifest format.
+func tagCacheKey(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	n := len(parts)
+	if n < 4 || parts[0] != "v2" || parts[n-2] != "manifests" || strings.Contains(parts[n-1], ":") {
+		return "", false
+	}
+	accept := sha256.Sum256([]byte(strings.Join(req.Header.Values("Accept"), ",")))
+	return req.URL.Host + "/" + strings.Join(parts[1:n-2], "/") + ":" + parts[n-1] + "/" + hex.EncodeToString(accept[:8]), true
+}
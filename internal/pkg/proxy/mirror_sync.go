@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// maxTagPages bounds the tag list pages followed for one repository.
+const maxTagPages = 100
+
+// MirrorSync lists the tags of the mirror_sync repositories on their cron
+// schedules and downloads new and updated tags into the cache through the
+// preloader. A sync still running when it is due again is skipped.
+type MirrorSync struct {
+	cfg       *config.Provider
+	preloader *Preloader
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func NewMirrorSync(cfg *config.Provider, preloader *Preloader) *MirrorSync {
+	return &MirrorSync{cfg: cfg, preloader: preloader, running: make(map[string]bool)}
+}
+
+func (m *MirrorSync) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(withBackground(context.Background()))
+	defer cancel()
+	for {
+		now := time.Now()
+		select {
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-stop:
+			return
+		}
+		for _, entry := range m.cfg.Current().MirrorSync {
+			if entry.Due(time.Now()) && m.start(entry.Repository) {
+				go func() {
+					defer m.finish(entry.Repository)
+					m.syncRepository(ctx, entry)
+				}()
+			}
+		}
+	}
+}
+
+func (m *MirrorSync) start(repository string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running[repository] {
+		logging.Logger.Warn("mirror sync still running, skipping schedule", "repository", repository)
+		return false
+	}
+	m.running[repository] = true
+	return true
+}
+
+func (m *MirrorSync) finish(repository string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running, repository)
+}
+
+func (m *MirrorSync) syncRepository(ctx context.Context, entry config.MirrorSyncSettings) {
+	start := time.Now()
+	tags, err := m.listTags(ctx, entry.Repository)
+	if err != nil {
+		logging.Logger.Warn("mirror sync failed to list tags", "repository", entry.Repository, "error", err)
+		return
+	}
+
+	var synced, failed, blobs int
+	var bytes int64
+	for _, tag := range tags {
+		if !entry.MatchesTag(tag) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		image := entry.Repository + ":" + tag
+		n, size, err := m.preloader.preload(ctx, config.PreloadImage{Image: image, Platforms: entry.Platforms})
+		if err != nil {
+			logging.Logger.Warn("mirror sync failed to copy tag", "image", image, "error", err)
+			failed++
+			continue
+		}
+		synced++
+		blobs += n
+		bytes += size
+	}
+	logging.Logger.Info("mirror sync finished", "repository", entry.Repository, "tags", synced, "failed", failed,
+		"blobs", blobs, "bytes", bytes, "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// listTags returns all tags of repository, following the registry's pagination
+// links.
+func (m *MirrorSync) listTags(ctx context.Context, repository string) ([]string, error) {
+	cfg := m.cfg.Current()
+	registry, upstreamPath := resolveUpstream("/v2/"+repository+"/tags/list", cfg)
+	if !cfg.IsRegistryAllowed(registry) {
+		return nil, fmt.Errorf("registry %s is not allowed", registry)
+	}
+	next := m.preloader.graphs.upstreamURL(registry, repositoryName(upstreamPath), "tags", "list")
+
+	var tags []string
+	for page := 0; next != "" && page < maxTagPages; page++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := m.preloader.transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("upstream returned %s", resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding tag list: %w", err)
+		}
+		tags = append(tags, list.Tags...)
+
+		next = ""
+		if link := nextLink(resp.Header.Get("Link")); link != "" {
+			if u, err := req.URL.Parse(link); err == nil {
+				next = u.String()
+			}
+		}
+	}
+	return tags, nil
+}
+
+// nextLink returns the target of a rel="next" Link header, as used by
+// registries to paginate tag lists.
+func nextLink(header string) string {
+	target, params, ok := strings.Cut(header, ";")
+	if !ok || !strings.Contains(params, `rel="next"`) {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(target), "<>")
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// mirrorCooldown is how long a mirror that failed is skipped.
+const mirrorCooldown = 30 * time.Second
+
+// mirrorHealth remembers which mirrors failed recently, so pulls do not pay
+// for a timeout on every request while a mirror is down.
+type mirrorHealth struct {
+	mu   sync.Mutex
+	down map[string]time.Time
+}
+
+func newMirrorHealth() *mirrorHealth {
+	return &mirrorHealth{down: make(map[string]time.Time)}
+}
+
+func (m *mirrorHealth) available(host string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Now().After(m.down[host])
+}
+
+func (m *mirrorHealth) report(host string, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if failed {
+		m.down[host] = time.Now().Add(mirrorCooldown)
+	} else {
+		delete(m.down, host)
+	}
+}
+
+// doMirrors tries a pull on the registry's mirrors in order, skipping those
+// that failed within mirrorCooldown, and returns the first usable response.
+// Errors, 5xx and 429 responses mark a mirror down; a 404 or an unanswered
+// authentication challenge only moves on, as the mirror may not have synced
+// the content yet or may not accept the mirror's credentials. It returns nil
+// when the canonical upstream must be asked instead. Mirrors are sent their
+// own credentials, never the registry's.
+func (e *Executor) doMirrors(registry string, req *http.Request, settings config.RegistrySettings) (*http.Response, error) {
+	for _, mirror := range settings.Mirrors {
+		host, insecure := config.MirrorHost(mirror)
+		if !e.mirrors.available(host) {
+			continue
+		}
+		mirrorReq := req.Clone(req.Context())
+		mirrorReq.URL.Host, mirrorReq.Host = host, host
+		if insecure {
+			mirrorReq.URL.Scheme = "http"
+		} else {
+			mirrorReq.URL.Scheme = "https"
+		}
+		client := e.getClientForRegistry(host, settings)
+		resp, err := e.auth.Mirror(mirrorReq, func(r *http.Request) (*http.Response, error) {
+			return e.do(client, registry, r, settings)
+		})
+		if err != nil && req.Context().Err() != nil {
+			return nil, err
+		}
+		failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		e.mirrors.report(host, failed)
+		if !failed && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			return resp, nil
+		}
+		if err != nil {
+			logging.Logger.DebugContext(req.Context(), "mirror failed, trying next upstream", "registry", registry, "mirror", host, "error", err)
+			continue
+		}
+		resp.Body.Close()
+		logging.Logger.DebugContext(req.Context(), "mirror failed, trying next upstream", "registry", registry, "mirror", host, "status", resp.StatusCode)
+	}
+	return nil, nil
+}
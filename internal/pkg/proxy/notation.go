@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oci-proxy/internal/pkg/config"
+)
+
+const notationArtifactType = "application/vnd.cncf.notary.signature"
+
+// notationCritical are the critical JWS headers understood; signatures
+// needing others, such as verification plugins, fail.
+var notationCritical = []string{"io.cncf.notary.signingScheme", "io.cncf.notary.expiry", "io.cncf.notary.authenticSigningTime"}
+
+// verifyNotation finds the Notary Project signatures of digest through the
+// referrers API and succeeds when any of them verifies against trust.
+func (m *signatureMiddleware) verifyNotation(ctx context.Context, registry, repo, digest string, trust *config.NotationPolicy) error {
+	data, status, err := m.fetch(ctx, m.graphs.upstreamURL(registry, repo, "referrers", digest)+"?artifactType="+url.QueryEscape(notationArtifactType))
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("fetching referrers: upstream returned %d", status)
+	}
+	var referrers struct {
+		Manifests []struct {
+			Digest       string `json:"digest"`
+			ArtifactType string `json:"artifactType"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &referrers); err != nil {
+		return fmt.Errorf("decoding referrers: %w", err)
+	}
+
+	var errs []error
+	for _, referrer := range referrers.Manifests {
+		if referrer.ArtifactType != notationArtifactType {
+			continue
+		}
+		err := m.verifyNotationSignature(ctx, registry, repo, referrer.Digest, digest, trust)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no signature found")
+	}
+	return errors.Join(errs...)
+}
+
+func (m *signatureMiddleware) verifyNotationSignature(ctx context.Context, registry, repo, signatureDigest, digest string, trust *config.NotationPolicy) error {
+	data, status, err := m.fetch(ctx, m.graphs.upstreamURL(registry, repo, "manifests", signatureDigest))
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("fetching signature %s: upstream returned %d", signatureDigest, status)
+	}
+	if err != nil {
+		return err
+	}
+	var signature manifest
+	if err := json.Unmarshal(data, &signature); err != nil || len(signature.Layers) != 1 {
+		return fmt.Errorf("signature %s is not a notation signature manifest", signatureDigest)
+	}
+	envelope := signature.Layers[0]
+	if envelope.MediaType != "application/jose+json" {
+		return fmt.Errorf("signature envelope %s is not supported, sign with --signature-format jws", envelope.MediaType)
+	}
+	data, status, err = m.fetch(ctx, m.graphs.upstreamURL(registry, repo, "blobs", envelope.Digest))
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("fetching signature envelope %s: upstream returned %d", envelope.Digest, status)
+	}
+	if err != nil {
+		return err
+	}
+	return verifyJWSEnvelope(data, digest, trust)
+}
+
+// notationSchemes maps the signing schemes to the kind of trust store their
+// certificate chains must lead to.
+var notationSchemes = map[string]string{
+	"notary.x509":                  "ca",
+	"notary.x509.signingAuthority": "signingAuthority",
+}
+
+// verifyJWSEnvelope checks a notation JWS signature envelope for digest: its
+// certificate chain must lead to the policy's trust stores of the signing
+// scheme and name a trusted identity, and the signature must be intact and
+// unexpired. Timestamp countersignatures are not supported, so the chain must
+// be valid now, except that permissive and audit policies accept the
+// authentic signing time of the signingAuthority scheme.
+func verifyJWSEnvelope(data []byte, digest string, trust *config.NotationPolicy) error {
+	var envelope struct {
+		Payload   string `json:"payload"`
+		Protected string `json:"protected"`
+		Signature string `json:"signature"`
+		Header    struct {
+			X5C [][]byte `json:"x5c"`
+		} `json:"header"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("decoding signature envelope: %w", err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		return fmt.Errorf("decoding protected header: %w", err)
+	}
+	var header struct {
+		Alg           string     `json:"alg"`
+		Crit          []string   `json:"crit"`
+		Scheme        string     `json:"io.cncf.notary.signingScheme"`
+		AuthenticTime time.Time  `json:"io.cncf.notary.authenticSigningTime"`
+		Expiry        *time.Time `json:"io.cncf.notary.expiry"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return fmt.Errorf("decoding protected header: %w", err)
+	}
+	for _, name := range header.Crit {
+		if !slices.Contains(notationCritical, name) {
+			return fmt.Errorf("unsupported critical header %q", name)
+		}
+	}
+	kind, ok := notationSchemes[header.Scheme]
+	if !ok {
+		return fmt.Errorf("unsupported signing scheme %q", header.Scheme)
+	}
+	if header.Expiry != nil && time.Now().After(*header.Expiry) {
+		return fmt.Errorf("signature expired at %s", header.Expiry.Format(time.RFC3339))
+	}
+
+	if len(envelope.Header.X5C) == 0 {
+		return errors.New("signature has no certificate chain")
+	}
+	var chain []*x509.Certificate
+	for _, der := range envelope.Header.X5C {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parsing certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	at := time.Now()
+	if kind == "signingAuthority" && trust.Level() != "strict" {
+		at = header.AuthenticTime
+	}
+	roots := trust.Roots(kind)
+	if roots == nil {
+		return fmt.Errorf("policy %q has no %s trust store for signing scheme %s", trust.Name, kind, header.Scheme)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("certificate not trusted by policy %q: %w", trust.Name, err)
+	}
+	if !trust.TrustsIdentity(chain[0]) {
+		return fmt.Errorf("signer %q is not a trusted identity of policy %q", chain[0].Subject, trust.Name)
+	}
+
+	if alg := notationAlgorithm(chain[0].PublicKey); alg == "" || alg != header.Alg {
+		return fmt.Errorf("signature algorithm %q does not match the signing key", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	if err := jwt.GetSigningMethod(header.Alg).Verify(envelope.Protected+"."+envelope.Payload, signature, chain[0].PublicKey); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+	var target struct {
+		TargetArtifact struct {
+			Digest string `json:"digest"`
+		} `json:"targetArtifact"`
+	}
+	if err := json.Unmarshal(payload, &target); err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+	if target.TargetArtifact.Digest != digest {
+		return fmt.Errorf("signature is for %s", target.TargetArtifact.Digest)
+	}
+	return nil
+}
+
+// notationAlgorithm returns the JWS algorithm the Notary Project signature
+// specification requires for key, or "" for unsupported keys.
+func notationAlgorithm(key crypto.PublicKey) string {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return map[int]string{2048: "PS256", 3072: "PS384", 4096: "PS512"}[key.N.BitLen()]
+	case *ecdsa.PublicKey:
+		return map[int]string{256: "ES256", 384: "ES384", 521: "ES512"}[key.Curve.Params().BitSize]
+	}
+	return ""
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"oci-proxy/internal/pkg/config"
+)
+
+// notationFixture holds a trust store with a ca and a signingAuthority root
+// and loads trust policies using it.
+type notationFixture struct {
+	t      *testing.T
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	sa     *x509.Certificate
+	saKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newNotationFixture(t *testing.T) *notationFixture {
+	t.Helper()
+	f := &notationFixture{t: t, dir: t.TempDir(), caKey: generateKey(t), saKey: generateKey(t)}
+	f.ca = f.root("test ca", f.caKey, "ca", "test")
+	f.sa = f.root("test tsa", f.saKey, "signingAuthority", "sa")
+	f.root("other ca", generateKey(t), "ca", "other")
+	return f
+}
+
+// root creates a self-signed certificate and stores it as x509/kind/name.
+func (f *notationFixture) root(name string, key *ecdsa.PrivateKey, kind, store string) *x509.Certificate {
+	f.t.Helper()
+	f.serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(f.serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-48 * time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	dir := filepath.Join(f.dir, "truststore", "x509", kind, store)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "root.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// leaf issues a code signing certificate for key, valid from notBefore for a
+// day.
+func (f *notationFixture) leaf(key crypto.Signer, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, notBefore time.Time) []byte {
+	f.t.Helper()
+	f.serial++
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(f.serial),
+		Subject:      pkix.Name{CommonName: "signer", Organization: []string{"Example"}},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, parent, key.Public(), parentKey)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return der
+}
+
+// policies loads a trust policy document and returns its policies by name.
+func (f *notationFixture) policies(document string) map[string]*config.NotationPolicy {
+	f.t.Helper()
+	policy := filepath.Join(f.dir, "trustpolicy.json")
+	if err := os.WriteFile(policy, []byte(document), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+	path := filepath.Join(f.dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("log_level: error\nnotation:\n  trust_policy: "+policy+"\n  trust_store: "+filepath.Join(f.dir, "truststore")+"\n"), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+	cfg, err := config.NewProvider(path)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	policies := make(map[string]*config.NotationPolicy)
+	for _, name := range []string{"strict", "permissive", "other", "named"} {
+		policies[name] = cfg.Current().Notation.Policy("registry.example/" + name)
+	}
+	return policies
+}
+
+// envelope returns a JWS envelope signing digest with key under alg, with
+// the protected header extending the notary.x509 defaults by header.
+func envelope(t *testing.T, alg string, key crypto.Signer, digest string, header map[string]any, chain ...[]byte) []byte {
+	t.Helper()
+	protected := map[string]any{
+		"alg":                          alg,
+		"crit":                         []string{"io.cncf.notary.signingScheme"},
+		"cty":                          "application/vnd.cncf.notary.payload.v1+json",
+		"io.cncf.notary.signingScheme": "notary.x509",
+		"io.cncf.notary.signingTime":   time.Now().Format(time.RFC3339),
+	}
+	for name, value := range header {
+		protected[name] = value
+	}
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	payload := encode(map[string]any{"targetArtifact": map[string]any{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": digest, "size": 1234}})
+	signed := encode(protected) + "." + payload
+	signature, err := jwt.GetSigningMethod(alg).Sign(signed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(map[string]any{
+		"payload":   payload,
+		"protected": encode(protected),
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+		"header":    map[string]any{"x5c": chain},
+	})
+	return data
+}
+
+func TestVerifyJWSEnvelope(t *testing.T) {
+	f := newNotationFixture(t)
+	policies := f.policies(`{"version": "1.0", "trustPolicies": [
+		{"name": "strict", "registryScopes": ["registry.example/strict"], "signatureVerification": {"level": "strict"},
+		 "trustStores": ["ca:test", "signingAuthority:sa"], "trustedIdentities": ["x509.subject: O=Example, CN=signer"]},
+		{"name": "permissive", "registryScopes": ["registry.example/permissive"], "signatureVerification": {"level": "permissive"},
+		 "trustStores": ["ca:test", "signingAuthority:sa"], "trustedIdentities": ["*"]},
+		{"name": "other", "registryScopes": ["registry.example/other"], "signatureVerification": {"level": "strict"},
+		 "trustStores": ["ca:other"], "trustedIdentities": ["*"]},
+		{"name": "named", "registryScopes": ["registry.example/named"], "signatureVerification": {"level": "strict"},
+		 "trustStores": ["ca:test"], "trustedIdentities": ["x509.subject: CN=someone"]}
+	]}`)
+
+	ecKey := generateKey(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(-time.Hour)
+	expired := time.Now().Add(-36 * time.Hour)
+	ecLeaf := f.leaf(ecKey, f.ca, f.caKey, now)
+	rsaLeaf := f.leaf(rsaKey, f.ca, f.caKey, now)
+	expiredLeaf := f.leaf(ecKey, f.ca, f.caKey, expired)
+	saLeaf := f.leaf(ecKey, f.sa, f.saKey, now)
+	expiredSALeaf := f.leaf(ecKey, f.sa, f.saKey, expired)
+
+	signingAuthority := map[string]any{
+		"crit":                                []string{"io.cncf.notary.signingScheme", "io.cncf.notary.authenticSigningTime"},
+		"io.cncf.notary.signingScheme":        "notary.x509.signingAuthority",
+		"io.cncf.notary.authenticSigningTime": expired.Add(time.Hour).Format(time.RFC3339),
+	}
+	valid := envelope(t, "ES256", ecKey, testImageDigest, nil, ecLeaf)
+	var tampered map[string]any
+	json.Unmarshal(valid, &tampered)
+	tampered["payload"] = base64.RawURLEncoding.EncodeToString([]byte(`{"targetArtifact":{"digest":"` + testImageDigest + `","size":1}}`))
+	tamperedData, _ := json.Marshal(tampered)
+
+	tests := []struct {
+		name     string
+		policy   string
+		envelope []byte
+		wantErr  string
+	}{
+		{"valid ES256", "strict", valid, ""},
+		{"valid PS256", "strict", envelope(t, "PS256", rsaKey, testImageDigest, nil, rsaLeaf), ""},
+		{"valid signing authority", "strict", envelope(t, "ES256", ecKey, testImageDigest, signingAuthority, saLeaf), ""},
+		{"signing authority at authentic signing time", "permissive", envelope(t, "ES256", ecKey, testImageDigest, signingAuthority, expiredSALeaf), ""},
+		{"expired signing authority certificate under strict", "strict", envelope(t, "ES256", ecKey, testImageDigest, signingAuthority, expiredSALeaf), "not trusted"},
+		{"wrong digest", "strict", envelope(t, "ES256", ecKey, "sha256:"+strings.Repeat("f", 64), nil, ecLeaf), "signature is for"},
+		{"tampered payload", "strict", tamperedData, "invalid signature"},
+		{"untrusted root", "other", valid, "not trusted"},
+		{"untrusted identity", "named", valid, "not a trusted identity"},
+		{"expired signature", "strict", envelope(t, "ES256", ecKey, testImageDigest, map[string]any{
+			"crit":                  []string{"io.cncf.notary.signingScheme", "io.cncf.notary.expiry"},
+			"io.cncf.notary.expiry": time.Now().Add(-time.Minute).Format(time.RFC3339),
+		}, ecLeaf), "expired"},
+		{"unknown critical header", "strict", envelope(t, "ES256", ecKey, testImageDigest, map[string]any{
+			"crit":                              []string{"io.cncf.notary.signingScheme", "io.cncf.notary.verificationPlugin"},
+			"io.cncf.notary.verificationPlugin": "example",
+		}, ecLeaf), "critical header"},
+		{"signing authority certificate with ca scheme", "strict", envelope(t, "ES256", ecKey, testImageDigest, nil, saLeaf), "not trusted"},
+		{"algorithm not matching the key", "strict", envelope(t, "RS256", rsaKey, testImageDigest, nil, rsaLeaf), "does not match"},
+		{"backdated signing time with expired certificate", "permissive", envelope(t, "ES256", ecKey, testImageDigest, map[string]any{
+			"io.cncf.notary.signingTime": expired.Add(time.Hour).Format(time.RFC3339),
+		}, expiredLeaf), "not trusted"},
+		{"missing certificate chain", "strict", envelope(t, "ES256", ecKey, testImageDigest, nil), "no certificate chain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyJWSEnvelope(tt.envelope, testImageDigest, policies[tt.policy])
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("verification failed: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatal("verification succeeded")
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("error %q does not mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
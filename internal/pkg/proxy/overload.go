@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+const diskProbeFile = ".overload-probe"
+
+// overload sheds registry requests while the proxy is overloaded: too many
+// registry requests in flight, a heap larger than max_memory, or a cache disk
+// taking longer than max_disk_latency to write and sync a probe file. Memory
+// and disks are sampled every second; a probe still running past the limit
+// counts as slow. Management endpoints such as /_/health are never shed, so
+// orchestrators and dashboards keep seeing the instance.
+type overload struct {
+	cfg      *config.Provider
+	inFlight atomic.Int64
+	shed     atomic.Int64
+	// probeStart is when the running disk probe started, in Unix nanoseconds.
+	probeStart atomic.Int64
+
+	mu      sync.Mutex
+	sampled string
+	logged  string
+}
+
+func newOverload(cfg *config.Provider) *overload {
+	return &overload{cfg: cfg}
+}
+
+func (o *overload) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.sample()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (o *overload) sample() {
+	cfg := o.cfg.Current()
+	var reason string
+	if limit := int64(cfg.Overload.MaxMemory); limit > 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if int64(m.HeapInuse) > limit {
+			reason = fmt.Sprintf("heap of %s exceeds max_memory", formatSize(int64(m.HeapInuse)))
+		}
+	}
+	if limit := cfg.Overload.MaxDiskLatency; limit > 0 && reason == "" {
+		for _, dir := range cacheDirs(cfg) {
+			if latency, err := o.probeDisk(dir); err != nil {
+				logging.Logger.Warn("disk latency probe failed", "dir", dir, "error", err)
+			} else if latency > limit {
+				reason = fmt.Sprintf("cache disk %s took %s to sync", dir, latency.Round(time.Millisecond))
+				break
+			}
+		}
+	}
+
+	o.mu.Lock()
+	o.sampled = reason
+	o.mu.Unlock()
+	o.logTransition(o.reason(1))
+}
+
+// probeDisk writes and syncs a small file in dir and returns how long it took.
+func (o *overload) probeDisk(dir string) (time.Duration, error) {
+	start := time.Now()
+	o.probeStart.Store(start.UnixNano())
+	defer o.probeStart.Store(0)
+
+	f, err := os.Create(filepath.Join(dir, diskProbeFile))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, 4096)); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// cacheDirs returns the distinct local cache directories of the configured
+// registries.
+func cacheDirs(cfg *config.Config) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	add(cfg.Defaults.CacheDir)
+	for name := range cfg.Registries {
+		if !config.IsRegistryPattern(name) {
+			add(cfg.GetRegistrySettings(name).CacheDir)
+		}
+	}
+	return dirs
+}
+
+// reason returns why the proxy is overloaded, or "" when it is not, counting
+// pending requests on top of those in flight.
+func (o *overload) reason(pending int64) string {
+	settings := o.cfg.Current().Overload
+	if settings.MaxInFlight > 0 && o.inFlight.Load()+pending > int64(settings.MaxInFlight) {
+		return fmt.Sprintf("max_in_flight of %d registry requests reached", settings.MaxInFlight)
+	}
+	if start := o.probeStart.Load(); start != 0 && settings.MaxDiskLatency > 0 {
+		if elapsed := time.Since(time.Unix(0, start)); elapsed > settings.MaxDiskLatency {
+			return fmt.Sprintf("cache disk probe running for %s", elapsed.Round(time.Millisecond))
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sampled
+}
+
+func (o *overload) logTransition(reason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch {
+	case reason != "" && o.logged == "":
+		logging.Logger.Warn("proxy overloaded, shedding registry requests", "reason", reason)
+	case reason == "" && o.logged != "":
+		logging.Logger.Info("proxy no longer overloaded", "shed", o.shed.Load())
+	}
+	o.logged = reason
+}
+
+// admit counts a registry request in flight, or returns why it must be shed.
+// Admitted requests must call done once they finish.
+func (o *overload) admit() string {
+	o.inFlight.Add(1)
+	if reason := o.reason(0); reason != "" {
+		o.inFlight.Add(-1)
+		o.shed.Add(1)
+		return reason
+	}
+	return ""
+}
+
+func (o *overload) done() {
+	o.inFlight.Add(-1)
+}
+
+func (o *overload) status() OverloadStatus {
+	return OverloadStatus{Reason: o.reason(1), InFlight: o.inFlight.Load(), Shed: o.shed.Load()}
+}
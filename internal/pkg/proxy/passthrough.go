@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+// passthroughMiddleware runs first in the pipeline. Registries in passthrough
+// mode accept any credentials at the proxy, so before the caches may answer a
+// manifest or blob pull it sends the request as a HEAD to the registry itself
+// with the client's own credentials, and answers refusals with the registry's
+// response. Content cached for one client is thereby only served to clients
+// the registry admits to the same repository.
+type passthroughMiddleware struct {
+	cfg      *config.Provider
+	auth     *middleware.AuthMiddleware
+	executor *Executor
+}
+
+func newPassthroughMiddleware(cfg *config.Provider, auth *middleware.AuthMiddleware, executor *Executor) *passthroughMiddleware {
+	return &passthroughMiddleware{cfg: cfg, auth: auth, executor: executor}
+}
+
+func (m *passthroughMiddleware) Name() string {
+	return "passthrough"
+}
+
+func (m *passthroughMiddleware) Process(req *http.Request, next middleware.Handler) (*http.Response, error) {
+	_, kind, _ := splitEndpoint(req.URL.Path)
+	if kind != "manifests" && kind != "blobs" || req.Method != http.MethodGet && req.Method != http.MethodHead ||
+		!m.cfg.Current().GetRegistrySettings(req.URL.Host).Passthrough() {
+		return next(req)
+	}
+	check := req.Clone(req.Context())
+	check.Method, check.Body, check.GetBody, check.ContentLength = http.MethodHead, http.NoBody, nil, 0
+	check.Header.Del("Range")
+	resp, err := m.auth.Process(check, m.executor.Confirm)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		resp.Body.Close()
+		return next(req)
+	}
+	// A HEAD response carries no body, so GETs get the refusal without one.
+	resp.Body.Close()
+	resp.Body, resp.ContentLength, resp.Request = http.NoBody, 0, req
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
@@ -14,6 +14,7 @@ type Middleware interface {
 type Pipeline struct {
 	middlewares  []Middleware
 	finalHandler middleware.Handler
+	audit        func() bool
 }
 
 func NewPipeline() *Pipeline {
@@ -27,11 +28,27 @@ func (p *Pipeline) Use(m Middleware) *Pipeline {
 	return p
 }
 
+// Names returns the middleware names in execution order.
+func (p *Pipeline) Names() []string {
+	names := make([]string, len(p.middlewares))
+	for i, m := range p.middlewares {
+		names[i] = m.Name()
+	}
+	return names
+}
+
 func (p *Pipeline) SetFinalHandler(h middleware.Handler) *Pipeline {
 	p.finalHandler = h
 	return p
 }
 
+// SetAudit makes the pipeline check middlewares for unsafe request and
+// response handling while enabled reports true.
+func (p *Pipeline) SetAudit(enabled func() bool) *Pipeline {
+	p.audit = enabled
+	return p
+}
+
 func (p *Pipeline) Execute(req *http.Request) (*http.Response, error) {
 	if len(p.middlewares) == 0 {
 		if p.finalHandler != nil {
@@ -47,6 +64,9 @@ func (p *Pipeline) Execute(req *http.Request) (*http.Response, error) {
 		m := p.middlewares[i]
 		next := chain
 		chain = func(r *http.Request) (*http.Response, error) {
+			if p.audit != nil && p.audit() {
+				return auditProcess(m, r, next)
+			}
 			return m.Process(r, next)
 		}
 	}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+// auditProcess runs m and logs violations of the pipeline's contracts, which
+// custom middlewares can easily break: requests passed down must be clones
+// rather than modified in place, responses a middleware replaces must be
+// closed, and response bodies must not be read after Close or concurrently.
+func auditProcess(m Middleware, req *http.Request, next middleware.Handler) (*http.Response, error) {
+	before := snapshotRequest(req)
+	var received []*http.Response
+	resp, err := m.Process(req, func(r *http.Request) (*http.Response, error) {
+		resp, err := next(r)
+		if resp != nil && resp.Body != nil {
+			if _, ok := resp.Body.(*auditedBody); !ok {
+				resp.Body = &auditedBody{ReadCloser: resp.Body, ctx: r.Context(), source: m.Name()}
+			}
+			received = append(received, resp)
+		}
+		return resp, err
+	})
+
+	if after := snapshotRequest(req); after != before {
+		logging.Logger.WarnContext(req.Context(), "pipeline audit: middleware modified a shared request in place, use Request.Clone",
+			"middleware", m.Name(), "method", after.method != before.method, "url", after.url != before.url, "headers", after.header != before.header)
+	}
+	for _, r := range received {
+		if b, ok := r.Body.(*auditedBody); ok && r != resp && !b.closed.Load() {
+			logging.Logger.WarnContext(req.Context(), "pipeline audit: middleware discarded a response without closing its body",
+				"middleware", m.Name(), "status", r.StatusCode)
+		}
+	}
+	return resp, err
+}
+
+type requestSnapshot struct {
+	method, url, header string
+}
+
+func snapshotRequest(req *http.Request) requestSnapshot {
+	var header bytes.Buffer
+	req.Header.Write(&header)
+	return requestSnapshot{method: req.Method, url: req.URL.String(), header: header.String()}
+}
+
+// auditedBody reports reads after Close and concurrent reads of a response
+// body produced below the source middleware.
+type auditedBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	source   string
+	reading  atomic.Bool
+	closed   atomic.Bool
+	reported atomic.Bool
+}
+
+func (b *auditedBody) Read(p []byte) (int, error) {
+	if b.closed.Load() {
+		b.report("pipeline audit: response body read after Close")
+	}
+	if !b.reading.CompareAndSwap(false, true) {
+		b.report("pipeline audit: response body read concurrently by two readers")
+	} else {
+		defer b.reading.Store(false)
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func (b *auditedBody) Close() error {
+	b.closed.Store(true)
+	return b.ReadCloser.Close()
+}
+
+func (b *auditedBody) report(msg string) {
+	if b.reported.CompareAndSwap(false, true) {
+		logging.Logger.WarnContext(b.ctx, msg, "below_middleware", b.source)
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// policyInput is the input document of policy decisions.
+type policyInput struct {
+	Method     string `json:"method"`
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest"`
+	MediaType  string `json:"media_type"`
+	User       string `json:"user,omitempty"`
+	ClientIP   string `json:"client_ip"`
+}
+
+// policyEngine admits client manifest requests with an OPA/Rego policy. The
+// decision is a boolean or an object with allow and an optional reason;
+// undefined decisions deny.
+type policyEngine struct {
+	cfg    *config.Provider
+	client *http.Client
+	mu     sync.Mutex
+	opa    *opaServer
+}
+
+func newPolicyEngine(cfg *config.Provider) *policyEngine {
+	p := &policyEngine{cfg: cfg, client: &http.Client{}}
+	p.server(cfg.Current().Policy)
+	cfg.OnReload(func(_, c *config.Config) { p.server(c.Policy) })
+	return p
+}
+
+// admit returns why the policy denies input, or "" when it is allowed. Failed
+// evaluations are errors unless policy.fail_open is set.
+func (p *policyEngine) admit(ctx context.Context, input policyInput) (string, error) {
+	settings := p.cfg.Current().Policy
+	if settings.URL == "" && settings.Bundle == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, settings.Timeout)
+	defer cancel()
+	result, err := p.evaluate(ctx, settings, input)
+	var decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err == nil && len(result) > 0 && json.Unmarshal(result, &decision.Allow) != nil && json.Unmarshal(result, &decision) != nil {
+		err = fmt.Errorf("unexpected decision %s", result)
+	}
+	if err != nil {
+		if settings.FailOpen {
+			logging.Logger.WarnContext(ctx, "policy evaluation failed, allowing request", "error", err)
+			return "", nil
+		}
+		return "", err
+	}
+	if decision.Allow {
+		return "", nil
+	}
+	if decision.Reason == "" {
+		decision.Reason = "denied by policy"
+	}
+	return decision.Reason, nil
+}
+
+// evaluate returns the policy's decision for input, or nil when it is
+// undefined.
+func (p *policyEngine) evaluate(ctx context.Context, settings config.PolicySettings, input policyInput) (json.RawMessage, error) {
+	if settings.URL != "" {
+		return queryOPA(ctx, p.client, settings.URL, input)
+	}
+	s := p.server(settings)
+	select {
+	case <-s.ready:
+	case <-s.exited:
+		return nil, s.err()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for opa to start: %w", ctx.Err())
+	}
+	path := strings.ReplaceAll(strings.TrimPrefix(settings.Query, "data."), ".", "/")
+	return queryOPA(ctx, s.client, "http://opa/v1/data/"+path, input)
+}
+
+// queryOPA posts input to an OPA data API endpoint and returns its result.
+func queryOPA(ctx context.Context, client *http.Client, url string, input policyInput) (json.RawMessage, error) {
+	body, _ := json.Marshal(map[string]any{"input": input})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OPA returned %d", resp.StatusCode)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("decoding OPA response: %w", err)
+	}
+	return response.Result, nil
+}
+
+// server returns the opa server of policy.bundle, starting it when the
+// bundle or command changed, or when the previous one exited over ten
+// seconds after it was started. Without a bundle it stops the server and
+// returns nil.
+func (p *policyEngine) server(settings config.PolicySettings) *opaServer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.opa; s != nil && (s.bundle != settings.Bundle || s.command != settings.Command || s.exitedAfter(10*time.Second)) {
+		go s.stop()
+		p.opa = nil
+	}
+	if p.opa == nil && settings.Bundle != "" {
+		p.opa = startOPA(settings)
+	}
+	return p.opa
+}
+
+// close stops the opa server.
+func (p *policyEngine) close() {
+	p.server(config.PolicySettings{})
+}
+
+// opaServer is an `opa run --server` process serving a policy bundle on a
+// unix socket in a private directory, so decisions are made by one long
+// running opa instead of an opa process each.
+type opaServer struct {
+	bundle, command string
+	dir             string
+	started         time.Time
+	cmd             *exec.Cmd
+	client          *http.Client
+	stderr          bytes.Buffer
+	ready, exited   chan struct{}
+	waitErr         error
+}
+
+func startOPA(settings config.PolicySettings) *opaServer {
+	s := &opaServer{bundle: settings.Bundle, command: settings.Command, started: time.Now(), ready: make(chan struct{}), exited: make(chan struct{})}
+	dir, err := os.MkdirTemp("", "oci-proxy-opa")
+	if err != nil {
+		s.waitErr = err
+		close(s.exited)
+		return s
+	}
+	s.dir = dir
+	socket := filepath.Join(dir, "opa.sock")
+	s.client = &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}}}
+	s.cmd = exec.Command(settings.Command, "run", "--server", "--log-level", "error", "--addr", "unix://"+socket, "--bundle", settings.Bundle)
+	s.cmd.Stderr = &s.stderr
+	if err := s.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		s.waitErr = err
+		close(s.exited)
+		return s
+	}
+	go func() {
+		s.waitErr = s.cmd.Wait()
+		os.RemoveAll(dir)
+		close(s.exited)
+	}()
+	go func() {
+		for {
+			if resp, err := s.client.Get("http://opa/health"); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					close(s.ready)
+					return
+				}
+			}
+			select {
+			case <-s.exited:
+				logging.Logger.Error("opa server exited", "bundle", s.bundle, "error", s.err())
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}()
+	return s
+}
+
+// exitedAfter reports whether the server exited and was started longer
+// than d ago.
+func (s *opaServer) exitedAfter(d time.Duration) bool {
+	select {
+	case <-s.exited:
+		return time.Since(s.started) > d
+	default:
+		return false
+	}
+}
+
+// err describes why the server exited. Call it once exited is closed.
+func (s *opaServer) err() error {
+	if message := strings.TrimSpace(s.stderr.String()); message != "" {
+		return fmt.Errorf("opa exited: %v: %s", s.waitErr, message)
+	}
+	return fmt.Errorf("opa exited: %v", s.waitErr)
+}
+
+func (s *opaServer) stop() {
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	<-s.exited
+}
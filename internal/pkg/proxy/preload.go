@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// Preloader downloads the blobs of the configured preload images into the
+// cache at startup and every preload interval. Manifests are resolved on each
+// round, so moved tags are followed; blobs already cached are skipped.
+type Preloader struct {
+	cfg       *config.Provider
+	graphs    *GraphBuilder
+	transport http.RoundTripper
+}
+
+func NewPreloader(cfg *config.Provider, graphs *GraphBuilder, transport http.RoundTripper) *Preloader {
+	return &Preloader{cfg: cfg, graphs: graphs, transport: transport}
+}
+
+func (p *Preloader) Run(stop <-chan struct{}) {
+	for {
+		p.preloadAll(stop)
+		select {
+		case <-time.After(p.cfg.Current().Preload.Interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *Preloader) preloadAll(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(withBackground(context.Background()))
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, image := range p.cfg.Current().Preload.Images {
+		if ctx.Err() != nil {
+			return
+		}
+		fetched, bytes, err := p.preload(ctx, image)
+		if err != nil {
+			logging.Logger.Warn("failed to preload image", "image", image.Image, "error", err)
+		} else if fetched > 0 {
+			logging.Logger.Info("preloaded image", "image", image.Image, "blobs", fetched, "bytes", bytes)
+		}
+	}
+}
+
+// preload fetches the uncached blobs of image through the pipeline, which
+// stores them in the registry's cache.
+func (p *Preloader) preload(ctx context.Context, image config.PreloadImage) (int, int64, error) {
+	graph, err := p.graphs.Build(ctx, image.Image)
+	if err != nil {
+		return 0, 0, err
+	}
+	missing, err := missingBlobs(graph, image.Platforms)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, digest := range missing {
+		n, err := p.fetchBlob(ctx, graph, digest)
+		if err != nil {
+			return 0, 0, fmt.Errorf("fetching blob %s: %w", digest, err)
+		}
+		total += n
+	}
+	return len(missing), total, nil
+}
+
+func (p *Preloader) fetchBlob(ctx context.Context, graph *ImageGraph, digest string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.graphs.upstreamURL(graph.Registry, graph.Repository, "blobs", digest), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return io.Copy(io.Discard, resp.Body)
+}
@@ -1,74 +1,274 @@
 package proxy
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/kv"
 	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+	"oci-proxy/internal/pkg/proxy/cache"
 	"oci-proxy/internal/pkg/proxy/middleware"
+	"oci-proxy/pkg/api"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 //go:embed all:web
 var webFS embed.FS
 
+// authKey holds whether the request passed client authentication, and
+// adminKey whether its client may use the management API.
+type (
+	authKey  struct{}
+	adminKey struct{}
+)
+
+// proxyChallenge asks clients for the credentials they logged in with.
+const proxyChallenge = `Basic realm="OCI-Proxy"`
+
+const maxCatalogSize = 16 << 20
+
+// The documents of the management API are declared in pkg/api, shared with
+// pkg/client.
+type (
+	RegistryStats    = api.RegistryStats
+	CredentialStatus = api.CredentialStatus
+	UpstreamStats    = api.UpstreamStats
+	ThrottleStats    = api.ThrottleStats
+	PullSession      = api.PullSession
+	PullSessionStats = api.PullSessionStats
+	RepositoryStats  = api.RepositoryStats
+	PullRanking      = api.PullRanking
+	StatsSample      = api.StatsSample
+	StatsPeriod      = api.StatsPeriod
+	QuotaReport      = api.QuotaReport
+	OverloadStatus   = api.OverloadStatus
+	Info             = api.Info
+	RegistryInfo     = api.RegistryInfo
+	ImageGraph       = api.ImageGraph
+	GraphNode        = api.GraphNode
+	CacheCheck       = api.CacheCheck
+	CacheEntries     = api.CacheEntries
+	CacheClear       = api.CacheClear
+	State            = api.State
+	StateImport      = api.StateImport
+	AuditRecord      = api.AuditRecord
+)
+
 type ProxyServer struct {
 	*http.Server
-	cacheManager *CacheManager
+	cfg            *config.Provider
+	proxy          *httputil.ReverseProxy
+	db             *metadb.DB
+	cacheManager   *CacheManager
+	executor       *Executor
+	checker        *CredentialChecker
+	pullStats      *PullStats
+	shadower       *Shadower
+	sharding       *sharding
+	graphs         *GraphBuilder
+	upstreamErrors *upstreamErrors
+	history        *StatsHistory
+	sessions       *pullSessions
+	quotas         *quotas
+	overload       *overload
+	clientLimits   *clientLimiter
+	audit          *auditLog
+	policy         *policyEngine
+	webhooks       *webhooks
+	pipeline       *Pipeline
+	stop           chan struct{}
 }
 
-func NewProxy(cfg *config.Config) (*ProxyServer, error) {
+func NewProxy(cfg *config.Provider) (*ProxyServer, error) {
+	db, err := metadb.Open(cfg.Current().MetadataDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata db: %w", err)
+	}
+	pullStats := NewPullStats(db)
+
+	webhooks := newWebhooks(cfg)
 	cacheManager := NewCacheManager(cfg)
-	executor := NewExecutor(cfg)
+	cacheManager.webhooks = webhooks
+	store, err := newStore(cfg.Current().Store)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store.redis.address: %w", err)
+	}
+	auth := middleware.NewAuthMiddleware(cfg, store)
+	executor := NewExecutor(cfg, auth)
+	auth.SetTransport(executor.Transport)
+	checker := NewCredentialChecker(cfg, executor)
 
-	pipeline := NewPipeline().
+	if cfg.Current().Store.CacheIndex {
+		cacheManager.index = store
+	}
+	scanner := NewScanner(cfg, db)
+	policy := newPolicyEngine(cfg)
+	pipeline := NewPipeline()
+	transport := NewTransport(pipeline)
+	graphs := NewGraphBuilder(cfg, cacheManager, transport)
+	pipeline.
+		Use(newPassthroughMiddleware(cfg, auth, executor)).
+		Use(newSignatureMiddleware(cfg, graphs)).
+		Use(middleware.NewCompatMiddleware(cfg)).
+		Use(middleware.NewTagMiddleware(cfg, store)).
 		Use(middleware.NewCacheMiddleware(cacheManager)).
-		Use(middleware.NewAuthMiddleware(cfg)).
-		SetFinalHandler(executor.Execute)
+		Use(auth).
+		Use(newManifestMiddleware(cfg, cacheManager, db, scanner, policy, webhooks)).
+		SetFinalHandler(executor.Execute).
+		SetAudit(func() bool { return cfg.Current().PipelineAudit })
 
-	transport := NewTransport(pipeline)
+	upstreamErrors := newUpstreamErrors(webhooks)
+	history := NewStatsHistory(cfg, db, cacheManager)
+	sessions := newPullSessions(cfg, pullStats, webhooks)
+	quotas := newQuotas(cfg, db)
+	overload := newOverload(cfg)
+	clientLimits := newClientLimiter(cfg)
+	audit := newAuditLog(cfg)
 
 	proxy := &httputil.ReverseProxy{
-		Director:  newDirector(cfg),
-		Transport: transport,
+		Director:       newDirector(cfg),
+		Transport:      transport,
+		ModifyResponse: newResponseModifier(cfg, pullStats, upstreamErrors),
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			logging.Logger.Debug("proxy error", "error", err, "path", r.URL.Path)
+			logging.Logger.DebugContext(r.Context(), "proxy error", "error", err, "path", r.URL.Path)
 			if err == r.Context().Err() {
 				return
 			}
-			w.WriteHeader(http.StatusBadGateway)
+			if errors.Is(err, errResponseHeadersTooLarge) {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			upstreamErrors.writeUnreachable(w, accessEntryFrom(r.Context()).registry, err)
 		},
 	}
 
 	ps := &ProxyServer{
-		cacheManager: cacheManager,
+		cfg:            cfg,
+		proxy:          proxy,
+		db:             db,
+		cacheManager:   cacheManager,
+		executor:       executor,
+		checker:        checker,
+		pullStats:      pullStats,
+		shadower:       NewShadower(cfg),
+		sharding:       newSharding(cfg),
+		graphs:         graphs,
+		upstreamErrors: upstreamErrors,
+		history:        history,
+		sessions:       sessions,
+		quotas:         quotas,
+		overload:       overload,
+		clientLimits:   clientLimits,
+		audit:          audit,
+		policy:         policy,
+		webhooks:       webhooks,
+		pipeline:       pipeline,
+		stop:           make(chan struct{}),
 	}
-	ps.Server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: newProxyHandler(proxy, cacheManager, cfg),
+	_, addr := cfg.Current().Listen()
+	ps.Server = &http.Server{Addr: addr, Handler: ps.handler()}
+	if current := cfg.Current(); current.TLS != nil || current.ACME != nil {
+		tlsSettings := current.TLS
+		if tlsSettings == nil {
+			tlsSettings = &config.TLSSettings{}
+		}
+		if ps.TLSConfig, err = tlsSettings.ServerConfig(); err != nil {
+			return nil, err
+		}
+		if current.ACME != nil {
+			manager := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(current.ACME.Domains...),
+				Cache:      autocert.DirCache(current.ACME.CacheDir),
+				Email:      current.ACME.Email,
+			}
+			if current.ACME.DirectoryURL != "" {
+				manager.Client = &acme.Client{DirectoryURL: current.ACME.DirectoryURL}
+			}
+			ps.TLSConfig.GetCertificate = manager.GetCertificate
+			ps.TLSConfig.NextProtos = []string{acme.ALPNProto}
+		}
 	}
+	logStartupReport(newInfo(cfg.Current(), pipeline))
+	go checker.Run(ps.stop)
+	go cacheManager.Run(ps.stop)
+	go NewKeepWarm(cfg, executor).Run(ps.stop)
+	go NewRetention(cfg, cacheManager, pullStats, graphs).Run(ps.stop)
+	go NewScrubber(cfg, cacheManager).Run(ps.stop)
+	preloader := NewPreloader(cfg, graphs, transport)
+	go preloader.Run(ps.stop)
+	go NewMirrorSync(cfg, preloader).Run(ps.stop)
+	go history.Run(ps.stop)
+	go sessions.Run(ps.stop)
+	go overload.Run(ps.stop)
+	go scanner.Run(ps.stop)
+	go webhooks.Run(ps.stop)
+	go ps.flushMetadata()
 	return ps, nil
 }
 
-func newProxyHandler(proxy *httputil.ReverseProxy, cacheManager *CacheManager, cfg *config.Config) http.Handler {
-	mux := http.NewServeMux()
-
-	logRequest := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			logging.Logger.Info("Request", "method", r.Method, "path", r.URL.Path)
-			next.ServeHTTP(w, r)
+func newStore(settings config.StoreSettings) (kv.Store, error) {
+	if settings.Backend == "redis" {
+		return kv.NewRedisStore(kv.RedisOptions{
+			Address:  settings.Redis.Address,
+			Username: settings.Redis.Username,
+			Password: settings.Redis.Password,
+			DB:       settings.Redis.DB,
+			Prefix:   settings.Redis.Prefix,
 		})
 	}
+	return kv.NewMemoryStore(), nil
+}
+
+func (ps *ProxyServer) flushMetadata() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ps.db.Flush(); err != nil {
+				logging.Logger.Error("failed to flush metadata db", "error", err)
+			}
+		case <-ps.stop:
+			return
+		}
+	}
+}
+
+func (ps *ProxyServer) Shutdown(ctx context.Context) error {
+	close(ps.stop)
+	defer ps.audit.close()
+	defer ps.policy.close()
+	return ps.Server.Shutdown(ctx)
+}
+
+func (ps *ProxyServer) handler() http.Handler {
+	mux := http.NewServeMux()
 
 	requireAuth := func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			if !cfg.Auth.IsAuthenticated(r) {
-				w.Header().Set("WWW-Authenticate", `Basic realm="OCI-Proxy"`)
+			if ok, _ := r.Context().Value(authKey{}).(bool); !ok {
+				w.Header().Set("WWW-Authenticate", proxyChallenge)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -76,17 +276,333 @@ func newProxyHandler(proxy *httputil.ReverseProxy, cacheManager *CacheManager, c
 		}
 	}
 
+	requireAdmin := func(next http.HandlerFunc) http.HandlerFunc {
+		return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+			if admin, _ := r.Context().Value(adminKey{}).(bool); !admin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		})
+	}
+
+	// passthroughAuth lets requests to registries in passthrough mode through
+	// with any credentials, which the upstream checks instead of the proxy, and
+	// challenges clients sending none so they send the ones they logged in
+	// with. The API version check challenges them too when any registry is in
+	// passthrough mode, since clients only send credentials once challenged.
+	passthroughAuth := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			current := ps.cfg.Current()
+			registry, _ := resolveUpstream(r.URL.Path, current)
+			ping := strings.Trim(r.URL.Path, "/") == "v2"
+			if ping && !current.HasPassthrough() || !ping && !current.GetRegistrySettings(registry).Passthrough() {
+				requireAuth(next)(w, r)
+				return
+			}
+			user, pass, ok := r.BasicAuth()
+			if !ok {
+				w.Header().Set("WWW-Authenticate", proxyChallenge)
+				writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "log in to the proxy with your upstream registry credentials")
+				return
+			}
+			ctx := middleware.WithClientAuth(r.Context(), config.Auth{Username: user, Password: pass})
+			next(w, r.WithContext(ctx))
+		}
+	}
+
+	// The health check stays 200 while overloaded so orchestrators do not
+	// restart an instance that is shedding load.
 	mux.HandleFunc("/_/health", func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{"status": "healthy"}
+		if status := ps.overload.status(); status.Reason != "" || status.Shed > 0 {
+			body["overload"] = status
+			if status.Reason != "" {
+				body["status"] = "overloaded"
+			}
+		}
+		if n := ps.clientLimits.rejected.Load(); n > 0 {
+			body["client_limited"] = n
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+		json.NewEncoder(w).Encode(body)
 	})
 
-	mux.HandleFunc("/_/stats", requireAuth(func(w http.ResponseWriter, r *http.Request) {
-		stats := cacheManager.GetStats()
+	// Clients other than admins get the cache statistics and upstream error
+	// counts the dashboard shows, without credential errors, upstream targets,
+	// throttling or pull sessions.
+	mux.HandleFunc("/_/stats", requireAuth(compressed(func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]RegistryStats)
+		for host, s := range ps.cacheManager.GetStats() {
+			stats[host] = RegistryStats{CacheStats: s}
+		}
+		for host, kinds := range ps.upstreamErrors.snapshot() {
+			s := stats[host]
+			s.UpstreamErrors = kinds
+			stats[host] = s
+		}
+		if admin, _ := r.Context().Value(adminKey{}).(bool); admin {
+			for host, status := range ps.checker.Statuses() {
+				s := stats[host]
+				s.Credential = &status
+				stats[host] = s
+			}
+			for host, upstreams := range ps.executor.UpstreamStats() {
+				s := stats[host]
+				s.Upstreams = upstreams
+				stats[host] = s
+			}
+			for host, throttling := range ps.executor.ThrottleStats() {
+				s := stats[host]
+				s.Throttling = &throttling
+				stats[host] = s
+			}
+			for host, pulls := range ps.sessions.snapshot() {
+				s := stats[host]
+				s.PullSessions = &pulls
+				stats[host] = s
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(stats)
+	})))
+
+	mux.HandleFunc("/_/stats/repositories", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ps.pullStats.All())
+	})))
+
+	mux.HandleFunc("GET /_/api/v1/pulls", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ps.sessions.list(r.URL.Query().Get("registry")))
+	})))
+
+	mux.HandleFunc("GET /_/audit", requireAdmin(compressed(ps.audit.serve)))
+
+	mux.HandleFunc("GET /_/api/v1/quotas", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = quotaMonth(time.Now())
+		} else if _, err := time.Parse("2006-01", month); err != nil {
+			http.Error(w, "month must be formatted as YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ps.quotas.report(month))
+	})))
+
+	mux.HandleFunc("GET /_/api/v1/stats/history", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "day"
+		} else if period != "day" && period != "week" {
+			http.Error(w, "period must be day or week", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ps.history.Query(r.URL.Query().Get("registry"), period))
+	})))
+
+	mux.HandleFunc("GET /_/api/v1/stats/top", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		kind, by := cmp.Or(q.Get("kind"), "repositories"), cmp.Or(q.Get("by"), "pulls")
+		if kind != "repositories" && kind != "images" {
+			http.Error(w, "kind must be repositories or images", http.StatusBadRequest)
+			return
+		}
+		if by != "pulls" && by != "bytes" && by != "cached_bytes" {
+			http.Error(w, "by must be pulls, bytes or cached_bytes", http.StatusBadRequest)
+			return
+		}
+		n := 10
+		if v := q.Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+				http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ps.pullStats.Top(kind == "images", q.Get("registry"), by, n))
+	})))
+
+	mux.HandleFunc("GET /_/metrics", requireAdmin(compressed(serveMetrics(ps.executor, ps.pullStats))))
+
+	mux.HandleFunc("/_/api/v1/info", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(newInfo(ps.cfg.Current(), ps.pipeline))
+	})))
+
+	mux.HandleFunc("GET /_/api/v1/graph", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		image := r.URL.Query().Get("image")
+		if image == "" {
+			http.Error(w, "image parameter is required", http.StatusBadRequest)
+			return
+		}
+		graph, err := ps.graphs.Build(r.Context(), image)
+		if err != nil {
+			logging.Logger.DebugContext(r.Context(), "failed to build image graph", "image", image, "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(graph)
+	})))
+
+	mux.HandleFunc("POST /_/api/v1/cache/check", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Images    []string `json:"images"`
+			Platforms []string `json:"platforms"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Images) == 0 {
+			http.Error(w, "expected a JSON body with a non-empty images list", http.StatusBadRequest)
+			return
+		}
+		results := make([]CacheCheck, len(body.Images))
+		for i, image := range body.Images {
+			results[i] = ps.graphs.Check(r.Context(), image, body.Platforms)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(results)
+	})))
+
+	mux.HandleFunc("DELETE /_/cache/{registry}/{digest}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		registry, digest := r.PathValue("registry"), r.PathValue("digest")
+		if !ps.cfg.Current().IsRegistryAllowed(registry) || !ps.cacheManager.GetCache(registry).Remove(digest) {
+			http.Error(w, "Blob not cached", http.StatusNotFound)
+			return
+		}
+		logging.Logger.InfoContext(r.Context(), "purged cached blob", "registry", registry, "digest", digest)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /_/cache/{registry}/entries", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		registry := r.PathValue("registry")
+		if !ps.cfg.Current().IsRegistryAllowed(registry) {
+			http.Error(w, "Registry not allowed", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		entries := ps.cacheManager.GetCache(registry).Entries()
+		switch q.Get("sort") {
+		case "", "recent":
+		case "size":
+			slices.SortStableFunc(entries, func(a, b cache.Entry) int { return cmp.Compare(b.Size, a.Size) })
+		case "age":
+			slices.SortStableFunc(entries, func(a, b cache.Entry) int { return a.LastAccess.Compare(b.LastAccess) })
+		default:
+			http.Error(w, "sort must be recent, size or age", http.StatusBadRequest)
+			return
+		}
+		offset = min(max(offset, 0), len(entries))
+		page := entries[offset:min(offset+min(limit, 1000), len(entries))]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(CacheEntries{Total: len(entries), Offset: offset, Entries: page})
+	})))
+
+	mux.HandleFunc("POST /_/cache/{registry}/clear", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		registry := r.PathValue("registry")
+		if !ps.cfg.Current().IsRegistryAllowed(registry) {
+			http.Error(w, "Registry not allowed", http.StatusNotFound)
+			return
+		}
+		c := ps.cacheManager.GetCache(registry)
+		stats := c.Stats()
+		if err := c.Clear(); err != nil {
+			logging.Logger.ErrorContext(r.Context(), "failed to clear cache", "registry", registry, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logging.Logger.InfoContext(r.Context(), "cleared registry cache", "registry", registry, "items", stats.Items, "bytes", stats.CurrentSize)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(CacheClear{Status: "cleared", Items: stats.Items, Bytes: stats.CurrentSize})
+	}))
+
+	mux.HandleFunc("GET /_/api/v1/state", requireAdmin(compressed(func(w http.ResponseWriter, r *http.Request) {
+		hosts := configuredHosts(ps.cfg.Current())
+		for host := range ps.cacheManager.GetStats() {
+			if !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+		state, err := snapshotState(ps.cfg, ps.db, ps.cacheManager, hosts, r.URL.Query().Get("secrets") == "true")
+		if err != nil {
+			logging.Logger.ErrorContext(r.Context(), "failed to export state", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="oci-proxy-state.json"`)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(state)
+	})))
+
+	mux.HandleFunc("POST /_/api/v1/state", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var state State
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, "expected a state exported from GET /_/api/v1/state", http.StatusBadRequest)
+			return
+		}
+		if state.Version != stateVersion {
+			http.Error(w, fmt.Sprintf("unsupported state version %d", state.Version), http.StatusBadRequest)
+			return
+		}
+		withConfig := r.URL.Query().Get("config") != "false"
+		if withConfig && state.Redacted {
+			http.Error(w, errRedactedState.Error()+", pass config=false", http.StatusBadRequest)
+			return
+		}
+		if withConfig {
+			if err := config.Install(ps.cfg.Path(), []byte(state.Config), state.Htpasswd, ps.cfg.Current().Auth.HtpasswdFile); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := ps.cfg.Reload(); err != nil {
+				logging.Logger.Error("Failed to reload config", "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		result, err := restoreState(ps.db, ps.cacheManager, &state)
+		if err != nil {
+			logging.Logger.ErrorContext(r.Context(), "failed to import state", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Config = withConfig
+		logging.Logger.InfoContext(r.Context(), "imported state", "exported_at", state.ExportedAt, "config", withConfig,
+			"metadata_keys", result.MetadataKeys, "cache_entries", result.CacheEntries, "missing_blobs", result.MissingBlobs)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}))
+
+	mux.HandleFunc("POST /_/reload", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if err := ps.cfg.Reload(); err != nil {
+			logging.Logger.Error("Failed to reload config", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
 	}))
 
 	webRoot, _ := fs.Sub(webFS, "web")
@@ -102,42 +618,150 @@ func newProxyHandler(proxy *httputil.ReverseProxy, cacheManager *CacheManager, c
 			return
 		}
 
-		requireAuth(func(w http.ResponseWriter, r *http.Request) {
-			if cfg.WhitelistMode && !isRegistryAllowed(r, cfg) {
+		passthroughAuth(func(w http.ResponseWriter, r *http.Request) {
+			current := ps.cfg.Current()
+			if isLocalPing(r, current) {
+				w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(map[string]string{})
+				return
+			}
+			if reason := ps.overload.admit(); reason != "" {
+				logging.Logger.DebugContext(r.Context(), "shed registry request", "reason", reason)
+				w.Header().Set("Retry-After", strconv.Itoa(int(current.Overload.RetryAfter.Seconds())))
+				writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the proxy is overloaded ("+reason+"), retry later")
+				return
+			}
+			defer ps.overload.done()
+			// Clients are limited by the peer that proxied their request.
+			if !accessEntryFrom(r.Context()).peer {
+				done, reason, retryAfter := ps.clientLimits.admit(clientIP(r), accessEntryFrom(r.Context()).user, r.Method == http.MethodGet && isBlobPath(r.URL.Path))
+				if reason != "" {
+					logging.Logger.DebugContext(r.Context(), "client limit reached", "reason", reason)
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					writeRegistryError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "client limit reached: "+reason+", retry later")
+					return
+				}
+				defer done()
+			}
+			if !isRegistryAllowed(r, current) {
 				http.Error(w, "Registry not allowed", http.StatusForbidden)
 				return
 			}
-			proxy.ServeHTTP(w, r)
+			registry, upstreamPath := resolveUpstream(r.URL.Path, current)
+			entry := accessEntryFrom(r.Context())
+			entry.registry, entry.repository, entry.reference = registry, repositoryName(upstreamPath), reference(upstreamPath)
+			settings := current.GetRegistrySettings(registry)
+			if !settings.AllowsMethod(r.Method) {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if settings.IsPathBlocked(upstreamPath) {
+				http.Error(w, "Path blocked", http.StatusForbidden)
+				return
+			}
+			if repo := repositoryName(upstreamPath); repo != "" && !settings.AllowsRepository(repo) {
+				writeRegistryError(w, http.StatusForbidden, "DENIED", fmt.Sprintf("repository %s/%s is not allowed by proxy policy", registry, repo))
+				return
+			}
+			if tag := manifestTag(r.Method, upstreamPath); tag != "" && !settings.AllowsTag(tag) {
+				writeRegistryError(w, http.StatusForbidden, "DENIED", fmt.Sprintf("tag %q is not allowed by proxy policy, pin a permitted tag or digest", tag))
+				return
+			}
+			if exceeded, retryAfter, warning := ps.quotas.check(entry.user, quotaNamespace(registry, entry.repository)); exceeded != "" && !entry.peer {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+				writeRegistryError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", exceeded)
+				return
+			} else if warning != "" && !entry.peer {
+				w.Header().Set(quotaWarningHeader, warning)
+			}
+			admin, _ := r.Context().Value(adminKey{}).(bool)
+			if expose := admin && r.Header.Get(timingHeader) != ""; expose || logging.Logger.Enabled(r.Context(), slog.LevelDebug) {
+				r = r.WithContext(withUpstreamTiming(r.Context(), expose))
+			}
+			if !entry.peer {
+				if entry.reference != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+					entry.session = ps.sessions.begin(registry, entry.repository, entry.reference, clientIP(r), !isBlobPath(upstreamPath))
+				}
+				ps.shadower.Mirror(r)
+			}
+			ps.sharding.serve(w, r, upstreamPath, ps.proxy)
 		})(w, r)
 	})
 
-	return logRequest(mux)
+	var handler http.Handler = mux
+	handler = allowClients(ps.cfg, handler)
+	handler = ps.audit.recordPulls(handler)
+	handler = ps.accountTraffic(handler)
+	handler = authenticate(ps.cfg, handler)
+	return accessLog(handler)
+}
+
+// authenticate identifies the client and whether it may use the management
+// API, and marks requests proxied by a sharding peer.
+func authenticate(cfg *config.Provider, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := cfg.Current()
+		user, groups, ok := current.Auth.Authenticate(r)
+		entry := accessEntryFrom(r.Context())
+		entry.user, entry.peer = user, fromPeer(r, current)
+		addr, _ := netip.ParseAddr(entry.client)
+		ctx := context.WithValue(r.Context(), authKey{}, ok)
+		ctx = context.WithValue(ctx, adminKey{}, ok && current.IsAdmin(user, groups, addr))
+		ctx = middleware.WithUser(ctx, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// allowClients rejects clients outside allowed_cidrs, or admin_allowed_cidrs
+// for the management API and web UI. The health check stays open to probes,
+// and peers without an IP address, such as those of unix socket listeners,
+// are local.
+func allowClients(cfg *config.Provider, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry := r.URL.Path == "/v2" || strings.HasPrefix(r.URL.Path, "/v2/")
+		if r.URL.Path != "/_/health" {
+			addr, err := netip.ParseAddr(clientIP(r))
+			if err == nil && !cfg.Current().AllowsClient(addr, !registry) {
+				logging.Logger.DebugContext(r.Context(), "client address not allowed", "client_ip", clientIP(r))
+				if registry {
+					writeRegistryError(w, http.StatusForbidden, "DENIED", "client address "+clientIP(r)+" is not allowed")
+				} else {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (ps *ProxyServer) PersistCache() {
 	if ps.cacheManager != nil {
 		ps.cacheManager.PersistAll()
 	}
+	if err := ps.db.Flush(); err != nil {
+		logging.Logger.Error("failed to flush metadata db", "error", err)
+	}
 }
 
-func newDirector(cfg *config.Config) func(*http.Request) {
+func newDirector(provider *config.Provider) func(*http.Request) {
 	return func(req *http.Request) {
-		remoteHost := cfg.DefaultRegistry
+		cfg := provider.Current()
+		remoteHost, upstreamPath := resolveUpstream(req.URL.Path, cfg)
+		req.URL.Path, req.URL.RawPath = upstreamPath, ""
 
-		path := req.URL.Path
-		parts := strings.Split(strings.Trim(path, "/"), "/")
-
-		if len(parts) >= 2 && parts[0] == "v2" {
-			potentialRegistry := parts[1]
-			if strings.Contains(potentialRegistry, ".") {
-				remoteHost = potentialRegistry
-				req.URL.Path = "/v2/" + strings.Join(parts[2:], "/")
-			} else if !strings.Contains(potentialRegistry, "/") {
-				req.URL.Path = "/v2/library/" + strings.Join(parts[1:], "/")
+		settings := cfg.GetRegistrySettings(remoteHost)
+		if from := req.URL.Query().Get("from"); from != "" {
+			if remoteHost == cfg.DefaultRegistry && !strings.Contains(from, "/") {
+				from = "library/" + from
 			}
+			q := req.URL.Query()
+			q.Set("from", settings.UpstreamRepository(from))
+			req.URL.RawQuery = q.Encode()
 		}
 
-		settings := cfg.GetRegistrySettings(remoteHost)
 		if settings.Insecure != nil && *settings.Insecure {
 			req.URL.Scheme = "http"
 		} else {
@@ -148,18 +772,193 @@ func newDirector(cfg *config.Config) func(*http.Request) {
 		req.Host = remoteHost
 		req.RequestURI = ""
 		req.Header.Del("Authorization")
+		if upstreamPath == "/v2/_catalog" {
+			// Catalog pages are filtered, which needs them uncompressed.
+			req.Header.Del("Accept-Encoding")
+		}
 	}
 }
 
+func newResponseModifier(provider *config.Provider, pullStats *PullStats, upstreamErrors *upstreamErrors) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if err := sanitizeResponse(resp); err != nil {
+			return err
+		}
+		upstreamErrors.translate(resp, provider.Current())
+		pullStats.Observe(resp)
+		cfg := provider.Current()
+		rewriteLocation(resp, cfg)
+		rewriteLink(resp, cfg)
+		return filterCatalog(resp, cfg)
+	}
+}
+
+// rewriteLocation points upstream Location headers (upload sessions, pushed
+// manifests) back at the proxy. The registry is encoded in the path, so any
+// replica can route follow-up requests without shared session state, and
+// namespace mappings and aliases are reversed so clients keep seeing their own names.
+func rewriteLocation(resp *http.Response, cfg *config.Config) {
+	if location, ok := proxyURL(resp, cfg, resp.Header.Get("Location")); ok {
+		resp.Header.Set("Location", location)
+	}
+}
+
+// rewriteLink points the pagination Link header of catalog and tag list pages
+// back at the proxy, so clients fetch the next page from the same registry.
+func rewriteLink(resp *http.Response, cfg *config.Config) {
+	target, params, ok := strings.Cut(resp.Header.Get("Link"), ";")
+	if !ok {
+		return
+	}
+	if link, ok := proxyURL(resp, cfg, strings.Trim(strings.TrimSpace(target), "<>")); ok {
+		resp.Header.Set("Link", "<"+link+">;"+params)
+	}
+}
+
+// proxyURL maps an upstream URL of the responding registry to the proxy.
+func proxyURL(resp *http.Response, cfg *config.Config, target string) (string, bool) {
+	if target == "" {
+		return "", false
+	}
+	u, err := resp.Request.URL.Parse(target)
+	if err != nil || u.Host != resp.Request.URL.Host || !strings.HasPrefix(u.Path, "/v2/") {
+		return "", false
+	}
+
+	prefix := u.Host
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/v2/"), "/")
+	if i := endpointIndex(parts); i >= 1 {
+		settings := cfg.GetRegistrySettings(u.Host)
+		repo := settings.ClientRepository(strings.Join(parts[:i], "/"))
+		if alias, name, ok := cfg.AliasFor(u.Host, repo); ok {
+			prefix, repo = alias, name
+		}
+		parts = append(strings.Split(repo, "/"), parts[i:]...)
+	}
+	u.Path = "/v2/" + prefix + "/" + strings.Join(parts, "/")
+	u.RawPath = ""
+	return strings.TrimSuffix(cfg.BaseURL, "/") + u.RequestURI(), true
+}
+
+// filterCatalog removes repositories the registry's repository rules deny
+// from catalog pages and reverses namespace mappings on the rest.
+func filterCatalog(resp *http.Response, cfg *config.Config) error {
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/v2/_catalog" || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	err := json.NewDecoder(io.LimitReader(resp.Body, maxCatalogSize)).Decode(&catalog)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("decoding catalog: %w", err)
+	}
+	settings := cfg.GetRegistrySettings(resp.Request.URL.Host)
+	repositories := make([]string, 0, len(catalog.Repositories))
+	for _, repo := range catalog.Repositories {
+		if settings.AllowsRepository(repo) {
+			repositories = append(repositories, settings.ClientRepository(repo))
+		}
+	}
+	body, _ := json.Marshal(map[string][]string{"repositories": repositories})
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
 func isRegistryAllowed(r *http.Request, cfg *config.Config) bool {
-	path := r.URL.Path
+	if strings.Trim(r.URL.Path, "/") == "v2" {
+		// The API version check is registry-agnostic and must succeed for clients to proceed.
+		return true
+	}
+	registry, _ := resolveUpstream(r.URL.Path, cfg)
+	return cfg.IsRegistryAllowed(registry)
+}
+
+// isLocalPing reports whether an API version check is answered by the proxy
+// instead of the default registry. With the podman compat profile, Podman and
+// other containers/image clients get a local answer, since they abort the
+// pull of any registry when the ping fails and only send credentials after
+// the ping challenged them, which requireAuth has already done.
+func isLocalPing(r *http.Request, cfg *config.Config) bool {
+	return (r.URL.Path == "/v2/" || r.URL.Path == "/v2") &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		cfg.CompatEnabled(config.CompatPodman) &&
+		strings.HasPrefix(r.Header.Get("User-Agent"), "containers/")
+}
+
+// resolveUpstream maps a proxy path to the upstream registry and its path. Paths may
+// name the registry explicitly (/v2/<registry>/<repo>/...); otherwise the default
+// registry is used and single-component repositories get the library/ prefix.
+// Aliases (/v2/<alias>/<repo>/...) resolve to their registry and repository
+// prefix, and the registry's namespaces mapping is applied to the repository name.
+func resolveUpstream(path string, cfg *config.Config) (registry, upstreamPath string) {
 	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v2" {
+		return cfg.DefaultRegistry, path
+	}
+
+	registry, repo := cfg.DefaultRegistry, parts[1:]
+	if host, prefix, ok := cfg.ResolveAlias(repo[0]); ok && endpointIndex(repo) != 1 {
+		registry, repo = host, repo[1:]
+		if prefix != "" && !(len(repo) == 1 && repo[0] == "_catalog") {
+			repo = append(strings.Split(prefix, "/"), repo...)
+		}
+	} else if isRegistryHost(repo[0]) {
+		registry, repo = repo[0], repo[1:]
+	} else if endpointIndex(repo) == 1 {
+		repo = append([]string{"library"}, repo...)
+	}
+	if i := endpointIndex(repo); i >= 1 {
+		settings := cfg.GetRegistrySettings(registry)
+		name := settings.UpstreamRepository(strings.Join(repo[:i], "/"))
+		repo = append(strings.Split(name, "/"), repo[i:]...)
+	}
+
+	upstreamPath = "/v2/" + strings.Join(repo, "/")
+	if len(repo) > 0 && strings.HasSuffix(path, "/") {
+		upstreamPath += "/"
+	}
+	return registry, upstreamPath
+}
+
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// repositoryName returns the repository of an upstream /v2/ path, or "" for
+// registry-level endpoints such as /v2/ and /v2/_catalog.
+func repositoryName(upstreamPath string) string {
+	parts := strings.Split(strings.Trim(upstreamPath, "/"), "/")
+	if i := endpointIndex(parts); i >= 2 {
+		return strings.Join(parts[1:i], "/")
+	}
+	return ""
+}
+
+// manifestTag returns the tag of a manifest pull, or "" when the request is not
+// a manifest GET or HEAD by tag.
+func manifestTag(method, upstreamPath string) string {
+	if method != http.MethodGet && method != http.MethodHead {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(upstreamPath, "/"), "/")
+	if i := endpointIndex(parts); i >= 2 && parts[i] == "manifests" && i == len(parts)-2 && !strings.Contains(parts[i+1], ":") {
+		return parts[i+1]
+	}
+	return ""
+}
 
-	if len(parts) >= 2 && parts[0] == "v2" {
-		potentialRegistry := parts[1]
-		if strings.Contains(potentialRegistry, ".") {
-			return cfg.IsRegistryAllowed(potentialRegistry)
+// endpointIndex returns the position of the API endpoint keyword following the
+// repository name, or -1 if there is none.
+func endpointIndex(parts []string) int {
+	for i := len(parts) - 2; i >= 1; i-- {
+		switch parts[i] {
+		case "manifests", "blobs", "tags", "referrers":
+			return i
 		}
 	}
-	return cfg.IsRegistryAllowed(cfg.DefaultRegistry)
+	return -1
 }
@@ -0,0 +1,471 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/proxy"
+	"oci-proxy/pkg/registrytest"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newProxy starts a proxy in front of upstream, configured with the given
+// registry settings, and returns its URL and cache directory.
+func newProxy(t *testing.T, upstream *registrytest.Registry, settings string) (string, string) {
+	t.Helper()
+	ps, cacheDir := newProxyServer(t, upstream, settings)
+	server := httptest.NewServer(ps.Handler)
+	t.Cleanup(server.Close)
+	return server.URL, cacheDir
+}
+
+// newProxyServer creates a proxy in front of upstream without listening.
+func newProxyServer(t *testing.T, upstream *registrytest.Registry, settings string) (*proxy.ProxyServer, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "oci-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("admin:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	yaml := fmt.Sprintf(`
+log_level: error
+metadata_db: %s
+auth:
+  username: user
+  password: secret
+  htpasswd_file: %s
+  admins: [admin]
+defaults:
+  cache_dir: %s
+registries:
+  %q:
+    insecure: true
+%s
+`, filepath.Join(dir, "metadata.json"), htpasswd, cacheDir, upstream.Host(), settings)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.NewProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := proxy.NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ps.Shutdown(ctx)
+		// Cache writes finish in the background after the response.
+		waitFor(t, "cache writes", func() bool {
+			tmp, _ := filepath.Glob(filepath.Join(cacheDir, "*.tmp"))
+			return len(tmp) == 0
+		})
+		os.RemoveAll(dir)
+	})
+	return ps, cacheDir
+}
+
+// client does not follow redirects, so that a pull only succeeds when the
+// proxy followed them itself.
+var client = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+// get fetches path from the proxy as the configured user.
+func get(t *testing.T, proxyURL, path string) *http.Response {
+	t.Helper()
+	return getAs(t, "user", proxyURL, path)
+}
+
+// getAs fetches path from the proxy as user, which is "user" or the admin
+// "admin".
+func getAs(t *testing.T, user, proxyURL, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, proxyURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(user, "secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// pull fetches path from the proxy and fails the test unless it answers with
+// want.
+func pull(t *testing.T, proxyURL, path string, want []byte) {
+	t.Helper()
+	resp := get(t, proxyURL, path)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, resp.StatusCode, body)
+	}
+	if want != nil && string(body) != string(want) {
+		t.Fatalf("GET %s: got %q, want %q", path, body, want)
+	}
+}
+
+// pullImage pulls the manifest and the layer of an image added to upstream.
+func pullImage(t *testing.T, upstream *registrytest.Registry, proxyURL string, layer []byte) string {
+	t.Helper()
+	prefix := "/v2/" + upstream.Host() + "/library/app"
+	pull(t, proxyURL, prefix+"/manifests/latest", nil)
+	digest := upstream.AddBlob(layer)
+	pull(t, proxyURL, prefix+"/blobs/"+digest, layer)
+	return digest
+}
+
+// waitFor polls cond until it holds or a second has passed, since the cache
+// is filled in the background.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPullThroughCache(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	layer := []byte("layer contents")
+	upstream.AddImage("library/app", "latest", layer)
+	proxyURL, cacheDir := newProxy(t, upstream, "")
+
+	digest := pullImage(t, upstream, proxyURL, layer)
+	waitFor(t, "the blob to be cached", func() bool {
+		_, err := os.Stat(filepath.Join(cacheDir, digest))
+		return err == nil
+	})
+	pull(t, proxyURL, "/v2/"+upstream.Host()+"/library/app/blobs/"+digest, layer)
+	if n := upstream.Count(http.MethodGet, "/v2/library/app/blobs/"+digest); n != 1 {
+		t.Fatalf("upstream served the blob %d times, want 1", n)
+	}
+}
+
+func TestBearerChallengeRetry(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{Auth: registrytest.AuthBearer, Username: "robot", Password: "token"})
+	defer upstream.Close()
+	layer := []byte("private layer")
+	upstream.AddImage("library/app", "latest", layer)
+	proxyURL, _ := newProxy(t, upstream, "    auth:\n      username: robot\n      password: token")
+
+	pullImage(t, upstream, proxyURL, layer)
+	if n := upstream.Count(http.MethodGet, "/token"); n == 0 {
+		t.Fatal("proxy never fetched a token after the bearer challenge")
+	}
+}
+
+func TestBearerChallengeWrongCredentials(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{Auth: registrytest.AuthBearer, Username: "robot", Password: "token"})
+	defer upstream.Close()
+	upstream.AddImage("library/app", "latest")
+	proxyURL, _ := newProxy(t, upstream, "    auth:\n      username: robot\n      password: wrong")
+
+	resp := get(t, proxyURL, "/v2/"+upstream.Host()+"/library/app/manifests/latest")
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("proxy served a manifest although the upstream refused its credentials")
+	}
+}
+
+func TestBlobRedirect(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{RedirectBlobs: true})
+	defer upstream.Close()
+	layer := []byte("redirected layer")
+	upstream.AddImage("library/app", "latest", layer)
+	proxyURL, _ := newProxy(t, upstream, "")
+
+	digest := pullImage(t, upstream, proxyURL, layer)
+	if n := upstream.Count(http.MethodGet, "/storage/"+digest); n != 1 {
+		t.Fatalf("proxy fetched the redirected blob %d times, want 1", n)
+	}
+}
+
+func TestSignaturePolicyRejectsUnsignedImageWithSubject(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	signed := upstream.AddImage("library/app", "latest", []byte("base layer"))
+	layer := upstream.AddBlob([]byte("unsigned layer"))
+	subject := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":37},`+
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":14}],`+
+		`"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":1}}`,
+		upstream.AddBlob([]byte(`{"architecture":"amd64","os":"linux"}`)), layer, signed)
+	upstream.AddManifest("library/app", "attached", []byte(subject))
+	upstream.AddManifest("library/app", strings.Replace(signed, ":", "-", 1)+".sig", []byte(subject))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	proxyURL, _ := newProxy(t, upstream, fmt.Sprintf("    signatures:\n      - repositories: [library/app]\n        key: %s", keyFile))
+
+	for _, ref := range []string{"attached", strings.Replace(signed, ":", "-", 1) + ".sig"} {
+		resp := get(t, proxyURL, "/v2/"+upstream.Host()+"/library/app/manifests/"+ref)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("GET manifest %s: status %d, want %d for an unsigned image", ref, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+}
+
+func TestClientWithoutIPAddress(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	upstream.AddImage("library/app", "latest")
+	ps, _ := newProxyServer(t, upstream, "")
+
+	// Unix socket listeners, as with systemd socket activation, leave the
+	// remote address empty.
+	path := "/v2/" + upstream.Host() + "/library/app/manifests/latest"
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = ""
+	req.SetBasicAuth("user", "secret")
+	rec := httptest.NewRecorder()
+	ps.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s without a client IP: status %d, want %d", path, rec.Code, http.StatusOK)
+	}
+}
+
+func TestUpstreamTimingHiddenFromNonAdmins(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	upstream.AddImage("library/app", "latest")
+	proxyURL, _ := newProxy(t, upstream, "")
+
+	req, err := http.NewRequest(http.MethodGet, proxyURL+"/v2/"+upstream.Host()+"/library/app/manifests/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("user", "secret")
+	req.Header.Set("X-Upstream-Timing", "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if timing := resp.Header.Get("X-Upstream-Timing") + resp.Trailer.Get("X-Upstream-Timing-Transfer"); timing != "" {
+		t.Fatalf("non-admin client received upstream timing %q", timing)
+	}
+}
+
+func TestShadowRequestsOmitCredentials(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	upstream.AddImage("library/app", "latest")
+	headers := make(chan http.Header, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer target.Close()
+	proxyURL, _ := newProxy(t, upstream, fmt.Sprintf("shadow:\n  target: %s\n  percent: 100", target.URL))
+
+	pull(t, proxyURL, "/v2/"+upstream.Host()+"/library/app/manifests/latest", nil)
+	select {
+	case h := <-headers:
+		if h.Get("Authorization") != "" {
+			t.Fatalf("shadow request carried the client's Authorization header %q", h.Get("Authorization"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the shadow request")
+	}
+}
+
+func TestCanaryWithoutRegistryCredentials(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{Auth: registrytest.AuthBasic, Username: "robot", Password: "token"})
+	defer upstream.Close()
+	auth := make(chan string, 1)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		http.NotFound(w, r)
+	}))
+	defer canary.Close()
+	proxyURL, _ := newProxy(t, upstream, fmt.Sprintf("    auth:\n      username: robot\n      password: token\n    canary:\n      upstream: %s\n      percent: 100\n      insecure: true",
+		strings.TrimPrefix(canary.URL, "http://")))
+
+	resp := get(t, proxyURL, "/v2/"+upstream.Host()+"/library/app/manifests/latest")
+	resp.Body.Close()
+	if got := <-auth; got != "" {
+		t.Fatalf("canary received the registry's Authorization header %q", got)
+	}
+}
+
+func TestStatsForUsersAndAdmins(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	upstream.AddImage("library/app", "latest")
+	proxyURL, _ := newProxy(t, upstream, "")
+	pull(t, proxyURL, "/v2/"+upstream.Host()+"/library/app/manifests/latest", nil)
+
+	for _, tt := range []struct {
+		user      string
+		upstreams bool
+	}{
+		{"user", false},
+		{"admin", true},
+	} {
+		resp := getAs(t, tt.user, proxyURL, "/_/stats")
+		var stats map[string]proxy.RegistryStats
+		err := json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("GET /_/stats as %s: status %d, error %v", tt.user, resp.StatusCode, err)
+		}
+		s, ok := stats[upstream.Host()]
+		if !ok {
+			t.Fatalf("GET /_/stats as %s: no cache statistics for the registry: %+v", tt.user, stats)
+		}
+		if got := s.Upstreams != nil; got != tt.upstreams {
+			t.Fatalf("GET /_/stats as %s: upstream stats reported %v, want %v", tt.user, got, tt.upstreams)
+		}
+	}
+}
+
+func TestPassthroughCacheRequiresUpstreamAccess(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{Auth: registrytest.AuthBearer, Username: "robot", Password: "token"})
+	defer upstream.Close()
+	layer := []byte("private layer")
+	upstream.AddImage("library/app", "latest", layer)
+	proxyURL, cacheDir := newProxy(t, upstream, "    manifest_ttl: 1h\n    tag_cache_ttl: 1h\n    auth:\n      mode: passthrough")
+	prefix := "/v2/" + upstream.Host() + "/library/app"
+	fetch := func(method, password, path string) int {
+		req, err := http.NewRequest(method, proxyURL+prefix+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("robot", password)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	digest := upstream.AddBlob(layer)
+	for _, path := range []string{"/manifests/latest", "/blobs/" + digest} {
+		if status := fetch(http.MethodGet, "token", path); status != http.StatusOK {
+			t.Fatalf("GET %s with valid credentials: status %d", path, status)
+		}
+	}
+	waitFor(t, "the blob to be cached", func() bool {
+		_, err := os.Stat(filepath.Join(cacheDir, digest))
+		return err == nil
+	})
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		for _, path := range []string{"/manifests/latest", "/blobs/" + digest} {
+			if status := fetch(method, "wrong", path); status != http.StatusUnauthorized {
+				t.Errorf("%s %s with wrong credentials: status %d, want 401", method, path, status)
+			}
+		}
+	}
+}
+
+func TestTagCacheSeparatesTenants(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{Auth: registrytest.AuthBearer, Username: "robot", Password: "token"})
+	defer upstream.Close()
+	upstream.AddImage("library/app", "latest")
+	proxyURL, _ := newProxy(t, upstream, `    tag_cache_ttl: 1h
+    tenant_auth:
+      a: {username: robot, password: token}
+      b: {username: robot, password: wrong}
+quotas:
+  tenants:
+    a: {members: [admin]}
+    b: {members: [user]}`)
+	head := func(user string) int {
+		req, err := http.NewRequest(http.MethodHead, proxyURL+"/v2/"+upstream.Host()+"/library/app/manifests/latest", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, "secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := head("admin"); status != http.StatusOK {
+		t.Fatalf("HEAD as a member of tenant a: status %d", status)
+	}
+	if status := head("user"); status == http.StatusOK {
+		t.Fatal("tenant b got the tag resolution cached with tenant a's credentials")
+	}
+}
+
+func TestCachedManifestDigestScopedToRepository(t *testing.T) {
+	upstream := registrytest.NewRegistry(registrytest.Options{})
+	defer upstream.Close()
+	digest := upstream.AddImage("library/app", "latest")
+	proxyURL, _ := newProxy(t, upstream, "    manifest_ttl: 1h")
+	fetch := func(repo string) int {
+		req, err := http.NewRequest(http.MethodGet, proxyURL+"/v2/"+upstream.Host()+"/"+repo+"/manifests/"+digest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "secret")
+		req.Header.Set("Accept", "*/*")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	waitFor(t, "the manifest to be served from the cache", func() bool {
+		fetched := upstream.Count(http.MethodGet, "/v2/library/app/manifests/")
+		return fetch("library/app") == http.StatusOK && upstream.Count(http.MethodGet, "/v2/library/app/manifests/") == fetched
+	})
+	if status := fetch("library/other"); status != http.StatusNotFound {
+		t.Fatalf("manifest cached for library/app requested from library/other: status %d, want 404", status)
+	}
+}
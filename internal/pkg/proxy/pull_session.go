@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// maxRecentPulls bounds the completed pull sessions kept for the API.
+const maxRecentPulls = 100
+
+type pullSessionKey struct {
+	registry, repository, client string
+}
+
+type pullSession struct {
+	PullSession
+	end      time.Time
+	inflight int
+}
+
+// pullSessions correlates registry requests into pull sessions and reports
+// each one once it completes.
+type pullSessions struct {
+	cfg      *config.Provider
+	stats    *PullStats
+	webhooks *webhooks
+
+	mu       sync.Mutex
+	active   map[pullSessionKey]*pullSession
+	recent   []PullSession
+	totals   map[string]*PullSessionStats
+	duration map[string]time.Duration
+}
+
+func newPullSessions(cfg *config.Provider, stats *PullStats, webhooks *webhooks) *pullSessions {
+	return &pullSessions{
+		cfg:      cfg,
+		stats:    stats,
+		webhooks: webhooks,
+		active:   make(map[pullSessionKey]*pullSession),
+		totals:   make(map[string]*PullSessionStats),
+		duration: make(map[string]time.Duration),
+	}
+}
+
+// begin joins the request to the client's session for the repository,
+// starting one if there is none. The first manifest reference names the pull.
+func (p *pullSessions) begin(registry, repository, reference, client string, manifest bool) *pullSession {
+	key := pullSessionKey{registry, repository, client}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.active[key]
+	if !ok {
+		s = &pullSession{PullSession: PullSession{Registry: registry, Repository: repository, Client: client, Start: time.Now()}}
+		p.active[key] = s
+	}
+	if !manifest {
+		s.Blobs++
+	} else if s.Reference == "" {
+		s.Reference = reference
+	}
+	s.inflight++
+	return s
+}
+
+// end records the response of a request started with begin.
+func (p *pullSessions) end(s *pullSession, bytes int64, cacheHit bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.inflight--
+	s.end = time.Now()
+	s.Requests++
+	s.Bytes += bytes
+	if cacheHit {
+		s.CachedBytes += bytes
+	}
+}
+
+func (p *pullSessions) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.complete(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// complete reports the sessions without requests in flight that have been
+// idle for pull_session_idle.
+func (p *pullSessions) complete(now time.Time) {
+	idle := p.cfg.Current().PullSessionIdle
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.active {
+		if s.inflight > 0 || now.Sub(s.end) < idle {
+			continue
+		}
+		delete(p.active, key)
+
+		duration := s.end.Sub(s.Start)
+		s.DurationMs = float64(duration) / float64(time.Millisecond)
+		if s.Bytes > 0 {
+			s.Coverage = float64(s.CachedBytes) / float64(s.Bytes)
+		}
+		p.recent = append(p.recent, s.PullSession)
+		if len(p.recent) > maxRecentPulls {
+			p.recent = p.recent[len(p.recent)-maxRecentPulls:]
+		}
+
+		totals, ok := p.totals[s.Registry]
+		if !ok {
+			totals = &PullSessionStats{}
+			p.totals[s.Registry] = totals
+		}
+		totals.Pulls++
+		totals.Bytes += s.Bytes
+		totals.CachedBytes += s.CachedBytes
+		p.duration[s.Registry] += duration
+		p.stats.RecordSession(s.PullSession)
+		p.webhooks.send(WebhookEvent{Event: "image.pulled", Registry: s.Registry, Repository: s.Repository, Reference: s.Reference, ClientIP: s.Client, Size: s.Bytes})
+
+		logging.Logger.Info("pull completed", "registry", s.Registry, "repository", s.Repository, "reference", s.Reference,
+			"client_ip", s.Client, "duration", duration.Round(time.Millisecond), "requests", s.Requests, "blobs", s.Blobs,
+			"bytes", s.Bytes, "coverage", s.Coverage)
+	}
+}
+
+// list returns the completed pull sessions of registry, or of all registries
+// when it is empty, most recent first.
+func (p *pullSessions) list(registry string) []PullSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recent := make([]PullSession, 0, len(p.recent))
+	for i := len(p.recent) - 1; i >= 0; i-- {
+		if registry == "" || p.recent[i].Registry == registry {
+			recent = append(recent, p.recent[i])
+		}
+	}
+	return recent
+}
+
+func (p *pullSessions) snapshot() map[string]PullSessionStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot := make(map[string]PullSessionStats, len(p.totals))
+	for registry, totals := range p.totals {
+		stats := *totals
+		stats.AvgDurationMs = float64(p.duration[registry]) / float64(totals.Pulls) / float64(time.Millisecond)
+		snapshot[registry] = stats
+	}
+	return snapshot
+}
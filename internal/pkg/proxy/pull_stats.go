@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+)
+
+const (
+	pullsBucket  = "pulls"
+	tagsBucket   = "tags"
+	imagesBucket = "images"
+)
+
+// TagPull records the digest a tag resolved to when it was last pulled.
+type TagPull struct {
+	Digest   string
+	LastPull time.Time
+}
+
+// PullStats counts successful manifest pulls per repository and completed pull
+// sessions per image in the metadata DB, and remembers the last pull of each
+// tag.
+type PullStats struct {
+	db *metadb.DB
+	mu sync.Mutex
+}
+
+func NewPullStats(db *metadb.DB) *PullStats {
+	return &PullStats{db: db}
+}
+
+// Observe records a pull for successful manifest GET responses.
+func (p *PullStats) Observe(resp *http.Response) {
+	req := resp.Request
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	i := endpointIndex(parts)
+	if i < 2 || parts[i] != "manifests" {
+		return
+	}
+	repository := req.URL.Host + "/" + strings.Join(parts[1:i], "/")
+	p.Record(repository)
+	if tag := manifestTag(req.Method, req.URL.Path); tag != "" {
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			if err := p.db.Put(tagsBucket, repository+":"+tag, TagPull{Digest: digest, LastPull: time.Now()}); err != nil {
+				logging.Logger.Warn("failed to store tag pull", "repository", repository, "tag", tag, "error", err)
+			}
+		}
+	}
+}
+
+// RecentTags returns, per repository of registry, its n most recently pulled
+// tags.
+func (p *PullStats) RecentTags(registry string, n int) map[string][]string {
+	type tagPull struct {
+		tag  string
+		last time.Time
+	}
+	byRepo := make(map[string][]tagPull)
+	p.db.ForEach(tagsBucket, func(key string, value json.RawMessage) error {
+		name, ok := strings.CutPrefix(key, registry+"/")
+		i := strings.LastIndex(name, ":")
+		var pull TagPull
+		if !ok || i < 0 || json.Unmarshal(value, &pull) != nil {
+			return nil
+		}
+		byRepo[name[:i]] = append(byRepo[name[:i]], tagPull{name[i+1:], pull.LastPull})
+		return nil
+	})
+
+	recent := make(map[string][]string, len(byRepo))
+	for repo, pulls := range byRepo {
+		slices.SortFunc(pulls, func(a, b tagPull) int { return b.last.Compare(a.last) })
+		for _, pull := range pulls[:min(n, len(pulls))] {
+			recent[repo] = append(recent[repo], pull.tag)
+		}
+	}
+	return recent
+}
+
+func (p *PullStats) Record(repository string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.update(pullsBucket, repository, func(stats *RepositoryStats) {
+		stats.Pulls++
+		stats.LastPull = time.Now()
+	})
+}
+
+// RecordSession counts a completed pull session as a pull of the image it
+// named and adds its bytes to the image and its repository.
+func (p *PullStats) RecordSession(s PullSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	repository := s.Registry + "/" + s.Repository
+	p.update(pullsBucket, repository, func(stats *RepositoryStats) {
+		stats.Bytes += s.Bytes
+		stats.CachedBytes += s.CachedBytes
+	})
+	if s.Reference == "" {
+		return
+	}
+	image := repository + ":" + s.Reference
+	if strings.Contains(s.Reference, ":") {
+		image = repository + "@" + s.Reference
+	}
+	p.update(imagesBucket, image, func(stats *RepositoryStats) {
+		stats.Pulls++
+		stats.LastPull = s.Start
+		stats.Bytes += s.Bytes
+		stats.CachedBytes += s.CachedBytes
+	})
+}
+
+func (p *PullStats) update(bucket, key string, fn func(*RepositoryStats)) {
+	var stats RepositoryStats
+	if _, err := p.db.Get(bucket, key, &stats); err != nil {
+		logging.Logger.Warn("failed to read pull stats", "key", key, "error", err)
+	}
+	fn(&stats)
+	if err := p.db.Put(bucket, key, stats); err != nil {
+		logging.Logger.Warn("failed to store pull stats", "key", key, "error", err)
+	}
+}
+
+func (p *PullStats) All() map[string]RepositoryStats {
+	return p.read(pullsBucket)
+}
+
+// Images returns the pull counters of each image.
+func (p *PullStats) Images() map[string]RepositoryStats {
+	return p.read(imagesBucket)
+}
+
+// Top returns the n repositories, or with images the n images, of registry,
+// or of every registry when it is empty, ranked by "pulls", "bytes" or
+// "cached_bytes". A non-positive n returns them all.
+func (p *PullStats) Top(images bool, registry, by string, n int) []PullRanking {
+	all := p.All()
+	if images {
+		all = p.Images()
+	}
+	var ranking []PullRanking
+	for name, stats := range all {
+		if registry == "" || strings.HasPrefix(name, registry+"/") {
+			ranking = append(ranking, PullRanking{Name: name, RepositoryStats: stats})
+		}
+	}
+	metric := func(r PullRanking) int64 {
+		switch by {
+		case "bytes":
+			return r.Bytes
+		case "cached_bytes":
+			return r.CachedBytes
+		}
+		return r.Pulls
+	}
+	slices.SortFunc(ranking, func(a, b PullRanking) int {
+		if c := cmp.Compare(metric(b), metric(a)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if n > 0 {
+		ranking = ranking[:min(n, len(ranking))]
+	}
+	return ranking
+}
+
+func (p *PullStats) read(bucket string) map[string]RepositoryStats {
+	all := make(map[string]RepositoryStats)
+	p.db.ForEach(bucket, func(key string, value json.RawMessage) error {
+		var stats RepositoryStats
+		if err := json.Unmarshal(value, &stats); err == nil {
+			all[key] = stats
+		}
+		return nil
+	})
+	return all
+}
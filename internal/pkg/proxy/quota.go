@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+)
+
+const (
+	quotasBucket       = "quotas"
+	quotaWarningHeader = "X-Quota-Warning"
+)
+
+// QuotaUsage is the transfer of a user or tenant in one month.
+type QuotaUsage struct {
+	Bytes        int64
+	SoftNotified bool `json:",omitempty"`
+	HardNotified bool `json:",omitempty"`
+}
+
+// DailyUsage is the upstream transfer of a user, tenant or namespace in one
+// day and the bytes it added to the cache.
+type DailyUsage struct {
+	Upstream         int64
+	Cached           int64
+	UpstreamNotified bool `json:",omitempty"`
+	CacheNotified    bool `json:",omitempty"`
+}
+
+// quotaEvent is the webhook payload sent when a limit is first crossed in a
+// month, or for daily limits in a day.
+type quotaEvent struct {
+	Event   string    `json:"event"`
+	Subject string    `json:"subject"`
+	Name    string    `json:"name"`
+	User    string    `json:"user"`
+	Month   string    `json:"month"`
+	Day     string    `json:"day,omitempty"`
+	Bytes   int64     `json:"bytes"`
+	Limit   int64     `json:"limit"`
+	Time    time.Time `json:"time"`
+}
+
+type quotaSubject struct {
+	kind, name string
+	limits     config.QuotaLimits
+}
+
+// quotas accounts the request and response bytes of registry traffic per
+// authenticated user, tenant and namespace and calendar month (UTC), and the
+// bytes fetched upstream and added to the cache per day, in the metadata DB,
+// and enforces the configured limits. Only users covered by a users entry or
+// a tenant, and namespaces with an entry, are accounted.
+type quotas struct {
+	cfg    *config.Provider
+	db     *metadb.DB
+	client *http.Client
+	mu     sync.Mutex
+}
+
+func newQuotas(cfg *config.Provider, db *metadb.DB) *quotas {
+	return &quotas{cfg: cfg, db: db, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func quotaMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// quotaKey keys the usage of s in a month or day.
+func quotaKey(period string, s quotaSubject) string {
+	return period + "/" + s.kind + "/" + s.name
+}
+
+// quotaNamespace returns the namespace of a repository, its registry and first
+// path component.
+func quotaNamespace(registry, repository string) string {
+	if registry == "" || repository == "" {
+		return ""
+	}
+	namespace, _, _ := strings.Cut(repository, "/")
+	return registry + "/" + namespace
+}
+
+func subjectsOf(settings config.QuotaSettings, user, namespace string) []quotaSubject {
+	var subjects []quotaSubject
+	if user != "" {
+		if limits, ok := settings.UserLimits(user); ok {
+			subjects = append(subjects, quotaSubject{"user", user, limits})
+		}
+		if tenant, ok := settings.TenantOf(user); ok {
+			subjects = append(subjects, quotaSubject{"tenant", tenant, settings.Tenants[tenant].QuotaLimits})
+		}
+	}
+	if limits, ok := settings.Namespaces[namespace]; ok {
+		subjects = append(subjects, quotaSubject{"namespace", namespace, limits})
+	}
+	return subjects
+}
+
+// check returns a message and the time until it resets when user, their
+// tenant or namespace has used up its hard limit this month or a daily limit
+// today, and otherwise a warning for each soft limit exceeded.
+func (q *quotas) check(user, namespace string) (exceeded string, retryAfter time.Duration, warning string) {
+	now := time.Now()
+	month, day := quotaMonth(now), quotaDay(now)
+	var warnings []string
+	for _, s := range subjectsOf(q.cfg.Current().Quotas, user, namespace) {
+		var usage QuotaUsage
+		q.db.Get(quotasBucket, quotaKey(month, s), &usage)
+		if hard := int64(s.limits.Hard); hard > 0 && usage.Bytes >= hard {
+			return fmt.Sprintf("%s %s has used its monthly transfer quota of %s", s.kind, s.name, formatSize(hard)), untilNextMonth(now), ""
+		}
+		var daily DailyUsage
+		q.db.Get(quotasBucket, quotaKey(day, s), &daily)
+		if limit := int64(s.limits.DailyUpstream); limit > 0 && daily.Upstream >= limit {
+			return fmt.Sprintf("%s %s has used its daily upstream quota of %s", s.kind, s.name, formatSize(limit)), untilNextDay(now), ""
+		}
+		if limit := int64(s.limits.DailyCache); limit > 0 && daily.Cached >= limit {
+			return fmt.Sprintf("%s %s has used its daily cache quota of %s", s.kind, s.name, formatSize(limit)), untilNextDay(now), ""
+		}
+		if soft := int64(s.limits.Soft); soft > 0 && usage.Bytes >= soft {
+			warnings = append(warnings, fmt.Sprintf("%s %s used %s of %s soft quota in %s", s.kind, s.name, formatSize(usage.Bytes), formatSize(soft), month))
+		}
+	}
+	return "", 0, strings.Join(warnings, "; ")
+}
+
+// record adds n transferred bytes, of which upstream were not served from the
+// cache and cached were added to it, to the usage of user, their tenant and
+// namespace, notifying the webhook when a limit is crossed for the first time
+// this month or, for daily limits, today.
+func (q *quotas) record(user, namespace string, n, upstream, cached int64) {
+	cfg := q.cfg.Current()
+	subjects := subjectsOf(cfg.Quotas, user, namespace)
+	if n <= 0 || len(subjects) == 0 {
+		return
+	}
+	now := time.Now()
+	month, day := quotaMonth(now), quotaDay(now)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range subjects {
+		key, dayKey := quotaKey(month, s), quotaKey(day, s)
+		var usage QuotaUsage
+		var daily DailyUsage
+		q.db.Get(quotasBucket, key, &usage)
+		q.db.Get(quotasBucket, dayKey, &daily)
+		usage.Bytes += n
+		daily.Upstream += upstream
+		daily.Cached += cached
+		for _, limit := range []struct {
+			name        string
+			day         string
+			used, quota int64
+			notified    *bool
+		}{
+			{"soft", "", usage.Bytes, int64(s.limits.Soft), &usage.SoftNotified},
+			{"hard", "", usage.Bytes, int64(s.limits.Hard), &usage.HardNotified},
+			{"daily_upstream", day, daily.Upstream, int64(s.limits.DailyUpstream), &daily.UpstreamNotified},
+			{"daily_cache", day, daily.Cached, int64(s.limits.DailyCache), &daily.CacheNotified},
+		} {
+			if limit.quota <= 0 || limit.used < limit.quota || *limit.notified {
+				continue
+			}
+			*limit.notified = true
+			logging.Logger.Warn("transfer quota exceeded", "subject", s.kind, "name", s.name, "limit", limit.name, "bytes", limit.used, "quota", limit.quota)
+			if cfg.Quotas.Webhook != "" {
+				go q.notify(cfg.Quotas.Webhook, quotaEvent{
+					Event:   "quota." + limit.name + "_limit_exceeded",
+					Subject: s.kind,
+					Name:    s.name,
+					User:    user,
+					Month:   month,
+					Day:     limit.day,
+					Bytes:   limit.used,
+					Limit:   limit.quota,
+					Time:    now,
+				})
+			}
+		}
+		if err := q.db.Put(quotasBucket, key, usage); err != nil {
+			logging.Logger.Warn("failed to record quota usage", "key", key, "error", err)
+		}
+		if daily != (DailyUsage{}) {
+			if err := q.db.Put(quotasBucket, dayKey, daily); err != nil {
+				logging.Logger.Warn("failed to record quota usage", "key", dayKey, "error", err)
+			}
+		}
+	}
+}
+
+func (q *quotas) notify(webhook string, event quotaEvent) {
+	body, _ := json.Marshal(event)
+	resp, err := q.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Logger.Warn("quota webhook failed", "event", event.Event, "name", event.Name, "error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logging.Logger.Warn("quota webhook failed", "event", event.Event, "name", event.Name, "status", resp.Status)
+	}
+}
+
+// report returns the usage of every accounted user, tenant and namespace in
+// month, with their current limits.
+func (q *quotas) report(month string) []QuotaReport {
+	settings := q.cfg.Current().Quotas
+	now := time.Now()
+	var reports []QuotaReport
+	q.db.ForEach(quotasBucket, func(key string, value json.RawMessage) error {
+		parts := strings.SplitN(key, "/", 3)
+		var usage QuotaUsage
+		if len(parts) != 3 || parts[0] != month || json.Unmarshal(value, &usage) != nil {
+			return nil
+		}
+		report := QuotaReport{Subject: parts[1], Name: parts[2], Month: month, Bytes: usage.Bytes}
+		var limits config.QuotaLimits
+		switch report.Subject {
+		case "tenant":
+			limits = settings.Tenants[report.Name].QuotaLimits
+		case "namespace":
+			limits = settings.Namespaces[report.Name]
+		default:
+			limits, _ = settings.UserLimits(report.Name)
+		}
+		report.Soft, report.Hard = int64(limits.Soft), int64(limits.Hard)
+		report.DailyUpstream, report.DailyCache = int64(limits.DailyUpstream), int64(limits.DailyCache)
+		reports = append(reports, report)
+		return nil
+	})
+	// ForEach holds the database's read lock, so daily usage is read after
+	// it returns.
+	if month == quotaMonth(now) {
+		for i := range reports {
+			var daily DailyUsage
+			q.db.Get(quotasBucket, quotaKey(quotaDay(now), quotaSubject{kind: reports[i].Subject, name: reports[i].Name}), &daily)
+			reports[i].UpstreamToday, reports[i].CachedToday = daily.Upstream, daily.Cached
+		}
+	}
+	slices.SortFunc(reports, func(a, b QuotaReport) int {
+		return cmp.Or(cmp.Compare(a.Subject, b.Subject), cmp.Compare(a.Name, b.Name))
+	})
+	return reports
+}
+
+// untilNextMonth returns the time until quotas reset.
+func untilNextMonth(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// untilNextDay returns the time until daily quotas reset.
+func untilNextDay(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets keyed by upstream registry or client,
+// counting requests or bytes.
+// Buckets start full and idle ones are dropped after bucketIdle, which only
+// forgives a debt older than that.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const bucketIdle = 10 * time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket), pruned: time.Now()}
+}
+
+// reserve takes n tokens from key's bucket, refilled at rate per second and
+// holding burst tokens, and returns how long the caller must wait for them.
+// When that is longer than maxWait no token is taken and ok is false.
+func (l *rateLimiter) reserve(key string, n, rate, burst float64, maxWait time.Duration) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.pruned) > bucketIdle {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	burst = max(burst, 1)
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, burst)
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	// Tokens go negative as callers queue for future refills.
+	wait = time.Duration((n - b.tokens) / rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens -= n
+	return wait, true
+}
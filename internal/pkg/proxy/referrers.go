@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+// referrersBucket maps registry/repository@digest?query keys to the referrers
+// lists last fetched for them.
+const referrersBucket = "referrers"
+
+const indexMediaType = "application/vnd.oci.image.index.v1+json"
+
+type storedReferrers struct {
+	Body    []byte
+	Filters string    `json:",omitempty"`
+	Stored  time.Time `json:",omitempty"`
+}
+
+// referrers answers the OCI 1.1 referrers API. Lists are reused for the
+// registry's referrers_ttl, and served regardless of age while the upstream
+// fails. Registries without the API are asked for the fallback tag
+// sha256-<hex> instead, so clients get a referrers list either way.
+func (m *manifestMiddleware) referrers(req *http.Request, settings config.RegistrySettings, registry, repo, digest string, next middleware.Handler) (*http.Response, error) {
+	key := registry + "/" + repo + "@" + digest + "?" + req.URL.RawQuery
+	var stored storedReferrers
+	cached, _ := m.db.Get(referrersBucket, key, &stored)
+	if cached && time.Since(stored.Stored) < settings.ReferrersTTL {
+		middleware.SetCacheStatus(req, "hit")
+		return stored.response(req), nil
+	}
+
+	resp, err := next(req)
+	if cached && (err != nil || resp.StatusCode >= http.StatusInternalServerError) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		logging.Logger.WarnContext(req.Context(), "upstream failed, serving cached referrers", "registry", registry, "digest", digest)
+		middleware.SetCacheStatus(req, "hit")
+		return stored.response(req), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+		if err != nil || len(body) > maxManifestSize {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return resp, nil
+		}
+		resp.Body.Close()
+		stored = storedReferrers{Body: body, Filters: resp.Header.Get("OCI-Filters-Applied")}
+	case http.StatusNotFound:
+		resp.Body.Close()
+		if stored, err = m.fallbackReferrers(req, digest, next); err != nil {
+			return nil, err
+		}
+	default:
+		return resp, nil
+	}
+	middleware.SetCacheStatus(req, "miss")
+	if m.cacheManager.GetCache(registry).Enabled() {
+		stored.Stored = time.Now()
+		if err := m.db.Put(referrersBucket, key, stored); err != nil {
+			logging.Logger.WarnContext(req.Context(), "failed to record referrers", "digest", digest, "error", err)
+		}
+	}
+	return stored.response(req), nil
+}
+
+// fallbackReferrers builds a referrers list from the index tagged with the
+// referrers tag schema, filtered by the artifactType query. A missing tag
+// means there are no referrers.
+func (m *manifestMiddleware) fallbackReferrers(req *http.Request, digest string, next middleware.Handler) (storedReferrers, error) {
+	fallback := req.Clone(req.Context())
+	fallback.URL.Path = strings.TrimSuffix(req.URL.Path, "/referrers/"+digest) + "/manifests/" + strings.Replace(digest, ":", "-", 1)
+	fallback.URL.RawPath, fallback.URL.RawQuery = "", ""
+	fallback.Header.Set("Accept", indexMediaType)
+	resp, err := next(fallback)
+	if err != nil {
+		return storedReferrers{}, err
+	}
+	defer resp.Body.Close()
+
+	var index struct {
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+			return storedReferrers{}, fmt.Errorf("decoding referrers tag: %w", err)
+		}
+	case http.StatusNotFound:
+	default:
+		return storedReferrers{}, fmt.Errorf("referrers tag: upstream returned %s", resp.Status)
+	}
+	artifactType := req.URL.Query().Get("artifactType")
+	manifests := make([]json.RawMessage, 0, len(index.Manifests))
+	for _, raw := range index.Manifests {
+		var d struct {
+			ArtifactType string `json:"artifactType"`
+		}
+		if json.Unmarshal(raw, &d) == nil && (artifactType == "" || d.ArtifactType == artifactType) {
+			manifests = append(manifests, raw)
+		}
+	}
+	body, _ := json.Marshal(map[string]any{"schemaVersion": 2, "mediaType": indexMediaType, "manifests": manifests})
+	stored := storedReferrers{Body: body}
+	if artifactType != "" {
+		stored.Filters = "artifactType"
+	}
+	return stored, nil
+}
+
+func (s storedReferrers) response(req *http.Request) *http.Response {
+	resp := localResponse(req, http.StatusOK, indexMediaType, s.Body)
+	resp.Header.Set("Docker-Distribution-Api-Version", "registry/2.0")
+	if s.Filters != "" {
+		resp.Header.Set("OCI-Filters-Applied", s.Filters)
+	}
+	return resp
+}
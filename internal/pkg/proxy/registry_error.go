@@ -0,0 +1,16 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeRegistryError responds with an error in the OCI distribution format so
+// clients such as docker and containerd show the message to the user.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
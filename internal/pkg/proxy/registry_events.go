@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// registryEventsMediaType is the media type of Docker registry notification
+// envelopes.
+const registryEventsMediaType = "application/vnd.docker.distribution.events.v1+json"
+
+// instanceID identifies this proxy process as the source of registry
+// notifications.
+var instanceID = newRequestID()
+
+type registryEnvelope struct {
+	Events []registryEvent `json:"events"`
+}
+
+// registryEvent is an event of the Docker registry notification format.
+type registryEvent struct {
+	ID        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Action    string          `json:"action"`
+	Target    registryTarget  `json:"target"`
+	Request   registryRequest `json:"request"`
+	Actor     registryActor   `json:"actor"`
+	Source    registrySource  `json:"source"`
+}
+
+type registryTarget struct {
+	MediaType  string `json:"mediaType,omitempty"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest,omitempty"`
+	Length     int64  `json:"length"`
+	Repository string `json:"repository"`
+	URL        string `json:"url,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+type registryRequest struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr"`
+	Host      string `json:"host"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent"`
+}
+
+type registryActor struct {
+	Name string `json:"name,omitempty"`
+}
+
+type registrySource struct {
+	Addr       string `json:"addr"`
+	InstanceID string `json:"instanceID"`
+}
+
+// notifyRegistry queues a Docker registry notification for a client's pull,
+// a manifest or blob GET answered with 200, or push, a manifest PUT or
+// completed blob upload answered with 201, of size bytes. Repositories are
+// named as clients address them through the proxy.
+func (w *webhooks) notifyRegistry(r *http.Request, status int, header http.Header, user string, size int64) {
+	if !w.enabled("registry") {
+		return
+	}
+	repo, kind, ref := splitEndpoint(r.URL.Path)
+	var action, mediaType string
+	switch {
+	case r.Method == http.MethodGet && status == http.StatusOK && (kind == "manifests" || kind == "blobs"):
+		action, mediaType = "pull", header.Get("Content-Type")
+	case r.Method == http.MethodPut && status == http.StatusCreated && kind == "manifests":
+		action, mediaType = "push", r.Header.Get("Content-Type")
+	case r.Method == http.MethodPut && status == http.StatusCreated && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+		action, mediaType = "push", "application/octet-stream"
+		repo, kind, ref = repositoryName(r.URL.Path), "blobs", r.URL.Query().Get("digest")
+	default:
+		return
+	}
+
+	target := registryTarget{MediaType: mediaType, Size: size, Length: size, Repository: repo, Digest: header.Get("Docker-Content-Digest")}
+	if strings.Contains(ref, ":") {
+		target.Digest = ref
+	} else if kind == "manifests" {
+		target.Tag = ref
+	}
+	if target.Digest != "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		target.URL = scheme + "://" + r.Host + "/v2/" + repo + "/" + kind + "/" + target.Digest
+	}
+	hostname, _ := os.Hostname()
+	event := registryEvent{
+		ID:        newRequestID(),
+		Timestamp: time.Now(),
+		Action:    action,
+		Target:    target,
+		Request:   registryRequest{ID: r.Header.Get(requestIDHeader), Addr: r.RemoteAddr, Host: r.Host, Method: r.Method, UserAgent: r.UserAgent()},
+		Actor:     registryActor{Name: user},
+		Source:    registrySource{Addr: hostname, InstanceID: instanceID},
+	}
+	body, _ := json.Marshal(registryEnvelope{Events: []registryEvent{event}})
+	w.enqueue(webhookMessage{format: "registry", event: action, id: event.ID, contentType: registryEventsMediaType, body: body})
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// Retention periodically prunes cached blobs of registries with a retention
+// max_age. Manifests and blobs of each repository's most recently pulled tags
+// and of pinned images are kept regardless of age; their manifests are resolved
+// through the proxy, and a registry is skipped for the round if any of them
+// cannot be.
+type Retention struct {
+	cfg          *config.Provider
+	cacheManager *CacheManager
+	pullStats    *PullStats
+	graphs       *GraphBuilder
+}
+
+func NewRetention(cfg *config.Provider, cacheManager *CacheManager, pullStats *PullStats, graphs *GraphBuilder) *Retention {
+	return &Retention{cfg: cfg, cacheManager: cacheManager, pullStats: pullStats, graphs: graphs}
+}
+
+func (r *Retention) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(r.cfg.Current().RetentionInterval):
+			r.applyAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *Retention) applyAll() {
+	cfg := r.cfg.Current()
+	for host, settings := range cfg.Registries {
+		if config.IsRegistryPattern(host) || settings.Retention.MaxAge <= 0 {
+			continue
+		}
+		r.apply(host, settings.Retention)
+	}
+}
+
+func (r *Retention) apply(host string, retention config.RetentionSettings) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	keep := make(map[string]bool)
+	protect := func(graph *ImageGraph, err error, image string) bool {
+		if err != nil {
+			logging.Logger.Warn("retention skipped, could not resolve protected image", "registry", host, "image", image, "error", err)
+			return false
+		}
+		for _, digest := range graph.Root.Digests() {
+			keep[digest] = true
+		}
+		return true
+	}
+	if retention.KeepTags > 0 {
+		for repo, tags := range r.pullStats.RecentTags(host, retention.KeepTags) {
+			for _, tag := range tags {
+				graph, err := r.graphs.build(ctx, host, repo, tag)
+				if !protect(graph, err, repo+":"+tag) {
+					return
+				}
+			}
+		}
+	}
+	for _, image := range retention.Pinned {
+		graph, err := r.graphs.Build(ctx, host+"/"+image)
+		if !protect(graph, err, image) {
+			return
+		}
+	}
+
+	removed, freed := r.cacheManager.GetCache(host).Prune(time.Now().Add(-retention.MaxAge), func(key string) bool { return keep[key] })
+	if removed > 0 {
+		logging.Logger.Info("retention pruned cached blobs", "registry", host, "removed", removed, "bytes", freed)
+	}
+}
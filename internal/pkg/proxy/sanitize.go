@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const maxResponseHeaderBytes = 64 << 10
+
+var errResponseHeadersTooLarge = errors.New("upstream response headers too large")
+
+// strippedResponseHeaders are upstream headers that could affect clients or
+// browsers beyond the scope of the proxied registry response.
+var strippedResponseHeaders = []string{
+	"Set-Cookie",
+	"Alt-Svc",
+	"Strict-Transport-Security",
+	"Public-Key-Pins",
+	"Clear-Site-Data",
+	"Refresh",
+	"Server",
+	"X-Powered-By",
+}
+
+// sanitizeResponse hardens upstream responses before they are forwarded.
+// Hop-by-hop headers are already removed by httputil.ReverseProxy.
+func sanitizeResponse(resp *http.Response) error {
+	if size := headerSize(resp.Header); size > maxResponseHeaderBytes {
+		resp.Body.Close()
+		return fmt.Errorf("%w: %d bytes", errResponseHeadersTooLarge, size)
+	}
+
+	for _, h := range strippedResponseHeaders {
+		resp.Header.Del(h)
+	}
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+
+	if isBlobPath(resp.Request.URL.Path) && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
+		resp.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return nil
+}
+
+func headerSize(h http.Header) int {
+	size := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			size += len(k) + len(v) + 4
+		}
+	}
+	return size
+}
+
+func isBlobPath(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	return len(parts) >= 4 && parts[len(parts)-2] == "blobs"
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+)
+
+// scansBucket maps registry/repository@digest keys to the verdicts of the
+// images scanned there.
+const scansBucket = "scans"
+
+// scanRetry is how long a failed scan is kept before the image is scanned
+// again.
+const scanRetry = 10 * time.Minute
+
+// ScanVerdict is the outcome of a Trivy scan of an image. A failed scan keeps
+// the vulnerabilities of the previous one.
+type ScanVerdict struct {
+	Vulnerabilities map[string]int `json:",omitempty"`
+	Error           string         `json:",omitempty"`
+	Scanned         time.Time
+}
+
+// scannedMediaTypes are the manifest media types of the images scanned.
+var scannedMediaTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type scanJob struct {
+	registry, repository, digest string
+}
+
+// Scanner scans the platform manifests clients pull with the trivy client in
+// server mode, which pulls the image through the proxy and analyzes it
+// against the configured Trivy server, and keeps the verdicts in the metadata
+// DB next to the manifests.
+type Scanner struct {
+	cfg   *config.Provider
+	db    *metadb.DB
+	queue chan scanJob
+
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func NewScanner(cfg *config.Provider, db *metadb.DB) *Scanner {
+	return &Scanner{cfg: cfg, db: db, queue: make(chan scanJob, 256), pending: make(map[string]bool)}
+}
+
+// Run scans queued images with scan.concurrency workers as read at startup.
+func (s *Scanner) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for range s.cfg.Current().Scan.Concurrency {
+		wg.Go(func() {
+			for {
+				select {
+				case job := <-s.queue:
+					s.scan(job)
+				case <-stop:
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// check returns the vulnerabilities that block an image, or "" when it may be
+// served, and queues a scan when the image has no current verdict. Images are
+// not blocked while they are scanned, as the scan pulls them through the
+// proxy.
+func (s *Scanner) check(registry, repository, digest string) string {
+	settings := s.cfg.Current().Scan
+	if settings.TrivyServer == "" {
+		return ""
+	}
+	key := registry + "/" + repository + "@" + digest
+	var verdict ScanVerdict
+	ok, _ := s.db.Get(scansBucket, key, &verdict)
+	if age := time.Since(verdict.Scanned); !ok || age > settings.MaxAge || verdict.Error != "" && age > scanRetry {
+		s.enqueue(key, scanJob{registry, repository, digest})
+	}
+	s.mu.Lock()
+	scanning := s.pending[key]
+	s.mu.Unlock()
+	if settings.BlockSeverity == "" || scanning {
+		return ""
+	}
+	var found []string
+	for _, severity := range config.Severities[slices.Index(config.Severities, settings.BlockSeverity):] {
+		if n := verdict.Vulnerabilities[severity]; n > 0 {
+			found = append(found, fmt.Sprintf("%d %s", n, severity))
+		}
+	}
+	return strings.Join(found, ", ")
+}
+
+func (s *Scanner) enqueue(key string, job scanJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[key] {
+		return
+	}
+	select {
+	case s.queue <- job:
+		s.pending[key] = true
+	default:
+		logging.Logger.Debug("scan queue full, skipping image", "registry", job.registry, "repository", job.repository, "digest", job.digest)
+	}
+}
+
+func (s *Scanner) scan(job scanJob) {
+	key := job.registry + "/" + job.repository + "@" + job.digest
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, key)
+		s.mu.Unlock()
+	}()
+
+	cfg := s.cfg.Current()
+	settings := cfg.Scan
+	address := settings.Registry
+	if address == "" {
+		host := strings.Trim(cfg.ListenAddress, "[]")
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		address = net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+	}
+	registrySettings := cfg.GetRegistrySettings(job.registry)
+	image := address + "/" + job.registry + "/" + registrySettings.ClientRepository(job.repository) + "@" + job.digest
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Timeout)
+	defer cancel()
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, settings.Command, "image", "--server", settings.TrivyServer, "--format", "json", "--quiet", "--insecure", image)
+	cmd.Env = os.Environ()
+	if cfg.Auth.Username != "" {
+		cmd.Env = append(cmd.Env, "TRIVY_USERNAME="+cfg.Auth.Username, "TRIVY_PASSWORD="+cfg.Auth.Password)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+
+	var report struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				Severity string
+			}
+		}
+	}
+	if err == nil {
+		err = json.Unmarshal(stdout.Bytes(), &report)
+	} else if message := strings.TrimSpace(stderr.String()); message != "" {
+		err = fmt.Errorf("%w: %s", err, message)
+	}
+
+	var verdict ScanVerdict
+	s.db.Get(scansBucket, key, &verdict)
+	verdict.Scanned, verdict.Error = time.Now(), ""
+	if err != nil {
+		verdict.Error = err.Error()
+		logging.Logger.Warn("image scan failed", "image", image, "error", err)
+	} else {
+		verdict.Vulnerabilities = make(map[string]int)
+		for _, result := range report.Results {
+			for _, vulnerability := range result.Vulnerabilities {
+				verdict.Vulnerabilities[vulnerability.Severity]++
+			}
+		}
+		logging.Logger.Info("image scanned", "image", image, "vulnerabilities", verdict.Vulnerabilities, "duration", time.Since(start).Round(time.Millisecond))
+	}
+	if err := s.db.Put(scansBucket, key, verdict); err != nil {
+		logging.Logger.Warn("failed to record scan verdict", "image", image, "error", err)
+	}
+}
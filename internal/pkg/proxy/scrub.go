@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// Scrubber re-hashes cached blobs at scrub.rate bytes per second, one pass
+// every scrub.interval, and removes entries whose content no longer matches
+// their digest so the next pull fetches them again. The first pass starts a
+// minute after startup.
+type Scrubber struct {
+	cfg          *config.Provider
+	cacheManager *CacheManager
+}
+
+func NewScrubber(cfg *config.Provider, cacheManager *CacheManager) *Scrubber {
+	return &Scrubber{cfg: cfg, cacheManager: cacheManager}
+}
+
+func (s *Scrubber) Run(stop <-chan struct{}) {
+	wait := time.Minute
+	for {
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		wait = time.Minute
+		if settings := s.cfg.Current().Scrub; settings.Rate > 0 {
+			s.scrubAll(stop)
+			wait = settings.Interval
+		}
+	}
+}
+
+func (s *Scrubber) scrubAll(stop <-chan struct{}) {
+	start := time.Now()
+	var scrubbed, corrupted int
+	var bytes int64
+	for host, c := range s.cacheManager.snapshot() {
+		for _, entry := range c.Entries() {
+			rate := int64(s.cfg.Current().Scrub.Rate)
+			if rate <= 0 {
+				return
+			}
+			ok, err := c.Verify(entry.Key, func(r io.Reader) io.Reader {
+				return &pacedReader{r: r, rate: rate, stop: stop}
+			})
+			if errors.Is(err, errScrubStopped) {
+				return
+			}
+			if err != nil {
+				logging.Logger.Warn("failed to scrub cache entry", "registry", host, "key", entry.Key, "error", err)
+				continue
+			}
+			scrubbed++
+			bytes += entry.Size
+			if !ok {
+				corrupted++
+			}
+		}
+	}
+	logging.Logger.Info("cache scrub finished", "entries", scrubbed, "bytes", bytes, "corrupted", corrupted,
+		"duration", time.Since(start).Round(time.Second))
+}
+
+// pacedReader limits reads to rate bytes per second.
+type pacedReader struct {
+	r    io.Reader
+	rate int64
+	stop <-chan struct{}
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if int64(len(b)) > p.rate {
+		b = b[:p.rate]
+	}
+	start := time.Now()
+	n, err := p.r.Read(b)
+	select {
+	case <-time.After(time.Duration(n)*time.Second/time.Duration(p.rate) - time.Since(start)):
+	case <-p.stop:
+		return n, errScrubStopped
+	}
+	return n, err
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+const (
+	shadowHeader      = "X-Shadow-Request"
+	shadowMaxInFlight = 16
+)
+
+// Shadower asynchronously replays a sample of client pull requests against a
+// secondary proxy or HTTP endpoint. Shadow responses are discarded, and
+// requests are dropped rather than queued when the target falls behind.
+type Shadower struct {
+	cfg      *config.Provider
+	client   *http.Client
+	inflight chan struct{}
+}
+
+func NewShadower(cfg *config.Provider) *Shadower {
+	return &Shadower{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inflight: make(chan struct{}, shadowMaxInFlight),
+	}
+}
+
+// Mirror sends a copy of r to the shadow target if it is sampled. Only GET and
+// HEAD are mirrored so the target never receives writes; requests that are
+// themselves shadowed are not mirrored again. Client credentials are only
+// forwarded with shadow.forward_credentials.
+func (s *Shadower) Mirror(r *http.Request) {
+	settings := s.cfg.Current().Shadow
+	if settings == nil || settings.Target == "" || r.Header.Get(shadowHeader) != "" {
+		return
+	}
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || rand.Float64()*100 >= settings.Percent {
+		return
+	}
+
+	method := r.Method
+	if settings.Mode != "full" {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(settings.Target, "/")+r.URL.RequestURI(), nil)
+	if err != nil {
+		logging.Logger.WarnContext(r.Context(), "invalid shadow request", "target", settings.Target, "error", err)
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(shadowHeader, "1")
+	req.Header.Del(peerHeader)
+	if !settings.ForwardCredentials {
+		for _, h := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+			req.Header.Del(h)
+		}
+	}
+
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		logging.Logger.DebugContext(r.Context(), "shadow target busy, dropping request", "path", r.URL.Path)
+		return
+	}
+	go func() {
+		defer func() { <-s.inflight }()
+		start := time.Now()
+		resp, err := s.client.Do(req)
+		if err != nil {
+			logging.Logger.WarnContext(r.Context(), "shadow request failed", "method", method, "path", req.URL.Path, "error", err)
+			return
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		level := logging.Logger.Debug
+		if resp.StatusCode >= 500 {
+			level = logging.Logger.Warn
+		}
+		level("shadow request", "method", method, "path", req.URL.Path, "status", resp.StatusCode, "bytes", n, "duration", time.Since(start))
+	}()
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+const (
+	// peerHeader carries sharding.secret on requests proxied between peers.
+	peerHeader = "X-OCI-Proxy-Peer"
+	// peerCacheHeader reports the owner's cache status back to the peer that
+	// proxied the request.
+	peerCacheHeader = "X-OCI-Proxy-Peer-Cache"
+)
+
+// sharding proxies GET and HEAD requests for blobs and manifests by digest to
+// the peer owning the digest. The receiving peer accounts for the request:
+// its pull session, quotas, notifications and access log entry; the owner
+// serves it from its cache. Requests are served locally when the owner cannot
+// be reached.
+type sharding struct {
+	cfg       *config.Provider
+	transport http.RoundTripper
+}
+
+func newSharding(cfg *config.Provider) *sharding {
+	return &sharding{cfg: cfg, transport: http.DefaultTransport.(*http.Transport).Clone()}
+}
+
+// fromPeer reports whether r was proxied by a peer.
+func fromPeer(r *http.Request, cfg *config.Config) bool {
+	secret := r.Header.Get(peerHeader)
+	return cfg.Sharding != nil && secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.Sharding.Secret)) == 1
+}
+
+func (s *sharding) serve(w http.ResponseWriter, r *http.Request, upstreamPath string, local http.Handler) {
+	// The secret is never sent upstream.
+	r.Header.Del(peerHeader)
+	settings := s.cfg.Current().Sharding
+	if settings == nil {
+		local.ServeHTTP(w, r)
+		return
+	}
+	if accessEntryFrom(r.Context()).peer {
+		local.ServeHTTP(&peerWriter{ResponseWriter: w, r: r}, r)
+		return
+	}
+	digest := reference(upstreamPath)
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.Contains(digest, ":") {
+		local.ServeHTTP(w, r)
+		return
+	}
+	owner := settings.Owner(digest)
+	target, err := url.Parse(owner)
+	if owner == settings.Self || err != nil {
+		local.ServeHTTP(w, r)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Transport: s.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Header.Set(peerHeader, settings.Secret)
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			middleware.SetCacheStatus(resp.Request, resp.Header.Get(peerCacheHeader))
+			resp.Header.Del(peerCacheHeader)
+			return nil
+		},
+		// The outgoing request carries the secret, so r is served instead.
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			logging.Logger.WarnContext(r.Context(), "sharding peer unreachable, serving locally", "peer", owner, "digest", digest, "error", err)
+			local.ServeHTTP(w, r)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// peerWriter reports the cache status of a request proxied by a peer in
+// peerCacheHeader.
+type peerWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *peerWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if cache := accessEntryFrom(w.r.Context()).cache; cache != "" {
+			w.Header().Set(peerCacheHeader, cache)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *peerWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *peerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/proxy/middleware"
+)
+
+const (
+	cosignSignature   = "dev.cosignproject.cosign/signature"
+	cosignCertificate = "dev.sigstore.cosign/certificate"
+	cosignChain       = "dev.sigstore.cosign/chain"
+	cosignBundle      = "dev.sigstore.cosign/bundle"
+
+	// verifiedTTL is how long a verified digest is served without checking
+	// its signatures again, so a revoked signature takes effect.
+	verifiedTTL       = 5 * time.Minute
+	maxVerifiedDigest = 10000
+)
+
+// signatureMiddleware runs first in the pipeline and serves the manifests of
+// repositories with a cosign signature policy or a notation trust policy only
+// once a signature of their digest verifies, answering others with a DENIED
+// registry error. Manifests listed in a verified index count as verified, so
+// platform pulls by digest pass. Signatures and their payloads are fetched
+// through the pipeline.
+type signatureFetchKey struct{}
+
+type signatureMiddleware struct {
+	cfg    *config.Provider
+	graphs *GraphBuilder
+
+	mu       sync.Mutex
+	verified map[string]time.Time
+}
+
+func newSignatureMiddleware(cfg *config.Provider, graphs *GraphBuilder) *signatureMiddleware {
+	m := &signatureMiddleware{cfg: cfg, graphs: graphs, verified: make(map[string]time.Time)}
+	cfg.OnReload(func(_, _ *config.Config) {
+		m.mu.Lock()
+		clear(m.verified)
+		m.mu.Unlock()
+	})
+	return m
+}
+
+func (m *signatureMiddleware) Name() string {
+	return "signatures"
+}
+
+func (m *signatureMiddleware) Process(req *http.Request, next middleware.Handler) (*http.Response, error) {
+	registry := req.URL.Host
+	repo, kind, ref := splitEndpoint(req.URL.Path)
+	if kind != "manifests" || req.Method != http.MethodGet || req.Context().Value(signatureFetchKey{}) != nil {
+		return next(req)
+	}
+	cfg := m.cfg.Current()
+	settings := cfg.GetRegistrySettings(registry)
+	policy := settings.SignaturePolicy(repo)
+	var trust *config.NotationPolicy
+	if cfg.Notation != nil {
+		if trust = cfg.Notation.Policy(registry + "/" + repo); trust != nil && trust.Level() == "skip" {
+			trust = nil
+		}
+	}
+	if policy == nil && trust == nil {
+		return next(req)
+	}
+	resp, err := next(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	var parsed manifest
+	json.Unmarshal(data, &parsed)
+	if isSignatureArtifact(parsed) {
+		// Signatures, attestations and SBOMs attached to an image are not
+		// signed themselves, and cannot be run as an image.
+		return resp, nil
+	}
+
+	key := registry + "/" + repo + "@"
+	if err := m.check(req.Context(), key+digest, len(data) > maxManifestSize, registry, repo, digest, policy, trust); err != nil {
+		resp.Body.Close()
+		logging.Logger.WarnContext(req.Context(), "rejected manifest without valid signature", "registry", registry, "repository", repo, "reference", ref, "digest", digest, "error", err)
+		body, _ := json.Marshal(map[string]any{
+			"errors": []map[string]string{{"code": "DENIED", "message": fmt.Sprintf("manifest %s of %s/%s has no valid signature: %v", digest, registry, repo, err)}},
+		})
+		return localResponse(req, http.StatusForbidden, "application/json", body), nil
+	}
+	for _, child := range parsed.Manifests {
+		m.markVerified(key + child.Digest)
+	}
+	return resp, nil
+}
+
+// check verifies digest against the policies that apply unless it was
+// verified recently. Notation policies at the audit level only log failures.
+func (m *signatureMiddleware) check(ctx context.Context, key string, tooLarge bool, registry, repo, digest string, policy *config.SignaturePolicy, trust *config.NotationPolicy) error {
+	m.mu.Lock()
+	verified := time.Now().Before(m.verified[key])
+	m.mu.Unlock()
+	if verified {
+		return nil
+	}
+	if tooLarge {
+		return fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+	if policy != nil {
+		if err := m.verifyCosign(ctx, registry, repo, digest, policy); err != nil {
+			return fmt.Errorf("cosign: %w", err)
+		}
+	}
+	if trust != nil {
+		if err := m.verifyNotation(ctx, registry, repo, digest, trust); err != nil {
+			if trust.Level() != "audit" {
+				return fmt.Errorf("notation: %w", err)
+			}
+			logging.Logger.WarnContext(ctx, "notation verification failed, serving for audit", "registry", registry, "repository", repo, "digest", digest, "policy", trust.Name, "error", err)
+		}
+	}
+	m.markVerified(key)
+	return nil
+}
+
+func (m *signatureMiddleware) markVerified(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if len(m.verified) >= maxVerifiedDigest {
+		for k, expires := range m.verified {
+			if now.After(expires) {
+				delete(m.verified, k)
+			}
+		}
+	}
+	m.verified[key] = now.Add(verifiedTTL)
+}
+
+// verifyCosign fetches the cosign signature manifest of digest, tagged
+// sha256-<hex>.sig, and succeeds when any of its signatures verifies.
+func (m *signatureMiddleware) verifyCosign(ctx context.Context, registry, repo, digest string, policy *config.SignaturePolicy) error {
+	data, status, err := m.fetch(ctx, m.graphs.upstreamURL(registry, repo, "manifests", strings.Replace(digest, ":", "-", 1)+".sig"))
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return errors.New("no signature found")
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("fetching signatures: upstream returned %d", status)
+	}
+	var signatures struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &signatures); err != nil {
+		return fmt.Errorf("decoding signatures: %w", err)
+	}
+
+	var errs []error
+	for _, layer := range signatures.Layers {
+		if layer.Annotations[cosignSignature] == "" {
+			continue
+		}
+		payload, status, err := m.fetch(ctx, m.graphs.upstreamURL(registry, repo, "blobs", layer.Digest))
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("fetching signature payload %s: upstream returned %d", layer.Digest, status)
+		}
+		if sum := sha256.Sum256(payload); err == nil && layer.Digest != "sha256:"+hex.EncodeToString(sum[:]) {
+			err = fmt.Errorf("signature payload does not match %s", layer.Digest)
+		}
+		if err == nil {
+			if err = verifyCosignSignature(payload, layer.Annotations, digest, policy); err == nil {
+				return nil
+			}
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no signature found")
+	}
+	return errors.Join(errs...)
+}
+
+// fetch gets a signature artifact through the pipeline, bypassing this
+// middleware.
+func (m *signatureMiddleware) fetch(ctx context.Context, url string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, signatureFetchKey{}, true), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json, "+indexMediaType)
+	resp, err := m.graphs.transport.RoundTrip(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	return data, resp.StatusCode, err
+}
+
+// verifyCosignSignature checks a simple signing payload and its signature
+// against policy: with the policy's key, or with the Fulcio certificate
+// attached to the signature. When the policy has a Rekor key, the signature
+// must come with a transparency log entry signed by it.
+func verifyCosignSignature(payload []byte, annotations map[string]string, digest string, policy *config.SignaturePolicy) error {
+	sig, err := base64.StdEncoding.DecodeString(annotations[cosignSignature])
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	var simple struct {
+		Critical struct {
+			Image struct {
+				Digest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simple); err != nil {
+		return fmt.Errorf("decoding signature payload: %w", err)
+	}
+	if simple.Critical.Image.Digest != digest {
+		return fmt.Errorf("signature is for %s", simple.Critical.Image.Digest)
+	}
+
+	key := policy.PublicKey()
+	var cert *x509.Certificate
+	if key == nil {
+		certs, err := cryptoutils.UnmarshalCertificatesFromPEM([]byte(annotations[cosignCertificate]))
+		if err != nil || len(certs) == 0 {
+			return errors.New("keyless signature has no certificate")
+		}
+		cert, key = certs[0], certs[0].PublicKey
+	}
+	var logged time.Time
+	if rekorKey := policy.RekorPublicKey(); rekorKey != nil {
+		if logged, err = verifyRekorBundle(annotations[cosignBundle], sig, payload, key, rekorKey); err != nil {
+			return err
+		}
+	}
+	if cert != nil {
+		chain, _ := cryptoutils.UnmarshalCertificatesFromPEM([]byte(annotations[cosignChain]))
+		intermediates := x509.NewCertPool()
+		for _, c := range chain {
+			intermediates.AddCert(c)
+		}
+		if err := policy.VerifyCertificate(cert, intermediates, logged); err != nil {
+			return err
+		}
+	}
+	return verifySignature(key, payload, sig)
+}
+
+// rekorPayload is the transparency log entry a Rekor bundle carries.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+}
+
+// verifyRekorBundle checks that a Rekor bundle comes from the log of
+// rekorKey, that its signed entry timestamp verifies over the RFC 8785
+// canonical JSON of its entry, and that the entry logs sig over payload made
+// with key, returning when it was logged.
+func verifyRekorBundle(data string, sig, payload []byte, key, rekorKey crypto.PublicKey) (time.Time, error) {
+	if data == "" {
+		return time.Time{}, errors.New("signature has no transparency log bundle")
+	}
+	var bundle struct {
+		SignedEntryTimestamp []byte
+		Payload              rekorPayload
+	}
+	if err := json.Unmarshal([]byte(data), &bundle); err != nil {
+		return time.Time{}, fmt.Errorf("decoding transparency log bundle: %w", err)
+	}
+	der, err := cryptoutils.MarshalPublicKeyToDER(rekorKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if logID := sha256.Sum256(der); bundle.Payload.LogID != hex.EncodeToString(logID[:]) {
+		return time.Time{}, errors.New("transparency log bundle is from another log")
+	}
+	entry, _ := json.Marshal(bundle.Payload)
+	canonical, err := jsoncanonicalizer.Transform(entry)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("canonicalizing transparency log entry: %w", err)
+	}
+	if err := verifySignature(rekorKey, canonical, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("transparency log bundle: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding transparency log entry: %w", err)
+	}
+	var record struct {
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return time.Time{}, fmt.Errorf("decoding transparency log entry: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	if record.Spec.Data.Hash.Algorithm != "sha256" || record.Spec.Data.Hash.Value != hex.EncodeToString(sum[:]) || !bytes.Equal(record.Spec.Signature.Content, sig) {
+		return time.Time{}, errors.New("transparency log entry is for another signature")
+	}
+	logged, err := cryptoutils.UnmarshalPEMToPublicKey(record.Spec.Signature.PublicKey.Content)
+	if certs, certErr := cryptoutils.UnmarshalCertificatesFromPEM(record.Spec.Signature.PublicKey.Content); certErr == nil && len(certs) > 0 {
+		logged, err = certs[0].PublicKey, nil
+	}
+	if err != nil || cryptoutils.EqualKeys(logged, key) != nil {
+		return time.Time{}, errors.New("transparency log entry is for another signing key")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// verifySignature checks sig over data with key, hashing with SHA-256 as
+// cosign and Rekor sign.
+func verifySignature(key crypto.PublicKey, data, sig []byte) error {
+	verifier, err := signature.LoadVerifier(key, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	return verifier.VerifySignature(bytes.NewReader(sig), bytes.NewReader(data))
+}
+
+// signatureLayerTypes are the media types of signature, attestation and SBOM
+// layers, by prefix.
+var signatureLayerTypes = []string{
+	"application/vnd.dev.cosign.simplesigning.v1+json",
+	"application/vnd.dsse.envelope.v1+json",
+	"application/vnd.dev.sigstore.bundle",
+	"application/vnd.in-toto+json",
+	"application/jose+json",
+	"application/cose",
+	"text/spdx",
+	"application/spdx",
+	"application/vnd.cyclonedx",
+}
+
+// isSignatureArtifact reports whether m is an image manifest whose layers are
+// all signatures, attestations or SBOMs, such as the artifacts cosign and
+// notation attach to an image.
+func isSignatureArtifact(m manifest) bool {
+	if m.Manifests != nil || len(m.Layers) == 0 {
+		return false
+	}
+	for _, layer := range m.Layers {
+		if !slices.ContainsFunc(signatureLayerTypes, func(prefix string) bool { return strings.HasPrefix(layer.MediaType, prefix) }) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyberphone/json-canonicalization/go/src/webpki.org/jsoncanonicalizer"
+
+	"oci-proxy/internal/pkg/config"
+)
+
+const testImageDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// cosignFixture holds the keys of a signer, a Fulcio CA and a Rekor log.
+type cosignFixture struct {
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	leafKey   *ecdsa.PrivateKey
+	leafPEM   []byte
+	rekorKey  *ecdsa.PrivateKey
+	otherKey  *ecdsa.PrivateKey
+	policyDir string
+}
+
+func newCosignFixture(t *testing.T) *cosignFixture {
+	t.Helper()
+	f := &cosignFixture{t: t, key: generateKey(t), leafKey: generateKey(t), rekorKey: generateKey(t), otherKey: generateKey(t), policyDir: t.TempDir()}
+
+	caKey := generateKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	issuer, _ := asn1.Marshal("https://issuer.example")
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(10 * time.Minute),
+		EmailAddresses:  []string{"ci@example.com"},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}, Value: issuer}},
+	}, ca, &f.leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.leafPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+
+	f.write("key.pem", publicKeyPEM(t, &f.key.PublicKey))
+	f.write("rekor.pem", publicKeyPEM(t, &f.rekorKey.PublicKey))
+	f.write("roots.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+	return f
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func (f *cosignFixture) write(name string, data []byte) {
+	if err := os.WriteFile(filepath.Join(f.policyDir, name), data, 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// policy loads a config whose registry has a signature policy for repo.
+func (f *cosignFixture) policy(repo, entry string) *config.SignaturePolicy {
+	f.t.Helper()
+	entry = strings.ReplaceAll(entry, "DIR", f.policyDir)
+	path := filepath.Join(f.policyDir, repo+".yaml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(`
+log_level: error
+registries:
+  registry.example:
+    signatures:
+      - repositories: [%s]
+%s
+`, repo, entry)), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+	cfg, err := config.NewProvider(path)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	settings := cfg.Current().GetRegistrySettings("registry.example")
+	return settings.SignaturePolicy(repo)
+}
+
+func payloadFor(digest string) []byte {
+	return []byte(`{"critical":{"identity":{"docker-reference":"registry.example/app"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// bundle returns a Rekor bundle logging sig over payload with the public key
+// or certificate in publicKey, whose entry timestamp is signed by logKey.
+func (f *cosignFixture) bundle(payload, sig, publicKey []byte, logKey *ecdsa.PrivateKey) string {
+	sum := sha256.Sum256(payload)
+	body, _ := json.Marshal(map[string]any{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]any{
+			"data":      map[string]any{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(sum[:])}},
+			"signature": map[string]any{"content": sig, "publicKey": map[string]any{"content": publicKey}},
+		},
+	})
+	der, _ := x509.MarshalPKIXPublicKey(&f.rekorKey.PublicKey)
+	logID := sha256.Sum256(der)
+	entry := rekorPayload{Body: base64.StdEncoding.EncodeToString(body), IntegratedTime: time.Now().Unix(), LogIndex: 42, LogID: hex.EncodeToString(logID[:])}
+	data, _ := json.Marshal(entry)
+	canonical, err := jsoncanonicalizer.Transform(data)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	bundle, _ := json.Marshal(map[string]any{"SignedEntryTimestamp": sign(f.t, logKey, canonical), "Payload": entry})
+	return string(bundle)
+}
+
+func TestVerifyCosignSignature(t *testing.T) {
+	f := newCosignFixture(t)
+	keyed := f.policy("keyed", "        key: DIR/key.pem")
+	keyedLogged := f.policy("logged", "        key: DIR/key.pem\n        rekor_key: DIR/rekor.pem")
+	keyless := func(identity, issuer string) *config.SignaturePolicy {
+		return f.policy("keyless", fmt.Sprintf("        issuer: %s\n        identity: %s\n        fulcio_roots: DIR/roots.pem\n        rekor_key: DIR/rekor.pem", issuer, identity))
+	}
+
+	payload := payloadFor(testImageDigest)
+	keySig := sign(t, f.key, payload)
+	leafSig := sign(t, f.leafKey, payload)
+	keyAnnotations := map[string]string{cosignSignature: base64.StdEncoding.EncodeToString(keySig)}
+	loggedAnnotations := map[string]string{
+		cosignSignature: base64.StdEncoding.EncodeToString(keySig),
+		cosignBundle:    f.bundle(payload, keySig, publicKeyPEM(t, &f.key.PublicKey), f.rekorKey),
+	}
+	keylessAnnotations := func(bundle string) map[string]string {
+		return map[string]string{cosignSignature: base64.StdEncoding.EncodeToString(leafSig), cosignCertificate: string(f.leafPEM), cosignBundle: bundle}
+	}
+	validBundle := f.bundle(payload, leafSig, f.leafPEM, f.rekorKey)
+	tampered := []byte(strings.Replace(string(payload), "registry.example/app", "registry.example/evil", 1))
+
+	tests := []struct {
+		name        string
+		policy      *config.SignaturePolicy
+		payload     []byte
+		annotations map[string]string
+		wantErr     string
+	}{
+		{"valid key-signed image", keyed, payload, keyAnnotations, ""},
+		{"valid key-signed image with bundle", keyedLogged, payload, loggedAnnotations, ""},
+		{"valid keyless image", keyless(`ci@example\.com`, "https://issuer.example"), payload, keylessAnnotations(validBundle), ""},
+		{"wrong identity", keyless(`other@example\.com`, "https://issuer.example"), payload, keylessAnnotations(validBundle), "identity"},
+		{"wrong issuer", keyless(`ci@example\.com`, "https://other.example"), payload, keylessAnnotations(validBundle), "issuer"},
+		{"tampered payload with key", keyed, tampered, keyAnnotations, "invalid signature"},
+		{"tampered payload keyless", keyless(`ci@example\.com`, "https://issuer.example"), tampered, keylessAnnotations(validBundle), "another signature"},
+		{"signature for another image", keyed, payloadFor("sha256:" + strings.Repeat("f", 64)), keyAnnotations, "signature is for"},
+		{"missing bundle", keyless(`ci@example\.com`, "https://issuer.example"), payload, keylessAnnotations(""), "no transparency log bundle"},
+		{"missing bundle with key", keyedLogged, payload, keyAnnotations, "no transparency log bundle"},
+		{"forged bundle", keyless(`ci@example\.com`, "https://issuer.example"), payload, keylessAnnotations(f.bundle(payload, leafSig, f.leafPEM, f.otherKey)), "transparency log bundle"},
+		{"bundle for another key", keyedLogged, payload, map[string]string{
+			cosignSignature: base64.StdEncoding.EncodeToString(keySig),
+			cosignBundle:    f.bundle(payload, keySig, publicKeyPEM(t, &f.otherKey.PublicKey), f.rekorKey),
+		}, "another signing key"},
+		{"missing certificate", keyless(`ci@example\.com`, "https://issuer.example"), payload, map[string]string{cosignSignature: base64.StdEncoding.EncodeToString(leafSig), cosignBundle: validBundle}, "no certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCosignSignature(tt.payload, tt.annotations, testImageDigest, tt.policy)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("verification failed: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatal("verification succeeded")
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("error %q does not mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
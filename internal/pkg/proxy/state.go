@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+	"oci-proxy/internal/pkg/proxy/cache"
+)
+
+const stateVersion = 1
+
+var errRedactedState = errors.New("the state was exported without secrets and cannot restore a config")
+
+func snapshotState(cfg *config.Provider, db *metadb.DB, cacheManager *CacheManager, hosts []string, secrets bool) (*State, error) {
+	data, err := os.ReadFile(cfg.Path())
+	if err != nil {
+		return nil, err
+	}
+	if !secrets {
+		if data, err = config.Redact(data); err != nil {
+			return nil, err
+		}
+	}
+	state := &State{
+		Version:    stateVersion,
+		ExportedAt: time.Now().UTC(),
+		Config:     string(data),
+		Redacted:   !secrets,
+		Metadata:   db.Dump(),
+		Caches:     make(map[string][]cache.Entry),
+	}
+	if file := cfg.Current().Auth.HtpasswdFile; file != "" && secrets {
+		users, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		state.Htpasswd = string(users)
+	}
+	for _, host := range hosts {
+		if entries := cacheManager.GetCache(host).Entries(); len(entries) > 0 {
+			state.Caches[host] = entries
+		}
+	}
+	return state, nil
+}
+
+// restoreState merges the metadata of state into db and adds its cache
+// entries to the caches of the current config. Existing metadata keys are
+// replaced; cache entries whose blobs are not in the new cache are skipped.
+func restoreState(db *metadb.DB, cacheManager *CacheManager, state *State) (StateImport, error) {
+	var result StateImport
+	if state.Version != stateVersion {
+		return result, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	db.Merge(state.Metadata)
+	if err := db.Flush(); err != nil {
+		return result, fmt.Errorf("failed to flush metadata db: %w", err)
+	}
+	for _, bucket := range state.Metadata {
+		result.MetadataKeys += len(bucket)
+	}
+	for host, entries := range state.Caches {
+		c := cacheManager.GetCache(host)
+		added, missing := c.Import(entries)
+		result.CacheEntries += added
+		result.MissingBlobs += missing
+		result.Registries++
+		if err := c.Persist(); err != nil {
+			logging.Logger.Error("failed to persist cache", "registry", host, "error", err)
+		}
+	}
+	return result, nil
+}
+
+// configuredHosts returns the registries with their own settings and the
+// default registry, whose caches exist without traffic.
+func configuredHosts(cfg *config.Config) []string {
+	var hosts []string
+	for name := range cfg.Registries {
+		if !config.IsRegistryPattern(name) {
+			hosts = append(hosts, name)
+		}
+	}
+	if cfg.DefaultRegistry != "" && !slices.Contains(hosts, cfg.DefaultRegistry) {
+		hosts = append(hosts, cfg.DefaultRegistry)
+	}
+	return hosts
+}
+
+// ExportState reads the state of a stopped proxy from its config file,
+// metadata DB and cache indexes.
+func ExportState(cfg *config.Provider) (*State, error) {
+	db, err := metadb.Open(cfg.Current().MetadataDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata db: %w", err)
+	}
+	return snapshotState(cfg, db, NewCacheManager(cfg), configuredHosts(cfg.Current()), true)
+}
+
+// ImportState installs the config of state at configPath and restores its
+// metadata and cache indexes, for a proxy that is not running. The htpasswd
+// users go to the auth.htpasswd_file of the config being replaced, or of the
+// imported config when there is none yet.
+func ImportState(configPath string, state *State) (StateImport, error) {
+	if state.Version != stateVersion {
+		return StateImport{}, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	if state.Redacted {
+		return StateImport{}, errRedactedState
+	}
+	var htpasswdFile string
+	if current, err := config.LoadConfig(configPath); err == nil {
+		htpasswdFile = current.Auth.HtpasswdFile
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return StateImport{}, err
+	} else if htpasswdFile, err = config.HtpasswdFile([]byte(state.Config)); err != nil {
+		return StateImport{}, err
+	}
+	if err := config.Install(configPath, []byte(state.Config), state.Htpasswd, htpasswdFile); err != nil {
+		return StateImport{}, err
+	}
+	cfg, err := config.NewProvider(configPath)
+	if err != nil {
+		return StateImport{}, err
+	}
+	db, err := metadb.Open(cfg.Current().MetadataDB)
+	if err != nil {
+		return StateImport{}, fmt.Errorf("failed to open metadata db: %w", err)
+	}
+	result, err := restoreState(db, NewCacheManager(cfg), state)
+	result.Config = true
+	return result, err
+}
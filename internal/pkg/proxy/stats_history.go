@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+	"oci-proxy/internal/pkg/metadb"
+	"oci-proxy/internal/pkg/proxy/cache"
+)
+
+const statsHistoryBucket = "stats_history"
+
+// StatsHistory counts bytes served per registry and periodically stores the
+// activity since the previous snapshot in the metadata DB, so trends survive
+// restarts without external monitoring.
+type StatsHistory struct {
+	cfg          *config.Provider
+	db           *metadb.DB
+	cacheManager *CacheManager
+
+	mu    sync.Mutex
+	bytes map[string]*StatsSample
+	last  map[string]cache.CacheStats
+}
+
+func NewStatsHistory(cfg *config.Provider, db *metadb.DB, cacheManager *CacheManager) *StatsHistory {
+	return &StatsHistory{
+		cfg:          cfg,
+		db:           db,
+		cacheManager: cacheManager,
+		bytes:        make(map[string]*StatsSample),
+		last:         make(map[string]cache.CacheStats),
+	}
+}
+
+// observe counts n response bytes served for registry.
+func (h *StatsHistory) observe(registry string, n int64, cacheHit bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.bytes[registry]
+	if !ok {
+		s = &StatsSample{}
+		h.bytes[registry] = s
+	}
+	s.BytesServed += n
+	if cacheHit {
+		s.BytesFromCache += n
+	}
+}
+
+func (h *StatsHistory) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(h.cfg.Current().StatsSnapshotInterval):
+			h.snapshot(time.Now().UTC())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *StatsHistory) snapshot(now time.Time) {
+	current := h.cacheManager.GetStats()
+	h.mu.Lock()
+	samples := make(map[string]StatsSample)
+	for registry, s := range h.bytes {
+		samples[registry] = *s
+	}
+	h.bytes = make(map[string]*StatsSample)
+	for registry, stats := range current {
+		last := h.last[registry]
+		s := samples[registry]
+		// Counters restart from zero when a cache is recreated after a reload.
+		s.Hits, s.Misses = stats.Hits-last.Hits, stats.Misses-last.Misses
+		if s.Hits < 0 || s.Misses < 0 {
+			s.Hits, s.Misses = stats.Hits, stats.Misses
+		}
+		samples[registry] = s
+		h.last[registry] = stats
+	}
+	h.mu.Unlock()
+
+	stamp := now.Format(time.RFC3339)
+	for registry, s := range samples {
+		if s == (StatsSample{}) {
+			continue
+		}
+		if err := h.db.Put(statsHistoryBucket, registry+"|"+stamp, s); err != nil {
+			logging.Logger.Warn("failed to store stats snapshot", "registry", registry, "error", err)
+		}
+	}
+
+	cutoff := now.Add(-h.cfg.Current().StatsRetention)
+	var expired []string
+	h.db.ForEach(statsHistoryBucket, func(key string, _ json.RawMessage) error {
+		if _, t, ok := parseSampleKey(key); ok && t.Before(cutoff) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	for _, key := range expired {
+		h.db.Delete(statsHistoryBucket, key)
+	}
+}
+
+// Query aggregates the stored samples of each registry, or only of registry
+// when it is set, by day or by week (starting Monday, UTC).
+func (h *StatsHistory) Query(registry, period string) map[string][]StatsPeriod {
+	byRegistry := make(map[string]map[time.Time]*StatsPeriod)
+	h.db.ForEach(statsHistoryBucket, func(key string, value json.RawMessage) error {
+		name, t, ok := parseSampleKey(key)
+		var s StatsSample
+		if !ok || (registry != "" && name != registry) || json.Unmarshal(value, &s) != nil {
+			return nil
+		}
+		start := t.Truncate(24 * time.Hour)
+		if period == "week" {
+			start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+		}
+		if byRegistry[name] == nil {
+			byRegistry[name] = make(map[time.Time]*StatsPeriod)
+		}
+		p, ok := byRegistry[name][start]
+		if !ok {
+			p = &StatsPeriod{Start: start}
+			byRegistry[name][start] = p
+		}
+		p.Hits += s.Hits
+		p.Misses += s.Misses
+		p.BytesServed += s.BytesServed
+		p.BytesFromCache += s.BytesFromCache
+		return nil
+	})
+
+	result := make(map[string][]StatsPeriod, len(byRegistry))
+	for name, periods := range byRegistry {
+		for _, p := range periods {
+			if total := p.Hits + p.Misses; total > 0 {
+				p.HitRatio = float64(p.Hits) / float64(total)
+			}
+			result[name] = append(result[name], *p)
+		}
+		slices.SortFunc(result[name], func(a, b StatsPeriod) int { return a.Start.Compare(b.Start) })
+	}
+	return result
+}
+
+func parseSampleKey(key string) (string, time.Time, bool) {
+	registry, stamp, ok := strings.Cut(key, "|")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, stamp)
+	return registry, t, err == nil
+}
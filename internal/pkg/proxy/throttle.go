@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttle remembers registries that asked us to back off so further requests
+// wait or fail fast instead of hitting the upstream again.
+type throttle struct {
+	mu    sync.Mutex
+	stats map[string]*throttleStats
+}
+
+// throttleStats are the stats of a registry with the end of the window its
+// RateLimitRemaining applies to.
+type throttleStats struct {
+	ThrottleStats
+	rateLimitExpires time.Time
+}
+
+func newThrottle() *throttle {
+	return &throttle{stats: make(map[string]*throttleStats)}
+}
+
+func (t *throttle) entry(registry string) *throttleStats {
+	s, ok := t.stats[registry]
+	if !ok {
+		s = &throttleStats{}
+		t.stats[registry] = s
+	}
+	return s
+}
+
+// remaining returns how long registry is still backing off.
+func (t *throttle) remaining(registry string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.stats[registry]; ok {
+		return time.Until(s.Until)
+	}
+	return 0
+}
+
+func (t *throttle) throttled(registry string, delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.entry(registry)
+	s.Throttled++
+	if until := time.Now().Add(delay); until.After(s.Until) {
+		s.Until = until
+	}
+}
+
+// rateLimitWindow is assumed for RateLimit-Remaining headers without a window.
+const rateLimitWindow = 6 * time.Hour
+
+// observe records the quota left at registry from a RateLimit-Remaining
+// header such as "95;w=21600".
+func (t *throttle) observe(registry string, header http.Header) {
+	value := header.Get("RateLimit-Remaining")
+	if value == "" {
+		return
+	}
+	count, params, _ := strings.Cut(value, ";")
+	remaining, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return
+	}
+	window := rateLimitWindow
+	if w, ok := strings.CutPrefix(strings.TrimSpace(params), "w="); ok {
+		if seconds, err := strconv.Atoi(w); err == nil && seconds > 0 {
+			window = time.Duration(seconds) * time.Second
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.entry(registry)
+	s.RateLimitRemaining = &remaining
+	s.rateLimitExpires = time.Now().Add(window)
+}
+
+// rateLimitRemaining returns the quota last reported by registry, unless its
+// window has passed since.
+func (t *throttle) rateLimitRemaining(registry string) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.stats[registry]
+	if !ok || s.RateLimitRemaining == nil || time.Now().After(s.rateLimitExpires) {
+		return 0, false
+	}
+	return *s.RateLimitRemaining, true
+}
+
+func (t *throttle) retried(registry string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entry(registry).Retried++
+}
+
+func (t *throttle) rejected(registry string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entry(registry).Rejected++
+}
+
+func (t *throttle) queued(registry string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entry(registry).Queued++
+}
+
+func (t *throttle) limited(registry string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entry(registry).Limited++
+}
+
+func (t *throttle) snapshot() map[string]ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]ThrottleStats, len(t.stats))
+	for registry, s := range t.stats {
+		entry := s.ThrottleStats
+		if time.Now().After(s.rateLimitExpires) {
+			entry.RateLimitRemaining = nil
+		}
+		snapshot[registry] = entry
+	}
+	return snapshot
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// tooManyRequests synthesizes a registry-style 429 telling the client to retry after wait.
+func tooManyRequests(req *http.Request, wait time.Duration, message string) *http.Response {
+	body := fmt.Sprintf(`{"errors":[{"code":"TOOMANYREQUESTS","message":%q}]}`, message)
+	resp := &http.Response{
+		StatusCode:    http.StatusTooManyRequests,
+		Status:        fmt.Sprintf("%d %s", http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Retry-After", retryAfterSeconds(wait))
+	return resp
+}
+
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
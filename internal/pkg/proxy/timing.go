@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/logging"
+)
+
+const (
+	timingHeader         = "X-Upstream-Timing"
+	timingTransferHeader = "X-Upstream-Timing-Transfer"
+)
+
+type timingKey struct{}
+
+// upstreamTiming records the phases of the last upstream round trip of a
+// request, logged at debug level and, when expose is set, returned to the
+// client.
+type upstreamTiming struct {
+	expose                               bool
+	mu                                   sync.Mutex
+	start, dnsStart, connStart, tlsStart time.Time
+	dns, connect, tls, ttfb              time.Duration
+}
+
+func withUpstreamTiming(ctx context.Context, expose bool) context.Context {
+	return context.WithValue(ctx, timingKey{}, &upstreamTiming{expose: expose})
+}
+
+func upstreamTimingFrom(ctx context.Context) *upstreamTiming {
+	t, _ := ctx.Value(timingKey{}).(*upstreamTiming)
+	return t
+}
+
+func (t *upstreamTiming) trace(req *http.Request) *http.Request {
+	t.locked(func() {
+		t.start = time.Now()
+		t.dns, t.connect, t.tls, t.ttfb = 0, 0, 0, 0
+	})
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.locked(func() { t.dnsStart = time.Now() }) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.locked(func() { t.dns = time.Since(t.dnsStart) }) },
+		ConnectStart:         func(string, string) { t.locked(func() { t.connStart = time.Now() }) },
+		ConnectDone:          func(string, string, error) { t.locked(func() { t.connect = time.Since(t.connStart) }) },
+		TLSHandshakeStart:    func() { t.locked(func() { t.tlsStart = time.Now() }) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.locked(func() { t.tls = time.Since(t.tlsStart) }) },
+		GotFirstResponseByte: func() { t.locked(func() { t.ttfb = time.Since(t.start) }) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (t *upstreamTiming) locked(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f()
+}
+
+func (t *upstreamTiming) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("dns=%s, connect=%s, tls=%s, ttfb=%s",
+		t.dns.Round(time.Microsecond), t.connect.Round(time.Microsecond),
+		t.tls.Round(time.Microsecond), t.ttfb.Round(time.Microsecond))
+}
+
+// annotate adds the timing header and reports the body transfer duration as a
+// trailer when the timing is exposed, and logs both once the body is read.
+func (t *upstreamTiming) annotate(resp *http.Response) {
+	if t.expose {
+		resp.Header.Set(timingHeader, t.String())
+		if resp.Trailer == nil {
+			resp.Trailer = make(http.Header)
+		}
+		resp.Trailer.Set(timingTransferHeader, "")
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, resp: resp, timing: t, start: time.Now()}
+}
+
+type timedBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	timing *upstreamTiming
+	start  time.Time
+	once   sync.Once
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func (b *timedBody) done() {
+	b.once.Do(func() {
+		transfer := time.Since(b.start).Round(time.Microsecond)
+		if b.timing.expose {
+			b.resp.Trailer.Set(timingTransferHeader, transfer.String())
+		}
+		logging.Logger.DebugContext(b.resp.Request.Context(), "upstream timing", "url", b.resp.Request.URL.String(),
+			"timing", b.timing.String(), "transfer", transfer)
+	})
+}
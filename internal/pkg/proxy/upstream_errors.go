@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+// Kinds of upstream failure translated for clients and counted per registry.
+const (
+	errRateLimited   = "rate_limited"
+	errAuthFailed    = "auth_failed"
+	errNotFound      = "repository_not_found"
+	errGeoBlocked    = "geo_blocked"
+	errUnreachable   = "unreachable"
+	maxErrorBodySize = 64 << 10
+)
+
+// upstreamErrors rewrites common upstream failures into registry errors with
+// actionable messages and counts them by kind. Failures other than missing
+// repositories, and 5xx responses, are sent to webhooks as upstream.failed.
+type upstreamErrors struct {
+	webhooks *webhooks
+
+	mu     sync.Mutex
+	counts map[string]map[string]int64
+}
+
+func newUpstreamErrors(webhooks *webhooks) *upstreamErrors {
+	return &upstreamErrors{webhooks: webhooks, counts: make(map[string]map[string]int64)}
+}
+
+func (u *upstreamErrors) record(registry, kind string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.counts[registry] == nil {
+		u.counts[registry] = make(map[string]int64)
+	}
+	u.counts[registry][kind]++
+}
+
+func (u *upstreamErrors) snapshot() map[string]map[string]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	snapshot := make(map[string]map[string]int64, len(u.counts))
+	for registry, kinds := range u.counts {
+		snapshot[registry] = make(map[string]int64, len(kinds))
+		for kind, n := range kinds {
+			snapshot[registry][kind] = n
+		}
+	}
+	return snapshot
+}
+
+// translate replaces the body of a recognized upstream error response with a
+// registry error explaining it. The upstream code and message are kept at the
+// end of the new message.
+func (u *upstreamErrors) translate(resp *http.Response, cfg *config.Config) {
+	if resp.StatusCode < 400 {
+		return
+	}
+	registry := resp.Request.URL.Host
+	repo := repositoryName(resp.Request.URL.Path)
+	settings := cfg.GetRegistrySettings(registry)
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	isRegistryError := json.Unmarshal(data, &body) == nil && len(body.Errors) > 0
+	upstream := ""
+	if isRegistryError {
+		upstream = fmt.Sprintf(" (upstream: %s: %s)", body.Errors[0].Code, body.Errors[0].Message)
+	}
+
+	var kind, code, message string
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		kind, code = errRateLimited, "TOOMANYREQUESTS"
+		message = fmt.Sprintf("upstream registry %s rate limit reached for this proxy", registry)
+		if remaining := resp.Header.Get("RateLimit-Remaining"); remaining != "" {
+			message += ", remaining " + remaining
+		}
+		if secs := resp.Header.Get("Retry-After"); secs != "" {
+			message += ", retry after " + secs + "s"
+		}
+		if settings.Auth.Username == "" {
+			message += "; configure credentials for " + registry + " in the proxy to raise the limit"
+		}
+	case resp.StatusCode == http.StatusUnauthorized:
+		kind, code = errAuthFailed, "UNAUTHORIZED"
+		if settings.Passthrough() {
+			message = fmt.Sprintf("upstream registry %s rejected your credentials or denied access to %s; log in to the proxy with your %s credentials", registry, repo, registry)
+		} else if settings.Auth.Username != "" {
+			message = fmt.Sprintf("upstream registry %s rejected the proxy's credentials, which may have expired, or denied access to %s", registry, repo)
+			logging.Logger.WarnContext(resp.Request.Context(), "upstream rejected configured credentials", "registry", registry, "repository", repo, "username", settings.Auth.Username)
+		} else {
+			message = fmt.Sprintf("upstream registry %s denied anonymous access to %s; it may not exist or may be private, in which case configure credentials for %s in the proxy", registry, repo, registry)
+		}
+		// The challenge points at the upstream token service, which clients cannot use through the proxy.
+		resp.Header.Del("Www-Authenticate")
+		if settings.Passthrough() {
+			resp.Header.Set("Www-Authenticate", proxyChallenge)
+		}
+	case resp.StatusCode == http.StatusNotFound && isRegistryError && body.Errors[0].Code == "NAME_UNKNOWN":
+		kind, code = errNotFound, "NAME_UNKNOWN"
+		message = fmt.Sprintf("repository %s not found at upstream registry %s", repo, registry)
+	case resp.StatusCode == http.StatusUnavailableForLegalReasons || resp.StatusCode == http.StatusForbidden && !isRegistryError:
+		kind, code = errGeoBlocked, "DENIED"
+		message = fmt.Sprintf("upstream registry %s refused the request with HTTP %d and no registry error, which usually means a geographic or network restriction on the proxy's location", registry, resp.StatusCode)
+	default:
+		if resp.StatusCode >= 500 {
+			u.webhooks.send(WebhookEvent{Event: "upstream.failed", Registry: registry, Repository: repo, Status: resp.StatusCode, Reason: resp.Status})
+		}
+		return
+	}
+
+	u.record(registry, kind)
+	if kind != errNotFound {
+		u.webhooks.send(WebhookEvent{Event: "upstream.failed", Registry: registry, Repository: repo, Status: resp.StatusCode, Reason: message + upstream})
+	}
+	out, _ := json.Marshal(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message + upstream}},
+	})
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Del("Content-Encoding")
+}
+
+// writeUnreachable responds to a failed upstream round trip with a registry
+// error naming the registry and the cause.
+func (u *upstreamErrors) writeUnreachable(w http.ResponseWriter, registry string, err error) {
+	u.record(registry, errUnreachable)
+	u.webhooks.send(WebhookEvent{Event: "upstream.failed", Registry: registry, Reason: err.Error()})
+	cause := "the connection failed"
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		cause = "its host name could not be resolved"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		cause = "the connection timed out"
+	case strings.Contains(err.Error(), "certificate") || strings.Contains(err.Error(), "tls:"):
+		cause = "its TLS certificate was rejected; set ca_file for it if it uses a private CA"
+	}
+	writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", fmt.Sprintf("upstream registry %s is unreachable: %s (%v)", registry, cause, err))
+}
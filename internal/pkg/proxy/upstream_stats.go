@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the upstream latency
+// histograms.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// histogram counts durations per latency bucket, not cumulatively.
+type histogram struct {
+	buckets    [len(latencyBuckets)]atomic.Int64
+	count, sum atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if i := sort.SearchFloat64s(latencyBuckets[:], d.Seconds()); i < len(latencyBuckets) {
+		h.buckets[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) avgMs() float64 {
+	if n := h.count.Load(); n > 0 {
+		return float64(h.sum.Load()) / float64(n) / float64(time.Millisecond)
+	}
+	return 0
+}
+
+type upstreamCounters struct {
+	requests, errors, newConns, reusedConns atomic.Int64
+	firstByte, transfer                     histogram
+
+	mu       sync.Mutex
+	statuses map[string]int64
+}
+
+type upstreamStats struct {
+	mu       sync.RWMutex
+	counters map[string]map[string]*upstreamCounters
+}
+
+func newUpstreamStats() *upstreamStats {
+	return &upstreamStats{counters: make(map[string]map[string]*upstreamCounters)}
+}
+
+// record counts a request to target made on behalf of registry and started
+// at start, and times the transfer of the response body. Transport errors and
+// 5xx responses count as errors.
+func (s *upstreamStats) record(registry, target string, start time.Time, resp *http.Response, err error) {
+	c := s.target(registry, target)
+	c.requests.Add(1)
+	c.firstByte.observe(time.Since(start))
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		c.errors.Add(1)
+	}
+	c.mu.Lock()
+	if c.statuses == nil {
+		c.statuses = make(map[string]int64)
+	}
+	c.statuses[status]++
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		c.transfer.observe(time.Since(start))
+		return
+	}
+	resp.Body = &transferBody{ReadCloser: resp.Body, start: start, transfer: &c.transfer}
+}
+
+// transferBody observes the time from the request until its body was read to the
+// end or closed.
+type transferBody struct {
+	io.ReadCloser
+	start    time.Time
+	transfer *histogram
+	once     sync.Once
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *transferBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func (b *transferBody) done() {
+	b.once.Do(func() { b.transfer.observe(time.Since(b.start)) })
+}
+
+// traceConns returns req with a trace counting whether each connection it
+// gets from the pool is new or reused.
+func (s *upstreamStats) traceConns(registry string, req *http.Request) *http.Request {
+	c := s.target(registry, req.URL.Host)
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.reusedConns.Add(1)
+			} else {
+				c.newConns.Add(1)
+			}
+		},
+	}))
+}
+
+func (s *upstreamStats) target(registry, target string) *upstreamCounters {
+	s.mu.RLock()
+	c, ok := s.counters[registry][target]
+	s.mu.RUnlock()
+	if !ok {
+		s.mu.Lock()
+		if c, ok = s.counters[registry][target]; !ok {
+			if s.counters[registry] == nil {
+				s.counters[registry] = make(map[string]*upstreamCounters)
+			}
+			c = &upstreamCounters{}
+			s.counters[registry][target] = c
+		}
+		s.mu.Unlock()
+	}
+	return c
+}
+
+func (s *upstreamStats) snapshot() map[string]map[string]UpstreamStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[string]map[string]UpstreamStats, len(s.counters))
+	for registry, targets := range s.counters {
+		snapshot[registry] = make(map[string]UpstreamStats, len(targets))
+		for target, c := range targets {
+			c.mu.Lock()
+			snapshot[registry][target] = UpstreamStats{
+				Requests: c.requests.Load(), Errors: c.errors.Load(),
+				AvgLatencyMs: c.firstByte.avgMs(), AvgTransferMs: c.transfer.avgMs(),
+				Statuses: maps.Clone(c.statuses), NewConns: c.newConns.Load(), ReusedConns: c.reusedConns.Load(),
+			}
+			c.mu.Unlock()
+		}
+	}
+	return snapshot
+}
@@ -62,6 +62,131 @@ async function copyToClipboard() {
     }, 2000);
 }
 
+const refreshInterval = 5000;
+let refreshTimer = null;
+let previousStats = null;
+
+function formatBytes(bytes) {
+    const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return `${bytes.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+async function fetchJSON(url) {
+    const resp = await fetch(url);
+    if (!resp.ok) throw new Error(resp.statusText);
+    return resp.json();
+}
+
+function cell(row, content) {
+    const td = document.createElement('td');
+    if (typeof content === 'string') {
+        td.textContent = content;
+    } else {
+        td.append(...content);
+    }
+    row.append(td);
+    return td;
+}
+
+function usageBar(current, max) {
+    const bar = document.createElement('div');
+    bar.className = 'usage-bar';
+    const fill = document.createElement('div');
+    fill.className = 'usage-fill';
+    fill.style.width = `${max > 0 ? Math.min(100, current / max * 100) : 0}%`;
+    bar.append(fill);
+    return bar;
+}
+
+function renderRegistries(stats, now) {
+    const rows = document.getElementById('dashboard-rows');
+    rows.replaceChildren();
+
+    for (const [registry, s] of Object.entries(stats)) {
+        const row = document.createElement('tr');
+        const name = cell(row, registry);
+        if (s.Credential) {
+            const state = s.Credential.Healthy ? i18n[currentLang].credentialHealthy : i18n[currentLang].credentialFailing;
+            name.title = s.Credential.Error ? `${state}: ${s.Credential.Error}` : state;
+            name.classList.add(s.Credential.Healthy ? 'healthy' : 'failing');
+        }
+
+        const lookups = s.Hits + s.Misses;
+        cell(row, lookups > 0 ? `${(s.Hits / lookups * 100).toFixed(1)}%` : '-');
+
+        let usage = `${formatBytes(s.CurrentSize)} / ${formatBytes(s.MaxSize)} · ${s.Items}`;
+        const recommended = s.WorkingSet?.['24h']?.Recommended?.['95%'];
+        const usageCell = cell(row, [usageBar(s.CurrentSize, s.MaxSize), usage]);
+        if (recommended) {
+            usageCell.title = `${i18n[currentLang].recommendedSize} ~${formatBytes(recommended)}`;
+        }
+
+        // Eviction rate is derived from the counter delta between two refreshes.
+        const previous = previousStats?.stats[registry];
+        if (previous && s.Evictions >= previous.Evictions) {
+            const minutes = (now - previousStats.at) / 60000;
+            cell(row, ((s.Evictions - previous.Evictions) / minutes).toFixed(1));
+        } else {
+            cell(row, '-');
+        }
+
+        const errors = Object.entries(s.UpstreamErrors || {});
+        const total = errors.reduce((sum, [, n]) => sum + n, 0);
+        const errorCell = cell(row, String(total));
+        errorCell.title = errors.map(([kind, n]) => `${kind}: ${n}`).join('\n');
+        if (total > 0) errorCell.classList.add('failing');
+
+        rows.append(row);
+    }
+}
+
+function renderRecentPulls(pulls) {
+    const list = document.getElementById('recent-pulls');
+    // Only admins may list pull sessions.
+    list.hidden = list.previousElementSibling.hidden = pulls === null;
+    if (pulls === null) return;
+    list.replaceChildren(...pulls.slice(0, 10).map(p => {
+        const reference = p.Reference ? (p.Reference.startsWith('sha256:') ? `@${p.Reference.slice(0, 19)}` : `:${p.Reference}`) : '';
+        const seconds = (p.DurationMs / 1000).toFixed(1);
+        return Object.assign(document.createElement('li'), {
+            textContent: `${p.Registry}/${p.Repository}${reference} · ${seconds}s · ${formatBytes(p.Bytes)} · ${(p.Coverage * 100).toFixed(0)}% ${i18n[currentLang].fromCache}`,
+            title: `${p.Client} · ${new Date(p.Start).toLocaleString()}`
+        });
+    }));
+    if (pulls.length === 0) {
+        list.append(Object.assign(document.createElement('li'), { textContent: i18n[currentLang].noPulls }));
+    }
+}
+
+async function refreshDashboard() {
+    const message = document.getElementById('status-message');
+    try {
+        const [stats, pulls] = await Promise.all([fetchJSON('/_/stats'), fetchJSON('/_/api/v1/pulls').catch(() => null)]);
+        const now = Date.now();
+        renderRegistries(stats, now);
+        renderRecentPulls(pulls);
+        previousStats = { stats, at: now };
+        message.textContent = '';
+    } catch (err) {
+        message.textContent = i18n[currentLang].statusUnavailable;
+    }
+}
+
+function toggleDashboard(open) {
+    clearInterval(refreshTimer);
+    refreshTimer = null;
+    previousStats = null;
+    if (open) {
+        refreshDashboard();
+        refreshTimer = setInterval(refreshDashboard, refreshInterval);
+    }
+}
+
 function init() {
     translatePage(currentLang);
 
@@ -80,6 +205,7 @@ function init() {
     document.getElementById('proxy-address').addEventListener('input', generateCommand);
     document.getElementById('image').addEventListener('input', generateCommand);
     document.getElementById('copy-btn').addEventListener('click', copyToClipboard);
+    document.getElementById('status').addEventListener('toggle', e => toggleDashboard(e.target.open));
 
     generateCommand();
 }if (document.readyState === 'loading') {
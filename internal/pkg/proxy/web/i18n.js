@@ -13,7 +13,20 @@ export const i18n = {
         copied: 'Copied!',
         waitingInput: 'Please enter image address...',
         waitingProxy: 'Please enter proxy server address...',
-        formatError: 'Invalid image address format'
+        formatError: 'Invalid image address format',
+        registryStatus: 'Registry Status',
+        credentialHealthy: 'credentials OK',
+        credentialFailing: 'credentials failing',
+        statusUnavailable: 'Status unavailable',
+        recommendedSize: '95% hit ratio (24h) needs',
+        registry: 'Registry',
+        hitRatio: 'Hit ratio',
+        cacheUsage: 'Cache',
+        evictionRate: 'Evictions/min',
+        upstreamErrors: 'Upstream errors',
+        recentPulls: 'Recent Pulls',
+        noPulls: 'No pulls yet',
+        fromCache: 'from cache'
     },
     zh: {
         title: 'OCI Proxy',
@@ -29,7 +42,20 @@ export const i18n = {
         copied: '已复制!',
         waitingInput: '请输入镜像地址...',
         waitingProxy: '请输入代理服务器地址...',
-        formatError: '镜像地址格式错误'
+        formatError: '镜像地址格式错误',
+        registryStatus: '仓库状态',
+        credentialHealthy: '凭据正常',
+        credentialFailing: '凭据异常',
+        statusUnavailable: '无法获取状态',
+        recommendedSize: '95% 命中率 (24h) 需要',
+        registry: '仓库',
+        hitRatio: '命中率',
+        cacheUsage: '缓存',
+        evictionRate: '淘汰/分钟',
+        upstreamErrors: '上游错误',
+        recentPulls: '最近拉取',
+        noPulls: '暂无拉取记录',
+        fromCache: '来自缓存'
     }
 };
 
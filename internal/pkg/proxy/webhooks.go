@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"oci-proxy/internal/pkg/config"
+	"oci-proxy/internal/pkg/logging"
+)
+
+const (
+	webhookQueueSize = 1024
+	webhookBackoff   = time.Second
+)
+
+// WebhookEvent is the JSON body POSTed to webhooks. Fields that do not apply
+// to an event are omitted.
+type WebhookEvent struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Registry   string    `json:"registry,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	Reference  string    `json:"reference,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	User       string    `json:"user,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// webhookMessage is an encoded event queued for the webhooks of its format
+// subscribed to it.
+type webhookMessage struct {
+	format, event, id, contentType string
+	body                           []byte
+}
+
+// webhookDelivery is a message bound for one webhook.
+type webhookDelivery struct {
+	hook config.WebhookSettings
+	webhookMessage
+}
+
+// webhooks delivers events to the configured webhooks, each from its own
+// bounded queue and worker, so slow receivers never hold up requests and a
+// failing webhook only delays its own deliveries. Events are dropped while a
+// webhook's queue is full.
+type webhooks struct {
+	cfg    *config.Provider
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	queues map[string]chan webhookDelivery
+}
+
+func newWebhooks(cfg *config.Provider) *webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhooks{cfg: cfg, client: &http.Client{}, ctx: ctx, cancel: cancel, queues: make(map[string]chan webhookDelivery)}
+	cfg.OnReload(func(_, newCfg *config.Config) { w.prune(newCfg.Webhooks) })
+	return w
+}
+
+// send queues e for the webhooks subscribed to it. It does nothing on a nil
+// receiver, for caches created outside the proxy.
+func (w *webhooks) send(e WebhookEvent) {
+	if !w.enabled("proxy") {
+		return
+	}
+	e.ID, e.Time = newRequestID(), time.Now()
+	body, _ := json.Marshal(e)
+	w.enqueue(webhookMessage{format: "proxy", event: e.Event, id: e.ID, contentType: "application/json", body: body})
+}
+
+func (w *webhooks) enabled(format string) bool {
+	return w != nil && slices.ContainsFunc(w.cfg.Current().Webhooks, func(hook config.WebhookSettings) bool {
+		return hook.Format == format
+	})
+}
+
+func webhookKey(hook config.WebhookSettings) string {
+	return hook.Format + " " + hook.URL
+}
+
+func (w *webhooks) enqueue(m webhookMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, hook := range w.cfg.Current().Webhooks {
+		if hook.Format != m.format || !hook.Subscribes(m.event) {
+			continue
+		}
+		key := webhookKey(hook)
+		queue, ok := w.queues[key]
+		if !ok {
+			queue = make(chan webhookDelivery, webhookQueueSize)
+			w.queues[key] = queue
+			go w.work(queue)
+		}
+		select {
+		case queue <- webhookDelivery{hook: hook, webhookMessage: m}:
+		default:
+			logging.Logger.Warn("webhook queue full, dropping event", "url", hook.URL, "event", m.event)
+		}
+	}
+}
+
+// prune stops the workers of webhooks that are no longer configured once
+// their queued deliveries are done.
+func (w *webhooks) prune(hooks []config.WebhookSettings) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, queue := range w.queues {
+		if !slices.ContainsFunc(hooks, func(hook config.WebhookSettings) bool { return webhookKey(hook) == key }) {
+			close(queue)
+			delete(w.queues, key)
+		}
+	}
+}
+
+func (w *webhooks) work(queue <-chan webhookDelivery) {
+	for {
+		select {
+		case d, ok := <-queue:
+			if !ok {
+				return
+			}
+			w.deliver(d)
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// Run stops delivering once stop is closed.
+func (w *webhooks) Run(stop <-chan struct{}) {
+	<-stop
+	w.cancel()
+}
+
+func (w *webhooks) deliver(d webhookDelivery) {
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(w.ctx, d.hook, d.webhookMessage)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= d.hook.MaxRetries() {
+			logging.Logger.Warn("webhook delivery failed", "url", d.hook.URL, "event", d.event, "id", d.id, "attempts", attempt+1, "error", err)
+			return
+		}
+		select {
+		case <-time.After(webhookBackoff << attempt):
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// post sends one delivery attempt, reporting whether a failure is worth
+// retrying.
+func (w *webhooks) post(ctx context.Context, hook config.WebhookSettings, m webhookMessage) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(m.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", m.contentType)
+	req.Header.Set("X-OCI-Proxy-Event", m.event)
+	req.Header.Set("X-OCI-Proxy-Delivery", m.id)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(m.body)
+		req.Header.Set("X-OCI-Proxy-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,174 @@
+// Package proxyproto reads the PROXY protocol v1 and v2 headers load
+// balancers such as HAProxy and AWS NLB prepend to connections, exposing the
+// original client address as the connection's remote address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts every PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Header is the longest v1 header line, including CRLF.
+const maxV1Header = 107
+
+// Listener wraps accepted connections from the addresses Trusts accepts so
+// that they are read after a required PROXY protocol header.
+type Listener struct {
+	net.Listener
+	Trusts  func(netip.Addr) bool
+	Timeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.Trusts(addr.AddrPort().Addr()) {
+		return c, nil
+	}
+	return &conn{Conn: c, reader: bufio.NewReader(c), timeout: l.Timeout}, nil
+}
+
+// conn reads the header on first use, in the goroutine serving the
+// connection rather than in the accept loop.
+type conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *conn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		remote, err := readHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.remote, err)
+			c.Conn.Close()
+			return
+		}
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readHeader reads a v1 or v2 header and returns the client address it
+// carries, or nil for health checks and unknown address families, which keep
+// the peer address.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+	if !bytes.HasPrefix(start, []byte("PROXY ")) {
+		return nil, errors.New("missing header")
+	}
+	return readV1(r)
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("malformed v1 header %q", text)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	dst, derr := netip.ParseAddr(fields[3])
+	port, perr := strconv.ParseUint(fields[4], 10, 16)
+	_, dperr := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil || derr != nil || perr != nil || dperr != nil || addr.Is4() != (fields[1] == "TCP4") || dst.Is4() != addr.Is4() {
+		return nil, fmt.Errorf("malformed v1 header %q", text)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	command, family := header[12]&0x0f, header[13]
+	if command == 0 {
+		// LOCAL, sent by the load balancer's own health checks.
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	var size int
+	switch family >> 4 {
+	case 1:
+		size = 4
+	case 2:
+		size = 16
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errors.New("v2 address block too short")
+	}
+	addr, _ := netip.AddrFromSlice(body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
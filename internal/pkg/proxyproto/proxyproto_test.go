@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// v2 returns a v2 header with command and family around body.
+func v2(version, command, family byte, body []byte) string {
+	header := append([]byte(nil), v2Signature...)
+	header = append(header, version<<4|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return string(append(header, body...))
+}
+
+func TestReadHeader(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0xdc, 0x04, 0x01, 0xbb}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, []byte{0x20, 0x01, 0x0d, 0xb8, 15: 1})
+	copy(tcp6[16:], []byte{0x20, 0x01, 0x0d, 0xb8, 15: 2})
+	binary.BigEndian.PutUint16(tcp6[32:], 56324)
+	binary.BigEndian.PutUint16(tcp6[34:], 443)
+	withTLV := append(append([]byte(nil), tcp4...), 0x04, 0x00, 0x01, 0xff)
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 unknown with addresses", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51", "", true},
+		{"v1 truncated before signature length", "PROXY ", "", true},
+		{"v1 without CR", "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.7 56324\r\n", "", true},
+		{"v1 extra field", "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443 1\r\n", "", true},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.7 56324 443\r\n", "", true},
+		{"v1 tcp4 with ipv6 source", "PROXY TCP4 2001:db8::1 198.51.100.7 56324 443\r\n", "", true},
+		{"v1 mixed families", "PROXY TCP6 2001:db8::1 198.51.100.7 56324 443\r\n", "", true},
+		{"v1 invalid source", "PROXY TCP4 192.0.2 198.51.100.7 56324 443\r\n", "", true},
+		{"v1 invalid destination", "PROXY TCP4 192.0.2.1 example.com 56324 443\r\n", "", true},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 198.51.100.7 65536 443\r\n", "", true},
+		{"v1 invalid destination port", "PROXY TCP4 192.0.2.1 198.51.100.7 56324 -1\r\n", "", true},
+		{"v2 tcp4", v2(2, 1, 0x11, tcp4), "192.0.2.1:56324", false},
+		{"v2 tcp6", v2(2, 1, 0x21, tcp6), "[2001:db8::1]:56324", false},
+		{"v2 with TLVs", v2(2, 1, 0x11, withTLV), "192.0.2.1:56324", false},
+		{"v2 local", v2(2, 0, 0x00, nil), "", false},
+		{"v2 unspecified family", v2(2, 1, 0x00, []byte{1, 2, 3}), "", false},
+		{"v2 unix family", v2(2, 1, 0x31, make([]byte, 216)), "", false},
+		{"v2 truncated signature", string(v2Signature[:8]), "", true},
+		{"v2 truncated fixed header", v2(2, 1, 0x11, tcp4)[:14], "", true},
+		{"v2 truncated addresses", v2(2, 1, 0x11, tcp4)[:20], "", true},
+		{"v2 short tcp4 block", v2(2, 1, 0x11, tcp4[:8]), "", true},
+		{"v2 short tcp6 block", v2(2, 1, 0x21, tcp6[:32]), "", true},
+		{"v2 wrong version", v2(1, 1, 0x11, tcp4), "", true},
+		{"v2 unknown command", v2(2, 2, 0x11, tcp4), "", true},
+		{"no header", "GET /v2/ HTTP/1.1\r\n\r\n", "", true},
+		{"empty", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := tt.header
+			if !tt.wantErr {
+				input += "DATA"
+			}
+			r := bufio.NewReader(strings.NewReader(input))
+			addr, err := readHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readHeader returned %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == "" && addr != nil:
+				t.Fatalf("got %v, want the peer address kept", addr)
+			case tt.want != "" && (addr == nil || addr.String() != tt.want):
+				t.Fatalf("got %v, want %s", addr, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "DATA" {
+				t.Fatalf("connection continues with %q, want DATA", rest)
+			}
+		})
+	}
+}
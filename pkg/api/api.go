@@ -0,0 +1,287 @@
+// Package api declares the JSON documents of the proxy's management API. The
+// proxy encodes them and pkg/client decodes them, so the two cannot drift
+// apart, and the package only depends on the standard library so clients do
+// not pull in the server.
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RegistryStats combines cache statistics with the credential health of a registry.
+type RegistryStats struct {
+	CacheStats
+	Credential *CredentialStatus        `json:",omitempty"`
+	Upstreams  map[string]UpstreamStats `json:",omitempty"`
+	Throttling *ThrottleStats           `json:",omitempty"`
+	// UpstreamErrors counts translated upstream failures by kind.
+	UpstreamErrors map[string]int64  `json:",omitempty"`
+	PullSessions   *PullSessionStats `json:",omitempty"`
+}
+
+// CacheStats provides statistics about cache usage.
+type CacheStats struct {
+	Hits        int64
+	Misses      int64
+	Evictions   int64
+	Items       int
+	CurrentSize int64
+	MaxSize     int64
+	WorkingSet  map[string]WorkingSetEstimate `json:",omitempty"`
+	// Scrubbed counts entries re-hashed by the scrubber, Corrupted those it
+	// removed because their content no longer matched their digest.
+	Scrubbed  int64 `json:",omitempty"`
+	Corrupted int64 `json:",omitempty"`
+	// PendingDeletes counts removed entries whose files are kept until the
+	// clients still downloading them finish.
+	PendingDeletes int `json:",omitempty"`
+}
+
+// WorkingSetEstimate summarizes the blobs requested within a window.
+// Recommended maps a byte hit ratio to the cache size that would have reached
+// it, holding the most frequently requested blobs. Ratios that were not
+// reachable because too few requests repeated are omitted.
+type WorkingSetEstimate struct {
+	UniqueBytes    int64
+	RequestedBytes int64
+	Recommended    map[string]int64 `json:",omitempty"`
+}
+
+// CredentialStatus is the result of the last credential check for a registry.
+type CredentialStatus struct {
+	Healthy   bool
+	Error     string `json:",omitempty"`
+	CheckedAt time.Time
+}
+
+// UpstreamStats counts requests sent to one upstream target of a registry and
+// the pooled connections they were sent on. AvgLatencyMs is the time to the
+// response headers, AvgTransferMs the time until the body was read or closed,
+// and Statuses counts responses by status code, or "error" for transport
+// errors.
+type UpstreamStats struct {
+	Requests      int64
+	Errors        int64
+	AvgLatencyMs  float64
+	AvgTransferMs float64
+	Statuses      map[string]int64 `json:",omitempty"`
+	NewConns      int64
+	ReusedConns   int64
+}
+
+// ThrottleStats counts 429 handling for a registry.
+type ThrottleStats struct {
+	Throttled int64     // 429 responses received from upstream
+	Retried   int64     // requests retried after waiting for Retry-After
+	Rejected  int64     // requests answered with a synthesized 429 while throttled
+	Queued    int64     `json:",omitempty"` // requests delayed by max_requests_per_minute
+	Limited   int64     `json:",omitempty"` // requests rejected by max_requests_per_minute
+	Until     time.Time `json:",omitempty"`
+	// RateLimitRemaining is the last RateLimit-Remaining reported by the
+	// upstream, such as Docker Hub's pull quota, until its window ends.
+	RateLimitRemaining *int `json:",omitempty"`
+}
+
+// PullSessionStats summarizes the completed pull sessions of a registry.
+type PullSessionStats struct {
+	Pulls         int64
+	AvgDurationMs float64
+	Bytes         int64
+	CachedBytes   int64
+}
+
+// PullSession is one client image pull: the manifest and blob requests a
+// client sent for a repository until it went idle for pull_session_idle.
+type PullSession struct {
+	Registry    string
+	Repository  string
+	Reference   string `json:",omitempty"`
+	Client      string
+	Start       time.Time
+	DurationMs  float64
+	Requests    int
+	Blobs       int
+	Bytes       int64
+	CachedBytes int64
+	// Coverage is the share of bytes served from the cache.
+	Coverage float64
+}
+
+// RepositoryStats holds durable pull counters for a repository or image. Pulls
+// counts manifest GETs for a repository and pull sessions for an image; Bytes
+// and CachedBytes add up the pull sessions, the latter served from the cache.
+type RepositoryStats struct {
+	Pulls       int64
+	LastPull    time.Time
+	Bytes       int64
+	CachedBytes int64
+}
+
+// PullRanking is a repository, or an image named by repository and tag or
+// digest, with its pull counters.
+type PullRanking struct {
+	Name string
+	RepositoryStats
+}
+
+// StatsSample is the activity of a registry during one snapshot interval.
+type StatsSample struct {
+	Hits           int64
+	Misses         int64
+	BytesServed    int64
+	BytesFromCache int64
+}
+
+// StatsPeriod aggregates samples over a day or week starting at Start.
+type StatsPeriod struct {
+	Start time.Time
+	StatsSample
+	HitRatio float64
+}
+
+// QuotaReport is the monthly usage of a user, tenant or namespace with its
+// limits, and for the current month today's usage against the daily limits.
+type QuotaReport struct {
+	Subject       string
+	Name          string
+	Month         string
+	Bytes         int64
+	Soft          int64 `json:",omitempty"`
+	Hard          int64 `json:",omitempty"`
+	UpstreamToday int64 `json:",omitempty"`
+	CachedToday   int64 `json:",omitempty"`
+	DailyUpstream int64 `json:",omitempty"`
+	DailyCache    int64 `json:",omitempty"`
+}
+
+// OverloadStatus is reported by /_/health.
+type OverloadStatus struct {
+	Reason   string `json:",omitempty"`
+	InFlight int64
+	Shed     int64
+}
+
+// Info summarizes the effective configuration so that misconfiguration is
+// evident from the startup log and from /_/api/v1/info.
+type Info struct {
+	Listeners   []string
+	Middlewares []string
+	Features    map[string]bool
+	Registries  map[string]RegistryInfo
+}
+
+// RegistryInfo describes the resolved settings of a configured registry.
+// Credentials are masked.
+type RegistryInfo struct {
+	Auth         string `json:",omitempty"`
+	CacheBackend string
+	CacheDir     string  `json:",omitempty"`
+	CacheMaxSize int64   `json:",omitempty"`
+	MinFreeDisk  int64   `json:",omitempty"`
+	FreeBytes    *uint64 `json:",omitempty"`
+	Chaos        bool    `json:",omitempty"`
+	Signatures   int     `json:",omitempty"`
+}
+
+// ImageGraph is the manifest list, manifests, configs and layers of an image
+// with the cache status of each node.
+type ImageGraph struct {
+	Registry    string
+	Repository  string
+	Reference   string
+	TotalBytes  int64
+	CachedBytes int64
+	Root        GraphNode
+}
+
+// GraphNode is a manifest or blob. Blobs are cached when they are in the
+// registry's cache; manifests when all their children are.
+type GraphNode struct {
+	Digest    string
+	MediaType string
+	Size      int64
+	Platform  string `json:",omitempty"`
+	Cached    bool
+	Children  []GraphNode `json:",omitempty"`
+}
+
+// CacheCheck reports whether an image is fully cached for a set of platforms.
+type CacheCheck struct {
+	Image   string
+	Cached  bool
+	Missing []string `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+// CacheEntries is a page of a registry's cache entries.
+type CacheEntries struct {
+	Total   int
+	Offset  int
+	Entries []CacheEntry
+}
+
+// CacheClear reports what clearing a registry's cache removed.
+type CacheClear struct {
+	Status string `json:"status"`
+	Items  int    `json:"items"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// CacheEntry describes a cached item.
+type CacheEntry struct {
+	Key        string
+	Size       int64
+	LastAccess time.Time
+}
+
+// State is the operational state of a proxy, exported to rebuild or migrate
+// it: the config file as written, including pinned, preload and mirror_sync
+// images, the htpasswd users, the metadata DB and the cache index of each
+// registry. Cached blobs are not included; they are picked up from the cache
+// directories or S3 buckets the new instance uses. A Redacted state has the
+// passwords and secrets of its config replaced and no htpasswd users, and
+// cannot restore a config.
+type State struct {
+	Version    int
+	ExportedAt time.Time
+	Config     string
+	Redacted   bool                                  `json:",omitempty"`
+	Htpasswd   string                                `json:",omitempty"`
+	Metadata   map[string]map[string]json.RawMessage `json:",omitempty"`
+	Caches     map[string][]CacheEntry               `json:",omitempty"`
+}
+
+// StateImport summarizes an import.
+type StateImport struct {
+	Config       bool
+	MetadataKeys int
+	CacheEntries int
+	MissingBlobs int
+	Registries   int
+}
+
+// AuditRecord is a manifest pull in the audit log: who pulled what, when and
+// from where, and how it was answered.
+type AuditRecord struct {
+	Time       time.Time
+	User       string `json:",omitempty"`
+	ClientIP   string
+	Registry   string
+	Repository string
+	Tag        string `json:",omitempty"`
+	Digest     string `json:",omitempty"`
+	Status     int
+	Cache      string `json:",omitempty"`
+	RequestID  string
+}
+
+// Digests returns the digests of node and everything under it, manifests
+// included.
+func (node GraphNode) Digests() []string {
+	digests := []string{node.Digest}
+	for _, child := range node.Children {
+		digests = append(digests, child.Digests()...)
+	}
+	return digests
+}
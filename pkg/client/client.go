@@ -0,0 +1,267 @@
+// Package client is a typed Go client for the OCI proxy's management API, the
+// endpoints under /_/ that report statistics and manage caches.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"oci-proxy/pkg/api"
+)
+
+// Response types are those the proxy encodes, so they cannot drift apart.
+type (
+	RegistryStats   = api.RegistryStats
+	RepositoryStats = api.RepositoryStats
+	PullRanking     = api.PullRanking
+	PullSession     = api.PullSession
+	QuotaReport     = api.QuotaReport
+	StatsPeriod     = api.StatsPeriod
+	Info            = api.Info
+	ImageGraph      = api.ImageGraph
+	CacheCheck      = api.CacheCheck
+	CacheEntries    = api.CacheEntries
+	CacheEntry      = api.CacheEntry
+	CacheClear      = api.CacheClear
+	OverloadStatus  = api.OverloadStatus
+	State           = api.State
+	StateImport     = api.StateImport
+	AuditRecord     = api.AuditRecord
+)
+
+// Health is the response of /_/health.
+type Health struct {
+	Status   string          `json:"status"`
+	Overload *OverloadStatus `json:"overload,omitempty"`
+}
+
+// Error is returned for responses with a status other than 2xx.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("oci-proxy: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client calls the management API of the proxy at BaseURL, authenticating
+// with Username and Password when the proxy requires it.
+type Client struct {
+	BaseURL    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// New returns a client for the proxy at baseURL, e.g. https://proxy.corp:5000.
+func New(baseURL, username, password string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Username: username, Password: password, HTTPClient: http.DefaultClient}
+}
+
+// Health reports whether the proxy is healthy or shedding load.
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var health Health
+	return health, c.do(ctx, http.MethodGet, "/_/health", nil, nil, &health)
+}
+
+// Stats returns the cache, upstream and pull statistics of each registry.
+func (c *Client) Stats(ctx context.Context) (map[string]RegistryStats, error) {
+	var stats map[string]RegistryStats
+	return stats, c.do(ctx, http.MethodGet, "/_/stats", nil, nil, &stats)
+}
+
+// RepositoryStats returns the pull counters of each repository.
+func (c *Client) RepositoryStats(ctx context.Context) (map[string]RepositoryStats, error) {
+	var stats map[string]RepositoryStats
+	return stats, c.do(ctx, http.MethodGet, "/_/stats/repositories", nil, nil, &stats)
+}
+
+// TopPulls returns the n repositories, or with images the n images, of
+// registry, or of every registry when it is empty, ranked by "pulls", "bytes"
+// or "cached_bytes"; empty values and n of 0 take the server's defaults.
+func (c *Client) TopPulls(ctx context.Context, images bool, registry, by string, n int) ([]PullRanking, error) {
+	var ranking []PullRanking
+	q := query("registry", registry, "by", by)
+	if images {
+		q.Set("kind", "images")
+	}
+	if n > 0 {
+		q.Set("n", strconv.Itoa(n))
+	}
+	return ranking, c.do(ctx, http.MethodGet, "/_/api/v1/stats/top", q, nil, &ranking)
+}
+
+// StatsHistory returns the daily or weekly activity of registry, or of every
+// registry when it is empty; period is "day" or "week".
+func (c *Client) StatsHistory(ctx context.Context, registry, period string) (map[string][]StatsPeriod, error) {
+	var history map[string][]StatsPeriod
+	return history, c.do(ctx, http.MethodGet, "/_/api/v1/stats/history", query("registry", registry, "period", period), nil, &history)
+}
+
+// Pulls returns the most recent pull sessions of registry, or of every
+// registry when it is empty.
+func (c *Client) Pulls(ctx context.Context, registry string) ([]PullSession, error) {
+	var pulls []PullSession
+	return pulls, c.do(ctx, http.MethodGet, "/_/api/v1/pulls", query("registry", registry), nil, &pulls)
+}
+
+// Quotas returns the usage of each user and tenant in month, formatted as
+// YYYY-MM, or in the current month when it is empty.
+func (c *Client) Quotas(ctx context.Context, month string) ([]QuotaReport, error) {
+	var reports []QuotaReport
+	return reports, c.do(ctx, http.MethodGet, "/_/api/v1/quotas", query("month", month), nil, &reports)
+}
+
+// AuditQuery selects audit records; zero fields match any record.
+type AuditQuery struct {
+	User, ClientIP, Registry, Repository string
+	// Reference is a tag or digest.
+	Reference    string
+	Since, Until time.Time
+	// Limit defaults to 1000 and is capped at 10000.
+	Limit int
+}
+
+// Audit returns the newest pulls in the audit log matching q, newest first.
+func (c *Client) Audit(ctx context.Context, q AuditQuery) ([]AuditRecord, error) {
+	values := query("user", q.User, "client_ip", q.ClientIP, "registry", q.Registry, "repository", q.Repository, "reference", q.Reference)
+	if !q.Since.IsZero() {
+		values.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		values.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	var records []AuditRecord
+	return records, c.do(ctx, http.MethodGet, "/_/audit", values, nil, &records)
+}
+
+// Info returns the listeners, middlewares, features and resolved registry
+// settings of the proxy.
+func (c *Client) Info(ctx context.Context) (Info, error) {
+	var info Info
+	return info, c.do(ctx, http.MethodGet, "/_/api/v1/info", nil, nil, &info)
+}
+
+// Graph returns the manifests and blobs of image with their cache status.
+func (c *Client) Graph(ctx context.Context, image string) (ImageGraph, error) {
+	var graph ImageGraph
+	return graph, c.do(ctx, http.MethodGet, "/_/api/v1/graph", query("image", image), nil, &graph)
+}
+
+// CheckCache reports which blobs of each image are not cached, considering
+// only platforms such as linux/amd64 when any are given.
+func (c *Client) CheckCache(ctx context.Context, images, platforms []string) ([]CacheCheck, error) {
+	body := map[string][]string{"images": images, "platforms": platforms}
+	var checks []CacheCheck
+	return checks, c.do(ctx, http.MethodPost, "/_/api/v1/cache/check", nil, body, &checks)
+}
+
+// CacheEntries returns a page of registry's cache entries sorted by "recent"
+// (the default), "size" or "age"; limit defaults to 100 and is capped at 1000.
+func (c *Client) CacheEntries(ctx context.Context, registry, sort string, offset, limit int) (CacheEntries, error) {
+	var entries CacheEntries
+	q := query("sort", sort)
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	return entries, c.do(ctx, http.MethodGet, "/_/cache/"+url.PathEscape(registry)+"/entries", q, nil, &entries)
+}
+
+// Purge evicts a blob from registry's cache and deletes its file.
+func (c *Client) Purge(ctx context.Context, registry, digest string) error {
+	return c.do(ctx, http.MethodDelete, "/_/cache/"+url.PathEscape(registry)+"/"+url.PathEscape(digest), nil, nil, nil)
+}
+
+// ClearCache removes every entry of registry's cache.
+func (c *Client) ClearCache(ctx context.Context, registry string) (CacheClear, error) {
+	var cleared CacheClear
+	return cleared, c.do(ctx, http.MethodPost, "/_/cache/"+url.PathEscape(registry)+"/clear", nil, nil, &cleared)
+}
+
+// ExportState returns the config, metadata and cache indexes of the proxy.
+// Unless withSecrets is set, the config's passwords and secrets are redacted
+// and the htpasswd users left out.
+func (c *Client) ExportState(ctx context.Context, withSecrets bool) (State, error) {
+	var state State
+	return state, c.do(ctx, http.MethodGet, "/_/api/v1/state", query("secrets", strconv.FormatBool(withSecrets)), nil, &state)
+}
+
+// ImportState restores an exported state, including its config unless
+// withConfig is false.
+func (c *Client) ImportState(ctx context.Context, state State, withConfig bool) (StateImport, error) {
+	var result StateImport
+	return result, c.do(ctx, http.MethodPost, "/_/api/v1/state", query("config", strconv.FormatBool(withConfig)), state, &result)
+}
+
+// Reload makes the proxy reload its config file.
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/_/reload", nil, nil, nil)
+}
+
+// query builds a query from key and value pairs, skipping empty values.
+func query(pairs ...string) url.Values {
+	q := url.Values{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			q.Set(pairs[i], pairs[i+1])
+		}
+	}
+	return q
+}
+
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, in, out any) error {
+	u := c.BaseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
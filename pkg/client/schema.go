@@ -0,0 +1,94 @@
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schemas returns a JSON Schema document whose $defs describe the response
+// types of the management API, generated from the Go types the proxy encodes
+// so clients in other languages can generate their own bindings.
+func Schemas() map[string]any {
+	defs := make(map[string]any)
+	for _, v := range []any{
+		Health{}, RegistryStats{}, RepositoryStats{}, PullRanking{}, StatsPeriod{}, PullSession{}, QuotaReport{}, Info{},
+		ImageGraph{}, CacheCheck{}, CacheEntries{}, CacheClear{}, State{}, StateImport{}, AuditRecord{},
+	} {
+		schemaOf(reflect.TypeOf(v), defs)
+	}
+	return map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$defs":   defs,
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf returns the schema of t, adding named struct types to defs and
+// referencing them.
+func schemaOf(t reflect.Type, defs map[string]any) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), defs)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			// Reserve the name first so recursive types such as GraphNode terminate.
+			defs[t.Name()] = nil
+			properties, required := make(map[string]any), []string{}
+			addFields(t, defs, properties, &required)
+			defs[t.Name()] = map[string]any{"type": "object", "properties": properties, "required": required}
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// addFields adds the JSON properties of struct t, including those of embedded
+// structs, following encoding/json's tag rules.
+func addFields(t reflect.Type, defs, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, defs, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, defs)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
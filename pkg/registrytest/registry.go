@@ -0,0 +1,301 @@
+// Package registrytest provides an in-process OCI registry for testing the
+// proxy and its configs end to end, in the style of net/http/httptest. It
+// serves the pull side of the v2 API, including range requests for blobs, with
+// optional latency, failures, basic or bearer authentication and blob
+// redirects.
+package registrytest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth modes of a Registry.
+const (
+	AuthNone   = ""
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+)
+
+const manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+// Options configure a Registry.
+type Options struct {
+	// Auth is AuthNone, AuthBasic, or AuthBearer for a Docker Hub style token
+	// service at /token that accepts Username and Password or anonymous
+	// requests when Anonymous is set.
+	Auth      string
+	Username  string
+	Password  string
+	Anonymous bool
+	// Latency delays every response.
+	Latency time.Duration
+	// ErrorRate is the share of requests, from 0 to 1, answered with
+	// ErrorStatus (default 503).
+	ErrorRate   float64
+	ErrorStatus int
+	// RedirectBlobs answers blob requests with a 307 to a storage URL, as
+	// registries backed by object storage do.
+	RedirectBlobs bool
+}
+
+// Registry is a fake registry listening on a local port.
+type Registry struct {
+	*httptest.Server
+	opts Options
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	requests  []string
+}
+
+// NewRegistry starts a registry with opts. Close it when done.
+func NewRegistry(opts Options) *Registry {
+	if opts.ErrorStatus == 0 {
+		opts.ErrorStatus = http.StatusServiceUnavailable
+	}
+	r := &Registry{opts: opts, blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// Host returns the host and port to configure as the upstream registry.
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.URL, "http://")
+}
+
+// AddBlob stores content and returns its digest.
+func (r *Registry) AddBlob(content []byte) string {
+	digest := digestOf(content)
+	r.mu.Lock()
+	r.blobs[digest] = content
+	r.mu.Unlock()
+	return digest
+}
+
+// AddImage stores a single-platform image with a config and the given layers
+// under repository:tag and returns the manifest's digest.
+func (r *Registry) AddImage(repository, tag string, layers ...[]byte) string {
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int    `json:"size"`
+	}
+	manifest := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		Config:        descriptor{"application/vnd.oci.image.config.v1+json", r.AddBlob(config), len(config)},
+		Layers:        []descriptor{},
+	}
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, descriptor{"application/vnd.oci.image.layer.v1.tar+gzip", r.AddBlob(layer), len(layer)})
+	}
+	data, _ := json.Marshal(manifest)
+	return r.AddManifest(repository, tag, data)
+}
+
+// AddManifest stores the image manifest data under repository:tag and returns
+// its digest.
+func (r *Registry) AddManifest(repository, tag string, data []byte) string {
+	digest := digestOf(data)
+	r.mu.Lock()
+	r.manifests[repository+":"+tag] = data
+	r.manifests[repository+"@"+digest] = data
+	r.mu.Unlock()
+	return digest
+}
+
+// Requests returns the method and path of every request received, such as
+// "GET /v2/library/alpine/manifests/latest".
+func (r *Registry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// Count returns how many requests had the given method and path prefix.
+func (r *Registry) Count(method, prefix string) int {
+	count := 0
+	for _, request := range r.Requests() {
+		if strings.HasPrefix(request, method+" "+prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+
+	time.Sleep(r.opts.Latency)
+	if r.opts.ErrorRate > 0 && rand.Float64() < r.opts.ErrorRate {
+		writeError(w, r.opts.ErrorStatus, "UNAVAILABLE", "injected failure")
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/token":
+		r.serveToken(w, req)
+	case strings.HasPrefix(req.URL.Path, "/storage/"):
+		r.serveBlob(w, req, strings.TrimPrefix(req.URL.Path, "/storage/"))
+	case strings.HasPrefix(req.URL.Path, "/v2/"):
+		if !r.authorized(w, req) {
+			return
+		}
+		r.serveV2(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) serveV2(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the fake registry only serves pulls")
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		digest := path[i+len("/blobs/"):]
+		if r.opts.RedirectBlobs {
+			http.Redirect(w, req, r.URL+"/storage/"+digest, http.StatusTemporaryRedirect)
+			return
+		}
+		r.serveBlob(w, req, digest)
+		return
+	}
+	writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown path")
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	key := repository + ":" + reference
+	if strings.HasPrefix(reference, "sha256:") {
+		key = repository + "@" + reference
+	}
+	r.mu.Lock()
+	data, ok := r.manifests[key]
+	r.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	w.Header().Set("Content-Type", manifestMediaType)
+	w.Header().Set("Docker-Content-Digest", digestOf(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	r.mu.Lock()
+	data, ok := r.blobs[digest]
+	r.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// authorized checks the request's credentials, answering with a challenge
+// when they are missing or wrong.
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	switch r.opts.Auth {
+	case AuthBasic:
+		if user, pass, ok := req.BasicAuth(); ok && user == r.opts.Username && pass == r.opts.Password {
+			return true
+		}
+		w.Header().Set("Www-Authenticate", `Basic realm="registrytest"`)
+	case AuthBearer:
+		if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && r.validToken(token, req.URL.Path) {
+			return true
+		}
+		challenge := fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"`, r.URL)
+		if repository := repositoryOf(req.URL.Path); repository != "" {
+			challenge += fmt.Sprintf(`,scope="repository:%s:pull"`, repository)
+		}
+		w.Header().Set("Www-Authenticate", challenge)
+	default:
+		return true
+	}
+	writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+// serveToken issues tokens that name the scope they grant, so that a token
+// for one repository is refused for another.
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	user, pass, ok := req.BasicAuth()
+	switch {
+	case ok && (user != r.opts.Username || pass != r.opts.Password):
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	case !ok && !r.opts.Anonymous:
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "anonymous access is disabled")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString([]byte(req.URL.Query().Get("scope")))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "expires_in": 300})
+}
+
+func (r *Registry) validToken(token, path string) bool {
+	scope, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	repository := repositoryOf(path)
+	return repository == "" || strings.HasPrefix(string(scope), "repository:"+repository+":")
+}
+
+// repositoryOf returns the repository of a manifests or blobs path.
+func repositoryOf(path string) string {
+	path = strings.TrimPrefix(path, "/v2/")
+	for _, kind := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(path, kind); i > 0 {
+			return path[:i]
+		}
+	}
+	return ""
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}